@@ -407,6 +407,9 @@ func run() error {
 		dialer.NetstackDialTCP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
 			return ns.DialContextTCP(ctx, dst)
 		}
+		dialer.NetstackDialUDP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+			return ns.DialContextUDP(ctx, dst)
+		}
 	}
 	if socksListener != nil || httpProxyListener != nil {
 		if httpProxyListener != nil {
@@ -613,7 +616,7 @@ func newNetstack(logf logger.Logf, dialer *tsdial.Dialer, e wgengine.Engine) (*n
 	if !ok {
 		return nil, fmt.Errorf("%T is not a wgengine.InternalsGetter", e)
 	}
-	return netstack.Create(logf, tunDev, e, magicConn, dialer, dns)
+	return netstack.Create(logf, tunDev, e, magicConn, dialer, dns, tstun.DefaultMTU)
 }
 
 // mustStartProxyListeners creates listeners for local SOCKS and HTTP
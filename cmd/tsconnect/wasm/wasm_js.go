@@ -35,6 +35,7 @@
 	"tailscale.com/logtail"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/net/tstun"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
 	"tailscale.com/wgengine"
@@ -108,7 +109,7 @@ func newIPN(jsConfig js.Value) map[string]any {
 	if !ok {
 		log.Fatalf("%T is not a wgengine.InternalsGetter", eng)
 	}
-	ns, err := netstack.Create(logf, tunDev, eng, magicConn, dialer, dnsManager)
+	ns, err := netstack.Create(logf, tunDev, eng, magicConn, dialer, dnsManager, tstun.DefaultMTU)
 	if err != nil {
 		log.Fatalf("netstack.Create: %v", err)
 	}
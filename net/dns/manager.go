@@ -437,6 +437,7 @@ type dnsTCPSession struct {
 
 	conn    net.Conn
 	srcAddr netip.AddrPort
+	query   func(ctx context.Context, bs []byte, from netip.AddrPort) ([]byte, error)
 
 	readClosing chan struct{}
 	responses   chan []byte // DNS replies pending writing
@@ -470,7 +471,7 @@ func (s *dnsTCPSession) handleWrites() {
 }
 
 func (s *dnsTCPSession) handleQuery(q []byte) {
-	resp, err := s.m.Query(s.ctx, q, s.srcAddr)
+	resp, err := s.query(s.ctx, q, s.srcAddr)
 	if err != nil {
 		s.m.logf("tcp query: %v", err)
 		return
@@ -524,10 +525,18 @@ func (s *dnsTCPSession) handleReads() {
 // HandleTCPConn implements magicDNS over TCP, taking a connection and
 // servicing DNS requests sent down it.
 func (m *Manager) HandleTCPConn(conn net.Conn, srcAddr netip.AddrPort) {
+	m.HandleTCPConnWithQuery(conn, srcAddr, m.Query)
+}
+
+// HandleTCPConnWithQuery is like HandleTCPConn, but answers each request
+// using query instead of m.Query. It lets callers intercept requests
+// while still using m's TCP framing and timeouts.
+func (m *Manager) HandleTCPConnWithQuery(conn net.Conn, srcAddr netip.AddrPort, query func(ctx context.Context, bs []byte, from netip.AddrPort) ([]byte, error)) {
 	s := dnsTCPSession{
 		m:           m,
 		conn:        conn,
 		srcAddr:     srcAddr,
+		query:       query,
 		responses:   make(chan []byte),
 		readClosing: make(chan struct{}),
 	}
@@ -14,13 +14,16 @@
 package socks5
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"tailscale.com/types/logger"
@@ -152,14 +155,23 @@ func (c *Conn) handleRequest() error {
 		c.clientConn.Write(buf)
 		return err
 	}
-	if req.command != connect {
+	c.request = req
+	switch req.command {
+	case connect:
+		return c.handleTCP()
+	case udpAssociate:
+		return c.handleUDP()
+	default:
 		res := &response{reply: commandNotSupported}
 		buf, _ := res.marshal()
 		c.clientConn.Write(buf)
 		return fmt.Errorf("unsupported command %v", req.command)
 	}
-	c.request = req
+}
 
+// handleTCP handles a CONNECT request by dialing its destination and
+// copying data between it and the client.
+func (c *Conn) handleTCP() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	srv, err := c.srv.dial(
@@ -174,25 +186,40 @@ func (c *Conn) handleRequest() error {
 		return err
 	}
 	defer srv.Close()
-	serverAddr, serverPortStr, err := net.SplitHostPort(srv.LocalAddr().String())
-	if err != nil {
+	if err := c.writeSuccess(srv.LocalAddr()); err != nil {
 		return err
 	}
-	serverPort, _ := strconv.Atoi(serverPortStr)
 
-	var bindAddrType addrType
-	if ip := net.ParseIP(serverAddr); ip != nil {
-		if ip.To4() != nil {
-			bindAddrType = ipv4
-		} else {
-			bindAddrType = ipv6
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(c.clientConn, srv)
+		if err != nil {
+			err = fmt.Errorf("from backend to client: %w", err)
 		}
-	} else {
-		bindAddrType = domainName
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(srv, c.clientConn)
+		if err != nil {
+			err = fmt.Errorf("from client to backend: %w", err)
+		}
+		errc <- err
+	}()
+	return <-errc
+}
+
+// writeSuccess sends the client a successful reply with bound address
+// addr.
+func (c *Conn) writeSuccess(addr net.Addr) error {
+	serverAddr, serverPortStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
 	}
+	serverPort, _ := strconv.Atoi(serverPortStr)
+
 	res := &response{
 		reply:        success,
-		bindAddrType: bindAddrType,
+		bindAddrType: addrTypeOf(serverAddr),
 		bindAddr:     serverAddr,
 		bindPort:     uint16(serverPort),
 	}
@@ -202,23 +229,166 @@ func (c *Conn) handleRequest() error {
 		buf, _ = res.marshal()
 	}
 	c.clientConn.Write(buf)
+	return nil
+}
 
-	errc := make(chan error, 2)
+// addrTypeOf returns the address type to encode host as.
+func addrTypeOf(host string) addrType {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return ipv4
+		}
+		return ipv6
+	}
+	return domainName
+}
+
+// handleUDP handles a UDP ASSOCIATE request. It relays datagrams
+// between the client and their destinations, each of which gets its
+// own conn from the Server's Dialer, until the client closes its TCP
+// connection.
+func (c *Conn) handleUDP() error {
+	// Listen on the address the client reached us on, so it can reach
+	// the relay too.
+	host, _, err := net.SplitHostPort(c.clientConn.LocalAddr().String())
+	if err != nil {
+		host = ""
+	}
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		res := &response{reply: generalFailure}
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return err
+	}
+	defer pc.Close()
+	if err := c.writeSuccess(pc.LocalAddr()); err != nil {
+		return err
+	}
+
+	a := &udpAssociation{
+		srv:     c.srv,
+		pc:      pc,
+		targets: make(map[string]net.Conn),
+	}
+	if ta, ok := c.clientConn.RemoteAddr().(*net.TCPAddr); ok {
+		a.clientIP = ta.IP
+	}
+	defer a.close()
+
+	// The association lasts as long as the TCP connection.
 	go func() {
-		_, err := io.Copy(c.clientConn, srv)
+		io.Copy(io.Discard, c.clientConn)
+		pc.Close()
+	}()
+	return a.relayFromClient()
+}
+
+// maxUDPPacketSize is the largest UDP datagram we relay.
+const maxUDPPacketSize = 65535
+
+// udpAssociation relays the datagrams of a UDP ASSOCIATE request.
+type udpAssociation struct {
+	srv      *Server
+	pc       net.PacketConn // where the client sends its datagrams
+	clientIP net.IP         // if non-nil, the only IP datagrams are accepted from
+
+	mu         sync.Mutex
+	clientAddr net.Addr            // where the client last sent from
+	targets    map[string]net.Conn // by destination host:port
+}
+
+// relayFromClient reads datagrams from the client and sends their
+// payloads to their destinations until a.pc is closed.
+func (a *udpAssociation) relayFromClient() error {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := a.pc.ReadFrom(buf)
 		if err != nil {
-			err = fmt.Errorf("from backend to client: %w", err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
 		}
-		errc <- err
-	}()
-	go func() {
-		_, err := io.Copy(srv, c.clientConn)
+		if ua, ok := addr.(*net.UDPAddr); ok && a.clientIP != nil && !a.clientIP.Equal(ua.IP) {
+			continue
+		}
+		req, data, err := parseUDPRequest(buf[:n])
 		if err != nil {
-			err = fmt.Errorf("from client to backend: %w", err)
+			a.srv.logf("UDP datagram from %v: %v", addr, err)
+			continue
 		}
-		errc <- err
-	}()
-	return <-errc
+		if req.frag != 0 {
+			// Fragmentation is optional, and we don't support it.
+			continue
+		}
+		a.mu.Lock()
+		a.clientAddr = addr
+		a.mu.Unlock()
+		target, err := a.target(req)
+		if err != nil {
+			a.srv.logf("UDP dial %s:%d: %v", req.destination, req.port, err)
+			continue
+		}
+		target.Write(data)
+	}
+}
+
+// target returns the conn to req's destination, dialing it if needed.
+func (a *udpAssociation) target(req *udpRequest) (net.Conn, error) {
+	key := net.JoinHostPort(req.destination, strconv.Itoa(int(req.port)))
+	a.mu.Lock()
+	target := a.targets[key]
+	a.mu.Unlock()
+	if target != nil {
+		return target, nil
+	}
+	hdr, err := req.marshal()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	target, err = a.srv.dial(ctx, "udp", key)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.targets == nil { // closed
+		target.Close()
+		return nil, net.ErrClosed
+	}
+	a.targets[key] = target
+	go a.relayToClient(target, hdr)
+	return target, nil
+}
+
+// relayToClient sends the datagrams read from target to the client,
+// prefixed with hdr, until target is closed.
+func (a *udpAssociation) relayToClient(target net.Conn, hdr []byte) {
+	buf := make([]byte, len(hdr)+maxUDPPacketSize)
+	copy(buf, hdr)
+	for {
+		n, err := target.Read(buf[len(hdr):])
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		clientAddr := a.clientAddr
+		a.mu.Unlock()
+		a.pc.WriteTo(buf[:len(hdr)+n], clientAddr)
+	}
+}
+
+// close closes all of a's conns to destinations.
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.targets {
+		c.Close()
+	}
+	a.targets = nil
 }
 
 // parseClientGreeting parses a request initiation packet
@@ -266,53 +436,93 @@ func parseClientRequest(r io.Reader) (*request, error) {
 	}
 	cmd := hdr[1]
 	destAddrType := addrType(hdr[3])
+	destination, port, err := readAddr(r, destAddrType)
+	if err != nil {
+		return nil, err
+	}
 
-	var destination string
-	var port uint16
+	return &request{
+		command:      commandType(cmd),
+		destination:  destination,
+		port:         port,
+		destAddrType: destAddrType,
+	}, nil
+}
 
+// readAddr reads an address of type destAddrType and a port from r.
+func readAddr(r io.Reader, destAddrType addrType) (destination string, port uint16, err error) {
 	if destAddrType == ipv4 {
 		var ip [4]byte
 		_, err = io.ReadFull(r, ip[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read IPv4 address")
+			return "", 0, fmt.Errorf("could not read IPv4 address")
 		}
 		destination = net.IP(ip[:]).String()
 	} else if destAddrType == domainName {
 		var dstSizeByte [1]byte
 		_, err = io.ReadFull(r, dstSizeByte[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read domain name size")
+			return "", 0, fmt.Errorf("could not read domain name size")
 		}
 		dstSize := int(dstSizeByte[0])
 		domainName := make([]byte, dstSize)
 		_, err = io.ReadFull(r, domainName)
 		if err != nil {
-			return nil, fmt.Errorf("could not read domain name")
+			return "", 0, fmt.Errorf("could not read domain name")
 		}
 		destination = string(domainName)
 	} else if destAddrType == ipv6 {
 		var ip [16]byte
 		_, err = io.ReadFull(r, ip[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read IPv6 address")
+			return "", 0, fmt.Errorf("could not read IPv6 address")
 		}
 		destination = net.IP(ip[:]).String()
 	} else {
-		return nil, fmt.Errorf("unsupported address type")
+		return "", 0, fmt.Errorf("unsupported address type")
 	}
 	var portBytes [2]byte
 	_, err = io.ReadFull(r, portBytes[:])
 	if err != nil {
-		return nil, fmt.Errorf("could not read port")
+		return "", 0, fmt.Errorf("could not read port")
 	}
-	port = binary.BigEndian.Uint16(portBytes[:])
+	return destination, binary.BigEndian.Uint16(portBytes[:]), nil
+}
 
-	return &request{
-		command:      commandType(cmd),
+// udpRequest represents the header of a datagram sent
+// by the client to the relay of a UDP ASSOCIATE request.
+type udpRequest struct {
+	frag         byte
+	destination  string
+	port         uint16
+	destAddrType addrType
+}
+
+// parseUDPRequest parses the header of a relayed UDP datagram and
+// returns it and the datagram's payload.
+func parseUDPRequest(pkt []byte) (*udpRequest, []byte, error) {
+	if len(pkt) < 4 {
+		return nil, nil, fmt.Errorf("could not read packet header")
+	}
+	r := bytes.NewReader(pkt[4:])
+	destAddrType := addrType(pkt[3])
+	destination, port, err := readAddr(r, destAddrType)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &udpRequest{
+		frag:         pkt[2],
 		destination:  destination,
 		port:         port,
 		destAddrType: destAddrType,
-	}, nil
+	}
+	return req, pkt[len(pkt)-r.Len():], nil
+}
+
+// marshal returns the header to prefix datagrams from req's
+// destination with when relaying them to the client.
+func (req *udpRequest) marshal() ([]byte, error) {
+	return appendAddr([]byte{0, 0, 0, byte(req.destAddrType)}, req.destAddrType, req.destination, req.port)
 }
 
 // response contains the contents of
@@ -339,31 +549,40 @@ func (res *response) marshal() ([]byte, error) {
 		return pkt, nil
 	}
 
-	var addr []byte
-	switch res.bindAddrType {
+	pkt, err := appendAddr(pkt, res.bindAddrType, res.bindAddr, res.bindPort)
+	if err != nil {
+		return nil, fmt.Errorf("%w for binding", err)
+	}
+	return pkt, nil
+}
+
+// appendAddr appends the encoding of address addr of type typ and
+// port to pkt.
+func appendAddr(pkt []byte, typ addrType, addr string, port uint16) ([]byte, error) {
+	var b []byte
+	switch typ {
 	case ipv4:
-		addr = net.ParseIP(res.bindAddr).To4()
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IPv4 address for binding")
+		b = net.ParseIP(addr).To4()
+		if b == nil {
+			return nil, fmt.Errorf("invalid IPv4 address")
 		}
 	case domainName:
-		if len(res.bindAddr) > 255 {
-			return nil, fmt.Errorf("invalid domain name for binding")
+		if len(addr) > 255 {
+			return nil, fmt.Errorf("invalid domain name")
 		}
-		addr = make([]byte, 0, len(res.bindAddr)+1)
-		addr = append(addr, byte(len(res.bindAddr)))
-		addr = append(addr, []byte(res.bindAddr)...)
+		b = make([]byte, 0, len(addr)+1)
+		b = append(b, byte(len(addr)))
+		b = append(b, []byte(addr)...)
 	case ipv6:
-		addr = net.ParseIP(res.bindAddr).To16()
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IPv6 address for binding")
+		b = net.ParseIP(addr).To16()
+		if b == nil {
+			return nil, fmt.Errorf("invalid IPv6 address")
 		}
 	default:
 		return nil, fmt.Errorf("unsupported address type")
 	}
 
-	pkt = append(pkt, addr...)
-	pkt = binary.BigEndian.AppendUint16(pkt, uint16(res.bindPort))
-
+	pkt = append(pkt, b...)
+	pkt = binary.BigEndian.AppendUint16(pkt, port)
 	return pkt, nil
 }
@@ -5,10 +5,13 @@
 package socks5
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"testing"
+	"time"
 
 	"golang.org/x/net/proxy"
 )
@@ -75,3 +78,78 @@ func TestRead(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestUDP(t *testing.T) {
+	// backend server which echoes datagrams back
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(buf[:n], addr)
+		}
+	}()
+	backendAddr := backend.LocalAddr().(*net.UDPAddr)
+
+	// SOCKS5 server
+	socks5, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go socks5Server(socks5)
+
+	conn, err := net.Dial("tcp", socks5.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{socks5Version, 1, noAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		t.Fatal(err)
+	}
+	// UDP ASSOCIATE with an unspecified client address.
+	if _, err := conn.Write([]byte{socks5Version, byte(udpAssociate), 0, byte(ipv4), 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	var res [10]byte
+	if _, err := io.ReadFull(conn, res[:]); err != nil {
+		t.Fatal(err)
+	}
+	if res[1] != byte(success) || res[3] != byte(ipv4) {
+		t.Fatalf("got reply %v; want success with an IPv4 address", res)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(res[4:8]), Port: int(binary.BigEndian.Uint16(res[8:]))}
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	hdr := []byte{0, 0, 0, byte(ipv4)}
+	hdr = append(hdr, backendAddr.IP.To4()...)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(backendAddr.Port))
+	if _, err := client.WriteTo(append(hdr, "Test"...), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(hdr, "Test"...); !bytes.Equal(buf[:n], want) {
+		t.Fatalf("got: %q want: %q", buf[:n], want)
+	}
+}
@@ -34,14 +34,18 @@
 // Extension, none), user-selected route acceptance prefs, etc.
 type Dialer struct {
 	Logf logger.Logf
-	// UseNetstackForIP if non-nil is whether NetstackDialTCP (if
-	// it's non-nil) should be used to dial the provided IP.
+	// UseNetstackForIP if non-nil is whether NetstackDialTCP and
+	// NetstackDialUDP (if non-nil) should be used to dial the provided IP.
 	UseNetstackForIP func(netip.Addr) bool
 
 	// NetstackDialTCP dials the provided IPPort using netstack.
 	// If nil, it's not used.
 	NetstackDialTCP func(context.Context, netip.AddrPort) (net.Conn, error)
 
+	// NetstackDialUDP dials the provided IPPort over UDP using netstack.
+	// If nil, it's not used.
+	NetstackDialUDP func(context.Context, netip.AddrPort) (net.Conn, error)
+
 	peerClientOnce sync.Once
 	peerClient     *http.Client
 
@@ -307,10 +311,14 @@ func (d *Dialer) UserDial(ctx context.Context, network, addr string) (net.Conn,
 		return nil, err
 	}
 	if d.UseNetstackForIP != nil && d.UseNetstackForIP(ipp.Addr()) {
-		if d.NetstackDialTCP == nil {
+		dial := d.NetstackDialTCP
+		if strings.HasPrefix(network, "udp") {
+			dial = d.NetstackDialUDP
+		}
+		if dial == nil {
 			return nil, errors.New("Dialer not initialized correctly")
 		}
-		return d.NetstackDialTCP(ctx, ipp)
+		return dial(ctx, ipp)
 	}
 	// TODO(bradfitz): netns, etc
 	var stdDialer net.Dialer
@@ -7,21 +7,31 @@
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"golang.org/x/net/dns/dnsmessage"
 	"gvisor.dev/gvisor/pkg/bufferv2"
 	"gvisor.dev/gvisor/pkg/refs"
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -35,6 +45,7 @@
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"gvisor.dev/gvisor/pkg/waiter"
+	"nhooyr.io/websocket"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/net/dns"
@@ -43,10 +54,14 @@
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/net/tstun"
+	"tailscale.com/net/wsconn"
 	"tailscale.com/syncs"
+	"tailscale.com/tstime/rate"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/opt"
+	"tailscale.com/util/mak"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
@@ -82,749 +97,3998 @@ func init() {
 // stack when Tailscale is running in fake mode.
 type Impl struct {
 	// ForwardTCPIn, if non-nil, handles forwarding an inbound TCP
-	// connection.
-	// TODO(bradfitz): provide mechanism for tsnet to reject a
-	// port other than accepting it and closing it.
+	// connection. To reject some ports rather than accepting and
+	// closing their connections, use ForwardTCPInFunc instead.
 	ForwardTCPIn func(c net.Conn, port uint16)
 
+	// ForwardTCPInFunc, if non-nil, is used instead of ForwardTCPIn.
+	// It's called with the destination port of each inbound TCP
+	// connection before the connection is accepted. If ok, handler is
+	// called with the accepted connection; otherwise the connection is
+	// reset, so the client sees it refused.
+	ForwardTCPInFunc func(port uint16) (handler func(net.Conn), ok bool)
+
+	// ForwardUDPIn, if non-nil, handles inbound UDP sessions to the
+	// local IPs instead of proxying them to the host over loopback. It's
+	// called in a new goroutine with a conn connected to the client and
+	// the local port the client sent to. ForwardUDPIn owns c: it must
+	// Close it when done, which ends the session, and nothing else
+	// closes it, so it's also responsible for timing out idle sessions.
+	ForwardUDPIn func(c net.PacketConn, port uint16)
+
+	// HandlerChain, if non-nil, is the order in which handlers are
+	// offered each inbound TCP connection; the first to claim it handles
+	// it. Connections no handler claims are forwarded to the host or a
+	// subnet. If nil, DefaultHandlerChain is used. To reorder or disable
+	// the built-in handlers, start from DefaultHandlerChain.
+	// It can only be set before calling Start.
+	HandlerChain []HandlerMatcher
+
 	// ProcessLocalIPs is whether netstack should handle incoming
 	// traffic directed at the Node.Addresses (local IPs).
 	// It can only be set before calling Start.
 	ProcessLocalIPs bool
 
+	// AnswerLocalPings is whether netstack should reply to ICMP echo
+	// requests for the local IPs itself, rather than leaving them to
+	// the host, which in userspace mode might not exist. It has no
+	// effect unless ProcessLocalIPs is set.
+	AnswerLocalPings bool
+
+	// DisableICMP, if true, makes netstack drop all ICMP and ICMPv6
+	// packets it would process and never send any: it doesn't reply to
+	// or relay pings, and doesn't send ICMP errors. This makes the node
+	// and the subnets it routes unpingable through netstack. It can't
+	// be combined with AnswerLocalPings or AnswerViaNeighborSolicits.
+	// It can only be set before calling Start.
+	DisableICMP bool
+
+	// MaxEchoReplyPayload, if non-zero, is the most echo data, after
+	// the identifier and sequence number, that netstack copies from an
+	// ICMP echo request into the reply it synthesizes. Longer data is
+	// truncated, so peers can't use large pings to reflect traffic.
+	// It must not be negative.
+	MaxEchoReplyPayload int
+
 	// ProcessSubnets is whether netstack should handle incoming
 	// traffic destined to non-local IPs (i.e. whether it should
 	// be a subnet router).
 	// It can only be set before calling Start.
 	ProcessSubnets bool
 
+	// HeartbeatInterval, if non-zero, is how often netstack logs a
+	// one-line summary of its activity: open TCP connections, open UDP
+	// sessions, and the bytes forwarded and packets dropped since the
+	// previous heartbeat.
+	// It can only be set before calling Start.
+	HeartbeatInterval time.Duration
+
+	// LogRate, if non-zero, limits how often each of netstack's log
+	// messages is repeated, so error storms don't flood the logs. The
+	// first occurrence of a message is logged; repeats within LogRate
+	// of it are counted instead, and a summary of them is logged at the
+	// end of that period. Messages are compared by format, not by their
+	// arguments.
+	// It can only be set before calling Start.
+	LogRate time.Duration
+
+	// BackendDialRetries is the number of additional attempts
+	// forwardTCP makes to dial a backend after the first dial fails,
+	// backing off between attempts. This lets a backend that's briefly
+	// restarting accept the connection rather than the client seeing an
+	// immediate RST. Retries stop if the client hangs up.
+	// Zero means to try only once.
+	BackendDialRetries int
+
+	// TCPConnectTimeout is how long each of forwardTCP's attempts to
+	// dial a backend may take before the client is sent a RST, so that
+	// an unresponsive backend doesn't tie up the connection. If zero,
+	// 30 seconds is used. ConnectTimeoutFunc can override it for some
+	// destinations. Neither applies to ForwardViaWebSocket.
+	TCPConnectTimeout time.Duration
+
+	// ConnectTimeoutFunc, if non-nil, is called with each backend
+	// address forwardTCP dials, and returns how long each attempt to
+	// dial it may take, so that a loopback service can fail fast while
+	// a distant subnet host gets longer. If it returns zero,
+	// TCPConnectTimeout is used.
+	ConnectTimeoutFunc func(dst netip.AddrPort) time.Duration
+
+	// BackendPoolForPort, if non-nil, maps local ports to pools of
+	// backend addresses ("ip:port") that connections to that port on
+	// the local IPs are spread across, instead of being forwarded to the
+	// port on 127.0.0.1. Backends are chosen round-robin, skipping any
+	// whose dial failed in the last backendPoolFailTTL unless they all
+	// did. If a dial fails, the next backend is tried.
+	// It can only be set before calling Start.
+	BackendPoolForPort map[uint16][]string
+
+	// ResolveBackend, if non-nil, is called to find the backend
+	// ("ip:port") that a TCP connection from src to port on the local
+	// IPs is forwarded to, such as by looking it up in a service
+	// registry, instead of the port on 127.0.0.1. Results are cached
+	// per port and source for resolveBackendTTL. If it fails or returns
+	// an invalid address, the connection is reset. ctx is canceled if
+	// the client resets the connection while waiting. It's not called
+	// for ports in BackendPoolForPort.
+	// It can only be set before calling Start.
+	ResolveBackend func(ctx context.Context, port uint16, src netip.Addr) (addr string, err error)
+
+	// BackendPoolLeastConns, if true, makes BackendPoolForPort choose
+	// the backend with the fewest connections in flight, rather than
+	// the next one round-robin.
+	// It can only be set before calling Start.
+	BackendPoolLeastConns bool
+
+	// SubnetPingRate, if non-zero, is the maximum number of ICMP echo
+	// requests per second that netstack relays to subnet (or 4via6)
+	// destinations on behalf of peers. Relayed pings over the limit are
+	// dropped, so a peer can't use a subnet router to ping-sweep its
+	// subnets. Echo requests to this node's own IPs aren't affected.
+	// It can only be set before calling Start.
+	SubnetPingRate int
+
+	// MaxDNSQueriesPerConn is the maximum number of MagicDNS queries
+	// served on a single UDP socket before netstack stops reading from
+	// it. If zero, defaultMaxDNSQueriesPerConn is used.
+	MaxDNSQueriesPerConn int
+
+	// DialAllowed, if non-nil, is called by DialContextTCP (with network
+	// "tcp") and DialContextUDP (with network "udp") before dialing dst.
+	// If it returns false, the dial fails with an error wrapping
+	// ErrDialNotAllowed.
+	DialAllowed func(network string, dst netip.AddrPort) bool
+
+	// HandleLinkLocalIPv6 is whether netstack should handle incoming
+	// TCP and UDP traffic destined to IPv6 link-local (fe80::/10)
+	// addresses, which some discovery protocols use. Such traffic is
+	// treated like traffic to a local IP and forwarded to the host over
+	// loopback. If false, link-local traffic is left to the host network
+	// stack (if any). Link-local traffic is never routed onward as subnet
+	// traffic, nor are pings to link-local addresses relayed, as those
+	// addresses are only meaningful on a single link.
+	// It can only be set before calling Start.
+	HandleLinkLocalIPv6 bool
+
+	// AnswerViaNeighborSolicits is whether netstack should answer IPv6
+	// Neighbor Solicitations for 4via6 addresses that this node routes,
+	// so that IPv6 hosts that do neighbor discovery before sending to
+	// them needn't have static neighbor entries.
+	// It can only be set before calling Start.
+	AnswerViaNeighborSolicits bool
+
+	// BackendTeardownGrace is how long forwardTCP keeps copying a
+	// backend's response to the client after the client has finished
+	// sending, giving the backend a chance to flush before the
+	// connection is torn down. The backend sees the client's EOF as a
+	// half-close. Zero means to tear down both sides immediately.
+	BackendTeardownGrace time.Duration
+
+	// FastInboundReject enables a precomputed check that lets netstack
+	// reject inbound packets it has no interest in with a single lookup,
+	// rather than evaluating each of its handlers per packet. It's meant
+	// for high-throughput servers (such as Linux in TUN mode) where
+	// netstack handles almost none of the inbound traffic. The set of
+	// interesting TCP ports is rebuilt on each netmap update; TCP SYNs
+	// to this node's own IPs still get the full check, as its peerapi
+	// port can change between netmap updates.
+	// It can only be set before calling Start.
+	FastInboundReject bool
+
+	// InjectWorkers, if greater than 1, is the number of goroutines
+	// writing the packets netstack sends into the tun device, for more
+	// egress throughput on busy subnet routers. Packets with the same
+	// addresses and ports are always written by the same goroutine, so
+	// each flow's packets stay in order. It must not be negative.
+	// It can only be set before calling Start.
+	InjectWorkers int
+
+	// InjectReaders, if greater than 1, is the number of goroutines
+	// reading the packets netstack sends, each parsing and injecting
+	// them (or handing them to InjectWorkers) concurrently. Unlike
+	// InjectWorkers, it doesn't keep each flow's packets in order, which
+	// costs TCP throughput, so it defaults to 1. It must not be negative
+	// or more than maxInjectReaders.
+	// It can only be set before calling Start.
+	InjectReaders int
+
+	// InjectBlocking, if true, makes netstack wait for room in the
+	// CreateOptions.LinkEndpointQueueSize queue rather than drop
+	// packets it sends while the queue is full. gVisor sends replies
+	// while processing the packets that injectInbound and
+	// handleLocalPackets hand it, so this pushes back on the tun read
+	// path instead of dropping MagicDNS and other service responses.
+	// The tradeoff is that one slow flow then delays all others,
+	// including latency-sensitive ones, until the queue drains.
+	// It can only be set before calling Start.
+	InjectBlocking bool
+
+	// DefaultTTL and DefaultHopLimit, if non-zero, are the IPv4 TTL and
+	// IPv6 hop limit of packets netstack originates, such as replies
+	// to pings and TCP resets and the packets of forwarded
+	// connections. Zero means gVisor's default of 64.
+	// They can only be set before calling Start.
+	DefaultTTL      uint8
+	DefaultHopLimit uint8
+
+	// TCPCongestionControl, if non-empty, is the congestion control
+	// algorithm of netstack's TCP endpoints: "reno" (gVisor's default)
+	// or "cubic", which usually does better on long, fast paths.
+	// It can only be set before calling Start.
+	TCPCongestionControl string
+
+	// TCPBufferSizes, if non-nil, sets the ranges within which gVisor
+	// sizes and auto-tunes the send and receive buffers of netstack's
+	// TCP endpoints. Raising the maximums can help bulk transfers over
+	// high-latency, high-bandwidth paths.
+	// It can only be set before calling Start.
+	TCPBufferSizes *TCPBufferSizes
+
+	// RewriteSubnetDial, if non-nil, is called with the source and
+	// destination (with any 4via6 mapping undone) of each TCP connection
+	// to a subnet before it's forwarded. If it returns true, the
+	// connection is forwarded to the returned address instead, such as
+	// to translate addresses or ports without iptables rules.
+	RewriteSubnetDial func(src, dst netip.AddrPort) (netip.AddrPort, bool)
+
+	// UseDialerForSubnets is whether forwardTCP dials subnet (non-local)
+	// backends using the Tailscale dialer's UserDial, so that forwarded
+	// connections follow the same egress policy as other connections
+	// tailscaled makes on behalf of users. Backends for local IPs are
+	// dialed with ForwardDialer, or else directly over loopback.
+	UseDialerForSubnets bool
+
+	// ForwardDialer, if non-nil, is used instead of a net.Dialer to dial
+	// the backends of forwarded TCP connections, such as to reach them
+	// through a SOCKS5 or HTTP CONNECT proxy. It isn't used for subnet
+	// backends if UseDialerForSubnets is set, and can't be used with
+	// ForwardViaWebSocket or AcquireBackend.
+	ForwardDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// DNSPreHandler, if non-nil, is called with each MagicDNS query
+	// (over UDP or TCP) before it's passed to the DNS manager. If it
+	// returns handled, resp is sent as the response and the DNS manager
+	// isn't consulted. It can be used to answer or block particular
+	// query types.
+	DNSPreHandler func(query []byte, src netip.AddrPort) (resp []byte, handled bool)
+
+	// NewUDPSessionRate, if non-zero, is the maximum number of new
+	// forwarded UDP sessions (distinct 5-tuples) per second. Packets
+	// that would start a session over the limit are dropped. This bounds
+	// the churn of backend sockets caused by a peer scanning through
+	// many ports or hosts.
+	// It can only be set before calling Start.
+	NewUDPSessionRate int
+
+	// NewUDPSessionRatePerSource, if non-zero, is like
+	// NewUDPSessionRate, but applies to each source IP separately.
+	NewUDPSessionRatePerSource int
+
+	// MaxConns, if non-zero, is the maximum number of TCP connections
+	// and UDP sessions that netstack forwards to backends at once, as
+	// a hard limit on the sockets they use. New TCP connections over
+	// the limit are reset and new UDP sessions are dropped; see
+	// Stats.ConnsOverLimit.
+	// It can only be set before calling Start.
+	MaxConns int
+
+	// PerClientConnRate, if non-nil, limits how fast each source IP can
+	// open TCP connections through netstack, so that one peer can't
+	// monopolize the forwarder's in-flight connection attempts.
+	// Connections over the limit are reset.
+	// It can only be set before calling Start.
+	PerClientConnRate *ConnRateLimit
+
+	// AcceptSchedule, if non-nil, is called with the current time for
+	// each new TCP connection and UDP session, which are forwarded
+	// only if it returns true; others are reset or dropped. It can
+	// restrict forwarding to, say, business hours. Connections that
+	// are already being forwarded aren't affected.
+	// It can only be set before calling Start.
+	AcceptSchedule func(now time.Time) bool
+
+	// HealthCheck, if non-nil, is called for each inbound packet and new
+	// connection, and while it returns an error, netstack fails closed:
+	// it doesn't process inbound packets and refuses new TCP connections
+	// and UDP sessions. It can report whether the LocalBackend or DNS
+	// manager is degraded, for instance. It must be cheap.
+	// It can only be set before calling Start.
+	HealthCheck func() error
+
+	// DNSTransport, if non-nil, is used instead of the DNS manager to
+	// answer MagicDNS queries (over UDP or TCP) that DNSPreHandler
+	// doesn't handle. It's given the wire-format query and returns the
+	// wire-format response. It can be used to send queries to a
+	// particular upstream, such as over DNS-over-HTTPS.
+	DNSTransport func(ctx context.Context, query []byte) ([]byte, error)
+
+	// DNSResolverOverride, if non-nil, is like DNSTransport but is also
+	// given the querier's address, so that a dedicated resolver can
+	// answer MagicDNS queries differently per client. It doesn't
+	// affect the forwarding of other traffic, including DNS to subnet
+	// hosts. At most one of DNSTransport and DNSResolverOverride may
+	// be set.
+	DNSResolverOverride func(ctx context.Context, query []byte, src netip.AddrPort) ([]byte, error)
+
+	// OnDNSQuery, if non-nil, is called with how long each MagicDNS
+	// query over UDP or TCP took, to tell slow upstreams apart from
+	// slow local handling. It must not block.
+	OnDNSQuery func(DNSQueryTiming)
+
+	// ConnTagger, if non-nil, is called for each new forwarded TCP
+	// connection or UDP session from src to dst. A non-empty result is
+	// recorded as the flow's ConnInfo.Tag and included in its logs, so
+	// that flows can be correlated with, for example, a trace ID supplied
+	// by the peer out of band.
+	ConnTagger func(src, dst netip.AddrPort) string
+
+	// AcquireBackend, if non-nil, supplies the backend connection for
+	// forwarded TCP connections to dst instead of forwardTCP dialing
+	// one, such as from a pool of persistent connections maintained by
+	// the caller. forwardTCP doesn't close the returned conn; it calls
+	// release once it's done with it.
+	AcquireBackend func(dst netip.AddrPort) (c net.Conn, release func(), err error)
+
+	// ForwardViaWebSocket, if non-nil, is the URL of a WebSocket
+	// endpoint to tunnel forwarded TCP connections through, for
+	// backends only reachable over HTTP. Each connection gets its own
+	// WebSocket, with its bytes carried in binary messages. It can't
+	// be used with AcquireBackend.
+	ForwardViaWebSocket *url.URL
+
+	// PeerAPIPortTTL, if non-zero, is how long netstack caches each
+	// local IP's peerapi port, sparing a LocalBackend lookup for every
+	// incoming peerapi SYN. The cache is also cleared on each netmap
+	// update.
+	PeerAPIPortTTL time.Duration
+
+	// StaticSubnetAddrsOnly, if true, makes netstack only handle subnet
+	// traffic to the subnet routes in the netmap, which updateIPs
+	// installs, rather than registering each new subnet destination IP
+	// as it's seen. Traffic to other IPs is reset.
+	// It can only be set before calling Start.
+	StaticSubnetAddrsOnly bool
+
+	// OnSubnetAddrRegistered, if non-nil, is called when traffic from
+	// peer makes netstack register subnet address addr, as an audit
+	// trail of which peers cause which addresses to be registered (by
+	// scanning a subnet, say). Registrations are also logged, rate
+	// limited, so this is the complete record. It must not block.
+	OnSubnetAddrRegistered func(peer, addr netip.Addr)
+
+	// OnUDPParseError, if non-nil, is called when a new inbound UDP
+	// flow is dropped because its source or destination address can't
+	// be parsed. flow describes it as "src -> dst".
+	OnUDPParseError func(flow string)
+
+	// BlockedForwardPorts are destination ports that netstack never
+	// forwards TCP connections or UDP sessions to, such as 25 to avoid
+	// relaying spam. Connections to them are reset. It doesn't apply to
+	// netstack's own services, such as MagicDNS and the peerapi.
+	// It can only be set before calling Start.
+	BlockedForwardPorts []uint16
+
+	// RewriteUDPToBackend and RewriteUDPToClient, if non-nil, rewrite
+	// the payload of each forwarded UDP packet headed to the backend or
+	// the client respectively, such as to fix up IPs embedded in a
+	// protocol. They may modify and return the payload they're passed,
+	// which is only valid until they return, or return nil to drop the
+	// packet. They run on every packet of every forwarded UDP session,
+	// so they must be cheap.
+	RewriteUDPToBackend func(payload []byte) []byte
+	RewriteUDPToClient  func(payload []byte) []byte
+
+	// StrictUDPReplySource, if true, makes netstack drop packets that
+	// a forwarded UDP session's backend socket receives from any
+	// address but the backend's, rather than forwarding them to the
+	// client. Either way, they're counted and logged, as they can be a
+	// sign of asymmetric routing.
+	StrictUDPReplySource bool
+
+	// UDPSharedBackendSocket, if true, makes all of a client's UDP
+	// sessions to subnet destinations share one backend socket, rather
+	// than each session having its own. Replies are demultiplexed to
+	// sessions by the backend's address, so to the outside the client
+	// has the same source address and port whatever it talks to
+	// (endpoint-independent mapping), and fewer sockets are used.
+	// Packets from addresses no session is talking to are counted and
+	// dropped, as with StrictUDPReplySource. Sessions to local IPs,
+	// which are proxied over loopback, always get their own socket.
+	// It can only be set before calling Start.
+	UDPSharedBackendSocket bool
+
+	// UDPBackendBindAddr, if non-nil, is called with the destination of
+	// each UDP session forwarded to a subnet, and returns the local IP
+	// to bind its backend socket to, such as that of a particular
+	// interface of a multi-homed router. If it's nil or returns an
+	// invalid IP or one of the other family, the socket is bound to
+	// the wildcard address.
+	// It can only be set before calling Start.
+	UDPBackendBindAddr func(dst netip.AddrPort) netip.Addr
+
+	// UDPBackendFamily, if non-nil, is called with the destination of
+	// each UDP session forwarded to a subnet, and reports whether its
+	// backend socket should be IPv4 rather than IPv6, overriding the
+	// choice by dst's family. An IPv6 socket reaches an IPv4 dst over
+	// its IPv4-mapped address, which needs a dual-stack host. An IPv4
+	// socket can't reach an IPv6 dst that's not IPv4-mapped, so
+	// returning true for one is logged and ignored.
+	// It can only be set before calling Start.
+	UDPBackendFamily func(dst netip.AddrPort) (is4 bool)
+
+	// UDPIdleTimeout, if non-nil, returns how long a forwarded UDP
+	// session to dstPort may be idle before netstack closes it. If it
+	// returns zero, the default is used: 30 seconds for port 53 and 2
+	// minutes otherwise.
+	UDPIdleTimeout func(dstPort uint16) time.Duration
+
+	// EnsureBackendPort, if non-nil, is called with the protocol
+	// ("udp") and local port of each socket netstack creates to
+	// forward a UDP session to a subnet, so embedders can open the
+	// host firewall for the backend's replies. If it succeeds,
+	// ReleaseBackendPort, if non-nil, is called with the same values
+	// when the session ends. An error is logged, and the session is
+	// forwarded anyway.
+	EnsureBackendPort  func(proto string, port uint16) error
+	ReleaseBackendPort func(proto string, port uint16)
+
+	// Reconnect, if non-nil, is called by RestoreConns for each flow
+	// that was being forwarded before a restart, to re-establish it as
+	// far as its protocol allows, such as by dialing the backend ahead
+	// of the client reconnecting. It's best effort: netstack's TCP
+	// state is lost on restart.
+	Reconnect func(SavedConn) error
+
+	// TCPCopyBufferSize, if non-zero, is the size of the buffer used to
+	// copy each direction of a forwarded TCP connection, instead of
+	// io.Copy's default of 32 KiB. Smaller buffers save memory with
+	// many connections open, at some cost in throughput; larger ones
+	// can help on high bandwidth-delay links. It must be at least
+	// 512 bytes.
+	// It can only be set before calling Start.
+	TCPCopyBufferSize int
+
+	// Keepalive, if non-nil, replaces gVisor's default TCP keepalive
+	// timing (2 hours idle, then 9 probes 75 seconds apart) on the TCP
+	// connections netstack accepts. SSH connections still wait 72 hours
+	// before their first probe. All of its fields must be positive.
+	// It can only be set before calling Start.
+	Keepalive *KeepaliveConfig
+
+	// ClientTCPNoDelay, if set, is whether the netstack side of
+	// forwarded TCP connections, toward the client, sends small
+	// segments immediately ("true") or coalesces them with Nagle's
+	// algorithm ("false"). If unset, gVisor's default is used, which
+	// is not to delay.
+	ClientTCPNoDelay opt.Bool
+
+	// ClampMSS, if non-zero, is the largest MSS netstack uses for the
+	// TCP connections it accepts, to avoid black holes when the path
+	// to the peer has a smaller MTU than the peer advertises, such as
+	// over a tunnel. It lowers the MSS option of inbound SYNs before
+	// gVisor sees them, as an iptables TCPMSS rule would. The MSS
+	// netstack advertises itself follows its NIC's MTU; see SetMTU.
+	// It must be zero or at least 88 (gVisor's minimum).
+	// It can only be set before calling Start.
+	ClampMSS uint16
+
+	// MaxDNSTCPMessageSize is the maximum length a MagicDNS request
+	// over TCP may declare in its length prefix. Connections declaring
+	// a longer request are closed before the DNS manager reads the
+	// request. If zero, maxDNSMessageSize is used.
+	MaxDNSTCPMessageSize int
+
+	// RefusedPortTTL, if non-zero, is how long forwardTCP remembers
+	// that a local (loopback) backend port refused a connection. During
+	// that time, further connections to the port are reset immediately,
+	// without dialing it, sparing clients the dial latency.
+	RefusedPortTTL time.Duration
+
+	// OnAddrsChanged, if non-nil, is called after a netmap update adds
+	// or removes any of the addresses netstack handles, with what
+	// changed. It must not block.
+	OnAddrsChanged func(AddrsChange)
+
+	// OnConnClose, if non-nil, is called with a TCP connection or UDP
+	// session's ConnInfo, including why it closed, after ns stops
+	// forwarding it or refuses to forward it, such as with
+	// CloseQuotaExceeded for MaxConns or CloseShutdown during Shutdown.
+	// It must not block.
+	OnConnClose func(ConnInfo)
+
+	// OnConnEvent, if non-nil, is called with a ConnEvent for each TCP
+	// connection and UDP session that netstack forwarded, once it ends,
+	// such as for auditing. It's called on a new goroutine, so it can't
+	// hold up forwarding.
+	OnConnEvent func(ConnEvent)
+
+	// OnForwardError, if non-nil, is called with the destination and
+	// the error when copying data of a forwarded TCP connection or UDP
+	// session fails with an error other than EOF, such as a reset by
+	// the backend. It must not block.
+	OnForwardError func(dst netip.AddrPort, err error)
+
+	// LogRejectedPeers, if set, logs each TCP connection netstack
+	// resets and each flow to a BlockedForwardPorts port with the name
+	// and user of the peer node it's from, as LocalBackend.WhoIs
+	// reports them, so operators can tell who was refused. Peers that
+	// can't be resolved are logged by IP alone.
+	LogRejectedPeers bool
+
+	// OnReject, if non-nil, is called with the flows LogRejectedPeers
+	// logs, whether or not it's set. It must not block.
+	OnReject func(RejectInfo)
+
+	// MirrorTo, if non-nil, is called with a copy of each chunk of
+	// payload that netstack forwards for TCP connections and UDP
+	// sessions, such as to feed an intrusion detection system. It's
+	// called from a single goroutine, fed by a queue of
+	// mirrorQueueSize chunks; chunks forwarded while the queue is full
+	// aren't mirrored, and are counted in Stats.MirrorDrops.
+	// It can only be set before calling Start.
+	MirrorTo func(dir Direction, b []byte)
+
+	// DisableReassembly, if true, makes netstack drop all fragmented
+	// inbound IP packets rather than reassembling them.
+	// It can only be set before calling Start.
+	DisableReassembly bool
+
+	// MaxReassemblyFragments, if non-zero, is the most fragments
+	// netstack accepts for a single IP packet. Once a packet has more,
+	// its remaining fragments are dropped and it's never reassembled.
+	// It can only be set before calling Start.
+	MaxReassemblyFragments int
+
+	// MaxReassemblyMemory, if non-zero, is the most bytes of fragments
+	// of incomplete packets that netstack holds for reassembly. Packets
+	// with fragments that would exceed it are dropped. It must not
+	// exceed 4 MiB, gVisor's own limit.
+	// It can only be set before calling Start.
+	MaxReassemblyMemory int
+
+	// ReassemblyTimeout, if non-zero, is how long after a packet's
+	// first fragment its remaining fragments are accepted. It must not
+	// exceed gVisor's own timeout, ipv4.ReassembleTimeout.
+	// It can only be set before calling Start.
+	ReassemblyTimeout time.Duration
+
 	ipstack   *stack.Stack
-	linkEP    *channel.Endpoint
+	linkEP    *linkEndpoint
 	tundev    *tstun.Wrapper
 	e         wgengine.Engine
 	mc        *magicsock.Conn
 	logf      logger.Logf
 	dialer    *tsdial.Dialer
-	ctx       context.Context        // alive until Close
-	ctxCancel context.CancelFunc     // called on Close
-	lb        *ipnlocal.LocalBackend // or nil
+	ctx       context.Context                           // alive until Close
+	ctxCancel context.CancelFunc                        // called on Close
+	lb        syncs.AtomicValue[*ipnlocal.LocalBackend] // or nil
 	dns       *dns.Manager
 
+	// limitedLogf is a rate-limited logf for potentially high volume
+	// messages.
+	limitedLogf logger.Logf
+
+	// logCoalescer, if non-nil, wraps logf per LogRate.
+	logCoalescer *logCoalescer
+
 	peerapiPort4Atomic uint32 // uint16 port number for IPv4 peerapi
 	peerapiPort6Atomic uint32 // uint16 port number for IPv6 peerapi
 
+	// interestingTCPPorts holds the TCP destination ports that
+	// netstack might handle when neither ProcessLocalIPs nor
+	// ProcessSubnets is set. It's nil unless FastInboundReject is set.
+	interestingTCPPorts syncs.AtomicValue[*portSet]
+
+	// staticSubnets are the subnet routes installed by updateIPs, for
+	// StaticSubnetAddrsOnly.
+	staticSubnets syncs.AtomicValue[[]netip.Prefix]
+
+	// selfAddrs are this node's addresses from the most recent netmap.
+	selfAddrs syncs.AtomicValue[[]netip.Prefix]
+
+	// startedAt is when Start completed, or the zero time before then.
+	startedAt syncs.AtomicValue[time.Time]
+
+	// maintenance is non-nil while in maintenance mode, between
+	// EnterMaintenance and ExitMaintenance.
+	maintenance syncs.AtomicValue[*maintenanceMode]
+
 	// atomicIsLocalIPFunc holds a func that reports whether an IP
 	// is a local (non-subnet) Tailscale IP address of this
 	// machine. It's always a non-nil func. It's changed on netmap
 	// updates.
 	atomicIsLocalIPFunc syncs.AtomicValue[func(netip.Addr) bool]
 
+	// backendPools are the pools from BackendPoolForPort, by port. It's
+	// set by Start and not modified after.
+	backendPools map[uint16]*backendPool
+
 	mu sync.Mutex
 	// connsOpenBySubnetIP keeps track of number of connections open
 	// for each subnet IP temporarily registered on netstack for active
 	// TCP connections, so they can be unregistered when connections are
 	// closed.
 	connsOpenBySubnetIP map[netip.Addr]int
-}
 
-// handleSSH is initialized in ssh.go (on Linux only) to register an SSH server
-// handler. See https://github.com/tailscale/tailscale/issues/3802.
-var handleSSH func(logger.Logf, *ipnlocal.LocalBackend, net.Conn) error
+	subnetPingLimiter *rate.Limiter // or nil if SubnetPingRate is zero
+	udpSessionLimiter *rate.Limiter // or nil if NewUDPSessionRate is zero
 
-const nicID = 1
-const mtu = tstun.DefaultMTU
+	// udpSourceLimiters are the per-source limiters for
+	// NewUDPSessionRatePerSource. It's reset when it reaches
+	// maxUDPSourceLimiters entries.
+	udpSourceLimiters map[netip.Addr]*rate.Limiter
 
-// maxUDPPacketSize is the maximum size of a UDP packet we copy in startPacketCopy
-// when relaying UDP packets. We don't use the 'mtu' const in anticipation of
-// one day making the MTU more dynamic.
-const maxUDPPacketSize = 1500
+	// tcpClientLimiters are the per-source limiters for
+	// PerClientConnRate. Entries idle for long enough to have refilled
+	// are removed at most every clientLimiterSweepInterval.
+	tcpClientLimiters      map[netip.Addr]*clientLimiter
+	lastClientLimiterSweep time.Time
 
-// Create creates and populates a new Impl.
-func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magicsock.Conn, dialer *tsdial.Dialer, dns *dns.Manager) (*Impl, error) {
-	if mc == nil {
-		return nil, errors.New("nil magicsock.Conn")
-	}
-	if tundev == nil {
-		return nil, errors.New("nil tundev")
-	}
-	if logf == nil {
-		return nil, errors.New("nil logger")
+	// fragments tracks fragmented packets being reassembled when any
+	// of the MaxReassembly* limits or ReassemblyTimeout are set.
+	fragments map[fragmentKey]*fragmentState
+	// fragmentBytes is the sum of the bytes of entries in fragments
+	// that are neither dropped nor complete.
+	fragmentBytes int
+	// lastFragmentSweep is when expired entries were last removed from
+	// fragments.
+	lastFragmentSweep time.Time
+
+	// peerAPIPorts caches LocalBackend.GetPeerAPIPort results by local
+	// IP. See PeerAPIPortTTL.
+	peerAPIPorts map[netip.Addr]peerAPIPortEntry
+
+	// resolvedBackends caches ResolveBackend results.
+	resolvedBackends map[resolveBackendKey]resolvedBackend
+
+	// pendingSYNs cancels the ResolveBackend lookups of TCP
+	// connections that aren't accepted yet, by their addresses.
+	pendingSYNs map[pendingSYNKey]context.CancelFunc
+
+	// refusedPorts maps loopback backend ports that recently refused
+	// a connection to when they were last refused. See RefusedPortTTL.
+	refusedPorts map[uint16]time.Time
+
+	// activeConns is the set of TCP connections and UDP sessions
+	// currently being forwarded.
+	activeConns map[*activeConn]bool
+
+	// mirrorc queues chunks for MirrorTo. It's nil if MirrorTo is nil.
+	mirrorc     chan mirrorChunk
+	mirrorDrops atomic.Uint64
+
+	// udpSharedMu guards udpSharedSockets. It's held while binding
+	// and releasing the sockets, so it's separate from mu.
+	udpSharedMu sync.Mutex
+	// udpSharedSockets are the backend sockets shared by each client's
+	// subnet UDP sessions, keyed by the client's address, when
+	// UDPSharedBackendSocket is set.
+	udpSharedSockets map[netip.AddrPort]*sharedUDPSocket
+
+	// unhealthy is whether HealthCheck last returned an error, to log
+	// changes.
+	unhealthy atomic.Bool
+
+	// shuttingDown is whether Shutdown has been called, after which
+	// new TCP connections and UDP sessions are rejected.
+	shuttingDown atomic.Bool
+
+	// Activity counters, reported by the heartbeat log.
+	activeTCPConns    atomic.Int64  // forwarded TCP connections currently open
+	activeUDPSessions atomic.Int64  // forwarded UDP sessions currently open
+	bytesForwarded    atomic.Uint64 // payload bytes copied in either direction
+	packetsDropped    atomic.Uint64 // packets or connection requests dropped
+	pingsRateLimited  atomic.Uint64 // relayed pings dropped by subnetPingLimiter
+	udpRateLimited    atomic.Uint64 // new UDP sessions dropped by NewUDPSessionRate*
+	tcpRateLimited    atomic.Uint64 // new TCP connections reset by PerClientConnRate
+	connsOverLimit    atomic.Uint64 // new flows refused by MaxConns
+	forwardingConns   atomic.Int64  // flows being forwarded, for MaxConns
+	udpParseErrors    atomic.Uint64 // new UDP flows with unparseable addresses
+	udpOtherSources   atomic.Uint64 // UDP replies not from the session's backend
+
+	// Handling counters. See Stats.
+	tcpConnsAccepted      atomic.Uint64
+	tcpConnsForwarded     atomic.Uint64
+	pingsHandled          atomic.Uint64
+	subnetAddrsRegistered atomic.Uint64
+
+	// Packets injected into netstack, by protocol. See PacketRates.
+	inboundTCPPackets   atomic.Uint64
+	inboundUDPPackets   atomic.Uint64
+	inboundICMPPackets  atomic.Uint64
+	inboundOtherPackets atomic.Uint64
+
+	// Packets written by netstack, by where they went. See PacketRates.
+	outboundToHostPackets  atomic.Uint64
+	outboundToPeersPackets atomic.Uint64
+
+	peerAPIPortLookups atomic.Int64 // calls to LocalBackend.GetPeerAPIPort
+
+	// handlerCounts counts inbound TCP connections and UDP sessions by
+	// how they were handled. See HandlerStats.
+	handlerCounts [numHandlerClasses]atomic.Int64
+
+	// Number of live goroutines of each kind. See GoroutineStats.
+	numInjectGoroutines  atomic.Int64
+	numForwardGoroutines atomic.Int64
+	numCopyGoroutines    atomic.Int64
+	numPingGoroutines    atomic.Int64
+
+	// userPingFunc, if non-nil, replaces userPing for relaying
+	// pings. It's only set by tests.
+	userPingFunc func(dstIP netip.Addr, pingResPkt []byte)
+
+	// injectPacketFunc, if non-nil, replaces writing the packets
+	// netstack sends into the tun device. It owns a reference to pkt.
+	// It's only set by tests.
+	injectPacketFunc func(pkt *stack.PacketBuffer, toHost bool)
+
+	// localPongFunc, if non-nil, replaces injecting replies to pings
+	// of local IPs. It's only set by tests.
+	localPongFunc func(pingResPkt []byte)
+
+	// neighborAdvertFunc, if non-nil, replaces injecting Neighbor
+	// Advertisements for 4via6 addresses. It's only set by tests.
+	neighborAdvertFunc func(pkt []byte)
+
+	// portUnreachableFunc, if non-nil, replaces injecting ICMP port
+	// unreachable errors. It's only set by tests.
+	portUnreachableFunc func(pkt []byte)
+
+	// timeNow, if non-nil, replaces time.Now for AcceptSchedule, UDP
+	// session activity tracking and StartedAt. It's only set by tests.
+	timeNow func() time.Time
+
+	// viaIPFunc, if non-nil, replaces LocalBackend.ShouldHandleViaIP in
+	// shouldHandleViaIP. It's only set by tests.
+	viaIPFunc func(netip.Addr) bool
+
+	// backendDialFunc, if non-nil, replaces the net.Dialer used by
+	// forwardTCP to dial backends. It's only set by tests.
+	backendDialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// whoIsFunc, if non-nil, replaces LocalBackend.WhoIs in whoIs.
+	// It's only set by tests.
+	whoIsFunc func(src netip.AddrPort) (node, user string)
+
+	// heartbeatTick, if non-nil, replaces the real ticker driving
+	// heartbeatLoop. It's only set by tests.
+	heartbeatTick <-chan time.Time
+
+	// udpIdleTimeout, if non-zero, overrides how long forwarded UDP
+	// sessions may be idle. It's only set by tests.
+	udpIdleTimeout time.Duration
+	// heartbeatDone is closed when heartbeatLoop returns.
+	// It's nil if the heartbeat isn't running.
+	heartbeatDone chan struct{}
+}
+
+// GoroutineCounts is the number of goroutines of each kind that an Impl
+// currently has running. It's returned by Impl.GoroutineStats.
+type GoroutineCounts struct {
+	Inject  int64 // reading packets from netstack; InjectReaders after Start, plus InjectWorkers
+	Forward int64 // handling a single TCP connection or UDP session
+	Copy    int64 // copying data in one direction of a forwarded flow
+	Ping    int64 // relaying a ping on behalf of a peer
+}
+
+// GoroutineStats returns the number of goroutines of each kind that ns
+// currently has running. Counts that grow without bound over time
+// indicate a leak.
+func (ns *Impl) GoroutineStats() GoroutineCounts {
+	return GoroutineCounts{
+		Inject:  ns.numInjectGoroutines.Load(),
+		Forward: ns.numForwardGoroutines.Load(),
+		Copy:    ns.numCopyGoroutines.Load(),
+		Ping:    ns.numPingGoroutines.Load(),
 	}
-	if e == nil {
-		return nil, errors.New("nil Engine")
+}
+
+// Stats describes the traffic netstack has handled since it was
+// created. It's returned by Impl.Stats.
+type Stats struct {
+	TCPConnsAccepted      uint64 // inbound TCP connection requests
+	TCPConnsForwarded     uint64 // TCP connections proxied to a backend
+	UDPSessionsOpen       int64  // forwarded UDP sessions currently open
+	PingsHandled          uint64 // ICMP echo requests answered or relayed
+	SubnetAddrsRegistered uint64 // times a subnet IP was added to gVisor
+	UDPRepliesFromOthers  uint64 // UDP replies not from the session's backend
+	LinkQueueDrops        uint64 // packets sent while the inject queue was full
+	MirrorDrops           uint64 // chunks not passed to MirrorTo as its queue was full
+	ConnsOverLimit        uint64 // new forwarded flows refused by MaxConns
+
+	// Stack is from the gVisor stack's own statistics.
+	Stack StackStats
+}
+
+// StackStats are selected statistics of the gVisor stack underlying
+// netstack. They're all totals since netstack was created, except for
+// TCP.CurrentEstablished.
+type StackStats struct {
+	DroppedPackets uint64 // packets dropped by the link layer
+
+	IP struct {
+		PacketsReceived     uint64
+		PacketsDelivered    uint64 // to a transport protocol
+		PacketsSent         uint64
+		MalformedReceived   uint64
+		InvalidDestinations uint64 // received for an address not on the NIC
+		OutgoingErrors      uint64
 	}
-	if dialer == nil {
-		return nil, errors.New("nil Dialer")
+	TCP struct {
+		ActiveOpens        uint64 // connections netstack initiated
+		PassiveOpens       uint64 // connections peers initiated
+		CurrentEstablished uint64 // connections now in ESTABLISHED or CLOSE-WAIT
+		EstablishedResets  uint64
+		FailedAttempts     uint64
+		SegmentsReceived   uint64 // valid segments
+		SegmentsSent       uint64
+		InvalidSegments    uint64
+		ResetsSent         uint64
+		Retransmits        uint64
+		Timeouts           uint64
 	}
-	ipstack := stack.New(stack.Options{
-		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
-		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
-	})
-	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
-	tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt)
-	if tcpipErr != nil {
-		return nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
+	UDP struct {
+		PacketsReceived     uint64
+		PacketsSent         uint64
+		UnknownPortErrors   uint64
+		ReceiveBufferErrors uint64
+		MalformedReceived   uint64
 	}
-	linkEP := channel.New(512, mtu, "")
-	if tcpipProblem := ipstack.CreateNIC(nicID, linkEP); tcpipProblem != nil {
-		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
+}
+
+// StartedAt returns when Start completed, or the zero time if it hasn't.
+func (ns *Impl) StartedAt() time.Time {
+	return ns.startedAt.Load()
+}
+
+// Uptime returns how long it's been since Start completed, or zero if
+// it hasn't. Dividing Stats counters by it gives average rates.
+func (ns *Impl) Uptime() time.Duration {
+	start := ns.StartedAt()
+	if start.IsZero() {
+		return 0
 	}
-	// By default the netstack NIC will only accept packets for the IPs
-	// registered to it. Since in some cases we dynamically register IPs
-	// based on the packets that arrive, the NIC needs to accept all
-	// incoming packets. The NIC won't receive anything it isn't meant to
-	// since WireGuard will only send us packets that are meant for us.
-	ipstack.SetPromiscuousMode(nicID, true)
-	// Add IPv4 and IPv6 default routes, so all incoming packets from the Tailscale side
-	// are handled by the one fake NIC we use.
-	ipv4Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 4)), tcpip.AddressMask(strings.Repeat("\x00", 4)))
-	ipv6Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 16)), tcpip.AddressMask(strings.Repeat("\x00", 16)))
-	ipstack.SetRouteTable([]tcpip.Route{
-		{
-			Destination: ipv4Subnet,
-			NIC:         nicID,
-		},
-		{
-			Destination: ipv6Subnet,
-			NIC:         nicID,
-		},
-	})
-	ns := &Impl{
-		logf:                logf,
-		ipstack:             ipstack,
-		linkEP:              linkEP,
-		tundev:              tundev,
-		e:                   e,
-		mc:                  mc,
-		dialer:              dialer,
-		connsOpenBySubnetIP: make(map[netip.Addr]int),
-		dns:                 dns,
+	return ns.now().Sub(start)
+}
+
+// Stats returns counters of the traffic ns has handled and statistics
+// from the gVisor stack.
+func (ns *Impl) Stats() Stats {
+	st := Stats{
+		TCPConnsAccepted:      ns.tcpConnsAccepted.Load(),
+		TCPConnsForwarded:     ns.tcpConnsForwarded.Load(),
+		UDPSessionsOpen:       ns.activeUDPSessions.Load(),
+		PingsHandled:          ns.pingsHandled.Load(),
+		SubnetAddrsRegistered: ns.subnetAddrsRegistered.Load(),
+		UDPRepliesFromOthers:  ns.udpOtherSources.Load(),
+		LinkQueueDrops:        ns.linkEP.queueDrops.Load(),
+		MirrorDrops:           ns.mirrorDrops.Load(),
+		ConnsOverLimit:        ns.connsOverLimit.Load(),
 	}
-	ns.ctx, ns.ctxCancel = context.WithCancel(context.Background())
-	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nil))
-	return ns, nil
+	gs := ns.ipstack.Stats()
+	ss := &st.Stack
+	ss.DroppedPackets = gs.DroppedPackets.Value()
+
+	ss.IP.PacketsReceived = gs.IP.PacketsReceived.Value()
+	ss.IP.PacketsDelivered = gs.IP.PacketsDelivered.Value()
+	ss.IP.PacketsSent = gs.IP.PacketsSent.Value()
+	ss.IP.MalformedReceived = gs.IP.MalformedPacketsReceived.Value()
+	ss.IP.InvalidDestinations = gs.IP.InvalidDestinationAddressesReceived.Value()
+	ss.IP.OutgoingErrors = gs.IP.OutgoingPacketErrors.Value()
+
+	ss.TCP.ActiveOpens = gs.TCP.ActiveConnectionOpenings.Value()
+	ss.TCP.PassiveOpens = gs.TCP.PassiveConnectionOpenings.Value()
+	ss.TCP.CurrentEstablished = gs.TCP.CurrentEstablished.Value()
+	ss.TCP.EstablishedResets = gs.TCP.EstablishedResets.Value()
+	ss.TCP.FailedAttempts = gs.TCP.FailedConnectionAttempts.Value()
+	ss.TCP.SegmentsReceived = gs.TCP.ValidSegmentsReceived.Value()
+	ss.TCP.SegmentsSent = gs.TCP.SegmentsSent.Value()
+	ss.TCP.InvalidSegments = gs.TCP.InvalidSegmentsReceived.Value()
+	ss.TCP.ResetsSent = gs.TCP.ResetsSent.Value()
+	ss.TCP.Retransmits = gs.TCP.Retransmits.Value()
+	ss.TCP.Timeouts = gs.TCP.Timeouts.Value()
+
+	ss.UDP.PacketsReceived = gs.UDP.PacketsReceived.Value()
+	ss.UDP.PacketsSent = gs.UDP.PacketsSent.Value()
+	ss.UDP.UnknownPortErrors = gs.UDP.UnknownPortErrors.Value()
+	ss.UDP.ReceiveBufferErrors = gs.UDP.ReceiveBufferErrors.Value()
+	ss.UDP.MalformedReceived = gs.UDP.MalformedPacketsReceived.Value()
+	return st
 }
 
-func (ns *Impl) Close() error {
-	ns.ctxCancel()
-	ns.ipstack.Close()
-	return nil
+// PacketStats describes the packets injected into netstack from peers
+// and the local host, by protocol, and the packets netstack wrote. It's
+// returned by Impl.PacketRates.
+type PacketStats struct {
+	// Time is when the stats were collected.
+	Time time.Time
+
+	// Total packets of each protocol since netstack was created.
+	TCP, UDP, ICMP, Other uint64
+
+	// Window is the time since the PacketStats passed to PacketRates,
+	// or since Start.
+	Window time.Duration
+
+	// Packets per second of each protocol over Window.
+	TCPRate, UDPRate, ICMPRate, OtherRate float64
+
+	// Total packets written by netstack since it was created: ToHost
+	// from the service IPs back to this host, and ToPeers out to peers.
+	ToHost, ToPeers uint64
 }
 
-// SetLocalBackend sets the LocalBackend; it should only be run before
-// the Start method is called.
-func (ns *Impl) SetLocalBackend(lb *ipnlocal.LocalBackend) {
-	ns.lb = lb
+// countInboundPacket counts p, which is being injected into netstack.
+func (ns *Impl) countInboundPacket(p *packet.Parsed) {
+	switch p.IPProto {
+	case ipproto.TCP:
+		ns.inboundTCPPackets.Add(1)
+	case ipproto.UDP:
+		ns.inboundUDPPackets.Add(1)
+	case ipproto.ICMPv4, ipproto.ICMPv6:
+		ns.inboundICMPPackets.Add(1)
+	default:
+		ns.inboundOtherPackets.Add(1)
+	}
 }
 
-// wrapProtoHandler returns protocol handler h wrapped in a version
-// that dynamically reconfigures ns's subnet addresses as needed for
-// outbound traffic.
-func (ns *Impl) wrapProtoHandler(h func(stack.TransportEndpointID, *stack.PacketBuffer) bool) func(stack.TransportEndpointID, *stack.PacketBuffer) bool {
-	return func(tei stack.TransportEndpointID, pb *stack.PacketBuffer) bool {
-		addr := tei.LocalAddress
-		ip, ok := netip.AddrFromSlice(net.IP(addr))
-		if !ok {
-			ns.logf("netstack: could not parse local address for incoming connection")
-			return false
-		}
-		ip = ip.Unmap()
-		if !ns.isLocalIP(ip) {
-			ns.addSubnetAddress(ip)
+// PacketRates returns the number of packets of each protocol injected
+// into netstack, and their rates since prev, which is the result of an
+// earlier call. If prev is the zero value, the rates are since Start.
+// As each caller passes its own prev, any number of callers can poll
+// it at their own intervals.
+func (ns *Impl) PacketRates(prev PacketStats) PacketStats {
+	st := PacketStats{
+		Time:  ns.now(),
+		TCP:   ns.inboundTCPPackets.Load(),
+		UDP:   ns.inboundUDPPackets.Load(),
+		ICMP:  ns.inboundICMPPackets.Load(),
+		Other: ns.inboundOtherPackets.Load(),
+
+		ToHost:  ns.outboundToHostPackets.Load(),
+		ToPeers: ns.outboundToPeersPackets.Load(),
+	}
+	if prev.Time.IsZero() {
+		prev = PacketStats{Time: ns.StartedAt()}
+		if prev.Time.IsZero() {
+			return st
 		}
-		return h(tei, pb)
 	}
+	st.Window = st.Time.Sub(prev.Time)
+	if secs := st.Window.Seconds(); secs > 0 {
+		st.TCPRate = float64(st.TCP-prev.TCP) / secs
+		st.UDPRate = float64(st.UDP-prev.UDP) / secs
+		st.ICMPRate = float64(st.ICMP-prev.ICMP) / secs
+		st.OtherRate = float64(st.Other-prev.Other) / secs
+	}
+	return st
 }
 
-// Start sets up all the handlers so netstack can start working. Implements
-// wgengine.FakeImpl.
-func (ns *Impl) Start() error {
-	ns.e.AddNetworkMapCallback(ns.updateIPs)
-	// size = 0 means use default buffer size
-	const tcpReceiveBufferSize = 0
-	const maxInFlightConnectionAttempts = 16
-	tcpFwd := tcp.NewForwarder(ns.ipstack, tcpReceiveBufferSize, maxInFlightConnectionAttempts, ns.acceptTCP)
-	udpFwd := udp.NewForwarder(ns.ipstack, ns.acceptUDP)
-	ns.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, ns.wrapProtoHandler(tcpFwd.HandlePacket))
-	ns.ipstack.SetTransportProtocolHandler(udp.ProtocolNumber, ns.wrapProtoHandler(udpFwd.HandlePacket))
-	go ns.inject()
-	ns.tundev.PostFilterIn = ns.injectInbound
-	ns.tundev.PreFilterFromTunToNetstack = ns.handleLocalPackets
-	return nil
+// handlerClass is how an inbound TCP connection or UDP session was
+// handled, for HandlerStats.
+type handlerClass int
+
+const (
+	handlerDNS      handlerClass = iota // MagicDNS
+	handlerSSH                          // Tailscale SSH
+	handlerPeerAPI                      // the peerapi
+	handlerQuad100                      // the web server on 100.100.100.100
+	handlerTCPIn                        // Impl.ForwardTCPIn, ForwardTCPInFunc or ForwardUDPIn
+	handlerLoopback                     // forwarded to the host over loopback
+	handlerSubnet                       // forwarded to a subnet
+	handlerRejected                     // dropped or reset
+	numHandlerClasses
+)
+
+var handlerClassNames = [numHandlerClasses]string{
+	handlerDNS:      "dns",
+	handlerSSH:      "ssh",
+	handlerPeerAPI:  "peerapi",
+	handlerQuad100:  "quad100",
+	handlerTCPIn:    "handler",
+	handlerLoopback: "loopback",
+	handlerSubnet:   "subnet",
+	handlerRejected: "rejected",
 }
 
-func (ns *Impl) addSubnetAddress(ip netip.Addr) {
-	ns.mu.Lock()
-	ns.connsOpenBySubnetIP[ip]++
-	needAdd := ns.connsOpenBySubnetIP[ip] == 1
-	ns.mu.Unlock()
-	// Only register address into netstack for first concurrent connection.
-	if needAdd {
-		pa := tcpip.ProtocolAddress{
-			AddressWithPrefix: tcpip.AddressWithPrefix{
-				Address:   tcpip.Address(ip.AsSlice()),
-				PrefixLen: int(ip.BitLen()),
-			},
-		}
-		if ip.Is4() {
-			pa.Protocol = ipv4.ProtocolNumber
-		} else if ip.Is6() {
-			pa.Protocol = ipv6.ProtocolNumber
-		}
-		ns.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{
-			PEB:        stack.CanBePrimaryEndpoint, // zero value default
-			ConfigType: stack.AddressConfigStatic,  // zero value default
-		})
+func (ns *Impl) countHandler(h handlerClass) {
+	ns.handlerCounts[h].Add(1)
+}
+
+// HandlerStats returns the number of inbound TCP connections and UDP
+// sessions that were handled by each of: "dns", "ssh", "peerapi",
+// "quad100", "handler" (ForwardTCPIn, ForwardTCPInFunc or ForwardUDPIn),
+// "loopback" (forwarded to the host), "subnet" (forwarded to a subnet)
+// and "rejected". Each connection or session is counted once.
+func (ns *Impl) HandlerStats() map[string]int64 {
+	m := make(map[string]int64, numHandlerClasses)
+	for h, name := range handlerClassNames {
+		m[name] = ns.handlerCounts[h].Load()
 	}
+	return m
 }
 
-func (ns *Impl) removeSubnetAddress(ip netip.Addr) {
-	ns.mu.Lock()
-	defer ns.mu.Unlock()
-	ns.connsOpenBySubnetIP[ip]--
-	// Only unregister address from netstack after last concurrent connection.
-	if ns.connsOpenBySubnetIP[ip] == 0 {
-		ns.ipstack.RemoveAddress(nicID, tcpip.Address(ip.AsSlice()))
-		delete(ns.connsOpenBySubnetIP, ip)
+// HandlerMatcher is an entry in Impl.HandlerChain.
+type HandlerMatcher struct {
+	// Name identifies the matcher. The built-in matchers from
+	// DefaultHandlerChain are named as in HandlerStats.
+	Name string
+
+	// Match is called with each inbound TCP connection, before it's
+	// accepted, until one claims it by returning ok. The connection is
+	// then accepted and passed to handler. It's nil for the built-in
+	// matchers.
+	Match func(id stack.TransportEndpointID) (handler func(net.Conn), ok bool)
+
+	builtin func(*Impl, *tcpRequest) (claimed bool) // or nil if Match is set
+}
+
+// DefaultHandlerChain returns the built-in TCP handlers in the order
+// they're used if Impl.HandlerChain is nil:
+//
+//   - "dns": MagicDNS on 100.100.100.100 port 53
+//   - "ssh": Tailscale SSH on port 22 of the local IPs, if enabled
+//   - "peerapi": the peerapi on the local IPs
+//   - "quad100": the web server on 100.100.100.100 port 80
+//   - "handler": Impl.ForwardTCPInFunc or ForwardTCPIn, if set
+//
+// The returned slice is new, so callers can modify it.
+func DefaultHandlerChain() []HandlerMatcher {
+	return []HandlerMatcher{
+		{Name: "dns", builtin: (*Impl).acceptDNSTCP},
+		{Name: "ssh", builtin: (*Impl).acceptSSH},
+		{Name: "peerapi", builtin: (*Impl).acceptPeerAPI},
+		{Name: "quad100", builtin: (*Impl).acceptQuad100},
+		{Name: "handler", builtin: (*Impl).acceptTCPIn},
 	}
 }
 
-func ipPrefixToAddressWithPrefix(ipp netip.Prefix) tcpip.AddressWithPrefix {
-	return tcpip.AddressWithPrefix{
-		Address:   tcpip.Address(ipp.Addr().AsSlice()),
-		PrefixLen: int(ipp.Bits()),
+// KeepaliveConfig is the TCP keepalive timing for Impl.Keepalive.
+type KeepaliveConfig struct {
+	Idle     time.Duration // how long a conn is idle before the first probe
+	Interval time.Duration // the time between unanswered probes
+	Count    int           // how many unanswered probes drop the conn
+}
+
+// validate returns an error if any of c's fields isn't positive.
+func (c *KeepaliveConfig) validate() error {
+	if c.Idle <= 0 || c.Interval <= 0 || c.Count <= 0 {
+		return fmt.Errorf("netstack: Keepalive fields must be positive; got %+v", *c)
 	}
+	return nil
 }
 
-var v4broadcast = netaddr.IPv4(255, 255, 255, 255)
+// TCPBufferSizes are the TCP buffer size ranges for Impl.TCPBufferSizes.
+// A zero range keeps gVisor's default, a minimum of 4 KiB, a default
+// of 1 MiB and a maximum of 4 MiB.
+type TCPBufferSizes struct {
+	Send    BufferSizeRange
+	Receive BufferSizeRange
+}
 
-func (ns *Impl) updateIPs(nm *netmap.NetworkMap) {
-	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nm.Addresses))
+// BufferSizeRange is a range of buffer sizes, in bytes. Buffers start
+// at Default and are auto-tuned between Min and Max.
+type BufferSizeRange struct {
+	Min, Default, Max int
+}
 
-	oldIPs := make(map[tcpip.AddressWithPrefix]bool)
-	for _, protocolAddr := range ns.ipstack.AllAddresses()[nicID] {
-		ap := protocolAddr.AddressWithPrefix
-		ip := netaddrIPFromNetstackIP(ap.Address)
-		if ip == v4broadcast && ap.PrefixLen == 32 {
-			// Don't add 255.255.255.255/32 to oldIPs so we don't
-			// delete it later. We didn't install it, so it's not
-			// ours to delete.
+// validate returns an error if either of b's non-zero ranges isn't
+// positive and ordered.
+func (b *TCPBufferSizes) validate() error {
+	for _, r := range []struct {
+		name string
+		BufferSizeRange
+	}{
+		{"Send", b.Send},
+		{"Receive", b.Receive},
+	} {
+		if r.BufferSizeRange == (BufferSizeRange{}) {
 			continue
 		}
-		oldIPs[ap] = true
-	}
-	newIPs := make(map[tcpip.AddressWithPrefix]bool)
-
-	isAddr := map[netip.Prefix]bool{}
-	if nm.SelfNode != nil {
-		for _, ipp := range nm.SelfNode.Addresses {
-			isAddr[ipp] = true
-			newIPs[ipPrefixToAddressWithPrefix(ipp)] = true
-		}
-		for _, ipp := range nm.SelfNode.AllowedIPs {
-			if !isAddr[ipp] && ns.ProcessSubnets {
-				newIPs[ipPrefixToAddressWithPrefix(ipp)] = true
-			}
+		if r.Min <= 0 || r.Default < r.Min || r.Max < r.Default {
+			return fmt.Errorf("netstack: TCPBufferSizes.%s %+v isn't 0 < Min <= Default <= Max", r.name, r.BufferSizeRange)
 		}
 	}
+	return nil
+}
 
-	ipsToBeAdded := make(map[tcpip.AddressWithPrefix]bool)
-	for ipp := range newIPs {
-		if !oldIPs[ipp] {
-			ipsToBeAdded[ipp] = true
-		}
-	}
-	ipsToBeRemoved := make(map[tcpip.AddressWithPrefix]bool)
-	for ip := range oldIPs {
-		if !newIPs[ip] {
-			ipsToBeRemoved[ip] = true
-		}
-	}
-	ns.mu.Lock()
-	for ip := range ns.connsOpenBySubnetIP {
-		ipp := tcpip.Address(ip.AsSlice()).WithPrefix()
-		delete(ipsToBeRemoved, ipp)
+// setTCPBufferSizes applies TCPBufferSizes to ns.ipstack.
+func (ns *Impl) setTCPBufferSizes() error {
+	b := ns.TCPBufferSizes
+	if b == nil {
+		return nil
 	}
-	ns.mu.Unlock()
-
-	for ipp := range ipsToBeRemoved {
-		err := ns.ipstack.RemoveAddress(nicID, ipp.Address)
-		if err != nil {
-			ns.logf("netstack: could not deregister IP %s: %v", ipp, err)
-		} else {
-			ns.logf("[v2] netstack: deregistered IP %s", ipp)
+	if r := b.Send; r != (BufferSizeRange{}) {
+		opt := tcpip.TCPSendBufferSizeRangeOption{Min: r.Min, Default: r.Default, Max: r.Max}
+		if err := ns.ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("netstack: setting TCP send buffer sizes: %v", err)
 		}
 	}
-	for ipp := range ipsToBeAdded {
-		pa := tcpip.ProtocolAddress{
-			AddressWithPrefix: ipp,
-		}
-		if ipp.Address.To4() == "" {
-			pa.Protocol = ipv6.ProtocolNumber
-		} else {
-			pa.Protocol = ipv4.ProtocolNumber
-		}
-		var err tcpip.Error
-		err = ns.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{
-			PEB:        stack.CanBePrimaryEndpoint, // zero value default
-			ConfigType: stack.AddressConfigStatic,  // zero value default
-		})
-		if err != nil {
-			ns.logf("netstack: could not register IP %s: %v", ipp, err)
-		} else {
-			ns.logf("[v2] netstack: registered IP %s", ipp)
+	if r := b.Receive; r != (BufferSizeRange{}) {
+		opt := tcpip.TCPReceiveBufferSizeRangeOption{Min: r.Min, Default: r.Default, Max: r.Max}
+		if err := ns.ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("netstack: setting TCP receive buffer sizes: %v", err)
 		}
 	}
+	return nil
 }
 
-// handleLocalPackets is hooked into the tun datapath for packets leaving
-// the host and arriving at tailscaled. This method returns filter.DropSilently
-// to intercept a packet for handling, for instance traffic to quad-100.
-func (ns *Impl) handleLocalPackets(p *packet.Parsed, t *tstun.Wrapper) filter.Response {
-	// If it's not traffic to the service IP (i.e. magicDNS) we don't
-	// care; resume processing.
-	if dst := p.Dst.Addr(); dst != magicDNSIP && dst != magicDNSIPv6 {
-		return filter.Accept
-	}
-	// Of traffic to the service IP, we only care about UDP 53, and TCP
-	// on port 80 & 53.
-	switch p.IPProto {
-	case ipproto.TCP:
-		if port := p.Dst.Port(); port != 53 && port != 80 {
-			return filter.Accept
-		}
-	case ipproto.UDP:
-		if port := p.Dst.Port(); port != 53 {
-			return filter.Accept
-		}
+// ConnRateLimit is a token bucket rate limit for Impl.PerClientConnRate.
+type ConnRateLimit struct {
+	Rate  float64 // connections per second
+	Burst int     // connections allowed at once after being idle
+}
+
+// validate returns an error if any of l's fields isn't positive.
+func (l *ConnRateLimit) validate() error {
+	if l.Rate <= 0 || l.Burst <= 0 {
+		return fmt.Errorf("netstack: PerClientConnRate fields must be positive; got %+v", *l)
 	}
+	return nil
+}
 
-	var pn tcpip.NetworkProtocolNumber
-	switch p.IPVersion {
-	case 4:
-		pn = header.IPv4ProtocolNumber
-	case 6:
-		pn = header.IPv6ProtocolNumber
+// refill returns how long it takes an empty bucket to fill.
+func (l *ConnRateLimit) refill() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// applyClientNoDelay sets ep's TCP_NODELAY option to ns.ClientTCPNoDelay,
+// if set.
+func (ns *Impl) applyClientNoDelay(ep tcpip.Endpoint) {
+	if noDelay, ok := ns.ClientTCPNoDelay.Get(); ok {
+		ep.SocketOptions().SetDelayOption(!noDelay)
 	}
-	if debugPackets {
-		ns.logf("[v2] service packet in (from %v): % x", p.Src, p.Buffer())
+}
+
+// applyKeepaliveConfig sets ep's TCP keepalive timing to ns.Keepalive,
+// if set. It doesn't enable keepalives.
+func (ns *Impl) applyKeepaliveConfig(ep tcpip.Endpoint) {
+	ka := ns.Keepalive
+	if ka == nil {
+		return
 	}
+	idle := tcpip.KeepaliveIdleOption(ka.Idle)
+	interval := tcpip.KeepaliveIntervalOption(ka.Interval)
+	ep.SetSockOpt(&idle)
+	ep.SetSockOpt(&interval)
+	ep.SetSockOptInt(tcpip.KeepaliveCountOption, ka.Count)
+}
 
-	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
-		Payload: bufferv2.MakeWithData(append([]byte(nil), p.Buffer()...)),
-	})
-	ns.linkEP.InjectInbound(pn, packetBuf)
-	packetBuf.DecRef()
-	return filter.DropSilently
+// ConnInfo describes a TCP connection or UDP session that netstack is
+// forwarding. It's returned by Impl.ActiveConns.
+type ConnInfo struct {
+	Proto   ipproto.Proto  // ipproto.TCP or ipproto.UDP
+	Src     netip.AddrPort // the peer's address
+	Dst     netip.AddrPort // the address the peer connected to
+	Backend netip.AddrPort // the address netstack forwards to
+	Start   time.Time      // when forwarding started
+	Tag     string         // from Impl.ConnTagger, or empty
+
+	// CloseReason is why the flow ended. It's only set in the ConnInfo
+	// passed to Impl.OnConnClose.
+	CloseReason CloseReason
+
+	// TCP is gVisor's view of the peer side of a TCP connection, as of
+	// the ActiveConns call or the end of the connection. It's nil for
+	// UDP sessions.
+	TCP *TCPStats
 }
 
-func (ns *Impl) DialContextTCP(ctx context.Context, ipp netip.AddrPort) (*gonet.TCPConn, error) {
-	remoteAddress := tcpip.FullAddress{
-		NIC:  nicID,
-		Addr: tcpip.Address(ipp.Addr().AsSlice()),
-		Port: ipp.Port(),
+// TCPStats are the retransmission and congestion statistics of the peer
+// side of a forwarded TCP connection, useful for diagnosing lossy paths.
+//
+// If SendBufFull is set, data from the backend is waiting on the
+// congestion or peer's window, so the path limits throughput; if it's
+// not, the backend isn't writing fast enough to fill it.
+type TCPStats struct {
+	Retransmits     uint64        // segments retransmitted
+	FastRetransmits uint64        // segments retransmitted in fast recovery
+	Timeouts        uint64        // times the retransmission timer expired
+	Cwnd            uint32        // congestion window, in segments
+	RTT             time.Duration // smoothed round-trip time
+	SendBufSize     int64         // send buffer size, in bytes
+	SendBufFull     bool          // whether the send buffer is full of unacknowledged data
+}
+
+// tcpStatsOf returns the TCPStats of ep, or nil if ep isn't a TCP
+// endpoint. It only reads ep's counters and state.
+func tcpStatsOf(ep tcpip.Endpoint) *TCPStats {
+	es, ok := ep.Stats().(*tcp.Stats)
+	if !ok {
+		return nil
 	}
-	var ipType tcpip.NetworkProtocolNumber
-	if ipp.Addr().Is4() {
-		ipType = ipv4.ProtocolNumber
-	} else {
-		ipType = ipv6.ProtocolNumber
+	var info tcpip.TCPInfoOption
+	ep.GetSockOpt(&info)
+	// gVisor only reports how much of the send buffer is used to a
+	// stack-wide probe run on every segment, so report whether it has
+	// room, as for a poll. It always does once the connection is
+	// closing.
+	state := tcp.EndpointState(info.State)
+	connected := state == tcp.StateEstablished || state == tcp.StateCloseWait
+	return &TCPStats{
+		Retransmits:     es.SendErrors.Retransmits.Value(),
+		FastRetransmits: es.SendErrors.FastRetransmit.Value(),
+		Timeouts:        es.SendErrors.Timeouts.Value(),
+		Cwnd:            info.SndCwnd,
+		RTT:             info.RTT,
+		SendBufSize:     ep.SocketOptions().GetSendBufferSize(),
+		SendBufFull:     connected && ep.Readiness(waiter.WritableEvents) == 0,
 	}
+}
 
-	return gonet.DialContextTCP(ctx, ns.ipstack, remoteAddress, ipType)
+// RejectInfo describes a TCP connection or UDP session netstack refused
+// to forward. It's passed to Impl.OnReject.
+type RejectInfo struct {
+	Proto  ipproto.Proto
+	Src    netip.AddrPort // the peer's address
+	Dst    netip.AddrPort // the address the peer connected to
+	Reason string         // why, such as "rate limited" or "blocked port"
+
+	// PeerName and PeerUser are the name of the node Src belongs to
+	// and the login name of its user, or empty if they couldn't be
+	// resolved.
+	PeerName string
+	PeerUser string
 }
 
-func (ns *Impl) DialContextUDP(ctx context.Context, ipp netip.AddrPort) (*gonet.UDPConn, error) {
-	remoteAddress := &tcpip.FullAddress{
-		NIC:  nicID,
-		Addr: tcpip.Address(ipp.Addr().AsSlice()),
-		Port: ipp.Port(),
+// CloseReason describes why a forwarded flow ended.
+type CloseReason int
+
+const (
+	CloseUnknown       CloseReason = iota
+	ClosePeer                      // the peer closed or stopped sending
+	CloseBackend                   // the backend closed, stopped sending or was unreachable
+	CloseReset                     // either side reset the connection
+	CloseIdleTimeout               // the flow was idle for too long
+	CloseQuotaExceeded             // the flow exceeded a connection or rate limit
+	CloseBlocked                   // the flow was blocked by policy
+	CloseShutdown                  // netstack was shutting down
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case ClosePeer:
+		return "peer-closed"
+	case CloseBackend:
+		return "backend-closed"
+	case CloseReset:
+		return "reset"
+	case CloseIdleTimeout:
+		return "idle-timeout"
+	case CloseQuotaExceeded:
+		return "quota-exceeded"
+	case CloseBlocked:
+		return "blocked"
+	case CloseShutdown:
+		return "shutdown"
 	}
-	var ipType tcpip.NetworkProtocolNumber
-	if ipp.Addr().Is4() {
-		ipType = ipv4.ProtocolNumber
-	} else {
-		ipType = ipv6.ProtocolNumber
+	return "unknown"
+}
+
+// Direction is which way forwarded data was going.
+type Direction int
+
+const (
+	DirToServer Direction = iota // from the peer to the backend
+	DirToClient                  // from the backend to the peer
+)
+
+func (d Direction) String() string {
+	if d == DirToClient {
+		return "to-client"
 	}
+	return "to-server"
+}
 
-	return gonet.DialUDP(ns.ipstack, nil, remoteAddress, ipType)
+// isConnReset reports whether err, from reading or writing a backend
+// conn or a gonet conn, means the connection was reset.
+func isConnReset(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Err != nil && oe.Err.Error() == (&tcpip.ErrConnectionReset{}).String()
 }
 
-// The inject goroutine reads in packets that netstack generated, and delivers
-// them to the correct path.
-func (ns *Impl) inject() {
-	for {
-		pkt := ns.linkEP.ReadContext(ns.ctx)
-		if pkt == nil {
-			if ns.ctx.Err() != nil {
-				// Return without logging.
-				return
-			}
-			ns.logf("[v2] ReadContext-for-write = ok=false")
-			continue
-		}
+// ClientFamily returns the IP version (4 or 6) used between the peer and
+// netstack.
+func (c ConnInfo) ClientFamily() int {
+	return ipFamily(c.Dst.Addr())
+}
 
-		if debugPackets {
-			ns.logf("[v2] packet Write out: % x", stack.PayloadSince(pkt.NetworkHeader()))
-		}
-
-		// In the normal case, netstack synthesizes the bytes for
-		// traffic which should transit back into WG and go to peers.
-		// However, some uses of netstack (presently, magic DNS)
-		// send traffic destined for the local device, hence must
-		// be injected 'inbound'.
-		sendToHost := false
-
-		// Determine if the packet is from a service IP, in which case it
-		// needs to go back into the machines network (inbound) instead of
-		// out.
-		// TODO(tom): Work out a way to avoid parsing packets to determine if
-		//            its from the service IP. Maybe gvisor netstack magic. I
-		//            went through the fields of PacketBuffer, and nop :/
-		// TODO(tom): Figure out if its safe to modify packet.Parsed to fill in
-		//            the IP src/dest even if its missing the rest of the pkt.
-		//            That way we dont have to do this twitchy-af byte-yeeting.
-		if b := pkt.NetworkHeader().Slice(); len(b) >= 20 { // min ipv4 header
-			switch b[0] >> 4 { // ip proto field
-			case 4:
-				if srcIP := netaddr.IPv4(b[12], b[13], b[14], b[15]); magicDNSIP == srcIP {
-					sendToHost = true
-				}
-			case 6:
-				if len(b) >= 40 { // min ipv6 header
-					if srcIP, ok := netip.AddrFromSlice(net.IP(b[8:24])); ok && magicDNSIPv6 == srcIP {
-						sendToHost = true
-					}
-				}
-			}
-		}
+// BackendFamily returns the IP version (4 or 6) used between netstack and
+// the backend. It can differ from ClientFamily, such as for 4via6 flows.
+func (c ConnInfo) BackendFamily() int {
+	return ipFamily(c.Backend.Addr())
+}
 
-		// pkt has a non-zero refcount, so injection methods takes
-		// ownership of one count and will decrement on completion.
-		if sendToHost {
-			if err := ns.tundev.InjectInboundPacketBuffer(pkt); err != nil {
-				log.Printf("netstack inject inbound: %v", err)
-				return
-			}
-		} else {
-			if err := ns.tundev.InjectOutboundPacketBuffer(pkt); err != nil {
-				log.Printf("netstack inject outbound: %v", err)
-				return
-			}
-		}
+func ipFamily(ip netip.Addr) int {
+	if ip.Is4() {
+		return 4
 	}
+	return 6
 }
 
-// isLocalIP reports whether ip is a Tailscale IP assigned to this
-// node directly (but not a subnet-routed IP).
-func (ns *Impl) isLocalIP(ip netip.Addr) bool {
-	return ns.atomicIsLocalIPFunc.Load()(ip)
+// summary returns a short description of c for logging, such as
+// "subnet, v6->v4, tag=abc".
+func (c ConnInfo) summary() string {
+	s := fmt.Sprintf("%s, v%d->v%d", flowClass(c.Backend.Addr()), c.ClientFamily(), c.BackendFamily())
+	if c.Tag != "" {
+		s += fmt.Sprintf(", tag=%q", c.Tag)
+	}
+	if c.CloseReason != CloseUnknown {
+		s += ", " + c.CloseReason.String()
+	}
+	return s
 }
 
-func (ns *Impl) processSSH() bool {
-	return ns.lb != nil && ns.lb.ShouldRunSSH()
+// activeConn is an entry in Impl.activeConns.
+type activeConn struct {
+	info   ConnInfo
+	ep     tcpip.Endpoint // the peer side of a TCP conn, or nil
+	reason atomic.Int32   // CloseReason; the first one set wins
+
+	toServer atomic.Int64 // payload bytes copied from the peer to the backend
+	toClient atomic.Int64 // payload bytes copied from the backend to the peer
+
+	// For UDP sessions, lastActive is the Unix time in nanoseconds a
+	// packet was last copied in either direction, and expire, guarded
+	// by Impl.mu, ends the session as if it had timed out.
+	lastActive atomic.Int64
+	expire     func()
 }
 
-func (ns *Impl) peerAPIPortAtomic(ip netip.Addr) *uint32 {
-	if ip.Is4() {
-		return &ns.peerapiPort4Atomic
-	} else {
-		return &ns.peerapiPort6Atomic
+// setCloseReason records r as why ac ended, unless a reason was already
+// recorded.
+func (ac *activeConn) setCloseReason(r CloseReason) {
+	ac.reason.CompareAndSwap(int32(CloseUnknown), int32(r))
+}
+
+// registerConn adds a flow described by info to ns.activeConns. For TCP
+// conns, ep is the peer side's endpoint, if known, to report TCPStats
+// from. The caller must call unregisterConn with the result when the
+// flow ends.
+func (ns *Impl) registerConn(info ConnInfo, ep tcpip.Endpoint) *activeConn {
+	if ns.ConnTagger != nil {
+		info.Tag = ns.ConnTagger(info.Src, info.Dst)
 	}
+	ac := &activeConn{info: info, ep: ep}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.activeConns[ac] = true
+	return ac
 }
 
-var viaRange = tsaddr.TailscaleViaRange()
+// unregisterConn removes ac from ns.activeConns, sets ac.info.CloseReason
+// and reports it to ns.OnConnClose.
+func (ns *Impl) unregisterConn(ac *activeConn) {
+	ns.mu.Lock()
+	delete(ns.activeConns, ac)
+	ns.mu.Unlock()
 
-// shouldProcessInbound reports whether an inbound packet (a packet from a
-// WireGuard peer) should be handled by netstack.
-func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
-	// Handle incoming peerapi connections in netstack.
-	if ns.lb != nil && p.IPProto == ipproto.TCP {
-		var peerAPIPort uint16
-		dstIP := p.Dst.Addr()
-		if p.TCPFlags&packet.TCPSynAck == packet.TCPSyn && ns.isLocalIP(dstIP) {
-			if port, ok := ns.lb.GetPeerAPIPort(p.Dst.Addr()); ok {
-				peerAPIPort = port
-				atomic.StoreUint32(ns.peerAPIPortAtomic(dstIP), uint32(port))
-			}
-		} else {
-			peerAPIPort = uint16(atomic.LoadUint32(ns.peerAPIPortAtomic(dstIP)))
-		}
-		if p.IPProto == ipproto.TCP && p.Dst.Port() == peerAPIPort {
-			return true
-		}
+	if ns.ctx.Err() != nil {
+		ac.info.CloseReason = CloseShutdown
+	} else {
+		ac.info.CloseReason = CloseReason(ac.reason.Load())
 	}
-	if ns.isInboundTSSH(p) && ns.processSSH() {
-		return true
+	if ac.ep != nil {
+		ac.info.TCP = tcpStatsOf(ac.ep)
 	}
-	if p.IPVersion == 6 && viaRange.Contains(p.Dst.Addr()) {
-		return ns.lb != nil && ns.lb.ShouldHandleViaIP(p.Dst.Addr())
+	if ns.OnConnClose != nil {
+		ns.OnConnClose(ac.info)
 	}
-	if !ns.ProcessLocalIPs && !ns.ProcessSubnets {
-		// Fast path for common case (e.g. Linux server in TUN mode) where
-		// netstack isn't used at all; don't even do an isLocalIP lookup.
-		return false
-	}
-	isLocal := ns.isLocalIP(p.Dst.Addr())
-	if ns.ProcessLocalIPs && isLocal {
-		return true
-	}
-	if ns.ProcessSubnets && !isLocal {
-		return true
+	if ns.OnConnEvent != nil {
+		go ns.OnConnEvent(ConnEvent{
+			Proto:         ac.info.Proto,
+			Src:           ac.info.Src,
+			Dst:           ac.info.Dst,
+			Start:         ac.info.Start,
+			End:           time.Now(),
+			BytesToServer: ac.toServer.Load(),
+			BytesToClient: ac.toClient.Load(),
+		})
 	}
-	return false
 }
 
-// setAmbientCapsRaw is non-nil on Linux for Synology, to run ping with
-// CAP_NET_RAW from tailscaled's binary.
-var setAmbientCapsRaw func(*exec.Cmd)
+// ConnEvent describes a TCP connection or UDP session that netstack
+// forwarded, once it's ended. It's passed to Impl.OnConnEvent.
+type ConnEvent struct {
+	Proto ipproto.Proto  // ipproto.TCP or ipproto.UDP
+	Src   netip.AddrPort // the peer's address
+	Dst   netip.AddrPort // the address the peer connected to
+	Start time.Time      // when forwarding started
+	End   time.Time      // when forwarding ended
 
-var userPingSem = syncs.NewSemaphore(20) // 20 child ping processes at once
+	BytesToServer int64 // payload bytes copied from the peer to the backend
+	BytesToClient int64 // payload bytes copied from the backend to the peer
+}
 
-var isSynology = runtime.GOOS == "linux" && distro.Get() == distro.Synology
+// ForwardedDests returns the distinct destination addresses of the TCP
+// connections and UDP sessions that ns is currently forwarding, sorted.
+func (ns *Impl) ForwardedDests() []netip.AddrPort {
+	ns.mu.Lock()
+	seen := make(map[netip.AddrPort]bool, len(ns.activeConns))
+	for ac := range ns.activeConns {
+		seen[ac.info.Dst] = true
+	}
+	ns.mu.Unlock()
+	ret := make([]netip.AddrPort, 0, len(seen))
+	for ap := range seen {
+		ret = append(ret, ap)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if c := ret[i].Addr().Compare(ret[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return ret[i].Port() < ret[j].Port()
+	})
+	return ret
+}
 
-// userPing tried to ping dstIP and if it succeeds, injects pingResPkt
-// into the tundev.
-//
-// It's used in userspace/netstack mode when we don't have kernel
-// support or raw socket access. As such, this does the dumbest thing
-// that can work: runs the ping command. It's not super efficient, so
-// it bounds the number of pings going on at once. The idea is that
-// people only use ping occasionally to see if their internet's working
-// so this doesn't need to be great.
-//
-// TODO(bradfitz): when we're running on Windows as the system user, use
-// raw socket APIs instead of ping child processes.
-func (ns *Impl) userPing(dstIP netip.Addr, pingResPkt []byte) {
-	if !userPingSem.TryAcquire() {
-		return
+// RegisteredIPs returns the addresses currently registered on the
+// netstack NIC, sorted. This includes the node's own addresses as well
+// as subnet addresses added on demand while connections to them are open.
+func (ns *Impl) RegisteredIPs() []netip.Prefix {
+	addrs := ns.ipstack.AllAddresses()[nicID]
+	ret := make([]netip.Prefix, 0, len(addrs))
+	for _, pa := range addrs {
+		ret = append(ret, addressWithPrefixToIPPrefix(pa.AddressWithPrefix))
 	}
-	defer userPingSem.Release()
+	sortPrefixes(ret)
+	return ret
+}
 
-	t0 := time.Now()
-	var err error
-	switch runtime.GOOS {
-	case "windows":
-		err = exec.Command("ping", "-n", "1", "-w", "3000", dstIP.String()).Run()
-	case "darwin":
-		// Note: 2000 ms is actually 1 second + 2,000
-		// milliseconds extra for 3 seconds total.
-		// See https://github.com/tailscale/tailscale/pull/3753 for details.
-		err = exec.Command("ping", "-c", "1", "-W", "2000", dstIP.String()).Run()
-	case "android":
-		ping := "/system/bin/ping"
-		if dstIP.Is6() {
-			ping = "/system/bin/ping6"
-		}
-		err = exec.Command(ping, "-c", "1", "-w", "3", dstIP.String()).Run()
-	default:
-		ping := "ping"
-		if isSynology {
-			ping = "/bin/ping"
-		}
-		cmd := exec.Command(ping, "-c", "1", "-W", "3", dstIP.String())
-		if isSynology && os.Getuid() != 0 {
-			// On DSM7 we run as non-root and need to pass
-			// CAP_NET_RAW if our binary has it.
-			setAmbientCapsRaw(cmd)
+// CloseIdleUDPSessions closes the forwarded UDP sessions that have not
+// copied a packet in either direction for at least idleFor, as if their
+// idle timeout had expired, and returns how many it closed.
+func (ns *Impl) CloseIdleUDPSessions(idleFor time.Duration) int {
+	cutoff := ns.now().Add(-idleFor).UnixNano()
+	var expire []func()
+	ns.mu.Lock()
+	for ac := range ns.activeConns {
+		if ac.expire != nil && ac.lastActive.Load() <= cutoff {
+			expire = append(expire, ac.expire)
 		}
-		err = cmd.Run()
 	}
-	d := time.Since(t0)
-	if err != nil {
-		if d < time.Second/2 {
-			// If it failed quicker than the 3 second
-			// timeout we gave above (500 ms is a
-			// reasonable threshold), then assume the ping
-			// failed for problems finding/running
-			// ping. We don't want to log if the host is
-			// just down.
-			ns.logf("exec ping of %v failed in %v: %v", dstIP, d, err)
-		}
-		return
+	ns.mu.Unlock()
+	for _, f := range expire {
+		f()
 	}
-	if debugNetstack() {
-		ns.logf("exec pinged %v in %v", dstIP, time.Since(t0))
+	return len(expire)
+}
+
+// ActiveConns returns the TCP connections and UDP sessions that ns is
+// currently forwarding, oldest first.
+func (ns *Impl) ActiveConns() []ConnInfo {
+	ns.mu.Lock()
+	ret := make([]ConnInfo, 0, len(ns.activeConns))
+	var eps []tcpip.Endpoint // parallel to ret
+	for ac := range ns.activeConns {
+		ret = append(ret, ac.info)
+		eps = append(eps, ac.ep)
 	}
-	if err := ns.tundev.InjectOutbound(pingResPkt); err != nil {
-		ns.logf("InjectOutbound ping response: %v", err)
+	ns.mu.Unlock()
+	// Read the TCP stats without ns.mu held, as it takes each
+	// endpoint's lock.
+	for i, ep := range eps {
+		if ep != nil {
+			ret[i].TCP = tcpStatsOf(ep)
+		}
 	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Start.Before(ret[j].Start)
+	})
+	return ret
 }
 
-func (ns *Impl) isInboundTSSH(p *packet.Parsed) bool {
-	return p.IPProto == ipproto.TCP &&
-		p.Dst.Port() == 22 &&
-		ns.isLocalIP(p.Dst.Addr())
+// SavedConn is the metadata of a forwarded TCP connection or UDP
+// session, saved by Impl.SaveConns so it can be passed to Impl.Reconnect
+// after a restart.
+type SavedConn struct {
+	Proto   ipproto.Proto
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Backend netip.AddrPort
 }
 
-// injectInbound is installed as a packet hook on the 'inbound' (from a
-// WireGuard peer) path. Returning filter.Accept releases the packet to
-// continue normally (typically being delivered to the host networking stack),
-// whereas returning filter.DropSilently is done when netstack intercepts the
-// packet and no further processing towards to host should be done.
-func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Response {
-	if !ns.shouldProcessInbound(p, t) {
-		// Let the host network stack (if any) deal with it.
-		return filter.Accept
-	}
+// savedConnsVersion is the version of the format written by SaveConns.
+const savedConnsVersion = 1
 
-	destIP := p.Dst.Addr()
+// savedConns is the JSON format written by SaveConns.
+type savedConns struct {
+	Version int
+	Conns   []SavedConn
+}
 
-	// If this is an echo request and we're a subnet router, handle pings
-	// ourselves instead of forwarding the packet on.
-	pingIP, handlePing := ns.shouldHandlePing(p)
-	if handlePing {
-		var pong []byte // the reply to the ping, if our relayed ping works
-		if destIP.Is4() {
-			h := p.ICMP4Header()
-			h.ToResponse()
-			pong = packet.Generate(&h, p.Payload())
-		} else if destIP.Is6() {
-			h := p.ICMP6Header()
-			h.ToResponse()
-			pong = packet.Generate(&h, p.Payload())
-		}
-		go ns.userPing(pingIP, pong)
-		return filter.DropSilently
+// SaveConns returns the flows that ns is currently forwarding, oldest
+// first, encoded for RestoreConns. It's meant to be called at shutdown.
+func (ns *Impl) SaveConns() ([]byte, error) {
+	conns := ns.ActiveConns()
+	sc := savedConns{
+		Version: savedConnsVersion,
+		Conns:   make([]SavedConn, 0, len(conns)),
+	}
+	for _, c := range conns {
+		sc.Conns = append(sc.Conns, SavedConn{
+			Proto:   c.Proto,
+			Src:     c.Src,
+			Dst:     c.Dst,
+			Backend: c.Backend,
+		})
 	}
+	return json.Marshal(sc)
+}
 
-	var pn tcpip.NetworkProtocolNumber
-	switch p.IPVersion {
-	case 4:
-		pn = header.IPv4ProtocolNumber
-	case 6:
-		pn = header.IPv6ProtocolNumber
+// RestoreConns decodes flows saved by SaveConns and passes each to
+// ns.Reconnect, logging any errors. It returns the number of flows that
+// were re-established.
+func (ns *Impl) RestoreConns(b []byte) (int, error) {
+	var sc savedConns
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return 0, fmt.Errorf("netstack: decoding saved conns: %w", err)
 	}
-	if debugPackets {
-		ns.logf("[v2] packet in (from %v): % x", p.Src, p.Buffer())
+	if sc.Version != savedConnsVersion {
+		return 0, fmt.Errorf("netstack: unknown saved conns version %d", sc.Version)
 	}
-	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
-		Payload: bufferv2.MakeWithData(append([]byte(nil), p.Buffer()...)),
-	})
-	ns.linkEP.InjectInbound(pn, packetBuf)
-	packetBuf.DecRef()
+	if ns.Reconnect == nil {
+		return 0, nil
+	}
+	n := 0
+	for _, c := range sc.Conns {
+		if err := ns.Reconnect(c); err != nil {
+			ns.logf("netstack: reconnecting %v %v -> %v: %v", c.Proto, c.Src, c.Dst, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
 
-	// We've now delivered this to netstack, so we're done.
-	// Instead of returning a filter.Accept here (which would also
-	// potentially deliver it to the host OS), and instead of
-	// filter.Drop (which would log about rejected traffic),
-	// instead return filter.DropSilently which just quietly stops
-	// processing it in the tstun TUN wrapper.
-	return filter.DropSilently
+// NetstackMem describes the state that drives netstack's memory usage.
+// It's returned by Impl.MemStats.
+//
+// gVisor doesn't report the size of its buffer pools, so these are the
+// counts of the objects holding buffers instead.
+type NetstackMem struct {
+	// Endpoints is the number of transport endpoints (sockets)
+	// registered with the gVisor stack.
+	Endpoints int
+	// LingeringEndpoints is the number of closed endpoints that gVisor
+	// is still holding on to, such as TCP connections in TIME-WAIT.
+	LingeringEndpoints int
+	// TCPConnected is the number of TCP connections that gVisor
+	// considers connected.
+	TCPConnected uint64
+	// QueuedPackets is the number of outbound packets generated by
+	// gVisor that are waiting to be injected.
+	QueuedPackets int
+	// Addresses is the number of IP addresses registered on the NIC.
+	Addresses int
+	// SubnetIPs is the number of subnet IPs dynamically registered for
+	// open connections.
+	SubnetIPs int
+	// ForwardedFlows is the number of TCP connections and UDP
+	// sessions currently being forwarded.
+	ForwardedFlows int
 }
 
-// shouldHandlePing returns whether or not netstack should handle an incoming
-// ICMP echo request packet, and the IP address that should be pinged from this
-// process. The IP address can be different from the destination in the packet
-// if the destination is a 4via6 address.
-func (ns *Impl) shouldHandlePing(p *packet.Parsed) (_ netip.Addr, ok bool) {
-	if !p.IsEchoRequest() {
-		return netip.Addr{}, false
+// MemStats returns a snapshot of the state that determines netstack's
+// memory usage, to help with sizing the devices it runs on.
+func (ns *Impl) MemStats() NetstackMem {
+	ns.mu.Lock()
+	subnetIPs := len(ns.connsOpenBySubnetIP)
+	ns.mu.Unlock()
+	return NetstackMem{
+		Endpoints:          len(ns.ipstack.RegisteredEndpoints()),
+		LingeringEndpoints: len(ns.ipstack.CleanupEndpoints()),
+		TCPConnected:       ns.ipstack.Stats().TCP.CurrentConnected.Value(),
+		QueuedPackets:      ns.linkEP.NumQueued(),
+		Addresses:          len(ns.ipstack.AllAddresses()[nicID]),
+		SubnetIPs:          subnetIPs,
+		ForwardedFlows:     int(ns.activeTCPConns.Load() + ns.activeUDPSessions.Load()),
 	}
+}
 
-	destIP := p.Dst.Addr()
+// stateVersion is the version of the format written by StateJSON.
+const stateVersion = 1
 
-	// We need to handle pings for all 4via6 addresses, even if this
-	// netstack instance normally isn't responsible for processing subnets.
-	//
-	// For example, on Linux, subnet router traffic could be handled via
-	// tun+iptables rules for most packets, but we still need to handle
-	// ICMP echo requests over 4via6 since the host networking stack
-	// doesn't know what to do with a 4via6 address.
-	//
-	// shouldProcessInbound returns 'true' to say that we should process
-	// all IPv6 packets with a destination address in the 'via' range, so
-	// check before we check the "ProcessSubnets" boolean below.
-	if viaRange.Contains(destIP) {
-		// The input echo request was to a 4via6 address, which we cannot
-		// simply ping as-is from this process. Translate the destination to an
-		// IPv4 address, so that our relayed ping (in userPing) is pinging the
-		// underlying destination IP.
-		//
-		// ICMPv4 and ICMPv6 are different protocols with different on-the-wire
-		// representations, so normally you can't send an ICMPv6 message over
-		// IPv4 and expect to get a useful result. However, in this specific
-		// case things are safe because the 'userPing' function doesn't make
-		// use of the input packet.
-		return tsaddr.UnmapVia(destIP), true
-	}
+// netstackState is the JSON format written by StateJSON. Fields are
+// only added to it; changing or removing one needs a new stateVersion.
+type netstackState struct {
+	Version    int
+	Time       time.Time
+	Conns      []connState
+	Addresses  []string // on the NIC, as address/prefix length
+	Routes     []string // destinations in the route table
+	Protocols  []string // network and transport protocols enabled
+	Stats      Stats
+	Handlers   map[string]int64 // see HandlerStats
+	Goroutines GoroutineCounts
+	Mem        NetstackMem
+	Options    map[string]any // see stateOptions
+}
 
-	// If we get here, we don't do anything unless this netstack instance
-	// is responsible for processing subnet traffic.
-	if !ns.ProcessSubnets {
-		return netip.Addr{}, false
+// connState is a ConnInfo in the format written by StateJSON.
+type connState struct {
+	Proto   string
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Backend netip.AddrPort
+	Start   time.Time
+	Tag     string    `json:",omitempty"`
+	TCP     *TCPStats `json:",omitempty"`
+}
+
+// StateJSON returns a snapshot of ns's state as JSON, for debugging:
+// the flows it's forwarding, its addresses, routes and protocols, its
+// counters, and its options. It's safe to call at any time after
+// Create.
+func (ns *Impl) StateJSON() ([]byte, error) {
+	st := netstackState{
+		Version:    stateVersion,
+		Time:       ns.now(),
+		Conns:      []connState{},
+		Stats:      ns.Stats(),
+		Handlers:   ns.HandlerStats(),
+		Goroutines: ns.GoroutineStats(),
+		Mem:        ns.MemStats(),
+		Options:    ns.stateOptions(),
+	}
+	for _, c := range ns.ActiveConns() {
+		st.Conns = append(st.Conns, connState{
+			Proto:   c.Proto.String(),
+			Src:     c.Src,
+			Dst:     c.Dst,
+			Backend: c.Backend,
+			Start:   c.Start,
+			Tag:     c.Tag,
+			TCP:     c.TCP,
+		})
+	}
+	for _, pa := range ns.ipstack.AllAddresses()[nicID] {
+		st.Addresses = append(st.Addresses, pa.AddressWithPrefix.String())
+	}
+	sort.Strings(st.Addresses)
+	for _, r := range ns.ipstack.GetRouteTable() {
+		st.Routes = append(st.Routes, r.Destination.String())
+	}
+	for _, p := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"ipv4", ns.ipstack.NetworkProtocolInstance(ipv4.ProtocolNumber) != nil},
+		{"ipv6", ns.ipstack.NetworkProtocolInstance(ipv6.ProtocolNumber) != nil},
+		{"tcp", ns.ipstack.TransportProtocolInstance(tcp.ProtocolNumber) != nil},
+		{"udp", ns.ipstack.TransportProtocolInstance(udp.ProtocolNumber) != nil},
+		{"icmpv4", ns.ipstack.TransportProtocolInstance(icmp.ProtocolNumber4) != nil},
+		{"icmpv6", ns.ipstack.TransportProtocolInstance(icmp.ProtocolNumber6) != nil},
+	} {
+		if p.enabled {
+			st.Protocols = append(st.Protocols, p.name)
+		}
 	}
+	return json.Marshal(st)
+}
 
-	// For non-4via6 addresses, we don't handle pings if they're destined
-	// for a Tailscale IP.
-	if tsaddr.IsTailscaleIP(destIP) {
-		return netip.Addr{}, false
+// stateOptions returns ns's exported options for StateJSON, keyed by
+// field name. Options that are funcs are reported as whether they're
+// set, as is ForwardViaWebSocket, whose URL may hold credentials;
+// HandlerChain is reported as its matchers' names; durations are
+// strings.
+func (ns *Impl) stateOptions() map[string]any {
+	m := map[string]any{}
+	v := reflect.ValueOf(ns).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f, sf := v.Field(i), v.Type().Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		switch x := f.Interface().(type) {
+		case *url.URL:
+			m[sf.Name] = x != nil
+		case []HandlerMatcher:
+			names := make([]string, len(x))
+			for i, h := range x {
+				names[i] = h.Name
+			}
+			m[sf.Name] = names
+		case time.Duration:
+			m[sf.Name] = x.String()
+		default:
+			if f.Kind() == reflect.Func {
+				m[sf.Name] = !f.IsNil()
+			} else {
+				m[sf.Name] = x
+			}
+		}
 	}
+	return m
+}
 
-	// This netstack instance is processing subnet traffic, so handle the
-	// ping ourselves.
-	return destIP, true
+// trackGoroutine increments n and returns a func that decrements it.
+// It's meant to be used at the top of a goroutine as:
+//
+//	defer trackGoroutine(&ns.numFooGoroutines)()
+func trackGoroutine(n *atomic.Int64) func() {
+	n.Add(1)
+	return func() { n.Add(-1) }
 }
 
-func netaddrIPFromNetstackIP(s tcpip.Address) netip.Addr {
-	switch len(s) {
-	case 4:
-		return netaddr.IPv4(s[0], s[1], s[2], s[3])
-	case 16:
-		var a [16]byte
-		copy(a[:], s)
-		return netip.AddrFrom16(a).Unmap()
+// handleSSH is initialized in ssh.go (on Linux only) to register an SSH server
+// handler. See https://github.com/tailscale/tailscale/issues/3802.
+var handleSSH func(logger.Logf, *ipnlocal.LocalBackend, net.Conn) error
+
+const nicID = 1
+
+// minUDPCopyBufferSize is the smallest buffer startPacketCopy reads UDP
+// packets into when relaying them, even if the MTU is smaller.
+const minUDPCopyBufferSize = 1500
+
+// validateMTU returns an error if mtu is too small for IPv6, which
+// requires more than IPv4, or too big for the tun device.
+func validateMTU(mtu uint32) error {
+	if mtu < header.IPv6MinimumMTU || mtu > tstun.MaxPacketSize {
+		return fmt.Errorf("netstack: MTU %d not in range [%d, %d]", mtu, header.IPv6MinimumMTU, tstun.MaxPacketSize)
 	}
-	return netip.Addr{}
+	return nil
 }
 
-func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
-	reqDetails := r.ID()
-	if debugNetstack() {
-		ns.logf("[v2] TCP ForwarderRequest: %s", stringifyTEI(reqDetails))
-	}
-	clientRemoteIP := netaddrIPFromNetstackIP(reqDetails.RemoteAddress)
-	if !clientRemoteIP.IsValid() {
-		ns.logf("invalid RemoteAddress in TCP ForwarderRequest: %s", stringifyTEI(reqDetails))
-		r.Complete(true) // sends a RST
-		return
-	}
+// Create creates and populates a new Impl, with a NIC using the given
+// MTU, which is usually tstun.DefaultMTU. It can be changed later with
+// SetMTU.
+func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magicsock.Conn, dialer *tsdial.Dialer, dns *dns.Manager, mtu uint32) (*Impl, error) {
+	return CreateWithOptions(logf, tundev, e, mc, dialer, dns, mtu, CreateOptions{})
+}
 
-	dialIP := netaddrIPFromNetstackIP(reqDetails.LocalAddress)
-	isTailscaleIP := tsaddr.IsTailscaleIP(dialIP)
+// CreateOptions are options for CreateWithOptions.
+type CreateOptions struct {
+	// NICRetries is how many more times to try creating the netstack
+	// NIC if the first attempt fails, as it may under transient
+	// resource exhaustion. The default is zero, to fail immediately.
+	NICRetries int
 
-	if viaRange.Contains(dialIP) {
-		isTailscaleIP = false
-		dialIP = tsaddr.UnmapVia(dialIP)
-	}
+	// NICRetryBackoff is how long to wait before the first retry of
+	// creating the NIC. It doubles after each retry. If zero, 100ms
+	// is used.
+	NICRetryBackoff time.Duration
 
-	defer func() {
-		if !isTailscaleIP {
-			// if this is a subnet IP, we added this in before the TCP handshake
-			// so netstack is happy TCP-handshaking as a subnet IP
-			ns.removeSubnetAddress(dialIP)
-		}
-	}()
+	// DisableUDP, if set, leaves UDP out of netstack's gVisor stack,
+	// for uses that only need TCP, such as a tsnet HTTP server. UDP
+	// is then neither forwarded nor answered, MagicDNS is only served
+	// over TCP, and DialContextUDP fails.
+	DisableUDP bool
 
-	var wq waiter.Queue
+	// DisableICMPEndpoints, if set, leaves out gVisor's ICMP transport
+	// protocols, which only back ICMP sockets; netstack doesn't use
+	// them itself. gVisor's IP layers still answer echo requests and
+	// send ICMP errors; see Impl.DisableICMP to stop those.
+	DisableICMPEndpoints bool
 
-	// We can't actually create the endpoint or complete the inbound
-	// request until we're sure that the connection can be handled by this
-	// endpoint. This function sets up the TCP connection and should be
-	// called immediately before a connection is handled.
-	createConn := func(opts ...tcpip.SettableSocketOption) *gonet.TCPConn {
-		ep, err := r.CreateEndpoint(&wq)
-		if err != nil {
-			ns.logf("CreateEndpoint error for %s: %v", stringifyTEI(reqDetails), err)
-			r.Complete(true) // sends a RST
-			return nil
-		}
-		r.Complete(false)
-		for _, opt := range opts {
-			ep.SetSockOpt(opt)
-		}
-		// SetKeepAlive so that idle connections to peers that have forgotten about
-		// the connection or gone completely offline eventually time out.
+	// LinkEndpointQueueSize, if non-zero, is how many packets netstack
+	// sends can be queued for injection into the tun device. Packets
+	// sent while the queue is full are dropped; see
+	// Stats.LinkQueueDrops. The default is 512, and it must be at
+	// least 64.
+	LinkEndpointQueueSize int
+
+	// createNIC, if non-nil, replaces createNIC. It's only set by tests.
+	createNIC func(*stack.Stack, *linkEndpoint) error
+}
+
+// CreateWithOptions is like Create, with opts.
+func CreateWithOptions(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magicsock.Conn, dialer *tsdial.Dialer, dns *dns.Manager, mtu uint32, opts CreateOptions) (*Impl, error) {
+	if mc == nil {
+		return nil, errors.New("nil magicsock.Conn")
+	}
+	if tundev == nil {
+		return nil, errors.New("nil tundev")
+	}
+	if logf == nil {
+		return nil, errors.New("nil logger")
+	}
+	if e == nil {
+		return nil, errors.New("nil Engine")
+	}
+	if dialer == nil {
+		return nil, errors.New("nil Dialer")
+	}
+	if err := validateMTU(mtu); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	ipstack := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: opts.transportProtocols(),
+	})
+	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
+	tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt)
+	if tcpipErr != nil {
+		return nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
+	}
+	linkEP := newLinkEndpoint(opts.linkEndpointQueueSize(), mtu)
+	if err := opts.createNICWithRetries(logf, ipstack, linkEP); err != nil {
+		return nil, err
+	}
+	ns := &Impl{
+		logf:                logf,
+		limitedLogf:         logger.RateLimitedFn(logf, time.Minute, 2, 10),
+		ipstack:             ipstack,
+		linkEP:              linkEP,
+		tundev:              tundev,
+		e:                   e,
+		mc:                  mc,
+		dialer:              dialer,
+		connsOpenBySubnetIP: make(map[netip.Addr]int),
+		activeConns:         make(map[*activeConn]bool),
+		dns:                 dns,
+	}
+	ns.ctx, ns.ctxCancel = context.WithCancel(context.Background())
+	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nil))
+	return ns, nil
+}
+
+// validate reports an error if opts has invalid settings.
+func (opts CreateOptions) validate() error {
+	if n := opts.LinkEndpointQueueSize; n < 0 || n != 0 && n < minLinkEndpointQueueSize {
+		return fmt.Errorf("netstack: LinkEndpointQueueSize %d is less than %d", n, minLinkEndpointQueueSize)
+	}
+	return nil
+}
+
+// linkEndpointQueueSize returns opts.LinkEndpointQueueSize, or the
+// default if it's zero.
+func (opts CreateOptions) linkEndpointQueueSize() int {
+	if opts.LinkEndpointQueueSize == 0 {
+		return defaultLinkEndpointQueueSize
+	}
+	return opts.LinkEndpointQueueSize
+}
+
+// transportProtocols returns the transport protocols of netstack's
+// gVisor stack: TCP, and UDP and ICMP unless opts disables them.
+func (opts CreateOptions) transportProtocols() []stack.TransportProtocolFactory {
+	protos := []stack.TransportProtocolFactory{tcp.NewProtocol}
+	if !opts.DisableUDP {
+		protos = append(protos, udp.NewProtocol)
+	}
+	if !opts.DisableICMPEndpoints {
+		protos = append(protos, icmp.NewProtocol4, icmp.NewProtocol6)
+	}
+	return protos
+}
+
+// createNICWithRetries calls createNIC, retrying with backoff as
+// configured by opts.
+func (opts CreateOptions) createNICWithRetries(logf logger.Logf, ipstack *stack.Stack, linkEP *linkEndpoint) error {
+	create := createNIC
+	if opts.createNIC != nil {
+		create = opts.createNIC
+	}
+	backoff := opts.NICRetryBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	for attempt := 1; ; attempt++ {
+		err := create(ipstack, linkEP)
+		if err == nil {
+			return nil
+		}
+		if attempt > opts.NICRetries {
+			if attempt == 1 {
+				return err
+			}
+			return fmt.Errorf("netstack: giving up after %d attempts: %w", attempt, err)
+		}
+		logf("netstack: %v; retrying in %v", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+const (
+	defaultLinkEndpointQueueSize = 512
+	minLinkEndpointQueueSize     = 64
+)
+
+// linkEndpoint is the netstack NIC's link endpoint. Packets gVisor sends
+// are queued for inject to read.
+type linkEndpoint struct {
+	*channel.Endpoint
+	queueSize  int // capacity of the channel.Endpoint's queue
+	mtu        atomic.Uint32
+	queueDrops atomic.Uint64 // packets dropped because the queue was full
+
+	// blockCtx, if non-nil, makes WritePackets wait for room in the
+	// queue until it's done, rather than drop packets. room holds a
+	// token for each free slot in the queue.
+	blockCtx context.Context
+	room     chan struct{}
+}
+
+func newLinkEndpoint(queueSize int, mtu uint32) *linkEndpoint {
+	e := &linkEndpoint{Endpoint: channel.New(queueSize, mtu, ""), queueSize: queueSize}
+	e.mtu.Store(mtu)
+	return e
+}
+
+// MTU implements stack.LinkEndpoint. Unlike the channel.Endpoint's, it
+// can be changed, by Impl.SetMTU.
+func (e *linkEndpoint) MTU() uint32 {
+	return e.mtu.Load()
+}
+
+// blockWhenFull makes e's WritePackets wait for room in its queue
+// until ctx is done. It must be called before e is used.
+func (e *linkEndpoint) blockWhenFull(ctx context.Context) {
+	e.blockCtx = ctx
+	e.room = make(chan struct{}, e.queueSize)
+	for i := 0; i < e.queueSize; i++ {
+		e.room <- struct{}{}
+	}
+}
+
+// WritePackets implements stack.LinkEndpoint. The channel.Endpoint
+// drops packets that don't fit in its queue without reporting an error,
+// so it counts them.
+func (e *linkEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	if e.room != nil {
+		return e.writePacketsBlocking(pkts)
+	}
+	n, err := e.Endpoint.WritePackets(pkts)
+	if err == nil {
+		e.queueDrops.Add(uint64(pkts.Len() - n))
+	}
+	return n, err
+}
+
+// writePacketsBlocking is WritePackets for blockWhenFull.
+func (e *linkEndpoint) writePacketsBlocking(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	n := 0
+	for _, pkt := range pkts.AsSlice() {
+		select {
+		case <-e.room:
+		case <-e.blockCtx.Done():
+			if n == 0 {
+				return 0, &tcpip.ErrClosedForSend{}
+			}
+			return n, nil
+		}
+		var one stack.PacketBufferList
+		one.PushBack(pkt)
+		m, err := e.Endpoint.WritePackets(one)
+		if err != nil {
+			e.room <- struct{}{}
+			if n == 0 {
+				return 0, err
+			}
+			return n, nil
+		}
+		if m == 0 {
+			// Only possible if packets were queued before
+			// blockWhenFull.
+			e.room <- struct{}{}
+			e.queueDrops.Add(1)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// ReadContext is like the channel.Endpoint's, but makes room for
+// another packet if blockWhenFull was called.
+func (e *linkEndpoint) ReadContext(ctx context.Context) *stack.PacketBuffer {
+	pkt := e.Endpoint.ReadContext(ctx)
+	if pkt != nil && e.room != nil {
+		e.room <- struct{}{}
+	}
+	return pkt
+}
+
+// createNIC creates ipstack's NIC with linkEP, routing everything to it.
+func createNIC(ipstack *stack.Stack, linkEP *linkEndpoint) error {
+	if tcpipProblem := ipstack.CreateNIC(nicID, linkEP); tcpipProblem != nil {
+		return fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
+	}
+	// By default the netstack NIC will only accept packets for the IPs
+	// registered to it. Since in some cases we dynamically register IPs
+	// based on the packets that arrive, the NIC needs to accept all
+	// incoming packets. The NIC won't receive anything it isn't meant to
+	// since WireGuard will only send us packets that are meant for us.
+	ipstack.SetPromiscuousMode(nicID, true)
+	// Add IPv4 and IPv6 default routes, so all incoming packets from the Tailscale side
+	// are handled by the one fake NIC we use.
+	ipv4Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 4)), tcpip.AddressMask(strings.Repeat("\x00", 4)))
+	ipv6Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 16)), tcpip.AddressMask(strings.Repeat("\x00", 16)))
+	ipstack.SetRouteTable([]tcpip.Route{
+		{
+			Destination: ipv4Subnet,
+			NIC:         nicID,
+		},
+		{
+			Destination: ipv6Subnet,
+			NIC:         nicID,
+		},
+	})
+	return nil
+}
+
+// SetMTU changes the MTU of netstack's NIC. Packets netstack sends from
+// then on are fragmented or segmented to fit it, but TCP connections
+// keep the MSS they started with.
+func (ns *Impl) SetMTU(mtu uint32) error {
+	if err := validateMTU(mtu); err != nil {
+		return err
+	}
+	ns.linkEP.mtu.Store(mtu)
+	return nil
+}
+
+// MTU returns the MTU of netstack's NIC.
+func (ns *Impl) MTU() uint32 {
+	return ns.linkEP.MTU()
+}
+
+// TCPIPStack returns the gVisor stack underlying ns, which Create made,
+// so it's never nil. It's for experiments that need stack settings or
+// protocol handlers that Impl doesn't expose, and isn't a stable API:
+// changes made through it may conflict with Impl's own use of the
+// stack, and it may change or be removed without notice.
+func (ns *Impl) TCPIPStack() *stack.Stack {
+	return ns.ipstack
+}
+
+// maintenanceMode is the state of Impl.EnterMaintenance.
+type maintenanceMode struct {
+	allow []netip.Prefix // sources that may still connect
+}
+
+// EnterMaintenance puts ns in maintenance mode, in which new TCP
+// connections and UDP sessions are refused unless their source is in
+// one of the allow prefixes, such as those of administrators who need
+// to reach the device to fix it. Connections already being forwarded
+// are unaffected. Calling it again replaces the allowlist.
+func (ns *Impl) EnterMaintenance(allow []netip.Prefix) {
+	ns.maintenance.Store(&maintenanceMode{allow: append([]netip.Prefix(nil), allow...)})
+	ns.logf("netstack: entered maintenance mode, allowing new connections only from %v", allow)
+}
+
+// ExitMaintenance takes ns out of maintenance mode, accepting new
+// connections from all sources again.
+func (ns *Impl) ExitMaintenance() {
+	if ns.maintenance.Swap(nil) != nil {
+		ns.logf("netstack: exited maintenance mode")
+	}
+}
+
+// allowedInMaintenance reports whether a new connection from src is
+// allowed, which it is unless ns is in maintenance mode and src isn't
+// in its allowlist.
+func (ns *Impl) allowedInMaintenance(src netip.Addr) bool {
+	m := ns.maintenance.Load()
+	if m == nil {
+		return true
+	}
+	for _, p := range m.allow {
+		if p.Contains(src) {
+			return true
+		}
+	}
+	if debugNetstack() {
+		ns.logf("[v2] netstack: refused new connection from %v in maintenance mode", src)
+	}
+	return false
+}
+
+// shutdownPollInterval is how often Shutdown checks whether forwarded
+// connections have drained.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown is like Close, but first stops accepting new TCP connections
+// and UDP sessions and waits for the ones being forwarded to end, so
+// that peers see them closed rather than reset. If ctx is done before
+// they end, Shutdown closes ns anyway and returns ctx.Err().
+func (ns *Impl) Shutdown(ctx context.Context) error {
+	ns.shuttingDown.Store(true)
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for !ns.drained() {
+		select {
+		case <-ctx.Done():
+			ns.Close()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return ns.Close()
+}
+
+// drained reports whether ns has no forwarded connections.
+func (ns *Impl) drained() bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return len(ns.activeConns) == 0 && ns.forwardingConns.Load() == 0
+}
+
+func (ns *Impl) Close() error {
+	ns.ctxCancel()
+	ns.ipstack.Close()
+	if ns.heartbeatDone != nil {
+		<-ns.heartbeatDone
+	}
+	if ns.logCoalescer != nil {
+		ns.logCoalescer.flush()
+	}
+	return nil
+}
+
+// logRateFree are format substrings that LogRate doesn't apply to.
+var logRateFree = []string{
+	"netstack: heartbeat: ", // already periodic
+}
+
+// maxCoalescedFormats is the most formats a logCoalescer counts repeats
+// of at once. Past that, new formats are logged without limit.
+const maxCoalescedFormats = 100
+
+// logCoalescer is a Logf wrapper that, for each format, logs the first
+// message and then counts repeats of it for a period, logging a summary
+// at the end.
+type logCoalescer struct {
+	inner  logger.Logf
+	period time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*coalescedFormat // keyed by format; nil after flush
+}
+
+type coalescedFormat struct {
+	repeats int
+	timer   *time.Timer
+}
+
+func newLogCoalescer(logf logger.Logf, period time.Duration) *logCoalescer {
+	return &logCoalescer{
+		inner:   logf,
+		period:  period,
+		pending: make(map[string]*coalescedFormat),
+	}
+}
+
+func (c *logCoalescer) logf(format string, args ...any) {
+	for _, sub := range logRateFree {
+		if strings.Contains(format, sub) {
+			c.inner(format, args...)
+			return
+		}
+	}
+	c.mu.Lock()
+	if cf, ok := c.pending[format]; ok {
+		cf.repeats++
+		c.mu.Unlock()
+		return
+	}
+	if c.pending != nil && len(c.pending) < maxCoalescedFormats {
+		c.pending[format] = &coalescedFormat{
+			timer: time.AfterFunc(c.period, func() { c.summarize(format) }),
+		}
+	}
+	c.mu.Unlock()
+	c.inner(format, args...)
+}
+
+// summarize ends the period of counting repeats of format, logging how
+// many there were.
+func (c *logCoalescer) summarize(format string) {
+	c.mu.Lock()
+	cf, ok := c.pending[format]
+	delete(c.pending, format)
+	c.mu.Unlock()
+	if ok && cf.repeats > 0 {
+		c.inner("[RATELIMIT] format(%q) repeated %d times in the last %v", format, cf.repeats, c.period)
+	}
+}
+
+// flush summarizes all formats now and stops counting repeats, so no
+// more summaries are logged once it returns.
+func (c *logCoalescer) flush() {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+	for format, cf := range pending {
+		cf.timer.Stop()
+		if cf.repeats > 0 {
+			c.inner("[RATELIMIT] format(%q) repeated %d times", format, cf.repeats)
+		}
+	}
+}
+
+// SetLocalBackend sets the LocalBackend; it should only be run before
+// the Start method is called.
+func (ns *Impl) SetLocalBackend(lb *ipnlocal.LocalBackend) {
+	ns.lb.Store(lb)
+}
+
+// ReplaceLocalBackend replaces the LocalBackend, which may be nil. Unlike
+// SetLocalBackend, it may be called after Start. Connections that are
+// already being handled by the old LocalBackend aren't affected.
+func (ns *Impl) ReplaceLocalBackend(lb *ipnlocal.LocalBackend) {
+	ns.lb.Store(lb)
+
+	// Forget the peerapi ports learned from the old LocalBackend.
+	ns.mu.Lock()
+	ns.peerAPIPorts = nil
+	ns.mu.Unlock()
+	atomic.StoreUint32(&ns.peerapiPort4Atomic, 0)
+	atomic.StoreUint32(&ns.peerapiPort6Atomic, 0)
+	if ns.FastInboundReject {
+		ns.updateInterestingTCPPorts(ns.selfAddrs.Load())
+	}
+}
+
+// wrapProtoHandler returns protocol handler h wrapped in a version
+// that dynamically reconfigures ns's subnet addresses as needed for
+// outbound traffic.
+func (ns *Impl) wrapProtoHandler(h func(stack.TransportEndpointID, *stack.PacketBuffer) bool) func(stack.TransportEndpointID, *stack.PacketBuffer) bool {
+	return func(tei stack.TransportEndpointID, pb *stack.PacketBuffer) bool {
+		addr := tei.LocalAddress
+		ip, ok := netip.AddrFromSlice(net.IP(addr))
+		if !ok {
+			ns.logf("netstack: could not parse local address for incoming connection")
+			return false
+		}
+		ip = ip.Unmap()
+		if !ns.isLocalIP(ip) {
+			if ns.StaticSubnetAddrsOnly {
+				if !ns.isStaticSubnetIP(ip) {
+					ns.packetsDropped.Add(1)
+					return false
+				}
+			} else if ns.addSubnetAddress(ip) {
+				peer, _ := netip.AddrFromSlice(net.IP(tei.RemoteAddress))
+				peer = peer.Unmap()
+				// Rate limited, as a peer scanning a subnet
+				// registers an address per destination.
+				ns.limitedLogf("netstack: registered subnet IP %v for traffic from %v", ip, peer)
+				if ns.OnSubnetAddrRegistered != nil {
+					ns.OnSubnetAddrRegistered(peer, ip)
+				}
+			}
+		}
+		return h(tei, pb)
+	}
+}
+
+// isStaticSubnetIP reports whether ip is within a subnet route that
+// updateIPs installed.
+func (ns *Impl) isStaticSubnetIP(ip netip.Addr) bool {
+	for _, p := range ns.staticSubnets.Load() {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate reports whether ns's options are in range and consistent with
+// each other. Start calls it, but it can be called earlier, such as to
+// check options read from a config file.
+func (ns *Impl) Validate() error {
+	if err := ns.validateReassemblyLimits(); err != nil {
+		return err
+	}
+	if ns.DNSTransport != nil && ns.DNSResolverOverride != nil {
+		return errors.New("netstack: DNSTransport and DNSResolverOverride are both set")
+	}
+	if ns.DisableReassembly && (ns.MaxReassemblyFragments != 0 || ns.MaxReassemblyMemory != 0 || ns.ReassemblyTimeout != 0) {
+		return errors.New("netstack: reassembly limits set with DisableReassembly")
+	}
+	if err := ns.validateCongestionControl(); err != nil {
+		return err
+	}
+	if n := ns.TCPCopyBufferSize; n != 0 && n < minTCPCopyBufferSize {
+		return fmt.Errorf("netstack: TCPCopyBufferSize %d is less than %d", n, minTCPCopyBufferSize)
+	}
+	if ns.Keepalive != nil {
+		if err := ns.Keepalive.validate(); err != nil {
+			return err
+		}
+	}
+	if ns.TCPBufferSizes != nil {
+		if err := ns.TCPBufferSizes.validate(); err != nil {
+			return err
+		}
+	}
+	if ns.PerClientConnRate != nil {
+		if err := ns.PerClientConnRate.validate(); err != nil {
+			return err
+		}
+	}
+	if ns.InjectWorkers < 0 {
+		return fmt.Errorf("netstack: negative InjectWorkers %d", ns.InjectWorkers)
+	}
+	if n := ns.InjectReaders; n < 0 || n > maxInjectReaders {
+		return fmt.Errorf("netstack: InjectReaders %d not in range [0, %d]", n, maxInjectReaders)
+	}
+	if n := ns.ClampMSS; n != 0 && n < header.TCPMinimumMSS {
+		return fmt.Errorf("netstack: ClampMSS %d is less than %d", n, header.TCPMinimumMSS)
+	}
+	if n := ns.MaxDNSTCPMessageSize; n < 0 || n > math.MaxUint16 {
+		return fmt.Errorf("netstack: MaxDNSTCPMessageSize %d not in range [0, %d]", n, math.MaxUint16)
+	}
+	for _, v := range []struct {
+		name string
+		n    int64
+	}{
+		{"MaxEchoReplyPayload", int64(ns.MaxEchoReplyPayload)},
+		{"BackendDialRetries", int64(ns.BackendDialRetries)},
+		{"SubnetPingRate", int64(ns.SubnetPingRate)},
+		{"MaxDNSQueriesPerConn", int64(ns.MaxDNSQueriesPerConn)},
+		{"NewUDPSessionRate", int64(ns.NewUDPSessionRate)},
+		{"NewUDPSessionRatePerSource", int64(ns.NewUDPSessionRatePerSource)},
+		{"MaxConns", int64(ns.MaxConns)},
+	} {
+		if v.n < 0 {
+			return fmt.Errorf("netstack: negative %s %d", v.name, v.n)
+		}
+	}
+	for _, v := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"HeartbeatInterval", ns.HeartbeatInterval},
+		{"LogRate", ns.LogRate},
+		{"BackendTeardownGrace", ns.BackendTeardownGrace},
+		{"PeerAPIPortTTL", ns.PeerAPIPortTTL},
+		{"RefusedPortTTL", ns.RefusedPortTTL},
+		{"TCPConnectTimeout", ns.TCPConnectTimeout},
+	} {
+		if v.d < 0 {
+			return fmt.Errorf("netstack: negative %s %v", v.name, v.d)
+		}
+	}
+	for _, m := range ns.HandlerChain {
+		if m.Match == nil && m.builtin == nil {
+			return fmt.Errorf("netstack: HandlerChain entry %q has no Match func", m.Name)
+		}
+	}
+	for port, addrs := range ns.BackendPoolForPort {
+		if _, err := newBackendPool(addrs); err != nil {
+			return fmt.Errorf("netstack: BackendPoolForPort[%d]: %w", port, err)
+		}
+		if ns.isBlockedForwardPort(port) {
+			return fmt.Errorf("netstack: BackendPoolForPort[%d] is for a port in BlockedForwardPorts", port)
+		}
+	}
+	if ns.BackendPoolLeastConns && len(ns.BackendPoolForPort) == 0 {
+		return errors.New("netstack: BackendPoolLeastConns set without BackendPoolForPort")
+	}
+	if ns.AnswerLocalPings && !ns.ProcessLocalIPs {
+		return errors.New("netstack: AnswerLocalPings set without ProcessLocalIPs")
+	}
+	if ns.DisableICMP && (ns.AnswerLocalPings || ns.AnswerViaNeighborSolicits) {
+		return errors.New("netstack: AnswerLocalPings or AnswerViaNeighborSolicits set with DisableICMP")
+	}
+	if ns.StaticSubnetAddrsOnly && !ns.ProcessSubnets {
+		return errors.New("netstack: StaticSubnetAddrsOnly set without ProcessSubnets")
+	}
+	if ns.ReleaseBackendPort != nil && ns.EnsureBackendPort == nil {
+		return errors.New("netstack: ReleaseBackendPort set without EnsureBackendPort")
+	}
+	if ns.ForwardViaWebSocket != nil && ns.AcquireBackend != nil {
+		return errors.New("netstack: ForwardViaWebSocket and AcquireBackend are both set")
+	}
+	if ns.ForwardDialer != nil && (ns.ForwardViaWebSocket != nil || ns.AcquireBackend != nil) {
+		return errors.New("netstack: ForwardDialer set with ForwardViaWebSocket or AcquireBackend")
+	}
+	return nil
+}
+
+// Start sets up all the handlers so netstack can start working. Implements
+// wgengine.FakeImpl.
+func (ns *Impl) Start() error {
+	if err := ns.Validate(); err != nil {
+		return err
+	}
+	for port, addrs := range ns.BackendPoolForPort {
+		pool, err := newBackendPool(addrs)
+		if err != nil {
+			return fmt.Errorf("netstack: BackendPoolForPort[%d]: %w", port, err)
+		}
+		mak.Set(&ns.backendPools, port, pool)
+	}
+	if ns.InjectBlocking {
+		ns.linkEP.blockWhenFull(ns.ctx)
+	}
+	if err := ns.setDefaultTTLs(); err != nil {
+		return err
+	}
+	if cc := ns.TCPCongestionControl; cc != "" {
+		opt := tcpip.CongestionControlOption(cc)
+		if err := ns.ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("netstack: setting TCP congestion control %q: %v", cc, err)
+		}
+	}
+	if err := ns.setTCPBufferSizes(); err != nil {
+		return err
+	}
+	if ns.LogRate > 0 {
+		ns.logCoalescer = newLogCoalescer(ns.logf, ns.LogRate)
+		ns.logf = ns.logCoalescer.logf
+	}
+	ns.e.AddNetworkMapCallback(ns.updateIPs)
+	// size = 0 means use default buffer size
+	tcpReceiveBufferSize := 0
+	if ns.TCPBufferSizes != nil {
+		tcpReceiveBufferSize = ns.TCPBufferSizes.Receive.Default
+	}
+	const maxInFlightConnectionAttempts = 16
+	tcpFwd := tcp.NewForwarder(ns.ipstack, tcpReceiveBufferSize, maxInFlightConnectionAttempts, ns.acceptTCP)
+	ns.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, ns.wrapProtoHandler(tcpFwd.HandlePacket))
+	if ns.udpEnabled() {
+		udpFwd := udp.NewForwarder(ns.ipstack, ns.acceptUDP)
+		ns.ipstack.SetTransportProtocolHandler(udp.ProtocolNumber, ns.wrapProtoHandler(udpFwd.HandlePacket))
+	}
+	if ns.FastInboundReject {
+		ns.updateInterestingTCPPorts(nil)
+	}
+	if ns.StaticSubnetAddrsOnly {
+		// Subnet routes are installed as a single prefix address,
+		// which doesn't make each IP within it local to the NIC.
+		// Spoofing lets endpoints use them anyway; wrapProtoHandler
+		// restricts which IPs that applies to.
+		if err := ns.ipstack.SetSpoofing(nicID, true); err != nil {
+			return fmt.Errorf("netstack: enabling spoofing: %v", err)
+		}
+	}
+	if ns.NewUDPSessionRate > 0 {
+		ns.udpSessionLimiter = rate.NewLimiter(rate.Limit(ns.NewUDPSessionRate), ns.NewUDPSessionRate)
+	}
+	if ns.SubnetPingRate > 0 {
+		ns.subnetPingLimiter = rate.NewLimiter(rate.Limit(ns.SubnetPingRate), ns.SubnetPingRate)
+	}
+	ns.startInject()
+	if ns.MirrorTo != nil {
+		ns.mirrorc = make(chan mirrorChunk, mirrorQueueSize)
+		go ns.mirrorLoop()
+	}
+	if ns.HeartbeatInterval > 0 {
+		ns.heartbeatDone = make(chan struct{})
+		go ns.heartbeatLoop()
+	}
+	ns.tundev.PostFilterIn = ns.injectInbound
+	ns.tundev.PreFilterFromTunToNetstack = ns.handleLocalPackets
+	ns.startedAt.Store(ns.now())
+	return nil
+}
+
+// maxReassemblyMemory is the largest allowed MaxReassemblyMemory. It's
+// the limit gVisor applies to fragments awaiting reassembly.
+const maxReassemblyMemory = 4 << 20
+
+func (ns *Impl) validateReassemblyLimits() error {
+	if ns.MaxReassemblyFragments < 0 {
+		return fmt.Errorf("netstack: invalid MaxReassemblyFragments %d", ns.MaxReassemblyFragments)
+	}
+	if ns.MaxReassemblyMemory < 0 || ns.MaxReassemblyMemory > maxReassemblyMemory {
+		return fmt.Errorf("netstack: MaxReassemblyMemory %d out of range [0, %d]", ns.MaxReassemblyMemory, maxReassemblyMemory)
+	}
+	if ns.ReassemblyTimeout < 0 || ns.ReassemblyTimeout > ipv4.ReassembleTimeout {
+		return fmt.Errorf("netstack: ReassemblyTimeout %v out of range [0, %v]", ns.ReassemblyTimeout, ipv4.ReassembleTimeout)
+	}
+	return nil
+}
+
+// fragmentKey identifies the IP packet that a fragment belongs to.
+type fragmentKey struct {
+	src, dst netip.Addr
+	id       uint32
+	proto    uint8
+}
+
+// fragmentState is the state of a fragmented IP packet in Impl.fragments.
+type fragmentState struct {
+	start   time.Time
+	n       int  // fragments accepted
+	bytes   int  // bytes of fragments accepted
+	payload int  // payload bytes of fragments accepted
+	size    int  // payload bytes of the whole packet, once its last fragment is seen
+	dropped bool // remaining fragments are dropped
+}
+
+// fragment describes an IP fragment, as parsed by parseFragment.
+type fragment struct {
+	key     fragmentKey // of the packet it's a fragment of
+	payload int         // payload bytes in the fragment
+	last    bool        // whether it's the packet's last fragment
+	end     int         // offset in the packet's payload just past it
+}
+
+// parseFragment parses the IP packet b as a fragment, reporting whether
+// it's a fragment at all.
+func parseFragment(b []byte) (_ fragment, ok bool) {
+	if len(b) == 0 {
+		return fragment{}, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		h := header.IPv4(b)
+		if !h.IsValid(len(b)) || (!h.More() && h.FragmentOffset() == 0) {
+			return fragment{}, false
+		}
+		payload := int(h.PayloadLength())
+		return fragment{
+			key: fragmentKey{
+				src:   netaddrIPFromNetstackIP(h.SourceAddress()),
+				dst:   netaddrIPFromNetstackIP(h.DestinationAddress()),
+				id:    uint32(h.ID()),
+				proto: h.Protocol(),
+			},
+			payload: payload,
+			last:    !h.More(),
+			end:     int(h.FragmentOffset()) + payload,
+		}, true
+	case 6:
+		h := header.IPv6(b)
+		if !h.IsValid(len(b)) || h.NextHeader() != uint8(header.IPv6FragmentExtHdrIdentifier) {
+			return fragment{}, false
+		}
+		f := header.IPv6Fragment(b[header.IPv6MinimumSize:])
+		if !f.IsValid() {
+			return fragment{}, false
+		}
+		payload := int(h.PayloadLength()) - header.IPv6FragmentHeaderSize
+		return fragment{
+			key: fragmentKey{
+				src:   netaddrIPFromNetstackIP(h.SourceAddress()),
+				dst:   netaddrIPFromNetstackIP(h.DestinationAddress()),
+				id:    f.ID(),
+				proto: f.NextHeader(),
+			},
+			payload: payload,
+			last:    !f.More(),
+			end:     int(f.FragmentOffset())*8 + payload,
+		}, true
+	}
+	return fragment{}, false
+}
+
+// allowFragment reports whether p should be injected into netstack,
+// applying DisableReassembly and the reassembly limits if p is a
+// fragment.
+func (ns *Impl) allowFragment(p *packet.Parsed) bool {
+	if !ns.DisableReassembly && ns.MaxReassemblyFragments == 0 && ns.MaxReassemblyMemory == 0 && ns.ReassemblyTimeout == 0 {
+		return true
+	}
+	b := p.Buffer()
+	frag, ok := parseFragment(b)
+	if !ok {
+		return true
+	}
+	if ns.DisableReassembly {
+		return false
+	}
+	timeout := ns.ReassemblyTimeout
+	if timeout == 0 {
+		timeout = ipv4.ReassembleTimeout
+	}
+
+	now := time.Now()
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if now.Sub(ns.lastFragmentSweep) >= time.Second {
+		ns.lastFragmentSweep = now
+		for k, st := range ns.fragments {
+			// Keep dropping a packet's fragments for as long as gVisor
+			// might still reassemble it.
+			if now.Sub(st.start) >= ipv4.ReassembleTimeout {
+				ns.dropFragmentsLocked(st)
+				delete(ns.fragments, k)
+			} else if now.Sub(st.start) >= timeout {
+				ns.dropFragmentsLocked(st)
+			}
+		}
+	}
+	st, ok := ns.fragments[frag.key]
+	if !ok {
+		st = &fragmentState{start: now}
+		mak.Set(&ns.fragments, frag.key, st)
+	}
+	switch {
+	case st.dropped:
+		return false
+	case now.Sub(st.start) >= timeout,
+		ns.MaxReassemblyFragments > 0 && st.n >= ns.MaxReassemblyFragments,
+		ns.MaxReassemblyMemory > 0 && ns.fragmentBytes+len(b) > ns.MaxReassemblyMemory:
+		ns.dropFragmentsLocked(st)
+		return false
+	}
+	st.n++
+	st.bytes += len(b)
+	st.payload += frag.payload
+	ns.fragmentBytes += len(b)
+	if frag.last {
+		st.size = frag.end
+	}
+	if st.size > 0 && st.payload >= st.size {
+		// All of the packet's fragments are in, so gVisor reassembles
+		// it as this one is injected, and no longer holds them.
+		ns.fragmentBytes -= st.bytes
+		delete(ns.fragments, frag.key)
+	}
+	return true
+}
+
+// dropFragmentsLocked marks st's packet as dropped and releases its bytes
+// from ns.fragmentBytes. ns.mu must be held.
+func (ns *Impl) dropFragmentsLocked(st *fragmentState) {
+	if st.dropped {
+		return
+	}
+	st.dropped = true
+	ns.fragmentBytes -= st.bytes
+	st.bytes = 0
+}
+
+// heartbeatLoop logs a summary of netstack activity every
+// HeartbeatInterval until ns is closed.
+func (ns *Impl) heartbeatLoop() {
+	defer close(ns.heartbeatDone)
+	tickc := ns.heartbeatTick
+	if tickc == nil {
+		t := time.NewTicker(ns.HeartbeatInterval)
+		defer t.Stop()
+		tickc = t.C
+	}
+	var lastBytes, lastDropped uint64
+	for {
+		select {
+		case <-ns.ctx.Done():
+			return
+		case <-tickc:
+		}
+		bytes, dropped := ns.bytesForwarded.Load(), ns.packetsDropped.Load()
+		ns.logf("netstack: heartbeat: tcp_conns=%d udp_sessions=%d bytes_forwarded=%d dropped=%d",
+			ns.activeTCPConns.Load(), ns.activeUDPSessions.Load(), bytes-lastBytes, dropped-lastDropped)
+		lastBytes, lastDropped = bytes, dropped
+	}
+}
+
+// addSubnetAddress registers ip with netstack, if it isn't already, for
+// a new connection to it, and reports whether it registered it.
+func (ns *Impl) addSubnetAddress(ip netip.Addr) (added bool) {
+	ns.mu.Lock()
+	ns.connsOpenBySubnetIP[ip]++
+	needAdd := ns.connsOpenBySubnetIP[ip] == 1
+	ns.mu.Unlock()
+	// Only register address into netstack for first concurrent connection.
+	if needAdd {
+		ns.subnetAddrsRegistered.Add(1)
+		pa := tcpip.ProtocolAddress{
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   tcpip.Address(ip.AsSlice()),
+				PrefixLen: int(ip.BitLen()),
+			},
+		}
+		if ip.Is4() {
+			pa.Protocol = ipv4.ProtocolNumber
+		} else if ip.Is6() {
+			pa.Protocol = ipv6.ProtocolNumber
+		}
+		ns.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{
+			PEB:        stack.CanBePrimaryEndpoint, // zero value default
+			ConfigType: stack.AddressConfigStatic,  // zero value default
+		})
+	}
+	return needAdd
+}
+
+func (ns *Impl) removeSubnetAddress(ip netip.Addr) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.connsOpenBySubnetIP[ip]--
+	// Only unregister address from netstack after last concurrent connection.
+	if ns.connsOpenBySubnetIP[ip] == 0 {
+		ns.ipstack.RemoveAddress(nicID, tcpip.Address(ip.AsSlice()))
+		delete(ns.connsOpenBySubnetIP, ip)
+	}
+}
+
+func ipPrefixToAddressWithPrefix(ipp netip.Prefix) tcpip.AddressWithPrefix {
+	return tcpip.AddressWithPrefix{
+		Address:   tcpip.Address(ipp.Addr().AsSlice()),
+		PrefixLen: int(ipp.Bits()),
+	}
+}
+
+var v4broadcast = netaddr.IPv4(255, 255, 255, 255)
+
+// isImplicitBroadcastAddr reports whether ap is 255.255.255.255/32,
+// which gVisor adds to netstack's NIC itself to receive IPv4
+// broadcasts. updateIPs didn't install it, so it must never remove it,
+// even if a netmap that listed it stops listing it.
+func isImplicitBroadcastAddr(ap tcpip.AddressWithPrefix) bool {
+	return ap.PrefixLen == 32 && netaddrIPFromNetstackIP(ap.Address) == v4broadcast
+}
+
+// diffIPs returns the addresses of want that updateIPs needs to add to
+// netstack's NIC, whose addresses are have, and those of have that it
+// needs to remove. The implicit broadcast address is never removed,
+// and as it's always present, never added.
+func diffIPs(have []tcpip.ProtocolAddress, want map[tcpip.AddressWithPrefix]bool) (add, remove map[tcpip.AddressWithPrefix]bool) {
+	old := make(map[tcpip.AddressWithPrefix]bool)
+	for _, pa := range have {
+		if ap := pa.AddressWithPrefix; !isImplicitBroadcastAddr(ap) {
+			old[ap] = true
+		}
+	}
+	add = make(map[tcpip.AddressWithPrefix]bool)
+	for ap := range want {
+		if !old[ap] && !isImplicitBroadcastAddr(ap) {
+			add[ap] = true
+		}
+	}
+	remove = make(map[tcpip.AddressWithPrefix]bool)
+	for ap := range old {
+		if !want[ap] {
+			remove[ap] = true
+		}
+	}
+	return add, remove
+}
+
+// AddrsChange describes the addresses a netmap update added to or
+// removed from netstack. It's passed to Impl.OnAddrsChanged.
+type AddrsChange struct {
+	// NetmapHash identifies the netmap that caused the change. See
+	// netmapAddrsHash.
+	NetmapHash string
+
+	Added   []netip.Prefix
+	Removed []netip.Prefix
+}
+
+// netmapAddrsHash returns a short hash of the parts of nm that updateIPs
+// uses, so log lines and AddrsChange values can be matched to the
+// netmap that caused them. Netmaps don't carry a version of their own.
+func netmapAddrsHash(nm *netmap.NetworkMap) string {
+	h := sha256.New()
+	write := func(tag string, pfxs []netip.Prefix) {
+		io.WriteString(h, tag)
+		for _, p := range pfxs {
+			b, _ := p.MarshalText()
+			h.Write(b)
+			io.WriteString(h, ",")
+		}
+	}
+	write("addrs:", nm.Addresses)
+	if nm.SelfNode != nil {
+		write("self:", nm.SelfNode.Addresses)
+		write("allowed:", nm.SelfNode.AllowedIPs)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:6])
+}
+
+func addressWithPrefixToIPPrefix(ap tcpip.AddressWithPrefix) netip.Prefix {
+	return netip.PrefixFrom(netaddrIPFromNetstackIP(ap.Address), ap.PrefixLen)
+}
+
+func (ns *Impl) updateIPs(nm *netmap.NetworkMap) {
+	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nm.Addresses))
+	ns.selfAddrs.Store(nm.Addresses)
+	ns.mu.Lock()
+	ns.peerAPIPorts = nil
+	ns.mu.Unlock()
+	if ns.FastInboundReject {
+		ns.updateInterestingTCPPorts(nm.Addresses)
+	}
+
+	newIPs := make(map[tcpip.AddressWithPrefix]bool)
+
+	isAddr := map[netip.Prefix]bool{}
+	var subnets []netip.Prefix
+	if nm.SelfNode != nil {
+		for _, ipp := range nm.SelfNode.Addresses {
+			isAddr[ipp] = true
+			newIPs[ipPrefixToAddressWithPrefix(ipp)] = true
+		}
+		for _, ipp := range nm.SelfNode.AllowedIPs {
+			if !isAddr[ipp] && ns.ProcessSubnets {
+				newIPs[ipPrefixToAddressWithPrefix(ipp)] = true
+				subnets = append(subnets, ipp)
+			}
+		}
+	}
+	ns.staticSubnets.Store(subnets)
+
+	ipsToBeAdded, ipsToBeRemoved := diffIPs(ns.ipstack.AllAddresses()[nicID], newIPs)
+	ns.mu.Lock()
+	for ip := range ns.connsOpenBySubnetIP {
+		ipp := tcpip.Address(ip.AsSlice()).WithPrefix()
+		delete(ipsToBeRemoved, ipp)
+	}
+	ns.mu.Unlock()
+
+	change := AddrsChange{NetmapHash: netmapAddrsHash(nm)}
+	for ipp := range ipsToBeRemoved {
+		err := ns.ipstack.RemoveAddress(nicID, ipp.Address)
+		if err != nil {
+			ns.logf("netstack: could not deregister IP %s (netmap %s): %v", ipp, change.NetmapHash, err)
+		} else {
+			ns.logf("[v2] netstack: deregistered IP %s (netmap %s)", ipp, change.NetmapHash)
+			change.Removed = append(change.Removed, addressWithPrefixToIPPrefix(ipp))
+		}
+	}
+	for ipp := range ipsToBeAdded {
+		pa := tcpip.ProtocolAddress{
+			AddressWithPrefix: ipp,
+		}
+		if ipp.Address.To4() == "" {
+			pa.Protocol = ipv6.ProtocolNumber
+		} else {
+			pa.Protocol = ipv4.ProtocolNumber
+		}
+		var err tcpip.Error
+		err = ns.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{
+			PEB:        stack.CanBePrimaryEndpoint, // zero value default
+			ConfigType: stack.AddressConfigStatic,  // zero value default
+		})
+		if err != nil {
+			ns.logf("netstack: could not register IP %s (netmap %s): %v", ipp, change.NetmapHash, err)
+		} else {
+			ns.logf("[v2] netstack: registered IP %s (netmap %s)", ipp, change.NetmapHash)
+			change.Added = append(change.Added, addressWithPrefixToIPPrefix(ipp))
+		}
+	}
+	if ns.OnAddrsChanged != nil && (len(change.Added) > 0 || len(change.Removed) > 0) {
+		sortPrefixes(change.Added)
+		sortPrefixes(change.Removed)
+		ns.OnAddrsChanged(change)
+	}
+}
+
+func sortPrefixes(pfxs []netip.Prefix) {
+	sort.Slice(pfxs, func(i, j int) bool {
+		a, b := pfxs[i], pfxs[j]
+		if a.Addr() != b.Addr() {
+			return a.Addr().Less(b.Addr())
+		}
+		return a.Bits() < b.Bits()
+	})
+}
+
+// handleLocalPackets is hooked into the tun datapath for packets leaving
+// the host and arriving at tailscaled. This method returns filter.DropSilently
+// to intercept a packet for handling, for instance traffic to quad-100.
+func (ns *Impl) handleLocalPackets(p *packet.Parsed, t *tstun.Wrapper) filter.Response {
+	// If it's not traffic to the service IP (i.e. magicDNS) we don't
+	// care; resume processing.
+	if dst := p.Dst.Addr(); dst != magicDNSIP && dst != magicDNSIPv6 {
+		return filter.Accept
+	}
+	// Of traffic to the service IP, we only care about UDP 53, and TCP
+	// on port 80 & 53.
+	switch p.IPProto {
+	case ipproto.TCP:
+		if port := p.Dst.Port(); port != 53 && port != 80 {
+			return filter.Accept
+		}
+	case ipproto.UDP:
+		if port := p.Dst.Port(); port != 53 {
+			return filter.Accept
+		}
+	}
+
+	var pn tcpip.NetworkProtocolNumber
+	switch p.IPVersion {
+	case 4:
+		pn = header.IPv4ProtocolNumber
+	case 6:
+		pn = header.IPv6ProtocolNumber
+	}
+	if debugPackets {
+		ns.logf("[v2] service packet in (from %v): % x", p.Src, p.Buffer())
+	}
+
+	if !ns.allowFragment(p) {
+		ns.packetsDropped.Add(1)
+		return filter.DropSilently
+	}
+	ns.countInboundPacket(p)
+	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: bufferv2.MakeWithData(append([]byte(nil), p.Buffer()...)),
+	})
+	ns.linkEP.InjectInbound(pn, packetBuf)
+	packetBuf.DecRef()
+	return filter.DropSilently
+}
+
+// errUDPDisabled is returned by DialContextUDP when
+// CreateOptions.DisableUDP was set.
+var errUDPDisabled = errors.New("netstack: UDP is disabled")
+
+// udpEnabled reports whether netstack's gVisor stack has UDP, which it
+// doesn't if CreateOptions.DisableUDP was set.
+func (ns *Impl) udpEnabled() bool {
+	return ns.ipstack.TransportProtocolInstance(udp.ProtocolNumber) != nil
+}
+
+// ErrDialNotAllowed is returned (wrapped) by DialContextTCP and
+// DialContextUDP when Impl.DialAllowed rejects the destination.
+var ErrDialNotAllowed = errors.New("netstack: dial not allowed")
+
+// checkDialAllowed returns an error if ns.DialAllowed rejects dialing
+// dst over network.
+func (ns *Impl) checkDialAllowed(network string, dst netip.AddrPort) error {
+	if ns.DialAllowed != nil && !ns.DialAllowed(network, dst) {
+		return fmt.Errorf("%w: %s %v", ErrDialNotAllowed, network, dst)
+	}
+	return nil
+}
+
+func (ns *Impl) DialContextTCP(ctx context.Context, ipp netip.AddrPort) (*gonet.TCPConn, error) {
+	if err := ns.checkDialAllowed("tcp", ipp); err != nil {
+		return nil, err
+	}
+	remoteAddress := tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(ipp.Addr().AsSlice()),
+		Port: ipp.Port(),
+	}
+	var ipType tcpip.NetworkProtocolNumber
+	if ipp.Addr().Is4() {
+		ipType = ipv4.ProtocolNumber
+	} else {
+		ipType = ipv6.ProtocolNumber
+	}
+
+	return gonet.DialContextTCP(ctx, ns.ipstack, remoteAddress, ipType)
+}
+
+func (ns *Impl) DialContextUDP(ctx context.Context, ipp netip.AddrPort) (*gonet.UDPConn, error) {
+	if !ns.udpEnabled() {
+		return nil, errUDPDisabled
+	}
+	if err := ns.checkDialAllowed("udp", ipp); err != nil {
+		return nil, err
+	}
+	remoteAddress := &tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(ipp.Addr().AsSlice()),
+		Port: ipp.Port(),
+	}
+	var ipType tcpip.NetworkProtocolNumber
+	if ipp.Addr().Is4() {
+		ipType = ipv4.ProtocolNumber
+	} else {
+		ipType = ipv6.ProtocolNumber
+	}
+
+	// gonet.DialUDP doesn't take a context, but it doesn't block
+	// either: it only binds and connects a local endpoint. So checking
+	// ctx on both sides of it is enough to honor cancellation.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, err := gonet.DialUDP(ns.ipstack, nil, remoteAddress, ipType)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// maxInjectReaders is the most InjectReaders allowed.
+const maxInjectReaders = 64
+
+// startInject starts the InjectReaders inject goroutines and any
+// InjectWorkers goroutines they hand packets to.
+func (ns *Impl) startInject() {
+	var workers []chan *stack.PacketBuffer // or nil to inject inline
+	if ns.InjectWorkers > 1 {
+		workers = make([]chan *stack.PacketBuffer, ns.InjectWorkers)
+		for i := range workers {
+			workers[i] = make(chan *stack.PacketBuffer, injectWorkerQueueLen)
+			go ns.injectWorker(workers[i])
+		}
+	}
+	readers := ns.InjectReaders
+	if readers < 1 {
+		readers = 1
+	}
+	var running atomic.Int32
+	running.Store(int32(readers))
+	for i := 0; i < readers; i++ {
+		go func() {
+			ns.inject(workers)
+			if running.Add(-1) == 0 {
+				for _, ch := range workers {
+					close(ch)
+				}
+			}
+		}()
+	}
+}
+
+// The inject goroutines read in packets that netstack generated, and
+// deliver them to the correct path, themselves or through the workers,
+// the InjectWorkers goroutines' channels.
+func (ns *Impl) inject(workers []chan *stack.PacketBuffer) {
+	defer trackGoroutine(&ns.numInjectGoroutines)()
+	for {
+		pkt := ns.linkEP.ReadContext(ns.ctx)
+		if pkt == nil {
+			if ns.ctx.Err() != nil {
+				// Return without logging.
+				return
+			}
+			ns.logf("[v2] ReadContext-for-write = ok=false")
+			continue
+		}
+		if workers == nil {
+			if !ns.injectPacket(pkt) {
+				return
+			}
+			continue
+		}
+		select {
+		case workers[injectFlowHash(pkt)%uint32(len(workers))] <- pkt:
+		case <-ns.ctx.Done():
+			pkt.DecRef()
+			return
+		}
+	}
+}
+
+// injectWorkerQueueLen is how many packets each InjectWorkers goroutine
+// can have queued.
+const injectWorkerQueueLen = 64
+
+// injectWorker injects the packets sent on ch until it's closed. After a
+// failed injection, it drops the rest, as inject would stop.
+func (ns *Impl) injectWorker(ch <-chan *stack.PacketBuffer) {
+	defer trackGoroutine(&ns.numInjectGoroutines)()
+	ok := true
+	for pkt := range ch {
+		if ok {
+			ok = ns.injectPacket(pkt)
+		} else {
+			pkt.DecRef()
+		}
+	}
+}
+
+// injectFlowHash returns a hash of the IP addresses and, for TCP and
+// UDP, the ports of pkt, so that inject sends all of a flow's packets
+// to the same worker.
+func injectFlowHash(pkt *stack.PacketBuffer) uint32 {
+	const prime32 = 16777619
+	h := uint32(2166136261) // FNV-1a
+	add := func(b []byte) {
+		for _, c := range b {
+			h ^= uint32(c)
+			h *= prime32
+		}
+	}
+	nh := pkt.NetworkHeader().Slice()
+	switch {
+	case len(nh) >= header.IPv4MinimumSize && nh[0]>>4 == 4:
+		add(nh[12:20])
+	case len(nh) >= header.IPv6MinimumSize && nh[0]>>4 == 6:
+		add(nh[8:40])
+	}
+	switch pkt.TransportProtocolNumber {
+	case tcp.ProtocolNumber, udp.ProtocolNumber:
+		if th := pkt.TransportHeader().Slice(); len(th) >= 4 {
+			add(th[:4])
+		}
+	}
+	return h
+}
+
+// injectPacket writes pkt, which netstack sent, into the tun device:
+// inbound to this host if it's from a service IP, or else outbound to
+// peers. It takes ownership of pkt's reference. It reports whether the
+// tun device accepted it.
+func (ns *Impl) injectPacket(pkt *stack.PacketBuffer) bool {
+	if debugPackets {
+		ns.logf("[v2] packet Write out: % x", stack.PayloadSince(pkt.NetworkHeader()))
+	}
+	if ns.DisableICMP {
+		switch pkt.TransportProtocolNumber {
+		case header.ICMPv4ProtocolNumber, header.ICMPv6ProtocolNumber:
+			pkt.DecRef()
+			ns.packetsDropped.Add(1)
+			return true
+		}
+	}
+
+	// In the normal case, netstack synthesizes the bytes for
+	// traffic which should transit back into WG and go to peers.
+	// However, some uses of netstack (presently, magic DNS)
+	// send traffic destined for the local device, hence must
+	// be injected 'inbound'.
+	sendToHost := false
+
+	// Determine if the packet is from a service IP, in which case it
+	// needs to go back into the machines network (inbound) instead of
+	// out.
+	// TODO(tom): Work out a way to avoid parsing packets to determine if
+	//            its from the service IP. Maybe gvisor netstack magic. I
+	//            went through the fields of PacketBuffer, and nop :/
+	// TODO(tom): Figure out if its safe to modify packet.Parsed to fill in
+	//            the IP src/dest even if its missing the rest of the pkt.
+	//            That way we dont have to do this twitchy-af byte-yeeting.
+	if b := pkt.NetworkHeader().Slice(); len(b) >= 20 { // min ipv4 header
+		switch b[0] >> 4 { // ip proto field
+		case 4:
+			if srcIP := netaddr.IPv4(b[12], b[13], b[14], b[15]); magicDNSIP == srcIP {
+				sendToHost = true
+			}
+		case 6:
+			if len(b) >= 40 { // min ipv6 header
+				if srcIP, ok := netip.AddrFromSlice(net.IP(b[8:24])); ok && magicDNSIPv6 == srcIP {
+					sendToHost = true
+				}
+			}
+		}
+	}
+
+	// pkt has a non-zero refcount, so injection methods takes
+	// ownership of one count and will decrement on completion.
+	if ns.injectPacketFunc != nil {
+		ns.injectPacketFunc(pkt, sendToHost)
+	} else if sendToHost {
+		if err := ns.tundev.InjectInboundPacketBuffer(pkt); err != nil {
+			log.Printf("netstack inject inbound: %v", err)
+			return false
+		}
+	} else {
+		if err := ns.tundev.InjectOutboundPacketBuffer(pkt); err != nil {
+			log.Printf("netstack inject outbound: %v", err)
+			return false
+		}
+	}
+	if sendToHost {
+		ns.outboundToHostPackets.Add(1)
+	} else {
+		ns.outboundToPeersPackets.Add(1)
+	}
+	return true
+}
+
+// isLocalIP reports whether ip is a Tailscale IP assigned to this
+// node directly (but not a subnet-routed IP).
+func (ns *Impl) isLocalIP(ip netip.Addr) bool {
+	return ns.atomicIsLocalIPFunc.Load()(ip)
+}
+
+func (ns *Impl) processSSH() bool {
+	lb := ns.lb.Load()
+	return lb != nil && lb.ShouldRunSSH()
+}
+
+func (ns *Impl) peerAPIPortAtomic(ip netip.Addr) *uint32 {
+	if ip.Is4() {
+		return &ns.peerapiPort4Atomic
+	} else {
+		return &ns.peerapiPort6Atomic
+	}
+}
+
+var viaRange = tsaddr.TailscaleViaRange()
+
+// ViaInfo reports whether netstack treats dst as a 4via6 address and,
+// if so, the IPv4 address it maps to, which is where connections and
+// pings to dst are forwarded.
+func (ns *Impl) ViaInfo(dst netip.Addr) (underlying netip.Addr, isVia bool) {
+	if !viaRange.Contains(dst) {
+		return netip.Addr{}, false
+	}
+	return tsaddr.UnmapVia(dst), true
+}
+
+// portSet is a set of port numbers.
+type portSet [(1 << 16) / 64]uint64
+
+func (s *portSet) add(port uint16) {
+	s[port/64] |= 1 << (port % 64)
+}
+
+func (s *portSet) contains(port uint16) bool {
+	return s[port/64]&(1<<(port%64)) != 0
+}
+
+// updateInterestingTCPPorts rebuilds the set of TCP ports used by
+// fastRejectInbound, given this node's addresses.
+func (ns *Impl) updateInterestingTCPPorts(addrs []netip.Prefix) {
+	ports := new(portSet)
+	if lb := ns.lb.Load(); lb != nil {
+		ports.add(22) // SSH
+		for _, pfx := range addrs {
+			if port, ok := lb.GetPeerAPIPort(pfx.Addr()); ok {
+				ports.add(port)
+			}
+		}
+	}
+	ns.interestingTCPPorts.Store(ports)
+}
+
+// fastRejectInbound reports whether the inbound packet p can be rejected
+// without evaluating the rest of shouldProcessInbound. A false result
+// means the full check is needed.
+func (ns *Impl) fastRejectInbound(p *packet.Parsed) bool {
+	if ns.ProcessLocalIPs || ns.ProcessSubnets {
+		return false
+	}
+	ports := ns.interestingTCPPorts.Load()
+	if ports == nil {
+		return false
+	}
+	if p.IPVersion == 6 {
+		if dst := p.Dst.Addr(); viaRange.Contains(dst) || isLinkLocalIPv6(dst) {
+			return false
+		}
+	}
+	if p.IPProto != ipproto.TCP {
+		return true
+	}
+	dst := p.Dst.Addr()
+	if ports.contains(p.Dst.Port()) {
+		return false
+	}
+	// LocalBackend can start its peerapi listeners after the netmap
+	// update that built ports, so SYNs to local IPs get the full
+	// check, which looks up the peerapi port. Later packets of those
+	// connections then match the port it learned.
+	if p.TCPFlags&packet.TCPSynAck == packet.TCPSyn && ns.isLocalIP(dst) {
+		return false
+	}
+	return p.Dst.Port() != uint16(atomic.LoadUint32(ns.peerAPIPortAtomic(dst)))
+}
+
+// resolveBackendTTL is how long ResolveBackend results are cached.
+const resolveBackendTTL = 5 * time.Second
+
+// resolveBackendKey is a key of Impl.resolvedBackends.
+type resolveBackendKey struct {
+	port uint16
+	src  netip.Addr
+}
+
+// resolvedBackend is an entry in Impl.resolvedBackends.
+type resolvedBackend struct {
+	addr    netip.AddrPort
+	expires time.Time
+}
+
+// resolveBackend returns the backend for a TCP connection from src to
+// port on the local IPs according to ResolveBackend, from
+// ns.resolvedBackends if it's cached there. Errors aren't cached.
+//
+// The lookup is done under a context that's canceled when the request
+// is abandoned: when the client resets it (see cancelPendingSYN), after
+// resolveBackendTimeout, or when ns closes.
+func (ns *Impl) resolveBackend(id stack.TransportEndpointID, port uint16, src netip.Addr) (netip.AddrPort, error) {
+	key := resolveBackendKey{port, src}
+	now := ns.now()
+	ns.mu.Lock()
+	e, cached := ns.resolvedBackends[key]
+	if !cached || !now.Before(e.expires) {
+		// On every miss, remove expired entries, so sources that
+		// are gone don't accumulate. Misses wait on ResolveBackend
+		// anyway, so the sweep is cheap in comparison.
+		for k, e := range ns.resolvedBackends {
+			if !now.Before(e.expires) {
+				delete(ns.resolvedBackends, k)
+			}
+		}
+	}
+	ns.mu.Unlock()
+	if cached && now.Before(e.expires) {
+		return e.addr, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ns.ctx, resolveBackendTimeout)
+	defer cancel()
+	synKey := pendingSYNKey{
+		src: netip.AddrPortFrom(netaddrIPFromNetstackIP(id.RemoteAddress), id.RemotePort),
+		dst: netip.AddrPortFrom(netaddrIPFromNetstackIP(id.LocalAddress), id.LocalPort),
+	}
+	ns.mu.Lock()
+	mak.Set(&ns.pendingSYNs, synKey, cancel)
+	ns.mu.Unlock()
+	defer func() {
+		ns.mu.Lock()
+		delete(ns.pendingSYNs, synKey)
+		ns.mu.Unlock()
+	}()
+
+	s, err := ns.ResolveBackend(ctx, port, src)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	mak.Set(&ns.resolvedBackends, key, resolvedBackend{addr, ns.now().Add(resolveBackendTTL)})
+	return addr, nil
+}
+
+// resolveBackendTimeout is how long resolveBackend waits for
+// ResolveBackend. By then, a client waiting to connect has resent its
+// SYN a few times, and is likely to have given up.
+const resolveBackendTimeout = 5 * time.Second
+
+// pendingSYNKey is a key of Impl.pendingSYNs.
+type pendingSYNKey struct {
+	src, dst netip.AddrPort
+}
+
+// cancelPendingSYN cancels the backend lookup for the not yet accepted
+// TCP connection that p, a TCP RST from the client, resets.
+func (ns *Impl) cancelPendingSYN(p *packet.Parsed) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if cancel, ok := ns.pendingSYNs[pendingSYNKey{p.Src, p.Dst}]; ok {
+		cancel()
+	}
+}
+
+// peerAPIPortEntry is an entry in Impl.peerAPIPorts.
+type peerAPIPortEntry struct {
+	port    uint16
+	ok      bool
+	expires time.Time
+}
+
+// peerAPIPort returns the peerapi port for the local IP ip according to
+// lb, and whether there is one, from ns.peerAPIPorts if it's cached
+// there.
+func (ns *Impl) peerAPIPort(lb *ipnlocal.LocalBackend, ip netip.Addr) (port uint16, ok bool) {
+	ttl := ns.PeerAPIPortTTL
+	now := time.Now()
+	if ttl > 0 {
+		ns.mu.Lock()
+		e, cached := ns.peerAPIPorts[ip]
+		ns.mu.Unlock()
+		if cached && now.Before(e.expires) {
+			return e.port, e.ok
+		}
+	}
+	ns.peerAPIPortLookups.Add(1)
+	port, ok = lb.GetPeerAPIPort(ip)
+	if ttl > 0 {
+		ns.mu.Lock()
+		mak.Set(&ns.peerAPIPorts, ip, peerAPIPortEntry{port, ok, now.Add(ttl)})
+		ns.mu.Unlock()
+	}
+	return port, ok
+}
+
+// shouldProcessInbound reports whether an inbound packet (a packet from a
+// WireGuard peer) should be handled by netstack.
+func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
+	if !ns.healthy() {
+		return false
+	}
+	if ns.FastInboundReject && ns.fastRejectInbound(p) {
+		return false
+	}
+	lb := ns.lb.Load()
+	// Handle incoming peerapi connections in netstack.
+	if lb != nil && p.IPProto == ipproto.TCP {
+		var peerAPIPort uint16
+		dstIP := p.Dst.Addr()
+		if p.TCPFlags&packet.TCPSynAck == packet.TCPSyn && ns.isLocalIP(dstIP) {
+			if port, ok := ns.peerAPIPort(lb, dstIP); ok {
+				peerAPIPort = port
+				atomic.StoreUint32(ns.peerAPIPortAtomic(dstIP), uint32(port))
+			}
+		} else {
+			peerAPIPort = uint16(atomic.LoadUint32(ns.peerAPIPortAtomic(dstIP)))
+		}
+		if p.IPProto == ipproto.TCP && p.Dst.Port() == peerAPIPort {
+			return true
+		}
+	}
+	if ns.isInboundTSSH(p) && ns.processSSH() {
+		return true
+	}
+	if p.IPVersion == 6 && viaRange.Contains(p.Dst.Addr()) {
+		return ns.shouldHandleViaIP(p.Dst.Addr())
+	}
+	if isLinkLocalIPv6(p.Dst.Addr()) {
+		return ns.HandleLinkLocalIPv6
+	}
+	if !ns.ProcessLocalIPs && !ns.ProcessSubnets {
+		// Fast path for common case (e.g. Linux server in TUN mode) where
+		// netstack isn't used at all; don't even do an isLocalIP lookup.
+		return false
+	}
+	isLocal := ns.isLocalIP(p.Dst.Addr())
+	if ns.ProcessLocalIPs && isLocal {
+		return true
+	}
+	if ns.ProcessSubnets && !isLocal {
+		return true
+	}
+	return false
+}
+
+// isLinkLocalIPv6 reports whether ip is an IPv6 link-local unicast
+// address (fe80::/10).
+func isLinkLocalIPv6(ip netip.Addr) bool {
+	return ip.Is6() && !ip.Is4In6() && ip.IsLinkLocalUnicast()
+}
+
+// setAmbientCapsRaw is non-nil on Linux for Synology, to run ping with
+// CAP_NET_RAW from tailscaled's binary.
+var setAmbientCapsRaw func(*exec.Cmd)
+
+var userPingSem = syncs.NewSemaphore(20) // 20 pings (sockets or child processes) at once
+
+// nativePing, if non-nil, sends an ICMP echo request to dstIP and waits
+// up to timeout for the reply, without running the ping command. It
+// returns errNoNativePing if it can't create a socket to ping with.
+// It's set on Linux.
+var nativePing func(dstIP netip.Addr, timeout time.Duration) error
+
+var errNoNativePing = errors.New("native ping unavailable")
+
+var isSynology = runtime.GOOS == "linux" && distro.Get() == distro.Synology
+
+// userPing tried to ping dstIP and if it succeeds, injects pingResPkt
+// into the tundev.
+//
+// It's used in userspace/netstack mode when we don't have kernel
+// support or raw socket access. On Linux, it sends the echo request
+// itself if it can create an ICMP socket (see nativePing). Otherwise it
+// does the dumbest thing that can work: runs the ping command. That's
+// not super efficient, so it bounds the number of pings going on at
+// once. The idea is that people only use ping occasionally to see
+// if their internet's working so this doesn't need to be great.
+//
+// TODO(bradfitz): when we're running on Windows as the system user, use
+// raw socket APIs instead of ping child processes.
+func (ns *Impl) userPing(dstIP netip.Addr, pingResPkt []byte) {
+	if !userPingSem.TryAcquire() {
+		ns.packetsDropped.Add(1)
+		return
+	}
+	defer userPingSem.Release()
+
+	t0 := time.Now()
+	how := "native"
+	err := errNoNativePing
+	if nativePing != nil {
+		err = nativePing(dstIP, 3*time.Second)
+	}
+	if errors.Is(err, errNoNativePing) {
+		how = "exec"
+		err = execPing(dstIP)
+	}
+	d := time.Since(t0)
+	if err != nil {
+		if d < time.Second/2 {
+			// If it failed quicker than the 3 second
+			// timeout we gave above (500 ms is a
+			// reasonable threshold), then assume the ping
+			// failed for problems finding/running
+			// ping. We don't want to log if the host is
+			// just down.
+			ns.logf("%s ping of %v failed in %v: %v", how, dstIP, d, err)
+		}
+		return
+	}
+	if debugNetstack() {
+		ns.logf("%s pinged %v in %v", how, dstIP, time.Since(t0))
+	}
+	if err := ns.tundev.InjectOutbound(pingResPkt); err != nil {
+		ns.logf("InjectOutbound ping response: %v", err)
+	}
+}
+
+// execPing pings dstIP once by running the ping command, waiting up to
+// about 3 seconds for a reply.
+func execPing(dstIP netip.Addr) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("ping", "-n", "1", "-w", "3000", dstIP.String()).Run()
+	case "darwin":
+		// Note: 2000 ms is actually 1 second + 2,000
+		// milliseconds extra for 3 seconds total.
+		// See https://github.com/tailscale/tailscale/pull/3753 for details.
+		return exec.Command("ping", "-c", "1", "-W", "2000", dstIP.String()).Run()
+	case "android":
+		ping := "/system/bin/ping"
+		if dstIP.Is6() {
+			ping = "/system/bin/ping6"
+		}
+		return exec.Command(ping, "-c", "1", "-w", "3", dstIP.String()).Run()
+	default:
+		ping := "ping"
+		if isSynology {
+			ping = "/bin/ping"
+		}
+		cmd := exec.Command(ping, "-c", "1", "-W", "3", dstIP.String())
+		if isSynology && os.Getuid() != 0 {
+			// On DSM7 we run as non-root and need to pass
+			// CAP_NET_RAW if our binary has it.
+			setAmbientCapsRaw(cmd)
+		}
+		return cmd.Run()
+	}
+}
+
+func (ns *Impl) isInboundTSSH(p *packet.Parsed) bool {
+	return p.IPProto == ipproto.TCP &&
+		p.Dst.Port() == 22 &&
+		ns.isLocalIP(p.Dst.Addr())
+}
+
+// injectInbound is installed as a packet hook on the 'inbound' (from a
+// WireGuard peer) path. Returning filter.Accept releases the packet to
+// continue normally (typically being delivered to the host networking stack),
+// whereas returning filter.DropSilently is done when netstack intercepts the
+// packet and no further processing towards to host should be done.
+func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Response {
+	if ns.AnswerViaNeighborSolicits && ns.handleViaNeighborSolicit(p) {
+		return filter.DropSilently
+	}
+	if !ns.shouldProcessInbound(p, t) {
+		// Let the host network stack (if any) deal with it.
+		return filter.Accept
+	}
+	if ns.DisableICMP && (p.IPProto == ipproto.ICMPv4 || p.IPProto == ipproto.ICMPv6) {
+		ns.packetsDropped.Add(1)
+		return filter.DropSilently
+	}
+
+	destIP := p.Dst.Addr()
+
+	// If this is an echo request and we're a subnet router, handle pings
+	// ourselves instead of forwarding the packet on.
+	pingIP, handlePing := ns.shouldHandlePing(p)
+	if handlePing {
+		var pong []byte // the reply to the ping, if our relayed ping works
+		if destIP.Is4() {
+			h := p.ICMP4Header()
+			h.ToResponse()
+			pong = packet.Generate(&h, ns.echoReplyPayload(p))
+		} else if destIP.Is6() {
+			h := p.ICMP6Header()
+			h.ToResponse()
+			pong = packet.Generate(&h, ns.echoReplyPayload(p))
+		}
+		ns.setReplyTTL(pong)
+		if ns.AnswerLocalPings && ns.isLocalIP(destIP) {
+			ns.pingsHandled.Add(1)
+			ns.answerLocalPing(pong)
+			return filter.DropSilently
+		}
+		if ns.subnetPingLimiter != nil && !ns.subnetPingLimiter.Allow() {
+			ns.pingsRateLimited.Add(1)
+			ns.packetsDropped.Add(1)
+			return filter.DropSilently
+		}
+		ns.pingsHandled.Add(1)
+		go func() {
+			defer trackGoroutine(&ns.numPingGoroutines)()
+			if ns.userPingFunc != nil {
+				ns.userPingFunc(pingIP, pong)
+			} else {
+				ns.userPing(pingIP, pong)
+			}
+		}()
+		return filter.DropSilently
+	}
+
+	var pn tcpip.NetworkProtocolNumber
+	switch p.IPVersion {
+	case 4:
+		pn = header.IPv4ProtocolNumber
+	case 6:
+		pn = header.IPv6ProtocolNumber
+	}
+	if debugPackets {
+		ns.logf("[v2] packet in (from %v): % x", p.Src, p.Buffer())
+	}
+	if !ns.allowFragment(p) {
+		ns.packetsDropped.Add(1)
+		return filter.DropSilently
+	}
+	ns.countInboundPacket(p)
+	b := append([]byte(nil), p.Buffer()...)
+	if ns.ClampMSS != 0 && p.IPProto == ipproto.TCP && p.TCPFlags&packet.TCPSyn != 0 {
+		clampSYNMSS(b, ns.ClampMSS)
+	}
+	if ns.ResolveBackend != nil && p.IPProto == ipproto.TCP && p.TCPFlags&packet.TCPRst != 0 {
+		ns.cancelPendingSYN(p)
+	}
+	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: bufferv2.MakeWithData(b),
+	})
+	ns.linkEP.InjectInbound(pn, packetBuf)
+	packetBuf.DecRef()
+
+	// We've now delivered this to netstack, so we're done.
+	// Instead of returning a filter.Accept here (which would also
+	// potentially deliver it to the host OS), and instead of
+	// filter.Drop (which would log about rejected traffic),
+	// instead return filter.DropSilently which just quietly stops
+	// processing it in the tstun TUN wrapper.
+	return filter.DropSilently
+}
+
+// validateCongestionControl reports whether TCPCongestionControl is
+// empty or one of the algorithms gVisor's TCP supports.
+func (ns *Impl) validateCongestionControl() error {
+	cc := ns.TCPCongestionControl
+	if cc == "" || ns.ipstack == nil {
+		return nil
+	}
+	var avail tcpip.TCPAvailableCongestionControlOption
+	if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &avail); err != nil {
+		return fmt.Errorf("netstack: getting available TCP congestion control: %v", err)
+	}
+	for _, a := range strings.Fields(string(avail)) {
+		if a == cc {
+			return nil
+		}
+	}
+	return fmt.Errorf("netstack: TCPCongestionControl %q is not one of %q", cc, strings.Fields(string(avail)))
+}
+
+// setDefaultTTLs applies DefaultTTL and DefaultHopLimit to ns.ipstack.
+func (ns *Impl) setDefaultTTLs() error {
+	for _, o := range []struct {
+		proto tcpip.NetworkProtocolNumber
+		ttl   uint8
+	}{
+		{ipv4.ProtocolNumber, ns.DefaultTTL},
+		{ipv6.ProtocolNumber, ns.DefaultHopLimit},
+	} {
+		if o.ttl == 0 {
+			continue
+		}
+		opt := tcpip.DefaultTTLOption(o.ttl)
+		if err := ns.ipstack.SetNetworkProtocolOption(o.proto, &opt); err != nil {
+			return fmt.Errorf("netstack: setting default TTL of protocol %d: %v", o.proto, err)
+		}
+	}
+	return nil
+}
+
+// clampSYNMSS lowers the MSS option of b, an IPv4 or IPv6 TCP SYN
+// packet, to mss if it's larger, updating the TCP checksum. It reports
+// whether it changed b. A SYN without an MSS option is left alone, as
+// TCP then assumes an MSS of 536 (RFC 9293), which is already small.
+func clampSYNMSS(b []byte, mss uint16) bool {
+	var src, dst tcpip.Address
+	var seg header.TCP
+	switch {
+	case len(b) >= header.IPv4MinimumSize && b[0]>>4 == 4:
+		h := header.IPv4(b)
+		if hl := int(h.HeaderLength()); hl >= header.IPv4MinimumSize && hl <= len(b) {
+			src, dst, seg = h.SourceAddress(), h.DestinationAddress(), header.TCP(b[hl:])
+		}
+	case len(b) >= header.IPv6MinimumSize && b[0]>>4 == 6:
+		h := header.IPv6(b)
+		src, dst, seg = h.SourceAddress(), h.DestinationAddress(), header.TCP(b[header.IPv6MinimumSize:])
+	}
+	if len(seg) < header.TCPMinimumSize {
+		return false
+	}
+	off := int(seg.DataOffset())
+	if off < header.TCPMinimumSize || off > len(seg) {
+		return false
+	}
+	opts := seg[header.TCPMinimumSize:off]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case header.TCPOptionEOL:
+			return false
+		case header.TCPOptionNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return false // malformed; gVisor will ignore the options
+		}
+		if opts[i] == header.TCPOptionMSS && opts[i+1] == header.TCPOptionMSSLength {
+			if binary.BigEndian.Uint16(opts[i+2:]) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(opts[i+2:], mss)
+			seg.SetChecksum(0)
+			xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst, uint16(len(seg)))
+			seg.SetChecksum(^header.Checksum(seg, xsum))
+			return true
+		}
+		i += int(opts[i+1])
+	}
+	return false
+}
+
+// setReplyTTL sets the TTL or hop limit of pong, an echo reply or ICMP
+// error made by packet.Generate, to DefaultTTL or DefaultHopLimit if set.
+func (ns *Impl) setReplyTTL(pong []byte) {
+	if len(pong) == 0 {
+		return
+	}
+	switch pong[0] >> 4 {
+	case 4:
+		if ns.DefaultTTL == 0 || len(pong) < header.IPv4MinimumSize {
+			return
+		}
+		h := header.IPv4(pong)
+		h.SetTTL(ns.DefaultTTL)
+		h.SetChecksum(0)
+		h.SetChecksum(^h.CalculateChecksum())
+	case 6:
+		// The hop limit isn't covered by any checksum.
+		if ns.DefaultHopLimit != 0 && len(pong) >= header.IPv6MinimumSize {
+			header.IPv6(pong).SetHopLimit(ns.DefaultHopLimit)
+		}
+	}
+}
+
+// shouldHandleViaIP reports whether ip is a 4via6 address that this
+// node routes.
+func (ns *Impl) shouldHandleViaIP(ip netip.Addr) bool {
+	if ns.viaIPFunc != nil {
+		return ns.viaIPFunc(ip)
+	}
+	lb := ns.lb.Load()
+	return lb != nil && lb.ShouldHandleViaIP(ip)
+}
+
+// handleViaNeighborSolicit answers p if it's a Neighbor Solicitation for
+// a 4via6 address that this node routes, reporting whether it was.
+func (ns *Impl) handleViaNeighborSolicit(p *packet.Parsed) bool {
+	if p.IPVersion != 6 || p.IPProto != ipproto.ICMPv6 {
+		return false
+	}
+	icmp := header.ICMPv6(p.Transport())
+	if len(icmp) < header.ICMPv6NeighborSolicitMinimumSize ||
+		icmp.Type() != header.ICMPv6NeighborSolicit || icmp.Code() != 0 ||
+		header.IPv6(p.Buffer()).HopLimit() != header.NDPHopLimit {
+		return false
+	}
+	target, ok := netip.AddrFromSlice([]byte(header.NDPNeighborSolicit(icmp.MessageBody()).TargetAddress()))
+	if !ok || !viaRange.Contains(target) {
+		return false
+	}
+	if !ns.shouldHandleViaIP(target) {
+		return false
+	}
+
+	// Reply to the solicitor, or to all nodes if it's doing duplicate
+	// address detection and so has no address yet (RFC 4861, 7.2.4).
+	src := tcpip.Address(target.AsSlice())
+	dst := tcpip.Address(p.Src.Addr().AsSlice())
+	solicited := !p.Src.Addr().IsUnspecified()
+	if !solicited {
+		dst = header.IPv6AllNodesMulticastAddress
+	}
+	advert := make([]byte, header.IPv6MinimumSize+header.ICMPv6NeighborAdvertMinimumSize)
+	header.IPv6(advert).Encode(&header.IPv6Fields{
+		PayloadLength:     header.ICMPv6NeighborAdvertMinimumSize,
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          header.NDPHopLimit,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	})
+	na := header.ICMPv6(advert[header.IPv6MinimumSize:])
+	na.SetType(header.ICMPv6NeighborAdvert)
+	body := header.NDPNeighborAdvert(na.MessageBody())
+	body.SetSolicitedFlag(solicited)
+	body.SetTargetAddress(src)
+	na.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: na, Src: src, Dst: dst}))
+
+	if ns.neighborAdvertFunc != nil {
+		ns.neighborAdvertFunc(advert)
+	} else if err := ns.tundev.InjectOutbound(advert); err != nil {
+		ns.logf("InjectOutbound neighbor advertisement: %v", err)
+	}
+	return true
+}
+
+// echoReplyPayload returns the payload of p, an ICMP echo request, to
+// send back in its reply, truncated to ns.MaxEchoReplyPayload.
+func (ns *Impl) echoReplyPayload(p *packet.Parsed) []byte {
+	b := p.Payload()
+	// The first 4 bytes are the identifier and sequence number, which
+	// the reply must keep.
+	if n := ns.MaxEchoReplyPayload; n > 0 && len(b) > 4+n {
+		b = b[:4+n]
+	}
+	return b
+}
+
+// answerLocalPing sends pingResPkt, the reply to a ping of a local IP,
+// back to the peer.
+func (ns *Impl) answerLocalPing(pingResPkt []byte) {
+	if ns.localPongFunc != nil {
+		ns.localPongFunc(pingResPkt)
+		return
+	}
+	if err := ns.tundev.InjectOutbound(pingResPkt); err != nil {
+		ns.logf("InjectOutbound local ping response: %v", err)
+	}
+}
+
+// shouldHandlePing returns whether or not netstack should handle an incoming
+// ICMP echo request packet, and the IP address that should be pinged from this
+// process. The IP address can be different from the destination in the packet
+// if the destination is a 4via6 address.
+func (ns *Impl) shouldHandlePing(p *packet.Parsed) (_ netip.Addr, ok bool) {
+	if ns.DisableICMP || !p.IsEchoRequest() {
+		return netip.Addr{}, false
+	}
+
+	destIP := p.Dst.Addr()
+
+	// We need to handle pings for all 4via6 addresses, even if this
+	// netstack instance normally isn't responsible for processing subnets.
+	//
+	// For example, on Linux, subnet router traffic could be handled via
+	// tun+iptables rules for most packets, but we still need to handle
+	// ICMP echo requests over 4via6 since the host networking stack
+	// doesn't know what to do with a 4via6 address.
+	//
+	// shouldProcessInbound returns 'true' to say that we should process
+	// all IPv6 packets with a destination address in the 'via' range, so
+	// check before we check the "ProcessSubnets" boolean below.
+	if underlying, ok := ns.ViaInfo(destIP); ok {
+		// The input echo request was to a 4via6 address, which we cannot
+		// simply ping as-is from this process. Translate the destination to an
+		// IPv4 address, so that our relayed ping (in userPing) is pinging the
+		// underlying destination IP.
+		//
+		// ICMPv4 and ICMPv6 are different protocols with different on-the-wire
+		// representations, so normally you can't send an ICMPv6 message over
+		// IPv4 and expect to get a useful result. However, in this specific
+		// case things are safe because the 'userPing' function doesn't make
+		// use of the input packet.
+		return underlying, true
+	}
+
+	// Link-local destinations aren't reachable from here.
+	if isLinkLocalIPv6(destIP) {
+		return netip.Addr{}, false
+	}
+
+	// Pings of local IPs are normally left to the host, unless we've
+	// been asked to answer them ourselves.
+	if ns.AnswerLocalPings && ns.ProcessLocalIPs && ns.isLocalIP(destIP) {
+		return destIP, true
+	}
+
+	// If we get here, we don't do anything unless this netstack instance
+	// is responsible for processing subnet traffic.
+	if !ns.ProcessSubnets {
+		return netip.Addr{}, false
+	}
+
+	// For non-4via6 addresses, we don't handle pings if they're destined
+	// for a Tailscale IP.
+	if tsaddr.IsTailscaleIP(destIP) {
+		return netip.Addr{}, false
+	}
+
+	// This netstack instance is processing subnet traffic, so handle the
+	// ping ourselves.
+	return destIP, true
+}
+
+func netaddrIPFromNetstackIP(s tcpip.Address) netip.Addr {
+	switch len(s) {
+	case 4:
+		return netaddr.IPv4(s[0], s[1], s[2], s[3])
+	case 16:
+		var a [16]byte
+		copy(a[:], s)
+		return netip.AddrFrom16(a).Unmap()
+	}
+	return netip.Addr{}
+}
+
+func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
+	// The tcp.Forwarder runs us in a new goroutine per connection.
+	defer trackGoroutine(&ns.numForwardGoroutines)()
+	ns.tcpConnsAccepted.Add(1)
+	reqDetails := r.ID()
+	if debugNetstack() {
+		ns.logf("[v2] TCP ForwarderRequest: %s", stringifyTEI(reqDetails))
+	}
+	clientRemoteIP := netaddrIPFromNetstackIP(reqDetails.RemoteAddress)
+	if !clientRemoteIP.IsValid() {
+		ns.logf("invalid RemoteAddress in TCP ForwarderRequest: %s", stringifyTEI(reqDetails))
+		ns.packetsDropped.Add(1)
+		ns.countHandler(handlerRejected)
+		r.Complete(true) // sends a RST
+		return
+	}
+
+	dialIP := netaddrIPFromNetstackIP(reqDetails.LocalAddress)
+	isTailscaleIP := tsaddr.IsTailscaleIP(dialIP)
+
+	if underlying, ok := ns.ViaInfo(dialIP); ok {
+		isTailscaleIP = false
+		dialIP = underlying
+	}
+
+	defer func() {
+		if !isTailscaleIP && !ns.StaticSubnetAddrsOnly {
+			// if this is a subnet IP, we added this in before the TCP handshake
+			// so netstack is happy TCP-handshaking as a subnet IP
+			ns.removeSubnetAddress(dialIP)
+		}
+	}()
+
+	src := netip.AddrPortFrom(clientRemoteIP, reqDetails.RemotePort)
+	dst := netip.AddrPortFrom(netaddrIPFromNetstackIP(reqDetails.LocalAddress), reqDetails.LocalPort)
+	if ns.shuttingDown.Load() {
+		ns.rejectTCP(r, src, dst, CloseShutdown, "shutting down")
+		return
+	}
+	if !ns.acceptScheduled() {
+		ns.rejectTCP(r, src, dst, CloseBlocked, "outside AcceptSchedule")
+		return
+	}
+	if !ns.healthy() {
+		ns.rejectTCP(r, src, dst, CloseBlocked, "unhealthy")
+		return
+	}
+	if !ns.allowedInMaintenance(clientRemoteIP) {
+		ns.rejectTCP(r, src, dst, CloseBlocked, "maintenance mode")
+		return
+	}
+	if !ns.allowClientConn(clientRemoteIP) {
+		if debugNetstack() {
+			ns.logf("[v2] netstack: rate limited new TCP connection from %v", clientRemoteIP)
+		}
+		ns.tcpRateLimited.Add(1)
+		ns.packetsDropped.Add(1)
+		ns.rejectTCP(r, src, dst, CloseQuotaExceeded, "rate limited")
+		return
+	}
+
+	var wq waiter.Queue
+	var clientEP tcpip.Endpoint // set by createConn
+
+	// We can't actually create the endpoint or complete the inbound
+	// request until we're sure that the connection can be handled by this
+	// endpoint. This function sets up the TCP connection and should be
+	// called immediately before a connection is handled.
+	createConn := func(opts ...tcpip.SettableSocketOption) *gonet.TCPConn {
+		ep, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			ns.logf("CreateEndpoint error for %s: %v", stringifyTEI(reqDetails), err)
+			r.Complete(true) // sends a RST
+			return nil
+		}
+		r.Complete(false)
+		clientEP = ep
+		ns.applyKeepaliveConfig(ep)
+		ns.applyClientNoDelay(ep)
+		for _, opt := range opts {
+			ep.SetSockOpt(opt)
+		}
+		// SetKeepAlive so that idle connections to peers that have forgotten about
+		// the connection or gone completely offline eventually time out.
 		// Applications might be setting this on a forwarded connection, but from
 		// userspace we can not see those, so the best we can do is to always
 		// perform them with conservative timing.
@@ -838,198 +4102,1212 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 		// peers.
 		ep.SocketOptions().SetKeepAlive(true)
 
-		// The ForwarderRequest.CreateEndpoint above asynchronously
-		// starts the TCP handshake. Note that the gonet.TCPConn
-		// methods c.RemoteAddr() and c.LocalAddr() will return nil
-		// until the handshake actually completes. But we have the
-		// remote address in reqDetails instead, so we don't use
-		// gonet.TCPConn.RemoteAddr. The byte copies in both
-		// directions to/from the gonet.TCPConn in forwardTCP will
-		// block until the TCP handshake is complete.
-		return gonet.NewTCPConn(&wq, ep)
+		// The ForwarderRequest.CreateEndpoint above asynchronously
+		// starts the TCP handshake. Note that the gonet.TCPConn
+		// methods c.RemoteAddr() and c.LocalAddr() will return nil
+		// until the handshake actually completes. But we have the
+		// remote address in reqDetails instead, so we don't use
+		// gonet.TCPConn.RemoteAddr. The byte copies in both
+		// directions to/from the gonet.TCPConn in forwardTCP will
+		// block until the TCP handshake is complete.
+		return gonet.NewTCPConn(&wq, ep)
+	}
+
+	req := &tcpRequest{
+		r:          r,
+		id:         reqDetails,
+		src:        src,
+		dst:        dst,
+		dialIP:     dialIP,
+		createConn: createConn,
+	}
+	chain := ns.HandlerChain
+	if chain == nil {
+		chain = DefaultHandlerChain()
+	}
+	for _, m := range chain {
+		if ns.offerTCP(m, req) {
+			return
+		}
+	}
+
+	if ns.rejectTCPIfBlocked(req) {
+		return
+	}
+	backendIP := dialIP
+	isLocal := isTailscaleIP || isLinkLocalIPv6(dialIP)
+	if isLocal {
+		backendIP = netaddr.IPv4(127, 0, 0, 1)
+	}
+	dialAddr := netip.AddrPortFrom(backendIP, uint16(reqDetails.LocalPort))
+	if backendIP == dialIP && ns.RewriteSubnetDial != nil {
+		if to, ok := ns.RewriteSubnetDial(req.src, dialAddr); ok {
+			dialAddr = to
+		}
+	}
+	if isLocal && ns.ResolveBackend != nil && ns.backendPools[dialAddr.Port()] == nil {
+		to, err := ns.resolveBackend(reqDetails, dialAddr.Port(), clientRemoteIP)
+		if err != nil {
+			ns.logf("netstack: could not resolve backend for port %d from %v: %v", dialAddr.Port(), clientRemoteIP, err)
+			ns.rejectTCP(r, src, dst, CloseBackend, "backend not resolved")
+			return
+		}
+		dialAddr = to
+	}
+	ns.logForwardDecision("TCP", req.src, req.dst, dialAddr)
+
+	if !ns.reserveConn() {
+		ns.packetsDropped.Add(1)
+		ns.rejectTCP(r, src, dst, CloseQuotaExceeded, "over MaxConns")
+		return
+	}
+	defer ns.forwardingConns.Add(-1)
+	if !ns.forwardTCP(createConn, &clientEP, req.src, req.dst, &wq, dialAddr) {
+		ns.rejectTCP(r, src, dst, CloseBackend, "backend unavailable")
+	}
+}
+
+// rejectTCP resets the new TCP connection r from src to dst, noting
+// that it was rejected for reason and reporting it to OnConnClose with
+// why.
+func (ns *Impl) rejectTCP(r *tcp.ForwarderRequest, src, dst netip.AddrPort, why CloseReason, reason string) {
+	ns.countHandler(handlerRejected)
+	ns.noteRejected(ipproto.TCP, src, dst, reason)
+	ns.reportRefused(ipproto.TCP, src, dst, why)
+	r.Complete(true) // sends a RST
+}
+
+// noteRejected logs the rejected flow from src to dst with its peer's
+// identity if LogRejectedPeers is set, and passes it to OnReject.
+func (ns *Impl) noteRejected(proto ipproto.Proto, src, dst netip.AddrPort, reason string) {
+	if !ns.LogRejectedPeers && ns.OnReject == nil {
+		return
+	}
+	ri := RejectInfo{Proto: proto, Src: src, Dst: dst, Reason: reason}
+	ri.PeerName, ri.PeerUser = ns.whoIs(src)
+	if ns.LogRejectedPeers {
+		if ri.PeerName != "" {
+			ns.logf("netstack: rejected %v from %v (%s, %s) to %v: %s", proto, src, ri.PeerName, ri.PeerUser, dst, reason)
+		} else {
+			ns.logf("netstack: rejected %v from %v (unknown peer) to %v: %s", proto, src, dst, reason)
+		}
+	}
+	if ns.OnReject != nil {
+		ns.OnReject(ri)
+	}
+}
+
+// whoIs returns the name of the node that src belongs to and the login
+// name of its user, or empty strings if they can't be resolved.
+func (ns *Impl) whoIs(src netip.AddrPort) (node, user string) {
+	if ns.whoIsFunc != nil {
+		return ns.whoIsFunc(src)
+	}
+	lb := ns.lb.Load()
+	if lb == nil {
+		return "", ""
+	}
+	n, u, ok := lb.WhoIs(src)
+	if !ok {
+		return "", ""
+	}
+	return n.Name, u.LoginName
+}
+
+// tcpRequest is an inbound TCP connection that acceptTCP is offering to
+// the HandlerChain.
+type tcpRequest struct {
+	r      *tcp.ForwarderRequest
+	id     stack.TransportEndpointID
+	src    netip.AddrPort // the client
+	dst    netip.AddrPort // as sent by the client
+	dialIP netip.Addr     // dst's IP, with any 4via6 mapping undone
+
+	// createConn accepts the connection. It returns nil, having reset
+	// the connection, if that fails.
+	createConn func(...tcpip.SettableSocketOption) *gonet.TCPConn
+}
+
+// offerTCP offers req to m, reporting whether m claimed it.
+func (ns *Impl) offerTCP(m HandlerMatcher, req *tcpRequest) (claimed bool) {
+	if m.builtin != nil {
+		return m.builtin(ns, req)
+	}
+	handler, ok := m.Match(req.id)
+	if !ok {
+		return false
+	}
+	ns.countHandler(handlerTCPIn)
+	if c := req.createConn(); c != nil {
+		handler(c)
+	}
+	return true
+}
+
+func (ns *Impl) acceptDNSTCP(req *tcpRequest) bool {
+	if req.id.LocalPort != 53 || (req.dialIP != magicDNSIP && req.dialIP != magicDNSIPv6) {
+		return false
+	}
+	ns.countHandler(handlerDNS)
+	if c := req.createConn(); c != nil {
+		go ns.dns.HandleTCPConnWithQuery(ns.limitDNSTCPConn(c), req.src, ns.timedDNSQuery())
+	}
+	return true
+}
+
+func (ns *Impl) acceptSSH(req *tcpRequest) bool {
+	lb := ns.lb.Load()
+	if lb == nil || req.id.LocalPort != 22 || !lb.ShouldRunSSH() || !ns.isLocalIP(req.dialIP) {
+		return false
+	}
+	// Use a higher keepalive idle time for SSH connections, as they are
+	// typically long lived and idle connections are more likely to be
+	// intentional. Ideally we would turn this off entirely, but we can't
+	// tell the difference between a long lived connection that is idle
+	// vs a connection that is dead because the peer has gone away.
+	// We pick 72h as that is typically sufficient for a long weekend.
+	idle := tcpip.KeepaliveIdleOption(72 * time.Hour)
+	ns.countHandler(handlerSSH)
+	if c := req.createConn(&idle); c != nil {
+		if err := lb.HandleSSHConn(c); err != nil {
+			ns.logf("ssh error: %v", err)
+		}
+	}
+	return true
+}
+
+func (ns *Impl) acceptPeerAPI(req *tcpRequest) bool {
+	lb := ns.lb.Load()
+	if lb == nil {
+		return false
+	}
+	port, ok := lb.GetPeerAPIPort(req.dialIP)
+	if !ok || req.id.LocalPort != port || !ns.isLocalIP(req.dialIP) {
+		return false
+	}
+	ns.countHandler(handlerPeerAPI)
+	if c := req.createConn(); c != nil {
+		lb.ServePeerAPIConnection(req.src, netip.AddrPortFrom(req.dialIP, port), c)
+	}
+	return true
+}
+
+func (ns *Impl) acceptQuad100(req *tcpRequest) bool {
+	lb := ns.lb.Load()
+	if lb == nil || req.id.LocalPort != 80 || (req.dialIP != magicDNSIP && req.dialIP != magicDNSIPv6) {
+		return false
+	}
+	ns.countHandler(handlerQuad100)
+	if c := req.createConn(); c != nil {
+		lb.HandleQuad100Port80Conn(c)
+	}
+	return true
+}
+
+// acceptTCPIn hands req to ns.ForwardTCPInFunc or ns.ForwardTCPIn, if
+// either is set, unless it's to one of BlockedForwardPorts.
+func (ns *Impl) acceptTCPIn(req *tcpRequest) bool {
+	if ns.ForwardTCPInFunc == nil && ns.ForwardTCPIn == nil {
+		return false
+	}
+	if ns.rejectTCPIfBlocked(req) {
+		return true
+	}
+	port := req.id.LocalPort
+	handler := func(c net.Conn) { ns.ForwardTCPIn(c, port) }
+	if ns.ForwardTCPInFunc != nil {
+		var ok bool
+		if handler, ok = ns.ForwardTCPInFunc(port); !ok {
+			ns.rejectTCP(req.r, req.src, req.dst, CloseBlocked, "unhandled port")
+			return true
+		}
+	}
+	ns.countHandler(handlerTCPIn)
+	if c := req.createConn(); c != nil {
+		handler(c)
+	}
+	return true
+}
+
+// rejectTCPIfBlocked resets req and reports true if it's to one of
+// ns.BlockedForwardPorts.
+func (ns *Impl) rejectTCPIfBlocked(req *tcpRequest) bool {
+	if !ns.isBlockedForwardPort(req.id.LocalPort) {
+		return false
+	}
+	ns.rejectBlocked(ipproto.TCP, req.src, req.dst)
+	req.r.Complete(true) // sends a RST
+	return true
+}
+
+// forwardTCP proxies the connection from src to dst, which has the
+// client side yet to be created by getClient, to a backend at dialAddr.
+// If clientEP is non-nil, getClient sets it to the client's endpoint.
+func (ns *Impl) forwardTCP(getClient func(...tcpip.SettableSocketOption) *gonet.TCPConn, clientEP *tcpip.Endpoint, src, dst netip.AddrPort, wq *waiter.Queue, dialAddr netip.AddrPort) (handled bool) {
+	dialAddrStr := dialAddr.String()
+	if debugNetstack() {
+		ns.logf("[v2] netstack: forwarding incoming connection to %s", dialAddrStr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.EventHUp) // TODO(bradfitz): right EventMask?
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+	done := make(chan bool)
+	// netstack doesn't close the notification channel automatically if there was no
+	// hup signal, so we close done after we're done to not leak the goroutine below.
+	defer close(done)
+	go func() {
+		defer trackGoroutine(&ns.numCopyGoroutines)()
+		select {
+		case <-notifyCh:
+			if debugNetstack() {
+				ns.logf("[v2] netstack: forwardTCP notifyCh fired; canceling context for %s", dialAddrStr)
+			}
+		case <-done:
+		}
+		cancel()
+	}()
+
+	isLoopback := dialAddr.Addr().IsLoopback()
+	var pool *backendPool
+	if isLoopback {
+		pool = ns.backendPools[dialAddr.Port()]
+	}
+	if isLoopback && pool == nil && ns.recentlyRefused(dialAddr.Port()) {
+		if debugNetstack() {
+			ns.logf("[v2] netstack: local port %d recently refused; resetting connection", dialAddr.Port())
+		}
+		return
+	}
+
+	// Attempt to dial the outbound connection before we accept the inbound one.
+	var server net.Conn
+	var release func()
+	var err error
+	if pool != nil {
+		dialAddr, server, release, err = ns.acquirePoolBackend(ctx, pool)
+		if err != nil {
+			ns.logf("netstack: could not connect to any backend for port %d: %v", dst.Port(), err)
+			return
+		}
+		dialAddrStr = dialAddr.String()
+	} else {
+		server, release, err = ns.acquireBackendTCP(ctx, dialAddr)
+		if err != nil {
+			ns.logf("netstack: could not connect to local server at %s: %v", dialAddr.String(), err)
+			if isLoopback && errors.Is(err, syscall.ECONNREFUSED) {
+				ns.noteRefused(dialAddr.Port())
+			}
+			return
+		}
+	}
+	defer release()
+
+	// If we get here, either the getClient call below will succeed and
+	// return something we can Close, or it will fail and will properly
+	// respond to the client with a RST. Either way, the caller no longer
+	// needs to clean up the client connection.
+	handled = true
+	ns.tcpConnsForwarded.Add(1)
+	if isLoopback {
+		ns.countHandler(handlerLoopback)
+	} else {
+		ns.countHandler(handlerSubnet)
+	}
+
+	// We dialed the connection; we can complete the client's TCP handshake.
+	client := getClient()
+	if client == nil {
+		return
+	}
+	defer client.Close()
+
+	// Conns from AcquireBackend might not be TCP.
+	if backendLocalAddr, ok := server.LocalAddr().(*net.TCPAddr); ok {
+		backendLocalIPPort := netaddr.Unmap(backendLocalAddr.AddrPort())
+		ns.e.RegisterIPPortIdentity(backendLocalIPPort, src.Addr())
+		defer ns.e.UnregisterIPPortIdentity(backendLocalIPPort)
+	}
+	ns.activeTCPConns.Add(1)
+	defer ns.activeTCPConns.Add(-1)
+	var ep tcpip.Endpoint
+	if clientEP != nil {
+		ep = *clientEP
+	}
+	ac := ns.registerConn(ConnInfo{
+		Proto:   ipproto.TCP,
+		Src:     src,
+		Dst:     dst,
+		Backend: dialAddr,
+		Start:   time.Now(),
+	}, ep)
+	reason, err := ns.proxyTCP(client, server, ac)
+	if err != nil {
+		ns.logf("proxy connection closed with error: %v", err)
+		ns.forwardError(dst, err)
+	}
+	ac.setCloseReason(reason)
+	ns.unregisterConn(ac)
+	ns.logf("[v2] netstack: forwarder connection to %s (%s) closed", dialAddrStr, ac.info.summary())
+	return
+}
+
+// forwardError passes err, from forwarding a connection or session to
+// dst, to OnForwardError if it's set and err isn't EOF.
+func (ns *Impl) forwardError(dst netip.AddrPort, err error) {
+	if ns.OnForwardError == nil || err == nil || errors.Is(err, io.EOF) {
+		return
+	}
+	ns.OnForwardError(dst, err)
+}
+
+// flowClass returns how a forwarded flow to backend was classified:
+// "local" if it was addressed to this node and is forwarded to the host
+// over loopback, or "subnet" if it's forwarded to its destination as-is.
+func flowClass(backend netip.Addr) string {
+	if backend.IsLoopback() {
+		return "local"
+	}
+	return "subnet"
+}
+
+// logForwardDecision logs how a new flow from src to dst was classified
+// and the backend address it's being forwarded to.
+func (ns *Impl) logForwardDecision(proto string, src, dst, backend netip.AddrPort) {
+	ns.logf("[v2] netstack: %s %v -> %v is %s; forwarding to %v", proto, src, dst, flowClass(backend.Addr()), backend)
+}
+
+// proxyTCP copies data between client and server in both directions.
+// It returns when either direction is done, after waiting up to
+// ns.BackendTeardownGrace for server to finish if it was the client that
+// finished first, and reports which side ended the connection. The
+// caller is responsible for closing both conns. If ac is non-nil, the
+// bytes copied each way are added to it.
+func (ns *Impl) proxyTCP(client, server net.Conn, ac *activeConn) (CloseReason, error) {
+	type copyResult struct {
+		fromClient bool
+		err        error
 	}
+	connClosed := make(chan copyResult, 2)
+	go func() {
+		defer trackGoroutine(&ns.numCopyGoroutines)()
+		n, err := ns.copyTCP(ns.mirrored(server, DirToServer), client)
+		ns.bytesForwarded.Add(uint64(n))
+		if ac != nil {
+			ac.toServer.Add(n)
+		}
+		connClosed <- copyResult{true, err}
+	}()
+	go func() {
+		defer trackGoroutine(&ns.numCopyGoroutines)()
+		n, err := ns.copyTCP(ns.mirrored(client, DirToClient), server)
+		ns.bytesForwarded.Add(uint64(n))
+		if ac != nil {
+			ac.toClient.Add(n)
+		}
+		connClosed <- copyResult{false, err}
+	}()
+	res := <-connClosed
+	reason := CloseBackend
+	switch {
+	case isConnReset(res.err):
+		reason = CloseReset
+	case res.fromClient:
+		reason = ClosePeer
+	}
+	if res.fromClient && ns.BackendTeardownGrace > 0 {
+		if cw, ok := server.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		timer := time.NewTimer(ns.BackendTeardownGrace)
+		defer timer.Stop()
+		select {
+		case <-connClosed:
+		case <-timer.C:
+		}
+	}
+	return reason, res.err
+}
+
+// minTCPCopyBufferSize is the smallest allowed TCPCopyBufferSize.
+const minTCPCopyBufferSize = 512
+
+// copyTCP copies from src to dst like io.Copy, but using a buffer of
+// ns.TCPCopyBufferSize bytes if it's set.
+func (ns *Impl) copyTCP(dst io.Writer, src io.Reader) (int64, error) {
+	if ns.TCPCopyBufferSize == 0 {
+		return io.Copy(dst, src)
+	}
+	// Hide any ReaderFrom or WriterTo methods, which would make
+	// io.CopyBuffer ignore our buffer.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, ns.TCPCopyBufferSize))
+}
 
-	// DNS
-	if reqDetails.LocalPort == 53 && (dialIP == magicDNSIP || dialIP == magicDNSIPv6) {
-		c := createConn()
-		if c == nil {
+// mirrorQueueSize is how many chunks of forwarded data can be queued
+// for MirrorTo.
+const mirrorQueueSize = 256
+
+// mirrorChunk is a copy of forwarded data queued for MirrorTo.
+type mirrorChunk struct {
+	dir Direction
+	b   []byte
+}
+
+// mirror queues a copy of b, forwarded in direction dir, for MirrorTo,
+// if it's set. It doesn't block.
+func (ns *Impl) mirror(dir Direction, b []byte) {
+	if ns.mirrorc == nil {
+		return
+	}
+	select {
+	case ns.mirrorc <- mirrorChunk{dir, append([]byte(nil), b...)}:
+	default:
+		ns.mirrorDrops.Add(1)
+	}
+}
+
+// mirrorLoop passes queued chunks to MirrorTo until ns is closed.
+func (ns *Impl) mirrorLoop() {
+	for {
+		select {
+		case c := <-ns.mirrorc:
+			ns.MirrorTo(c.dir, c.b)
+		case <-ns.ctx.Done():
 			return
 		}
-		go ns.dns.HandleTCPConn(c, netip.AddrPortFrom(clientRemoteIP, reqDetails.RemotePort))
+	}
+}
+
+// mirrored returns w, wrapped to mirror what's written to it in
+// direction dir if MirrorTo is set.
+func (ns *Impl) mirrored(w io.Writer, dir Direction) io.Writer {
+	if ns.mirrorc == nil {
+		return w
+	}
+	return mirrorWriter{ns, w, dir}
+}
+
+// mirrorWriter is an io.Writer that mirrors what it writes.
+type mirrorWriter struct {
+	ns  *Impl
+	w   io.Writer
+	dir Direction
+}
+
+func (m mirrorWriter) Write(b []byte) (int, error) {
+	n, err := m.w.Write(b)
+	m.ns.mirror(m.dir, b[:n])
+	return n, err
+}
+
+// recentlyRefused reports whether the loopback backend port refused a
+// connection within the last RefusedPortTTL.
+func (ns *Impl) recentlyRefused(port uint16) bool {
+	if ns.RefusedPortTTL <= 0 {
+		return false
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	t, ok := ns.refusedPorts[port]
+	if !ok {
+		return false
+	}
+	if time.Since(t) >= ns.RefusedPortTTL {
+		delete(ns.refusedPorts, port)
+		return false
+	}
+	return true
+}
+
+// noteRefused records that the loopback backend port refused a
+// connection.
+func (ns *Impl) noteRefused(port uint16) {
+	if ns.RefusedPortTTL <= 0 {
 		return
 	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	mak.Set(&ns.refusedPorts, port, time.Now())
+}
+
+// acquireBackendTCP returns a connection to the TCP backend at addr,
+// either from ns.AcquireBackend or by dialing it, and a func to call when
+// done with the connection.
+func (ns *Impl) acquireBackendTCP(ctx context.Context, addr netip.AddrPort) (c net.Conn, release func(), err error) {
+	if ns.AcquireBackend != nil {
+		return ns.AcquireBackend(addr)
+	}
+	c, err = ns.dialBackendTCP(ctx, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, func() { c.Close() }, nil
+}
+
+// backendPoolFailTTL is how long a BackendPoolForPort backend whose
+// dial failed is skipped for.
+const backendPoolFailTTL = 10 * time.Second
+
+// backendPool is a BackendPoolForPort pool.
+type backendPool struct {
+	backends []*poolBackend
+	next     atomic.Uint32 // round-robin position
+}
+
+type poolBackend struct {
+	addr     netip.AddrPort
+	inFlight atomic.Int64 // connections being dialed or proxied
+	failedAt atomic.Int64 // unix nanos of the last failed dial, or 0
+}
+
+func newBackendPool(addrs []string) (*backendPool, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no backends")
+	}
+	p := &backendPool{}
+	for _, s := range addrs {
+		addr, err := netip.ParseAddrPort(s)
+		if err != nil {
+			return nil, err
+		}
+		p.backends = append(p.backends, &poolBackend{addr: addr})
+	}
+	return p, nil
+}
+
+// order returns p's backends in the order a new connection should try
+// them: the ones that haven't recently failed, round-robin from the next
+// position or starting with the one with the fewest connections in
+// flight if leastConns, and then the rest.
+func (p *backendPool) order(leastConns bool) []*poolBackend {
+	next := p.next.Add(1) - 1
+	cutoff := time.Now().Add(-backendPoolFailTTL).UnixNano()
+	var healthy, failed []*poolBackend
+	for _, b := range p.backends {
+		if t := b.failedAt.Load(); t != 0 && t > cutoff {
+			failed = append(failed, b)
+		} else {
+			healthy = append(healthy, b)
+		}
+	}
+	order := make([]*poolBackend, 0, len(p.backends))
+	if n := len(healthy); n > 0 {
+		start := int(next % uint32(n))
+		order = append(order, healthy[start:]...)
+		order = append(order, healthy[:start]...)
+	}
+	if leastConns && len(order) > 1 {
+		least := 0
+		for i, b := range order {
+			if b.inFlight.Load() < order[least].inFlight.Load() {
+				least = i
+			}
+		}
+		order[0], order[least] = order[least], order[0]
+	}
+	return append(order, failed...)
+}
+
+// acquirePoolBackend returns a connection to one of pool's backends,
+// its address, and a func to call when done with the connection. It
+// tries the backends in pool.order until one succeeds.
+func (ns *Impl) acquirePoolBackend(ctx context.Context, pool *backendPool) (addr netip.AddrPort, c net.Conn, release func(), err error) {
+	for _, b := range pool.order(ns.BackendPoolLeastConns) {
+		b.inFlight.Add(1)
+		var done func()
+		c, done, err = ns.acquireBackendTCP(ctx, b.addr)
+		if err == nil {
+			b.failedAt.Store(0)
+			return b.addr, c, func() {
+				done()
+				b.inFlight.Add(-1)
+			}, nil
+		}
+		b.inFlight.Add(-1)
+		b.failedAt.Store(time.Now().UnixNano())
+		if debugNetstack() {
+			ns.logf("[v2] netstack: pool backend %v failed: %v", b.addr, err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return netip.AddrPort{}, nil, nil, err
+}
+
+// backendDialRetryDelay is the delay before the first retry of a failed
+// backend dial. It doubles with each subsequent retry.
+const backendDialRetryDelay = 100 * time.Millisecond
+
+// dialBackendTCP dials the TCP backend at addr, retrying up to
+// ns.BackendDialRetries times if the dial fails. It gives up early if
+// ctx is done.
+func (ns *Impl) dialBackendTCP(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+	dial := ns.backendDialFunc
+	if dial == nil {
+		if ns.ForwardViaWebSocket != nil {
+			dial = ns.dialWebSocket
+		} else if ns.UseDialerForSubnets && !addr.Addr().IsLoopback() {
+			dial = ns.dialer.UserDial
+		} else if ns.ForwardDialer != nil {
+			dial = ns.ForwardDialer
+		} else {
+			var stdDialer net.Dialer
+			dial = stdDialer.DialContext
+		}
+	}
+	timeout := ns.connectTimeout(addr)
+	if ns.ForwardViaWebSocket != nil && ns.backendDialFunc == nil {
+		// The WebSocket lives only as long as its dial's ctx.
+		timeout = 0
+	}
+	delay := backendDialRetryDelay
+	for attempt := 0; ; attempt++ {
+		c, err := dialWithTimeout(ctx, dial, addr.String(), timeout)
+		if err == nil || attempt >= ns.BackendDialRetries || ctx.Err() != nil {
+			return c, err
+		}
+		if debugNetstack() {
+			ns.logf("[v2] netstack: dial to %s failed (attempt %d): %v; retrying in %v", addr, attempt+1, err, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// connectTimeout returns how long each attempt to dial the TCP backend
+// at addr may take.
+func (ns *Impl) connectTimeout(addr netip.AddrPort) time.Duration {
+	if ns.ConnectTimeoutFunc != nil {
+		if d := ns.ConnectTimeoutFunc(addr); d > 0 {
+			return d
+		}
+	}
+	if ns.TCPConnectTimeout > 0 {
+		return ns.TCPConnectTimeout
+	}
+	return defaultTCPConnectTimeout
+}
+
+// defaultTCPConnectTimeout is the default Impl.TCPConnectTimeout.
+const defaultTCPConnectTimeout = 30 * time.Second
+
+// dialWithTimeout dials addr over TCP with dial, giving up after timeout
+// if it's non-zero.
+func dialWithTimeout(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return dial(ctx, "tcp", addr)
+}
+
+// webSocketPingInterval is how often dialWebSocket's conns send a ping
+// to keep the WebSocket alive through proxies with idle timeouts.
+const webSocketPingInterval = 30 * time.Second
 
-	if ns.lb != nil {
-		if reqDetails.LocalPort == 22 && ns.processSSH() && ns.isLocalIP(dialIP) {
-			// Use a higher keepalive idle time for SSH connections, as they are
-			// typically long lived and idle connections are more likely to be
-			// intentional. Ideally we would turn this off entirely, but we can't
-			// tell the difference between a long lived connection that is idle
-			// vs a connection that is dead because the peer has gone away.
-			// We pick 72h as that is typically sufficient for a long weekend.
-			idle := tcpip.KeepaliveIdleOption(72 * time.Hour)
-			c := createConn(&idle)
-			if c == nil {
+// dialWebSocket dials ns.ForwardViaWebSocket and returns the WebSocket as
+// a net.Conn that lives until ctx is done or it's closed. Its signature
+// matches net.Dialer.DialContext, but network and addr are ignored.
+func (ns *Impl) dialWebSocket(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, _, err := websocket.Dial(ctx, ns.ForwardViaWebSocket.String(), &websocket.DialOptions{
+		CompressionMode: websocket.CompressionDisabled,
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		ticker := time.NewTicker(webSocketPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
 				return
+			case <-ticker.C:
 			}
-			if err := ns.lb.HandleSSHConn(c); err != nil {
-				ns.logf("ssh error: %v", err)
+			// Pongs are only read while the conn is being read from,
+			// which proxyTCP always is.
+			pingCtx, cancel := context.WithTimeout(ctx, webSocketPingInterval)
+			err := c.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				if ctx.Err() == nil {
+					ns.logf("netstack: WebSocket ping to %v failed: %v", ns.ForwardViaWebSocket, err)
+					c.Close(websocket.StatusGoingAway, "ping failed")
+				}
+				return
 			}
+		}
+	}()
+	return wsconn.NetConn(ctx, c, websocket.MessageBinary), nil
+}
+
+func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
+	sess := r.ID()
+	if debugNetstack() {
+		ns.logf("[v2] UDP ForwarderRequest: %v", stringifyTEI(sess))
+	}
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		ns.logf("acceptUDP: could not create endpoint: %v", err)
+		ns.countHandler(handlerRejected)
+		return
+	}
+	srcAddr, dstAddr, ok := ns.udpFlowAddrs(sess)
+	if !ok {
+		ns.packetsDropped.Add(1)
+		ns.countHandler(handlerRejected)
+		ep.Close()
+		return
+	}
+	if ns.shuttingDown.Load() {
+		ns.rejectUDP(ep, srcAddr, dstAddr, CloseShutdown, "shutting down")
+		return
+	}
+	if !ns.acceptScheduled() {
+		ns.rejectUDP(ep, srcAddr, dstAddr, CloseBlocked, "outside AcceptSchedule")
+		return
+	}
+	if !ns.healthy() {
+		ns.rejectUDP(ep, srcAddr, dstAddr, CloseBlocked, "unhealthy")
+		return
+	}
+	if !ns.allowedInMaintenance(srcAddr.Addr()) {
+		ns.rejectUDP(ep, srcAddr, dstAddr, CloseBlocked, "maintenance mode")
+		return
+	}
+
+	// Handle magicDNS traffic (via UDP) here.
+	if dst := dstAddr.Addr(); dst == magicDNSIP || dst == magicDNSIPv6 {
+		if dstAddr.Port() != 53 {
+			ns.countHandler(handlerRejected)
+			ep.Close()
+			return // Only MagicDNS traffic runs on the service IPs for now.
+		}
+
+		ns.countHandler(handlerDNS)
+		c := gonet.NewUDPConn(ns.ipstack, &wq, ep)
+		go ns.handleMagicDNSUDP(srcAddr, c)
+		return
+	}
+
+	if ns.isBlockedForwardPort(dstAddr.Port()) {
+		ns.rejectBlocked(ipproto.UDP, srcAddr, dstAddr)
+		ep.Close()
+		return
+	}
+
+	if ns.ForwardUDPIn != nil {
+		if dst := dstAddr.Addr(); ns.isLocalIP(dst) || isLinkLocalIPv6(dst) {
+			ns.countHandler(handlerTCPIn)
+			c := gonet.NewUDPConn(ns.ipstack, &wq, ep)
+			go ns.ForwardUDPIn(c, dstAddr.Port())
 			return
 		}
-		if port, ok := ns.lb.GetPeerAPIPort(dialIP); ok {
-			if reqDetails.LocalPort == port && ns.isLocalIP(dialIP) {
-				c := createConn()
-				if c == nil {
-					return
-				}
+	}
+
+	if !ns.allowNewUDPSession(srcAddr.Addr()) {
+		if debugNetstack() {
+			ns.logf("[v2] netstack: rate limited new UDP session %v -> %v", srcAddr, dstAddr)
+		}
+		ns.udpRateLimited.Add(1)
+		ns.packetsDropped.Add(1)
+		ns.rejectUDP(ep, srcAddr, dstAddr, CloseQuotaExceeded, "rate limited")
+		return
+	}
+
+	if !ns.reserveConn() {
+		ns.packetsDropped.Add(1)
+		ns.rejectUDP(ep, srcAddr, dstAddr, CloseQuotaExceeded, "over MaxConns")
+		return
+	}
+	c := gonet.NewUDPConn(ns.ipstack, &wq, ep)
+	go func() {
+		defer ns.forwardingConns.Add(-1)
+		ns.forwardUDP(c, &wq, srcAddr, dstAddr)
+	}()
+}
+
+// rejectUDP closes ep, the endpoint of the new UDP flow from src to dst,
+// noting that it was rejected for reason and reporting it to
+// OnConnClose with why.
+func (ns *Impl) rejectUDP(ep tcpip.Endpoint, src, dst netip.AddrPort, why CloseReason, reason string) {
+	ns.countHandler(handlerRejected)
+	ns.noteRejected(ipproto.UDP, src, dst, reason)
+	ns.reportRefused(ipproto.UDP, src, dst, why)
+	ep.Close()
+}
+
+// reserveConn reserves one of the MaxConns flows that can be forwarded
+// at once, reporting whether one was free. If so, the caller must
+// decrement ns.forwardingConns when the flow ends.
+func (ns *Impl) reserveConn() bool {
+	n := ns.forwardingConns.Add(1)
+	if ns.MaxConns > 0 && n > int64(ns.MaxConns) {
+		ns.forwardingConns.Add(-1)
+		ns.connsOverLimit.Add(1)
+		if debugNetstack() {
+			ns.logf("[v2] netstack: refusing new flow; %d already forwarded", ns.MaxConns)
+		}
+		return false
+	}
+	return true
+}
+
+// isBlockedForwardPort reports whether port is in ns.BlockedForwardPorts.
+func (ns *Impl) isBlockedForwardPort(port uint16) bool {
+	for _, p := range ns.BlockedForwardPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectBlocked records that a new flow from src to dst was refused
+// because of BlockedForwardPorts, and reports it to ns.OnConnClose.
+func (ns *Impl) rejectBlocked(proto ipproto.Proto, src, dst netip.AddrPort) {
+	ns.logf("[v2] netstack: %v %v -> %v is to a blocked port; refusing", proto, src, dst)
+	ns.packetsDropped.Add(1)
+	ns.countHandler(handlerRejected)
+	ns.noteRejected(proto, src, dst, "blocked port")
+	ns.reportRefused(proto, src, dst, CloseBlocked)
+}
+
+// reportRefused reports the new flow from src to dst, which ns refused
+// to forward, to ns.OnConnClose with why.
+func (ns *Impl) reportRefused(proto ipproto.Proto, src, dst netip.AddrPort, why CloseReason) {
+	if ns.OnConnClose != nil {
+		ns.OnConnClose(ConnInfo{
+			Proto:       proto,
+			Src:         src,
+			Dst:         dst,
+			Start:       ns.now(),
+			CloseReason: why,
+		})
+	}
+}
+
+// udpFlowAddrs returns the source and destination addresses of the new
+// UDP flow sess. If either can't be parsed, it reports the error to
+// ns.OnUDPParseError and returns ok false.
+func (ns *Impl) udpFlowAddrs(sess stack.TransportEndpointID) (src, dst netip.AddrPort, ok bool) {
+	dst, dstOK := ipPortOfNetstackAddr(sess.LocalAddress, sess.LocalPort)
+	src, srcOK := ipPortOfNetstackAddr(sess.RemoteAddress, sess.RemotePort)
+	if dstOK && srcOK {
+		return src, dst, true
+	}
+	ns.udpParseErrors.Add(1)
+	flow := stringifyTEI(sess)
+	if debugNetstack() {
+		ns.logf("[v2] netstack: dropping UDP flow with unparseable address: %s", flow)
+	}
+	if ns.OnUDPParseError != nil {
+		ns.OnUDPParseError(flow)
+	}
+	return netip.AddrPort{}, netip.AddrPort{}, false
+}
 
-				src := netip.AddrPortFrom(clientRemoteIP, reqDetails.RemotePort)
-				dst := netip.AddrPortFrom(dialIP, port)
-				ns.lb.ServePeerAPIConnection(src, dst, c)
-				return
+// maxUDPSourceLimiters is the maximum number of source IPs for which
+// per-source UDP session limiters are kept. Past that, they're all
+// discarded and started over, rather than growing without bound.
+const maxUDPSourceLimiters = 4096
+
+// allowNewUDPSession reports whether a new forwarded UDP session from
+// src is within NewUDPSessionRate and NewUDPSessionRatePerSource.
+func (ns *Impl) allowNewUDPSession(src netip.Addr) bool {
+	if n := ns.NewUDPSessionRatePerSource; n > 0 {
+		ns.mu.Lock()
+		lim, ok := ns.udpSourceLimiters[src]
+		if !ok {
+			if len(ns.udpSourceLimiters) >= maxUDPSourceLimiters {
+				ns.udpSourceLimiters = nil
 			}
+			lim = rate.NewLimiter(rate.Limit(n), n)
+			mak.Set(&ns.udpSourceLimiters, src, lim)
 		}
-		if reqDetails.LocalPort == 80 && (dialIP == magicDNSIP || dialIP == magicDNSIPv6) {
-			c := createConn()
-			if c == nil {
-				return
-			}
-			ns.lb.HandleQuad100Port80Conn(c)
-			return
+		ns.mu.Unlock()
+		if !lim.Allow() {
+			return false
 		}
 	}
+	return ns.udpSessionLimiter == nil || ns.udpSessionLimiter.Allow()
+}
 
-	if ns.ForwardTCPIn != nil {
-		c := createConn()
-		if c == nil {
-			return
-		}
-		ns.ForwardTCPIn(c, reqDetails.LocalPort)
-		return
-	}
-	if isTailscaleIP {
-		dialIP = netaddr.IPv4(127, 0, 0, 1)
+// clientLimiterSweepInterval is the most often allowClientConn removes
+// idle entries from Impl.tcpClientLimiters.
+const clientLimiterSweepInterval = time.Minute
+
+// acceptScheduled reports whether AcceptSchedule allows new
+// connections now.
+func (ns *Impl) acceptScheduled() bool {
+	if ns.AcceptSchedule == nil {
+		return true
 	}
-	dialAddr := netip.AddrPortFrom(dialIP, uint16(reqDetails.LocalPort))
+	return ns.AcceptSchedule(ns.now())
+}
 
-	if !ns.forwardTCP(createConn, clientRemoteIP, &wq, dialAddr) {
-		r.Complete(true) // sends a RST
+// now returns the current time, from timeNow if set.
+func (ns *Impl) now() time.Time {
+	if ns.timeNow != nil {
+		return ns.timeNow()
 	}
+	return time.Now()
 }
 
-func (ns *Impl) forwardTCP(getClient func(...tcpip.SettableSocketOption) *gonet.TCPConn, clientRemoteIP netip.Addr, wq *waiter.Queue, dialAddr netip.AddrPort) (handled bool) {
-	dialAddrStr := dialAddr.String()
-	if debugNetstack() {
-		ns.logf("[v2] netstack: forwarding incoming connection to %s", dialAddrStr)
+// healthy reports whether HealthCheck passes, logging when that
+// changes.
+func (ns *Impl) healthy() bool {
+	if ns.HealthCheck == nil {
+		return true
 	}
+	err := ns.HealthCheck()
+	if wasUnhealthy := ns.unhealthy.Swap(err != nil); wasUnhealthy != (err != nil) {
+		if err != nil {
+			ns.logf("netstack: health check failed, refusing traffic: %v", err)
+		} else {
+			ns.logf("netstack: health check passed, accepting traffic again")
+		}
+	}
+	return err == nil
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// clientLimiter is an entry in Impl.tcpClientLimiters.
+type clientLimiter struct {
+	lim      *rate.Limiter
+	lastUsed time.Time
+}
 
-	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.EventHUp) // TODO(bradfitz): right EventMask?
-	wq.EventRegister(&waitEntry)
-	defer wq.EventUnregister(&waitEntry)
-	done := make(chan bool)
-	// netstack doesn't close the notification channel automatically if there was no
-	// hup signal, so we close done after we're done to not leak the goroutine below.
-	defer close(done)
-	go func() {
-		select {
-		case <-notifyCh:
-			if debugNetstack() {
-				ns.logf("[v2] netstack: forwardTCP notifyCh fired; canceling context for %s", dialAddrStr)
+// allowClientConn reports whether a new TCP connection from src is
+// within PerClientConnRate.
+func (ns *Impl) allowClientConn(src netip.Addr) bool {
+	l := ns.PerClientConnRate
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if now.Sub(ns.lastClientLimiterSweep) >= clientLimiterSweepInterval {
+		ns.lastClientLimiterSweep = now
+		// A limiter idle for as long as its bucket takes to fill is
+		// the same as a new one.
+		idle := l.refill()
+		for ip, cl := range ns.tcpClientLimiters {
+			if now.Sub(cl.lastUsed) >= idle {
+				delete(ns.tcpClientLimiters, ip)
 			}
-		case <-done:
 		}
-		cancel()
-	}()
-
-	// Attempt to dial the outbound connection before we accept the inbound one.
-	var stdDialer net.Dialer
-	server, err := stdDialer.DialContext(ctx, "tcp", dialAddrStr)
-	if err != nil {
-		ns.logf("netstack: could not connect to local server at %s: %v", dialAddr.String(), err)
-		return
 	}
-	defer server.Close()
+	cl, ok := ns.tcpClientLimiters[src]
+	if !ok {
+		cl = &clientLimiter{lim: rate.NewLimiter(rate.Limit(l.Rate), l.Burst)}
+		mak.Set(&ns.tcpClientLimiters, src, cl)
+	}
+	cl.lastUsed = now
+	return cl.lim.Allow()
+}
 
-	// If we get here, either the getClient call below will succeed and
-	// return something we can Close, or it will fail and will properly
-	// respond to the client with a RST. Either way, the caller no longer
-	// needs to clean up the client connection.
-	handled = true
+// DNSQueryTiming is how long netstack took to handle a MagicDNS query.
+// It's passed to Impl.OnDNSQuery.
+type DNSQueryTiming struct {
+	Proto ipproto.Proto  // ipproto.UDP or ipproto.TCP
+	Src   netip.AddrPort // the querier's address
+	Err   error          // why the query failed, if it did
 
-	// We dialed the connection; we can complete the client's TCP handshake.
-	client := getClient()
-	if client == nil {
-		return
+	// Query is the time spent answering the query, by DNSPreHandler,
+	// DNSTransport, DNSResolverOverride or the DNS manager.
+	Query time.Duration
+	// Write is the time spent writing the response. It's zero for TCP,
+	// whose responses the DNS manager writes.
+	Write time.Duration
+	// Total is the time from reading the query to writing the
+	// response.
+	Total time.Duration
+}
+
+// timedDNSQuery returns ns.dnsQuery, wrapped to report each query's
+// timing to OnDNSQuery if set, for the DNS manager's TCP handler.
+func (ns *Impl) timedDNSQuery() func(context.Context, []byte, netip.AddrPort) ([]byte, error) {
+	if ns.OnDNSQuery == nil {
+		return ns.dnsQuery
 	}
-	defer client.Close()
+	return func(ctx context.Context, q []byte, src netip.AddrPort) ([]byte, error) {
+		start := time.Now()
+		resp, err := ns.dnsQuery(ctx, q, src)
+		d := time.Since(start)
+		ns.OnDNSQuery(DNSQueryTiming{Proto: ipproto.TCP, Src: src, Err: err, Query: d, Total: d})
+		return resp, err
+	}
+}
 
-	backendLocalAddr := server.LocalAddr().(*net.TCPAddr)
-	backendLocalIPPort := netaddr.Unmap(backendLocalAddr.AddrPort())
-	ns.e.RegisterIPPortIdentity(backendLocalIPPort, clientRemoteIP)
-	defer ns.e.UnregisterIPPortIdentity(backendLocalIPPort)
-	connClosed := make(chan error, 2)
-	go func() {
-		_, err := io.Copy(server, client)
-		connClosed <- err
-	}()
-	go func() {
-		_, err := io.Copy(client, server)
-		connClosed <- err
-	}()
-	err = <-connClosed
-	if err != nil {
-		ns.logf("proxy connection closed with error: %v", err)
+// dnsQuery answers the MagicDNS query q from src.
+func (ns *Impl) dnsQuery(ctx context.Context, q []byte, src netip.AddrPort) ([]byte, error) {
+	if ns.DNSPreHandler != nil {
+		if resp, handled := ns.DNSPreHandler(q, src); handled {
+			return resp, nil
+		}
 	}
-	ns.logf("[v2] netstack: forwarder connection to %s closed", dialAddrStr)
-	return
+	if ns.DNSTransport != nil {
+		return ns.DNSTransport(ctx, q)
+	}
+	if ns.DNSResolverOverride != nil {
+		return ns.DNSResolverOverride(ctx, q, src)
+	}
+	return ns.dns.Query(ctx, q, src)
 }
 
-func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
-	sess := r.ID()
-	if debugNetstack() {
-		ns.logf("[v2] UDP ForwarderRequest: %v", stringifyTEI(sess))
+// minDNSUDPSize is the largest DNS response over UDP that every client
+// accepts, and the limit for those that don't advertise a larger one
+// with EDNS0 (RFC 1035, section 4.2.1).
+const minDNSUDPSize = 512
+
+// dnsUDPSizeLimit returns the largest DNS response over UDP that the
+// client that sent query accepts, per its EDNS0 OPT record if any.
+func dnsUDPSizeLimit(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return minDNSUDPSize
 	}
-	var wq waiter.Queue
-	ep, err := r.CreateEndpoint(&wq)
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return minDNSUDPSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return minDNSUDPSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			// The OPT record's class is the client's UDP payload size.
+			if size := int(h.Class); size > minDNSUDPSize {
+				return size
+			}
+			return minDNSUDPSize
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return minDNSUDPSize
+		}
+	}
+}
+
+// truncateDNSResponse returns resp, the response to the DNS query over
+// UDP, or if it's larger than the client accepts, just its header and
+// question with the TC bit set, so that the client retries over TCP.
+// It returns resp unchanged if it can't be parsed.
+func truncateDNSResponse(query, resp []byte) []byte {
+	if len(resp) <= minDNSUDPSize || len(resp) <= dnsUDPSizeLimit(query) {
+		return resp
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
 	if err != nil {
-		ns.logf("acceptUDP: could not create endpoint: %v", err)
-		return
+		return resp
 	}
-	dstAddr, ok := ipPortOfNetstackAddr(sess.LocalAddress, sess.LocalPort)
-	if !ok {
-		ep.Close()
-		return
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return resp
 	}
-	srcAddr, ok := ipPortOfNetstackAddr(sess.RemoteAddress, sess.RemotePort)
-	if !ok {
-		ep.Close()
-		return
+	h.Truncated = true
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return resp
+		}
+	}
+	tc, err := b.Finish()
+	if err != nil {
+		return resp
 	}
+	return tc
+}
 
-	// Handle magicDNS traffic (via UDP) here.
-	if dst := dstAddr.Addr(); dst == magicDNSIP || dst == magicDNSIPv6 {
-		if dstAddr.Port() != 53 {
-			ep.Close()
-			return // Only MagicDNS traffic runs on the service IPs for now.
-		}
+// maxDNSMessageSize is the largest DNS message that can be sent over TCP,
+// per its 16-bit length prefix.
+const maxDNSMessageSize = 65535
 
-		c := gonet.NewUDPConn(ns.ipstack, &wq, ep)
-		go ns.handleMagicDNSUDP(srcAddr, c)
-		return
+// limitDNSTCPConn wraps the DNS-over-TCP conn c to enforce
+// ns.MaxDNSTCPMessageSize.
+func (ns *Impl) limitDNSTCPConn(c net.Conn) net.Conn {
+	max := ns.MaxDNSTCPMessageSize
+	if max <= 0 || max >= maxDNSMessageSize {
+		return c // nothing to enforce
 	}
+	return &dnsTCPSizeLimitConn{Conn: c, max: max, logf: ns.logf}
+}
 
-	c := gonet.NewUDPConn(ns.ipstack, &wq, ep)
-	go ns.forwardUDP(c, &wq, srcAddr, dstAddr)
+// dnsTCPSizeLimitConn is a DNS-over-TCP server conn that closes itself if
+// the client declares a request longer than max.
+type dnsTCPSizeLimitConn struct {
+	net.Conn
+	max  int
+	logf logger.Logf
+
+	prefix  [2]byte // length prefix of the next request
+	nprefix int     // bytes of prefix read so far
+	remain  int     // bytes of the current request not yet read
+}
+
+func (c *dnsTCPSizeLimitConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if serr := c.scan(p[:n]); serr != nil {
+		c.logf("netstack: closing DNS TCP conn from %v: %v", c.RemoteAddr(), serr)
+		c.Conn.Close()
+		return 0, serr
+	}
+	return n, err
 }
 
-func (ns *Impl) handleMagicDNSUDP(srcAddr netip.AddrPort, c *gonet.UDPConn) {
+// scan advances c's position in the stream of length-prefixed requests
+// over b, which was just read, returning an error if a request is too
+// long.
+func (c *dnsTCPSizeLimitConn) scan(b []byte) error {
+	for len(b) > 0 {
+		if c.remain > 0 {
+			n := c.remain
+			if n > len(b) {
+				n = len(b)
+			}
+			c.remain -= n
+			b = b[n:]
+			continue
+		}
+		c.prefix[c.nprefix] = b[0]
+		c.nprefix++
+		b = b[1:]
+		if c.nprefix == len(c.prefix) {
+			c.nprefix = 0
+			c.remain = int(binary.BigEndian.Uint16(c.prefix[:]))
+			if c.remain > c.max {
+				return fmt.Errorf("DNS request length %d exceeds max %d", c.remain, c.max)
+			}
+		}
+	}
+	return nil
+}
+
+// defaultMaxDNSQueriesPerConn is the default value of
+// Impl.MaxDNSQueriesPerConn. Clients like glibc send a handful of queries
+// on one socket; this is high enough to never matter to them while still
+// bounding how long one client can keep a handler busy.
+const defaultMaxDNSQueriesPerConn = 1000
+
+func (ns *Impl) handleMagicDNSUDP(srcAddr netip.AddrPort, c net.Conn) {
+	defer trackGoroutine(&ns.numForwardGoroutines)()
 	// In practice, implementations are advised not to exceed 512 bytes
 	// due to fragmenting. Just to be sure, we bump all the way to the MTU.
-	const maxUDPReqSize = mtu
+	maxUDPReqSize := ns.linkEP.MTU()
 	// Packets are being generated by the local host, so there should be
 	// very, very little latency. 150ms was chosen as something of an upper
 	// bound on resource usage, while hopefully still being long enough for
@@ -1044,21 +5322,57 @@ func (ns *Impl) handleMagicDNSUDP(srcAddr netip.AddrPort, c *gonet.UDPConn) {
 	// in a loop (with a tight deadline so we don't chew too many resources).
 	//
 	// See: https://github.com/bminor/glibc/blob/f7fbb99652eceb1b6b55e4be931649df5946497c/resolv/res_send.c#L995
-	for {
+	maxQueries := ns.MaxDNSQueriesPerConn
+	if maxQueries <= 0 {
+		maxQueries = defaultMaxDNSQueriesPerConn
+	}
+	//
+	// Queries are made with ns.ctx, so that closing ns cancels them and
+	// ends the loop.
+	for i := 0; i < maxQueries && ns.ctx.Err() == nil; i++ {
 		c.SetReadDeadline(time.Now().Add(readDeadline))
-		n, _, err := c.ReadFrom(q)
+		n, err := c.Read(q)
 		if err != nil {
-			if oe, ok := err.(*net.OpError); !(ok && oe.Timeout()) {
+			if oe, ok := err.(*net.OpError); !(ok && oe.Timeout()) && ns.ctx.Err() == nil {
 				ns.logf("dns udp read: %v", err) // log non-timeout errors
 			}
 			return
 		}
-		resp, err := ns.dns.Query(context.Background(), q[:n], srcAddr)
+		var start time.Time
+		if ns.OnDNSQuery != nil {
+			start = time.Now()
+		}
+		resp, err := ns.dnsQuery(ns.ctx, q[:n], srcAddr)
 		if err != nil {
-			ns.logf("dns udp query: %v", err)
+			if ns.ctx.Err() == nil {
+				ns.logf("dns udp query: %v", err)
+			}
+			if ns.OnDNSQuery != nil {
+				d := time.Since(start)
+				ns.OnDNSQuery(DNSQueryTiming{Proto: ipproto.UDP, Src: srcAddr, Err: err, Query: d, Total: d})
+			}
 			return
 		}
-		c.Write(resp)
+		resp = truncateDNSResponse(q[:n], resp)
+		var answered time.Time
+		if ns.OnDNSQuery != nil {
+			answered = time.Now()
+		}
+		_, err = c.Write(resp)
+		if ns.OnDNSQuery != nil {
+			done := time.Now()
+			ns.OnDNSQuery(DNSQueryTiming{
+				Proto: ipproto.UDP,
+				Src:   srcAddr,
+				Err:   err,
+				Query: answered.Sub(start),
+				Write: done.Sub(answered),
+				Total: done.Sub(start),
+			})
+		}
+	}
+	if debugNetstack() {
+		ns.logf("[v2] netstack: closing DNS UDP conn from %v after %d queries", srcAddr, maxQueries)
 	}
 }
 
@@ -1068,40 +5382,62 @@ func (ns *Impl) handleMagicDNSUDP(srcAddr netip.AddrPort, c *gonet.UDPConn) {
 // 127.0.0.1, or any other IP (from an advertised subnet), in which case we
 // proxy to it directly.
 func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientAddr, dstAddr netip.AddrPort) {
+	defer trackGoroutine(&ns.numForwardGoroutines)()
 	port, srcPort := dstAddr.Port(), clientAddr.Port()
+	origDstAddr := dstAddr
 	if debugNetstack() {
 		ns.logf("[v2] netstack: forwarding incoming UDP connection on port %v", port)
 	}
 
 	var backendListenAddr *net.UDPAddr
 	var backendRemoteAddr *net.UDPAddr
-	isLocal := ns.isLocalIP(dstAddr.Addr())
+	isLocal := ns.isLocalIP(dstAddr.Addr()) || isLinkLocalIPv6(dstAddr.Addr())
 	if isLocal {
 		backendRemoteAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(port)}
 		backendListenAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(srcPort)}
 	} else {
-		if dstIP := dstAddr.Addr(); viaRange.Contains(dstIP) {
-			dstAddr = netip.AddrPortFrom(tsaddr.UnmapVia(dstIP), dstAddr.Port())
+		if underlying, ok := ns.ViaInfo(dstAddr.Addr()); ok {
+			dstAddr = netip.AddrPortFrom(underlying, dstAddr.Port())
 		}
-		backendRemoteAddr = net.UDPAddrFromAddrPort(dstAddr)
-		if dstAddr.Addr().Is4() {
-			backendListenAddr = &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: int(srcPort)}
+		backendListenAddr, backendRemoteAddr = ns.udpBackendAddrs(dstAddr, srcPort)
+	}
+
+	ns.logForwardDecision("UDP", clientAddr, dstAddr, netaddr.Unmap(backendRemoteAddr.AddrPort()))
+
+	var backendConn net.PacketConn
+	shared := false
+	if ns.UDPSharedBackendSocket && !isLocal {
+		f, err := ns.sharedUDPFlow(clientAddr, netaddr.Unmap(backendRemoteAddr.AddrPort()), backendListenAddr)
+		if err != nil {
+			ns.logf("netstack: could not share UDP socket for %v: %v, using a new one", dstAddr, err)
 		} else {
-			backendListenAddr = &net.UDPAddr{IP: net.ParseIP("::"), Port: int(srcPort)}
+			backendConn, shared = f, true
 		}
 	}
-
-	backendConn, err := net.ListenUDP("udp", backendListenAddr)
-	if err != nil {
-		ns.logf("netstack: could not bind local port %v: %v, trying again with random port", backendListenAddr.Port, err)
-		backendListenAddr.Port = 0
-		backendConn, err = net.ListenUDP("udp", backendListenAddr)
+	if backendConn == nil {
+		c, err := ns.listenUDPBackend(backendListenAddr)
 		if err != nil {
 			ns.logf("netstack: could not create UDP socket, preventing forwarding to %v: %v", dstAddr, err)
+			ns.countHandler(handlerRejected)
+			ns.injectPortUnreachable(clientAddr, origDstAddr)
 			return
 		}
+		backendConn = c
 	}
 	backendLocalAddr := backendConn.LocalAddr().(*net.UDPAddr)
+	if isLocal {
+		ns.countHandler(handlerLoopback)
+	} else {
+		ns.countHandler(handlerSubnet)
+		if ns.EnsureBackendPort != nil && !shared { // sharedUDPFlow ensures shared sockets' ports
+			bport := backendLocalAddr.AddrPort().Port()
+			if err := ns.EnsureBackendPort("udp", bport); err != nil {
+				ns.logf("netstack: EnsureBackendPort(udp, %d): %v", bport, err)
+			} else if ns.ReleaseBackendPort != nil {
+				defer ns.ReleaseBackendPort("udp", bport)
+			}
+		}
+	}
 
 	backendLocalIPPort := netip.AddrPortFrom(backendListenAddr.AddrPort().Addr().Unmap().WithZone(backendLocalAddr.Zone), backendLocalAddr.AddrPort().Port())
 	if !backendLocalIPPort.IsValid() {
@@ -1111,9 +5447,22 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientAddr,
 		ns.e.RegisterIPPortIdentity(backendLocalIPPort, dstAddr.Addr())
 	}
 	ctx, cancel := context.WithCancel(context.Background())
+	ns.activeUDPSessions.Add(1)
+	ac := ns.registerConn(ConnInfo{
+		Proto:   ipproto.UDP,
+		Src:     clientAddr,
+		Dst:     origDstAddr,
+		Backend: netaddr.Unmap(backendRemoteAddr.AddrPort()),
+		Start:   time.Now(),
+	}, nil)
+	ac.lastActive.Store(ns.now().UnixNano())
 
 	idleTimeout := 2 * time.Minute
-	if port == 53 {
+	if ns.udpIdleTimeout != 0 {
+		idleTimeout = ns.udpIdleTimeout
+	} else if d := ns.udpIdleTimeoutFor(port); d > 0 {
+		idleTimeout = d
+	} else if port == 53 {
 		// Make DNS packet copies time out much sooner.
 		//
 		// TODO(bradfitz): make DNS queries over UDP forwarding even
@@ -1122,35 +5471,342 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientAddr,
 		// wait a few seconds (or zero, really)
 		idleTimeout = 30 * time.Second
 	}
-	timer := time.AfterFunc(idleTimeout, func() {
-		if isLocal {
-			ns.e.UnregisterIPPortIdentity(backendLocalIPPort)
+	var expireOnce sync.Once
+	expire := func() {
+		expireOnce.Do(func() {
+			if isLocal {
+				ns.e.UnregisterIPPortIdentity(backendLocalIPPort)
+			}
+			ns.logf("netstack: UDP session between %s and %s (%s) timed out", backendListenAddr, backendRemoteAddr, ac.info.summary())
+			ac.setCloseReason(CloseIdleTimeout)
+			cancel()
+			client.Close()
+			backendConn.Close()
+		})
+	}
+	timer := time.AfterFunc(idleTimeout, expire)
+	ns.mu.Lock()
+	ac.expire = expire
+	ns.mu.Unlock()
+	wroteTo := func(counter *atomic.Int64) func(int) {
+		return func(n int) {
+			timer.Reset(idleTimeout)
+			ac.lastActive.Store(ns.now().UnixNano())
+			counter.Add(int64(n))
+		}
+	}
+	ns.startPacketCopy(ctx, cancel, DirToClient, client, net.UDPAddrFromAddrPort(clientAddr), backendConn, netaddr.Unmap(backendRemoteAddr.AddrPort()), ns.RewriteUDPToClient, wroteTo(&ac.toClient), func(err error, srcClosed bool) {
+		if srcClosed {
+			ac.setCloseReason(CloseBackend)
 		}
-		ns.logf("netstack: UDP session between %s and %s timed out", backendListenAddr, backendRemoteAddr)
-		cancel()
-		client.Close()
-		backendConn.Close()
+		ns.forwardError(origDstAddr, err)
 	})
-	extend := func() {
-		timer.Reset(idleTimeout)
-	}
-	startPacketCopy(ctx, cancel, client, net.UDPAddrFromAddrPort(clientAddr), backendConn, ns.logf, extend)
-	startPacketCopy(ctx, cancel, backendConn, backendRemoteAddr, client, ns.logf, extend)
+	ns.startPacketCopy(ctx, cancel, DirToServer, backendConn, backendRemoteAddr, client, netip.AddrPort{}, ns.RewriteUDPToBackend, wroteTo(&ac.toServer), func(err error, srcClosed bool) {
+		if srcClosed {
+			ac.setCloseReason(ClosePeer)
+		}
+		ns.forwardError(origDstAddr, err)
+	})
+	// Wait for the copies to be done before decrementing the
+	// session count and the subnet address count (which may
+	// remove the route).
+	<-ctx.Done()
+	ns.unregisterConn(ac)
+	ns.logf("[v2] netstack: forwarder UDP session to %v (%s) closed", backendRemoteAddr, ac.info.summary())
+	ns.activeUDPSessions.Add(-1)
 	if isLocal {
-		// Wait for the copies to be done before decrementing the
-		// subnet address count to potentially remove the route.
-		<-ctx.Done()
 		ns.removeSubnetAddress(dstAddr.Addr())
 	}
 }
 
-func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.PacketConn, dstAddr net.Addr, src net.PacketConn, logf logger.Logf, extend func()) {
+// ICMP codes for a port unreachable error (RFC 792 and RFC 4443).
+const (
+	icmp4PortUnreachable packet.ICMP4Code = 3
+	icmp6PortUnreachable packet.ICMP6Code = 4
+)
+
+// injectPortUnreachable sends client an ICMP port unreachable error
+// from dst for its UDP traffic to dst, so that it stops retransmitting
+// to a destination netstack can't forward to.
+func (ns *Impl) injectPortUnreachable(client, dst netip.AddrPort) {
+	if ns.DisableICMP {
+		return
+	}
+	// The error quotes the IP and UDP headers of the client's packet,
+	// which are reconstructed here.
+	var pkt []byte
+	if dst.Addr().Is4() {
+		orig := packet.Generate(&packet.UDP4Header{
+			IP4Header: packet.IP4Header{Src: client.Addr(), Dst: dst.Addr()},
+			SrcPort:   client.Port(),
+			DstPort:   dst.Port(),
+		}, nil)
+		h := packet.ICMP4Header{
+			IP4Header: packet.IP4Header{Src: dst.Addr(), Dst: client.Addr()},
+			Type:      packet.ICMP4Unreachable,
+			Code:      icmp4PortUnreachable,
+		}
+		pkt = packet.Generate(&h, append(make([]byte, 4), orig...))
+	} else {
+		orig := packet.Generate(&packet.UDP6Header{
+			IP6Header: packet.IP6Header{Src: client.Addr(), Dst: dst.Addr()},
+			SrcPort:   client.Port(),
+			DstPort:   dst.Port(),
+		}, nil)
+		h := packet.ICMP6Header{
+			IP6Header: packet.IP6Header{Src: dst.Addr(), Dst: client.Addr()},
+			Type:      packet.ICMP6Unreachable,
+			Code:      icmp6PortUnreachable,
+		}
+		pkt = packet.Generate(&h, append(make([]byte, 4), orig...))
+	}
+	ns.setReplyTTL(pkt)
+	if ns.portUnreachableFunc != nil {
+		ns.portUnreachableFunc(pkt)
+		return
+	}
+	if err := ns.tundev.InjectOutbound(pkt); err != nil {
+		ns.logf("InjectOutbound port unreachable: %v", err)
+	}
+}
+
+// udpBackendAddrs returns the addresses to bind the backend socket of
+// a UDP session from srcPort to subnet destination dst to, and to send
+// to, in the family chosen by udpBackendIs4.
+func (ns *Impl) udpBackendAddrs(dst netip.AddrPort, srcPort uint16) (listen, remote *net.UDPAddr) {
+	is4 := ns.udpBackendIs4(dst)
+	ip := dst.Addr()
+	if is4 {
+		ip = ip.Unmap()
+	} else if ip.Is4() {
+		ip = netip.AddrFrom16(ip.As16())
+	}
+	listen = &net.UDPAddr{IP: ns.udpBackendBindIP(dst, is4).AsSlice(), Port: int(srcPort)}
+	return listen, net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, dst.Port()))
+}
+
+// udpBackendIs4 reports whether the backend socket of a UDP session to
+// subnet destination dst should be IPv4: UDPBackendFamily's choice if
+// it can reach dst, or else whether dst is IPv4.
+func (ns *Impl) udpBackendIs4(dst netip.AddrPort) bool {
+	is4 := dst.Addr().Is4()
+	if ns.UDPBackendFamily == nil {
+		return is4
+	}
+	want4 := ns.UDPBackendFamily(dst)
+	if want4 && !dst.Addr().Unmap().Is4() {
+		ns.logf("netstack: UDPBackendFamily chose IPv4 for IPv6 destination %v; using IPv6", dst)
+		return false
+	}
+	return want4
+}
+
+// udpBackendBindIP returns the IP to bind the backend socket of a UDP
+// session to subnet destination dst to: UDPBackendBindAddr's choice,
+// or else the wildcard address of the socket's family, IPv4 if is4.
+func (ns *Impl) udpBackendBindIP(dst netip.AddrPort, is4 bool) netip.Addr {
+	if ns.UDPBackendBindAddr != nil {
+		if ip := ns.UDPBackendBindAddr(dst); ip.IsValid() && ip.Is4() == is4 {
+			return ip
+		}
+	}
+	if is4 {
+		return netip.IPv4Unspecified()
+	}
+	return netip.IPv6Unspecified()
+}
+
+// listenUDPBackend binds a backend UDP socket to laddr, or to a random
+// port if its port is taken.
+func (ns *Impl) listenUDPBackend(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	c, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		ns.logf("netstack: could not bind local port %v: %v, trying again with random port", laddr.Port, err)
+		laddr.Port = 0
+		c, err = net.ListenUDP("udp", laddr)
+	}
+	return c, err
+}
+
+// sharedUDPSocket is a backend UDP socket shared by a client's subnet
+// UDP sessions when Impl.UDPSharedBackendSocket is set.
+type sharedUDPSocket struct {
+	ns      *Impl
+	client  netip.AddrPort
+	bindIP  net.IP // what conn was bound to, which may be a wildcard
+	conn    *net.UDPConn
+	release func()        // if non-nil, releases the port from EnsureBackendPort
+	dead    chan struct{} // closed when reading conn fails
+
+	// flows are the sessions using the socket, keyed by their backend
+	// address. It's guarded by ns.udpSharedMu.
+	flows map[netip.AddrPort]*sharedUDPFlow
+}
+
+// sharedUDPFlow is a UDP session's view of a sharedUDPSocket, which
+// only receives packets from the session's backend.
+type sharedUDPFlow struct {
+	s         *sharedUDPSocket
+	backend   netip.AddrPort
+	pkts      chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// sharedUDPFlowQueueSize is how many packets from its backend a
+// sharedUDPFlow buffers before dropping them.
+const sharedUDPFlowQueueSize = 64
+
+// sharedUDPFlow returns a net.PacketConn for the UDP session from
+// client to backend that uses client's shared backend socket, binding
+// it to laddr if it doesn't exist yet. The socket is closed, and its
+// port released, once all its sessions are closed.
+func (ns *Impl) sharedUDPFlow(client, backend netip.AddrPort, laddr *net.UDPAddr) (*sharedUDPFlow, error) {
+	ns.udpSharedMu.Lock()
+	defer ns.udpSharedMu.Unlock()
+	s := ns.udpSharedSockets[client]
+	if s == nil {
+		c, err := ns.listenUDPBackend(laddr)
+		if err != nil {
+			return nil, err
+		}
+		s = &sharedUDPSocket{ns: ns, client: client, bindIP: laddr.IP, conn: c, dead: make(chan struct{})}
+		if ns.EnsureBackendPort != nil {
+			bport := c.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+			if err := ns.EnsureBackendPort("udp", bport); err != nil {
+				ns.logf("netstack: EnsureBackendPort(udp, %d): %v", bport, err)
+			} else if ns.ReleaseBackendPort != nil {
+				s.release = func() { ns.ReleaseBackendPort("udp", bport) }
+			}
+		}
+		mak.Set(&ns.udpSharedSockets, client, s)
+		go s.readLoop()
+	} else if !s.bindIP.Equal(laddr.IP) {
+		return nil, fmt.Errorf("%v's shared socket is bound to %v, not %v", client, s.bindIP, laddr.IP)
+	} else if _, ok := s.flows[backend]; ok {
+		// Only possible with 4via6, where sessions to different
+		// addresses can have the same backend.
+		return nil, fmt.Errorf("%v already has a session to %v", client, backend)
+	}
+	f := &sharedUDPFlow{
+		s:       s,
+		backend: backend,
+		pkts:    make(chan []byte, sharedUDPFlowQueueSize),
+		closed:  make(chan struct{}),
+	}
+	mak.Set(&s.flows, backend, f)
+	return f, nil
+}
+
+// readLoop reads packets from s.conn and queues each for the session
+// with its source as backend, until reading fails.
+func (s *sharedUDPSocket) readLoop() {
+	defer trackGoroutine(&s.ns.numCopyGoroutines)()
+	defer close(s.dead)
+	buf := make([]byte, s.ns.udpCopyBufferSize())
+	for {
+		n, src, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		src = netaddr.Unmap(src)
+		s.ns.udpSharedMu.Lock()
+		f := s.flows[src]
+		s.ns.udpSharedMu.Unlock()
+		if f == nil {
+			s.ns.udpOtherSources.Add(1)
+			s.ns.limitedLogf("netstack: UDP packet from %v to %v's shared socket, which has no session with it", src, s.client)
+			continue
+		}
+		select {
+		case f.pkts <- append([]byte(nil), buf[:n]...):
+		default:
+			s.ns.packetsDropped.Add(1)
+		}
+	}
+}
+
+func (f *sharedUDPFlow) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-f.pkts:
+		return copy(b, pkt), net.UDPAddrFromAddrPort(f.backend), nil
+	case <-f.closed:
+		return 0, nil, net.ErrClosed
+	case <-f.s.dead:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (f *sharedUDPFlow) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return f.s.conn.WriteTo(b, addr)
+}
+
+// Close ends f's session, closing the shared socket if it was the
+// last one using it.
+func (f *sharedUDPFlow) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		ns := f.s.ns
+		ns.udpSharedMu.Lock()
+		defer ns.udpSharedMu.Unlock()
+		delete(f.s.flows, f.backend)
+		if len(f.s.flows) > 0 {
+			return
+		}
+		delete(ns.udpSharedSockets, f.s.client)
+		f.s.conn.Close()
+		if f.s.release != nil {
+			f.s.release()
+		}
+	})
+	return nil
+}
+
+func (f *sharedUDPFlow) LocalAddr() net.Addr { return f.s.conn.LocalAddr() }
+
+// errNoDeadlines is returned by sharedUDPFlow's deadline methods, as
+// forwardUDP doesn't use deadlines.
+var errNoDeadlines = errors.New("netstack: deadlines not supported on shared UDP sockets")
+
+func (f *sharedUDPFlow) SetDeadline(time.Time) error      { return errNoDeadlines }
+func (f *sharedUDPFlow) SetReadDeadline(time.Time) error  { return errNoDeadlines }
+func (f *sharedUDPFlow) SetWriteDeadline(time.Time) error { return errNoDeadlines }
+
+// udpIdleTimeoutFor returns ns.UDPIdleTimeout's idle timeout for UDP
+// sessions to port, or zero to use the default.
+func (ns *Impl) udpIdleTimeoutFor(port uint16) time.Duration {
+	if ns.UDPIdleTimeout == nil {
+		return 0
+	}
+	return ns.UDPIdleTimeout(port)
+}
+
+// udpCopyBufferSize returns the size of the buffers UDP packets are
+// read into when forwarding them.
+func (ns *Impl) udpCopyBufferSize() int {
+	if n := int(ns.linkEP.MTU()); n > minUDPCopyBufferSize {
+		return n
+	}
+	return minUDPCopyBufferSize
+}
+
+// startPacketCopy starts a goroutine copying packets from src to dst,
+// which are going in direction dir, until ctx is done or either fails,
+// calling wrote with the size of each packet written.
+// If rewrite is non-nil, each packet's payload is replaced by its
+// result, and dropped if that's nil. If wantSrc is valid, packets from
+// other addresses are checked with checkUDPReplySource. failed is
+// called with the error if reading from src or writing to dst fails
+// before ctx is done, and whether it was reading from src.
+func (ns *Impl) startPacketCopy(ctx context.Context, cancel context.CancelFunc, dir Direction, dst net.PacketConn, dstAddr net.Addr, src net.PacketConn, wantSrc netip.AddrPort, rewrite func([]byte) []byte, wrote func(n int), failed func(err error, srcClosed bool)) {
+	logf := ns.logf
 	if debugNetstack() {
 		logf("[v2] netstack: startPacketCopy to %v (%T) from %T", dstAddr, dst, src)
 	}
 	go func() {
+		defer trackGoroutine(&ns.numCopyGoroutines)()
 		defer cancel() // tear down the other direction's copy
-		pkt := make([]byte, maxUDPPacketSize)
+		pkt := make([]byte, ns.udpCopyBufferSize())
 		for {
 			select {
 			case <-ctx.Done():
@@ -1160,25 +5816,57 @@ func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.Pac
 				if err != nil {
 					if ctx.Err() == nil {
 						logf("read packet from %s failed: %v", srcAddr, err)
+						failed(err, true)
 					}
 					return
 				}
-				_, err = dst.WriteTo(pkt[:n], dstAddr)
+				if wantSrc.IsValid() && !ns.checkUDPReplySource(srcAddr, wantSrc) {
+					continue
+				}
+				payload := pkt[:n]
+				if rewrite != nil {
+					if payload = rewrite(payload); payload == nil {
+						if debugNetstack() {
+							logf("[v2] dropped rewritten UDP packet %s -> %s", srcAddr, dstAddr)
+						}
+						continue
+					}
+				}
+				_, err = dst.WriteTo(payload, dstAddr)
 				if err != nil {
 					if ctx.Err() == nil {
 						logf("write packet to %s failed: %v", dstAddr, err)
+						failed(err, false)
 					}
 					return
 				}
+				ns.bytesForwarded.Add(uint64(len(payload)))
+				ns.mirror(dir, payload)
 				if debugNetstack() {
 					logf("[v2] wrote UDP packet %s -> %s", srcAddr, dstAddr)
 				}
-				extend()
+				wrote(len(payload))
 			}
 		}
 	}()
 }
 
+// checkUDPReplySource counts and logs a packet from srcAddr that's not
+// from wantSrc, the backend of its UDP session. It reports whether to
+// forward the packet.
+func (ns *Impl) checkUDPReplySource(srcAddr net.Addr, wantSrc netip.AddrPort) bool {
+	ua, ok := srcAddr.(*net.UDPAddr)
+	if !ok {
+		return true
+	}
+	if got := netaddr.Unmap(ua.AddrPort()); got != wantSrc {
+		ns.udpOtherSources.Add(1)
+		ns.limitedLogf("netstack: UDP reply from %v, not backend %v; asymmetric routing?", got, wantSrc)
+		return !ns.StrictUDPReplySource
+	}
+	return true
+}
+
 func stringifyTEI(tei stack.TransportEndpointID) string {
 	localHostPort := net.JoinHostPort(tei.LocalAddress.String(), strconv.Itoa(int(tei.LocalPort)))
 	remoteHostPort := net.JoinHostPort(tei.RemoteAddress.String(), strconv.Itoa(int(tei.RemotePort)))
@@ -5,9 +5,18 @@
 package netstack
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"net/netip"
 	"os/exec"
 	"syscall"
+	"time"
 
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
 )
 
@@ -17,4 +26,67 @@ func init() {
 			AmbientCaps: []uintptr{unix.CAP_NET_RAW},
 		}
 	}
+	nativePing = linuxPing
+}
+
+// linuxPing implements nativePing. It uses an unprivileged ICMP socket
+// if the kernel allows it (see net.ipv4.ping_group_range), or else a
+// raw socket, which needs CAP_NET_RAW.
+func linuxPing(dstIP netip.Addr, timeout time.Duration) error {
+	network, rawNetwork, laddr := "udp4", "ip4:icmp", "0.0.0.0"
+	proto, reqType, replyType := 1, icmp.Type(ipv4.ICMPTypeEcho), icmp.Type(ipv4.ICMPTypeEchoReply)
+	if dstIP.Is6() {
+		network, rawNetwork, laddr = "udp6", "ip6:ipv6-icmp", "::"
+		proto, reqType, replyType = 58, ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	raw := false
+	c, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		if c, err = icmp.ListenPacket(rawNetwork, laddr); err != nil {
+			return errNoNativePing
+		}
+		raw = true
+	}
+	defer c.Close()
+
+	var idAndData [10]byte
+	if _, err := rand.Read(idAndData[:]); err != nil {
+		return err
+	}
+	req := &icmp.Echo{
+		ID:   int(binary.BigEndian.Uint16(idAndData[:2])), // replaced by the kernel unless raw
+		Seq:  1,
+		Data: idAndData[2:],
+	}
+	b, err := (&icmp.Message{Type: reqType, Body: req}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+	var dst net.Addr = &net.UDPAddr{IP: dstIP.AsSlice(), Zone: dstIP.Zone()}
+	if raw {
+		dst = &net.IPAddr{IP: dstIP.AsSlice(), Zone: dstIP.Zone()}
+	}
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := c.WriteTo(b, dst); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		m, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || m.Type != replyType {
+			continue
+		}
+		// Unprivileged ICMP sockets only receive replies to their own
+		// requests, but raw sockets receive all of them.
+		if reply, ok := m.Body.(*icmp.Echo); ok && (!raw || reply.ID == req.ID) &&
+			reply.Seq == req.Seq && bytes.Equal(reply.Data, req.Data) {
+			return nil
+		}
+	}
 }
@@ -5,16 +5,53 @@
 package netstack
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"net/url"
+	"reflect"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/bufferv2"
 	"gvisor.dev/gvisor/pkg/refs"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"nhooyr.io/websocket"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/net/tstun"
+	"tailscale.com/net/wsconn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
 	"tailscale.com/types/ipproto"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/opt"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
 )
@@ -46,7 +83,7 @@ func TestInjectInboundLeak(t *testing.T) {
 		t.Fatal("failed to get internals")
 	}
 
-	ns, err := Create(logf, tunWrap, eng, magicSock, dialer, dns)
+	ns, err := Create(logf, tunWrap, eng, magicSock, dialer, dns, tstun.DefaultMTU)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -87,7 +124,13 @@ func TestNetstackLeakMode(t *testing.T) {
 	}
 }
 
-func makeNetstack(t *testing.T, config func(*Impl)) *Impl {
+func makeNetstack(t testing.TB, config func(*Impl)) *Impl {
+	return makeNetstackWithOptions(t, CreateOptions{}, config)
+}
+
+// makeNetstackWithOptions is like makeNetstack, creating the Impl with
+// CreateWithOptions.
+func makeNetstackWithOptions(t testing.TB, opts CreateOptions, config func(*Impl)) *Impl {
 	tunDev := tstun.NewFake()
 	dialer := new(tsdial.Dialer)
 	logf := func(format string, args ...any) {
@@ -113,7 +156,7 @@ func makeNetstack(t *testing.T, config func(*Impl)) *Impl {
 		t.Fatal("failed to get internals")
 	}
 
-	ns, err := Create(logf, tunWrap, eng, magicSock, dialer, dns)
+	ns, err := CreateWithOptions(logf, tunWrap, eng, magicSock, dialer, dns, tstun.DefaultMTU, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -128,6 +171,109 @@ func makeNetstack(t *testing.T, config func(*Impl)) *Impl {
 	return ns
 }
 
+// addLocalIP registers ip with ns's stack as one of the node's own
+// addresses, as updateIPs does, rather than as a subnet address.
+func addLocalIP(t testing.TB, ns *Impl, ip netip.Addr) {
+	t.Helper()
+	pa := tcpip.ProtocolAddress{
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.Address(ip.AsSlice()),
+			PrefixLen: ip.BitLen(),
+		},
+		Protocol: ipv4.ProtocolNumber,
+	}
+	if ip.Is6() {
+		pa.Protocol = ipv6.ProtocolNumber
+	}
+	if err := ns.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{}); err != nil {
+		t.Fatalf("registering %v: %v", ip, err)
+	}
+}
+
+func TestCreateDisableProtocols(t *testing.T) {
+	ns := makeNetstackWithOptions(t, CreateOptions{DisableUDP: true, DisableICMPEndpoints: true}, func(*Impl) {})
+	for _, proto := range []tcpip.TransportProtocolNumber{udp.ProtocolNumber, icmp.ProtocolNumber4, icmp.ProtocolNumber6} {
+		if ns.ipstack.TransportProtocolInstance(proto) != nil {
+			t.Errorf("transport protocol %d registered", proto)
+		}
+	}
+	if ns.ipstack.TransportProtocolInstance(tcp.ProtocolNumber) == nil {
+		t.Error("TCP not registered")
+	}
+	if _, err := ns.DialContextUDP(context.Background(), netip.MustParseAddrPort("100.64.0.2:53")); err != errUDPDisabled {
+		t.Errorf("DialContextUDP error = %v; want %v", err, errUDPDisabled)
+	}
+
+	// Inbound UDP isn't forwarded.
+	p := &packet.Parsed{}
+	p.Decode(packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{Src: netip.MustParseAddr("100.64.0.2"), Dst: netip.MustParseAddr("100.64.0.1")},
+		SrcPort:   1234,
+		DstPort:   5353,
+	}, []byte("hello")))
+	ns.injectInbound(p, nil)
+	for name, n := range ns.HandlerStats() {
+		if n != 0 {
+			t.Errorf("UDP packet counted by handler %q", name)
+		}
+	}
+
+	// By default, all are registered.
+	ns = makeNetstack(t, func(*Impl) {})
+	for _, proto := range []tcpip.TransportProtocolNumber{tcp.ProtocolNumber, udp.ProtocolNumber, icmp.ProtocolNumber4, icmp.ProtocolNumber6} {
+		if ns.ipstack.TransportProtocolInstance(proto) == nil {
+			t.Errorf("by default, transport protocol %d not registered", proto)
+		}
+	}
+}
+
+func TestCreateNICRetries(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		retries  int
+		failures int
+		wantErr  string
+	}{
+		{"no-retries", 0, 1, "transient"},
+		{"retry-succeeds", 2, 2, ""},
+		{"retries-exhausted", 2, 3, "netstack: giving up after 3 attempts: transient"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ipstack := stack.New(stack.Options{
+				NetworkProtocols: []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			})
+			defer ipstack.Close()
+			linkEP := newLinkEndpoint(defaultLinkEndpointQueueSize, tstun.DefaultMTU)
+			attempts := 0
+			opts := CreateOptions{
+				NICRetries:      tt.retries,
+				NICRetryBackoff: time.Millisecond,
+				createNIC: func(ipstack *stack.Stack, linkEP *linkEndpoint) error {
+					attempts++
+					if attempts <= tt.failures {
+						return errors.New("transient")
+					}
+					return createNIC(ipstack, linkEP)
+				},
+			}
+			err := opts.createNICWithRetries(t.Logf, ipstack, linkEP)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ipstack.CheckNIC(nicID) {
+					t.Error("NIC not created")
+				}
+				if attempts != tt.failures+1 {
+					t.Errorf("attempts = %d; want %d", attempts, tt.failures+1)
+				}
+			} else if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("err = %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestShouldHandlePing(t *testing.T) {
 	srcIP := netip.AddrFrom4([4]byte{1, 2, 3, 4})
 
@@ -252,3 +398,5480 @@ func TestShouldHandlePing(t *testing.T) {
 		})
 	}
 }
+
+func TestAnswerViaNeighborSolicits(t *testing.T) {
+	var adverts [][]byte
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.AnswerViaNeighborSolicits = true
+		impl.neighborAdvertFunc = func(pkt []byte) { adverts = append(adverts, pkt) }
+		// The 4via6 route 10.1.1.0/24 in site 7.
+		via := netip.MustParsePrefix("fd7a:115c:a1e0:b1a:0:7:a01:100/120")
+		impl.viaIPFunc = via.Contains
+	})
+	src := netip.MustParseAddr("fe80::1")
+	solicit := func(src, target netip.Addr) *packet.Parsed {
+		b := make([]byte, header.IPv6MinimumSize+header.ICMPv6NeighborSolicitMinimumSize)
+		dst := tcpip.Address(header.SolicitedNodeAddr(tcpip.Address(target.AsSlice())))
+		header.IPv6(b).Encode(&header.IPv6Fields{
+			PayloadLength:     header.ICMPv6NeighborSolicitMinimumSize,
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          header.NDPHopLimit,
+			SrcAddr:           tcpip.Address(src.AsSlice()),
+			DstAddr:           dst,
+		})
+		icmp := header.ICMPv6(b[header.IPv6MinimumSize:])
+		icmp.SetType(header.ICMPv6NeighborSolicit)
+		header.NDPNeighborSolicit(icmp.MessageBody()).SetTargetAddress(tcpip.Address(target.AsSlice()))
+		icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: icmp, Src: tcpip.Address(src.AsSlice()), Dst: dst}))
+		p := &packet.Parsed{}
+		p.Decode(b)
+		return p
+	}
+
+	for _, target := range []netip.Addr{
+		netip.MustParseAddr("fd7a:115c:a1e0:b1a:0:8:a01:109"), // another site
+		netip.MustParseAddr("fd7a:115c:a1e0::1"),              // not 4via6
+	} {
+		if ns.handleViaNeighborSolicit(solicit(src, target)) {
+			t.Errorf("answered solicitation for %v", target)
+		}
+	}
+	if len(adverts) != 0 {
+		t.Fatalf("got %d advertisements; want none", len(adverts))
+	}
+
+	target := netip.MustParseAddr("fd7a:115c:a1e0:b1a:0:7:a01:109")
+	if resp := ns.injectInbound(solicit(src, target), nil); resp != filter.DropSilently {
+		t.Errorf("injectInbound = %v; want DropSilently", resp)
+	}
+	if len(adverts) != 1 {
+		t.Fatalf("got %d advertisements; want 1", len(adverts))
+	}
+	ip := header.IPv6(adverts[0])
+	na := header.ICMPv6(ip.Payload())
+	body := header.NDPNeighborAdvert(na.MessageBody())
+	if got := netip.AddrFrom16(*(*[16]byte)([]byte(ip.SourceAddress()))); got != target {
+		t.Errorf("advertisement from %v; want %v", got, target)
+	}
+	if got := netip.AddrFrom16(*(*[16]byte)([]byte(ip.DestinationAddress()))); got != src {
+		t.Errorf("advertisement to %v; want %v", got, src)
+	}
+	if na.Type() != header.ICMPv6NeighborAdvert || !body.SolicitedFlag() || body.TargetAddress() != tcpip.Address(target.AsSlice()) {
+		t.Errorf("advertisement type %v, solicited %v, target %v; want solicited NA for %v", na.Type(), body.SolicitedFlag(), body.TargetAddress(), target)
+	}
+	if got := header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: na, Src: ip.SourceAddress(), Dst: ip.DestinationAddress()}); got != na.Checksum() {
+		t.Errorf("checksum = %#x; want %#x", na.Checksum(), got)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	tick := make(chan time.Time)
+	logs := make(chan string, 10)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.HeartbeatInterval = time.Hour
+		impl.heartbeatTick = tick
+		impl.logf = func(format string, args ...any) {
+			select {
+			case logs <- fmt.Sprintf(format, args...):
+			default:
+			}
+		}
+	})
+	ns.bytesForwarded.Add(100)
+	ns.packetsDropped.Add(2)
+
+	tick <- time.Now()
+	waitForLog := func(want string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case l := <-logs:
+				if strings.Contains(l, "heartbeat") {
+					if !strings.Contains(l, want) {
+						t.Fatalf("heartbeat log %q does not contain %q", l, want)
+					}
+					return
+				}
+			case <-timeout:
+				t.Fatal("timeout waiting for heartbeat")
+			}
+		}
+	}
+	waitForLog("bytes_forwarded=100 dropped=2")
+
+	// Counters are reported relative to the previous heartbeat.
+	ns.bytesForwarded.Add(5)
+	tick <- time.Now()
+	waitForLog("bytes_forwarded=5 dropped=0")
+
+	ns.Close()
+	select {
+	case <-ns.heartbeatDone:
+	default:
+		t.Fatal("heartbeat goroutine still running after Close")
+	}
+}
+
+func TestDialBackendTCPRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	errRefused := errors.New("connection refused")
+	var attempts int
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.backendDialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			attempts++
+			if attempts == 1 {
+				return nil, errRefused
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+	})
+
+	t.Run("no-retries", func(t *testing.T) {
+		attempts = 0
+		ns.BackendDialRetries = 0
+		_, err := ns.dialBackendTCP(context.Background(), ln.Addr().(*net.TCPAddr).AddrPort())
+		if err != errRefused {
+			t.Fatalf("got err %v; want %v", err, errRefused)
+		}
+		if attempts != 1 {
+			t.Errorf("got %d attempts; want 1", attempts)
+		}
+	})
+
+	t.Run("retry-succeeds", func(t *testing.T) {
+		attempts = 0
+		ns.BackendDialRetries = 2
+		c, err := ns.dialBackendTCP(context.Background(), ln.Addr().(*net.TCPAddr).AddrPort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if attempts != 2 {
+			t.Errorf("got %d attempts; want 2", attempts)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		attempts = 0
+		ns.BackendDialRetries = 2
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := ns.dialBackendTCP(ctx, ln.Addr().(*net.TCPAddr).AddrPort()); err == nil {
+			t.Fatal("unexpected success with canceled context")
+		}
+		if attempts != 1 {
+			t.Errorf("got %d attempts; want 1", attempts)
+		}
+	})
+}
+
+func TestSubnetPingRate(t *testing.T) {
+	const limit = 5
+	var relayed atomic.Int32
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessSubnets = true
+		impl.SubnetPingRate = limit
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+		impl.userPingFunc = func(netip.Addr, []byte) { relayed.Add(1) }
+	})
+
+	const N = 100
+	for i := 0; i < N; i++ {
+		icmph := packet.ICMP4Header{
+			IP4Header: packet.IP4Header{
+				IPProto: ipproto.ICMPv4,
+				Src:     netip.MustParseAddr("100.64.1.1"),
+				Dst:     netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}),
+			},
+			Type: packet.ICMP4EchoRequest,
+			Code: packet.ICMP4NoCode,
+		}
+		_, payload := packet.ICMPEchoPayload(nil)
+		pkt := &packet.Parsed{}
+		pkt.Decode(packet.Generate(icmph, payload))
+		if got := ns.injectInbound(pkt, nil); got != filter.DropSilently {
+			t.Fatalf("injectInbound = %v; want DropSilently", got)
+		}
+	}
+
+	limited := ns.pingsRateLimited.Load()
+	if limited < N-limit-1 {
+		t.Errorf("rate limited %d pings; want at least %d", limited, N-limit-1)
+	}
+	// userPingFunc runs in its own goroutine; wait for the
+	// allowed pings to be relayed.
+	want := int32(N - limited)
+	for deadline := time.Now().Add(5 * time.Second); relayed.Load() < want && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got := relayed.Load(); got != want {
+		t.Errorf("relayed %d pings; want %d", got, want)
+	}
+}
+
+func TestGoroutineStats(t *testing.T) {
+	waitFor := func(desc string, cond func(GoroutineCounts) bool, ns *Impl) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if cond(ns.GoroutineStats()) {
+				return
+			}
+		}
+		t.Fatalf("timeout waiting for %s; stats = %+v", desc, ns.GoroutineStats())
+	}
+
+	unblockPing := make(chan bool)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessSubnets = true
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+		impl.userPingFunc = func(netip.Addr, []byte) { <-unblockPing }
+	})
+	waitFor("inject goroutine", func(gc GoroutineCounts) bool { return gc.Inject == 1 }, ns)
+	base := ns.GoroutineStats()
+
+	// A relayed ping.
+	icmph := packet.ICMP4Header{
+		IP4Header: packet.IP4Header{
+			IPProto: ipproto.ICMPv4,
+			Src:     netip.MustParseAddr("100.64.1.1"),
+			Dst:     netip.MustParseAddr("10.0.0.1"),
+		},
+		Type: packet.ICMP4EchoRequest,
+		Code: packet.ICMP4NoCode,
+	}
+	_, payload := packet.ICMPEchoPayload(nil)
+	pkt := &packet.Parsed{}
+	pkt.Decode(packet.Generate(icmph, payload))
+	ns.injectInbound(pkt, nil)
+	waitFor("ping goroutine", func(gc GoroutineCounts) bool { return gc.Ping == base.Ping+1 }, ns)
+	close(unblockPing)
+	waitFor("ping goroutine exit", func(gc GoroutineCounts) bool { return gc == base }, ns)
+
+	// A UDP packet copy.
+	src, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	ns.startPacketCopy(ctx, cancel, DirToServer, dst, dst.LocalAddr(), src, netip.AddrPort{}, nil, func(int) {}, func(error, bool) {})
+	waitFor("copy goroutine", func(gc GoroutineCounts) bool { return gc.Copy == base.Copy+1 }, ns)
+	cancel()
+	src.Close()
+	waitFor("copy goroutine exit", func(gc GoroutineCounts) bool { return gc == base }, ns)
+
+	ns.Close()
+	waitFor("inject goroutine exit", func(gc GoroutineCounts) bool { return gc.Inject == 0 }, ns)
+}
+
+// udpPair returns a UDP socket and a second socket connected to it, as
+// handleMagicDNSUDP expects its conn to be.
+func udpPair(t *testing.T) (client, server *net.UDPConn) {
+	t.Helper()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err = net.DialUDP("udp", nil, client.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+func TestMaxDNSQueriesPerConn(t *testing.T) {
+	const max = 3
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.MaxDNSQueriesPerConn = max
+	})
+
+	client, server := udpPair(t)
+	for i := 0; i < max+2; i++ {
+		// Not a valid DNS query, but it still gets a (FORMERR) response.
+		if _, err := client.WriteTo([]byte("query"), server.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		ns.handleMagicDNSUDP(client.LocalAddr().(*net.UDPAddr).AddrPort(), server)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleMagicDNSUDP didn't return")
+	}
+
+	var responses int
+	buf := make([]byte, 1500)
+	for {
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, _, err := client.ReadFrom(buf); err != nil {
+			break
+		}
+		responses++
+	}
+	if responses != max {
+		t.Errorf("got %d responses; want %d", responses, max)
+	}
+}
+
+func TestMagicDNSUDPClose(t *testing.T) {
+	started := make(chan bool, 1)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.DNSTransport = func(ctx context.Context, query []byte) ([]byte, error) {
+			started <- true
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+	})
+
+	client, server := udpPair(t)
+	if _, err := client.WriteTo([]byte("query"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		ns.handleMagicDNSUDP(client.LocalAddr().(*net.UDPAddr).AddrPort(), server)
+		close(done)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("query not started")
+	}
+	ns.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handleMagicDNSUDP didn't return after Close")
+	}
+}
+
+func TestOnDNSQuery(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	timings := make(chan DNSQueryTiming, 1)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.DNSTransport = func(ctx context.Context, query []byte) ([]byte, error) {
+			time.Sleep(delay)
+			return []byte("response"), nil
+		}
+		impl.OnDNSQuery = func(qt DNSQueryTiming) { timings <- qt }
+	})
+
+	client, server := udpPair(t)
+	if _, err := client.WriteTo([]byte("query"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	src := client.LocalAddr().(*net.UDPAddr).AddrPort()
+	go ns.handleMagicDNSUDP(src, server)
+	select {
+	case qt := <-timings:
+		if qt.Proto != ipproto.UDP || qt.Src != src || qt.Err != nil {
+			t.Errorf("timing = %+v; want successful UDP query from %v", qt, src)
+		}
+		if qt.Query < delay {
+			t.Errorf("Query = %v; want at least %v", qt.Query, delay)
+		}
+		if qt.Total < qt.Query+qt.Write {
+			t.Errorf("Total = %v; want at least Query+Write = %v", qt.Total, qt.Query+qt.Write)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnDNSQuery not called")
+	}
+
+	resp, err := ns.timedDNSQuery()(context.Background(), []byte("query"), src)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("TCP query = %q, %v", resp, err)
+	}
+	if qt := <-timings; qt.Proto != ipproto.TCP || qt.Query < delay || qt.Total != qt.Query {
+		t.Errorf("TCP timing = %+v; want Query = Total >= %v", qt, delay)
+	}
+}
+
+func TestDialContextUDPCanceled(t *testing.T) {
+	ns := makeNetstack(t, func(*Impl) {})
+	addLocalIP(t, ns, netip.MustParseAddr("100.64.0.1")) // so dials can succeed
+	dst := netip.MustParseAddrPort("100.64.0.2:53")
+
+	c, err := ns.DialContextUDP(context.Background(), dst)
+	if err != nil {
+		t.Fatalf("DialContextUDP: %v", err)
+	}
+	c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if c, err := ns.DialContextUDP(ctx, dst); err != context.Canceled {
+		if c != nil {
+			c.Close()
+		}
+		t.Errorf("DialContextUDP with canceled context = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestDialAllowed(t *testing.T) {
+	allowed := netip.MustParseAddrPort("100.64.0.1:53")
+	denied := netip.MustParseAddrPort("100.64.0.2:53")
+	var gotNetworks []string
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.DialAllowed = func(network string, dst netip.AddrPort) bool {
+			gotNetworks = append(gotNetworks, network)
+			return dst == allowed
+		}
+	})
+
+	if _, err := ns.DialContextTCP(context.Background(), denied); !errors.Is(err, ErrDialNotAllowed) {
+		t.Errorf("DialContextTCP(%v) = %v; want ErrDialNotAllowed", denied, err)
+	}
+	if _, err := ns.DialContextUDP(context.Background(), denied); !errors.Is(err, ErrDialNotAllowed) {
+		t.Errorf("DialContextUDP(%v) = %v; want ErrDialNotAllowed", denied, err)
+	}
+
+	// The stack has no addresses, so the allowed dials fail too, but
+	// not because DialAllowed rejected them.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := ns.DialContextUDP(ctx, allowed); errors.Is(err, ErrDialNotAllowed) {
+		t.Errorf("DialContextUDP(%v) = %v; want it to be allowed", allowed, err)
+	}
+	if _, err := ns.DialContextTCP(ctx, allowed); errors.Is(err, ErrDialNotAllowed) {
+		t.Errorf("DialContextTCP(%v) = %v; want it to be allowed", allowed, err)
+	}
+
+	want := []string{"tcp", "udp", "udp", "tcp"}
+	if fmt.Sprint(gotNetworks) != fmt.Sprint(want) {
+		t.Errorf("DialAllowed called with networks %v; want %v", gotNetworks, want)
+	}
+}
+
+func TestMemStats(t *testing.T) {
+	ns := makeNetstack(t, func(*Impl) {})
+	base := ns.MemStats()
+
+	ip := netip.MustParseAddr("10.0.0.1")
+	ns.addSubnetAddress(ip)
+	c, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(ip.AsSlice()),
+		Port: 5000,
+	}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ns.MemStats()
+	if got.Endpoints != base.Endpoints+1 {
+		t.Errorf("Endpoints = %d with open conn; want %d", got.Endpoints, base.Endpoints+1)
+	}
+	if got.Addresses != base.Addresses+1 {
+		t.Errorf("Addresses = %d; want %d", got.Addresses, base.Addresses+1)
+	}
+	if got.SubnetIPs != base.SubnetIPs+1 {
+		t.Errorf("SubnetIPs = %d; want %d", got.SubnetIPs, base.SubnetIPs+1)
+	}
+
+	c.Close()
+	ns.removeSubnetAddress(ip)
+	if got := ns.MemStats(); got != base {
+		t.Errorf("MemStats after close = %+v; want %+v", got, base)
+	}
+}
+
+func TestHandleLinkLocalIPv6(t *testing.T) {
+	udph := packet.UDP6Header{
+		IP6Header: packet.IP6Header{
+			IPProto: ipproto.UDP,
+			Src:     netip.MustParseAddr("fd7a:115c:a1e0::1"),
+			Dst:     netip.MustParseAddr("fe80::1"),
+		},
+		SrcPort: 5353,
+		DstPort: 5353,
+	}
+	pkt := &packet.Parsed{}
+	pkt.Decode(packet.Generate(udph, []byte("hello")))
+
+	for _, handle := range []bool{false, true} {
+		t.Run(fmt.Sprint(handle), func(t *testing.T) {
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.ProcessSubnets = true
+				impl.HandleLinkLocalIPv6 = handle
+				impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+			})
+			want := filter.Accept
+			if handle {
+				want = filter.DropSilently
+			}
+			if got := ns.injectInbound(pkt, nil); got != want {
+				t.Errorf("injectInbound = %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (c1, c2 *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c1v, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2v, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c1v.Close()
+		c2v.Close()
+	})
+	return c1v.(*net.TCPConn), c2v.(*net.TCPConn)
+}
+
+func TestBackendTeardownGrace(t *testing.T) {
+	for _, grace := range []time.Duration{0, 5 * time.Second} {
+		t.Run(grace.String(), func(t *testing.T) {
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.BackendTeardownGrace = grace
+			})
+			peer, client := tcpPair(t)
+			server, backend := tcpPair(t)
+
+			proxyDone := make(chan error, 1)
+			go func() {
+				_, err := ns.proxyTCP(client, server, nil)
+				client.Close()
+				server.Close()
+				proxyDone <- err
+			}()
+
+			// The peer sends its request and half-closes. The
+			// backend only responds once it's seen the whole
+			// request.
+			io.WriteString(peer, "request")
+			peer.CloseWrite()
+			go func() {
+				io.ReadAll(backend)
+				time.Sleep(50 * time.Millisecond)
+				io.WriteString(backend, "response")
+				backend.Close()
+			}()
+
+			got, _ := io.ReadAll(peer)
+			if err := <-proxyDone; err != nil {
+				t.Fatalf("proxyTCP: %v", err)
+			}
+			want := "response"
+			if grace == 0 {
+				// Torn down as soon as the peer finished sending.
+				want = ""
+			}
+			if string(got) != want {
+				t.Errorf("peer got %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestOnConnEvent(t *testing.T) {
+	events := make(chan ConnEvent, 2)
+	localIP := netip.MustParseAddr("100.64.0.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.BackendTeardownGrace = 5 * time.Second
+		impl.udpIdleTimeout = 50 * time.Millisecond
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.OnConnEvent = func(ev ConnEvent) { events <- ev }
+	})
+	src := netip.MustParseAddrPort("100.64.0.2:1234")
+	check := func(proto ipproto.Proto, dst netip.AddrPort, toServer, toClient int64) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Proto != proto || ev.Src != src || ev.Dst != dst {
+				t.Errorf("event for %v %v -> %v; want %v %v -> %v", ev.Proto, ev.Src, ev.Dst, proto, src, dst)
+			}
+			if ev.BytesToServer != toServer || ev.BytesToClient != toClient {
+				t.Errorf("%v bytes to server, client = %d, %d; want %d, %d", proto, ev.BytesToServer, ev.BytesToClient, toServer, toClient)
+			}
+			if ev.Start.IsZero() || ev.End.Before(ev.Start) {
+				t.Errorf("%v event Start, End = %v, %v", proto, ev.Start, ev.End)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %v event", proto)
+		}
+	}
+
+	// TCP, via proxyTCP as forwardTCP uses it.
+	tcpDst := netip.AddrPortFrom(localIP, 80)
+	peer, client := tcpPair(t)
+	server, backend := tcpPair(t)
+	go func() {
+		io.ReadAll(backend)
+		io.WriteString(backend, "response!")
+		backend.Close()
+	}()
+	io.WriteString(peer, "request")
+	peer.CloseWrite()
+	ac := ns.registerConn(ConnInfo{Proto: ipproto.TCP, Src: src, Dst: tcpDst, Start: time.Now()}, nil)
+	if _, err := ns.proxyTCP(client, server, ac); err != nil {
+		t.Fatalf("proxyTCP: %v", err)
+	}
+	ns.unregisterConn(ac)
+	check(ipproto.TCP, tcpDst, int64(len("request")), int64(len("response!")))
+
+	// UDP, through forwardUDP to an echo server on loopback.
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	udpDst := netip.AddrPortFrom(localIP, uint16(echo.LocalAddr().(*net.UDPAddr).Port))
+	addLocalIP(t, ns, localIP)
+	p := &packet.Parsed{}
+	p.Decode(packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{Src: src.Addr(), Dst: udpDst.Addr()},
+		SrcPort:   src.Port(),
+		DstPort:   udpDst.Port(),
+	}, []byte("hello")))
+	ns.injectInbound(p, nil)
+	check(ipproto.UDP, udpDst, 5, 5)
+}
+
+func TestMirrorTo(t *testing.T) {
+	type chunk struct {
+		dir Direction
+		b   string
+	}
+	chunks := make(chan chunk, 100)
+	localIP := netip.MustParseAddr("100.64.0.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.BackendTeardownGrace = 5 * time.Second
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.MirrorTo = func(dir Direction, b []byte) { chunks <- chunk{dir, string(b)} }
+	})
+	// wantMirrored checks that what's mirrored next is toServer and
+	// toClient, in chunks of any size.
+	wantMirrored := func(proto, toServer, toClient string) {
+		t.Helper()
+		var got [2]string
+		for got[DirToServer] != toServer || got[DirToClient] != toClient {
+			select {
+			case c := <-chunks:
+				got[c.dir] += c.b
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s mirrored %q to server, %q to client; want %q, %q", proto, got[DirToServer], got[DirToClient], toServer, toClient)
+			}
+		}
+	}
+
+	// TCP, via proxyTCP as forwardTCP uses it.
+	peer, client := tcpPair(t)
+	server, backend := tcpPair(t)
+	go func() {
+		io.ReadAll(backend)
+		io.WriteString(backend, "response!")
+		backend.Close()
+	}()
+	io.WriteString(peer, "request")
+	peer.CloseWrite()
+	if _, err := ns.proxyTCP(client, server, nil); err != nil {
+		t.Fatalf("proxyTCP: %v", err)
+	}
+	wantMirrored("TCP", "request", "response!")
+
+	// UDP, through forwardUDP to an echo server on loopback.
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	addLocalIP(t, ns, localIP)
+	p := &packet.Parsed{}
+	p.Decode(packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{Src: netip.MustParseAddr("100.64.0.2"), Dst: localIP},
+		SrcPort:   1234,
+		DstPort:   uint16(echo.LocalAddr().(*net.UDPAddr).Port),
+	}, []byte("hello")))
+	ns.injectInbound(p, nil)
+	wantMirrored("UDP", "hello", "hello")
+
+	if n := ns.Stats().MirrorDrops; n != 0 {
+		t.Errorf("MirrorDrops = %d; want 0", n)
+	}
+}
+
+func TestForwardUDPLogsClassification(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	tests := []struct {
+		name string
+		dst  netip.AddrPort
+		want string
+	}{
+		{"local", netip.AddrPortFrom(localIP, 5301), "is local; forwarding to 127.0.0.1:5301"},
+		{"subnet", netip.MustParseAddrPort("192.0.2.1:5302"), "is subnet; forwarding to 192.0.2.1:5302"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := make(chan string, 100)
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+				impl.logf = func(format string, args ...any) {
+					select {
+					case logs <- fmt.Sprintf(format, args...):
+					default:
+					}
+				}
+			})
+
+			ns.addSubnetAddress(tt.dst.Addr())
+			var wq waiter.Queue
+			client, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+				NIC:  nicID,
+				Addr: tcpip.Address(tt.dst.Addr().AsSlice()),
+				Port: tt.dst.Port(),
+			}, nil, ipv4.ProtocolNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan bool)
+			go func() {
+				ns.forwardUDP(client, &wq, netip.MustParseAddrPort("100.64.0.2:0"), tt.dst)
+				close(done)
+			}()
+
+			timeout := time.After(5 * time.Second)
+			for found := false; !found; {
+				select {
+				case l := <-logs:
+					found = strings.Contains(l, tt.want)
+				case <-timeout:
+					t.Fatalf("timeout waiting for log containing %q", tt.want)
+				}
+			}
+			client.Close()
+			<-done
+		})
+	}
+}
+
+// tcpSegment returns a minimal TCP header with the given ports and flags.
+func tcpSegment(srcPort, dstPort uint16, flags packet.TCPFlag) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b[0:2], srcPort)
+	binary.BigEndian.PutUint16(b[2:4], dstPort)
+	b[12] = 5 << 4 // data offset, in 32-bit words
+	b[13] = byte(flags)
+	return b
+}
+
+// tcpSYN4 returns an IPv4 TCP SYN packet from src to dst with a valid
+// checksum, so netstack will accept it.
+func tcpSYN4(src, dst netip.AddrPort) []byte {
+	b := packet.Generate(packet.IP4Header{
+		IPProto: ipproto.TCP,
+		Src:     src.Addr(),
+		Dst:     dst.Addr(),
+	}, tcpSegment(src.Port(), dst.Port(), packet.TCPSyn))
+	tcp := header.TCP(b[header.IPv4MinimumSize:])
+	tcp.SetWindowSize(65535)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber,
+		tcpip.Address(src.Addr().AsSlice()), tcpip.Address(dst.Addr().AsSlice()), uint16(len(tcp)))
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum))
+	return b
+}
+
+// tcpSYNWithMSS returns an IPv4 or IPv6 TCP SYN packet from src to dst
+// with a valid checksum and, if mss is non-zero, an MSS option.
+func tcpSYNWithMSS(src, dst netip.AddrPort, mss uint16) []byte {
+	var opts []byte
+	if mss != 0 {
+		// NOPs first, to check they're skipped.
+		opts = []byte{header.TCPOptionNOP, header.TCPOptionNOP, 0, 0, 0, 0, header.TCPOptionNOP, header.TCPOptionNOP}
+		header.EncodeMSSOption(uint32(mss), opts[2:])
+	}
+	seg := make(header.TCP, header.TCPMinimumSize+len(opts))
+	seg.Encode(&header.TCPFields{
+		SrcPort:    src.Port(),
+		DstPort:    dst.Port(),
+		DataOffset: uint8(len(seg)),
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	copy(seg[header.TCPMinimumSize:], opts)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber,
+		tcpip.Address(src.Addr().AsSlice()), tcpip.Address(dst.Addr().AsSlice()), uint16(len(seg)))
+	seg.SetChecksum(^seg.CalculateChecksum(xsum))
+	if src.Addr().Is4() {
+		return packet.Generate(packet.IP4Header{IPProto: ipproto.TCP, Src: src.Addr(), Dst: dst.Addr()}, seg)
+	}
+	return packet.Generate(packet.IP6Header{IPProto: ipproto.TCP, Src: src.Addr(), Dst: dst.Addr()}, seg)
+}
+
+func TestClampSYNMSS(t *testing.T) {
+	tests := []struct {
+		src, dst    string
+		mss         uint16
+		wantChanged bool
+		wantMSS     uint16
+	}{
+		{"100.64.0.2:1234", "10.0.0.1:22", 1460, true, 1200},
+		{"[fd7a:115c:a1e0::2]:1234", "[2001:db8::1]:22", 1440, true, 1200},
+		{"100.64.0.2:1234", "10.0.0.1:22", 1100, false, 1100},
+		{"100.64.0.2:1234", "10.0.0.1:22", 0, false, 536}, // no option
+	}
+	for _, tt := range tests {
+		src, dst := netip.MustParseAddrPort(tt.src), netip.MustParseAddrPort(tt.dst)
+		b := tcpSYNWithMSS(src, dst, tt.mss)
+		if changed := clampSYNMSS(b, 1200); changed != tt.wantChanged {
+			t.Errorf("%v with MSS %d: changed = %v; want %v", dst, tt.mss, changed, tt.wantChanged)
+		}
+		var p packet.Parsed
+		p.Decode(b)
+		seg := header.TCP(p.Transport())
+		if got := header.ParseSynOptions(seg.Options(), false).MSS; got != tt.wantMSS {
+			t.Errorf("%v with MSS %d: got MSS %d; want %d", dst, tt.mss, got, tt.wantMSS)
+		}
+		if !seg.IsChecksumValid(tcpip.Address(src.Addr().AsSlice()), tcpip.Address(dst.Addr().AsSlice()), 0, 0) {
+			t.Errorf("%v with MSS %d: bad checksum after clamping", dst, tt.mss)
+		}
+	}
+}
+
+// inboundTestPackets returns a variety of inbound packets for testing
+// shouldProcessInbound.
+func inboundTestPackets() []*packet.Parsed {
+	var pkts []*packet.Parsed
+	add := func(b []byte) {
+		p := new(packet.Parsed)
+		p.Decode(b)
+		pkts = append(pkts, p)
+	}
+	src4 := netip.MustParseAddr("100.64.0.2")
+	src6 := netip.MustParseAddr("fd7a:115c:a1e0::2")
+	for _, dst := range []string{"100.64.0.1", "10.0.0.1", "fd7a:115c:a1e0::1", "2001:db8::1", "fe80::1", "fd7a:115c:a1e0:b1a:0:7:a01:109"} {
+		dst := netip.MustParseAddr(dst)
+		for _, port := range []uint16{22, 80, 5353} {
+			if dst.Is4() {
+				add(packet.Generate(packet.UDP4Header{
+					IP4Header: packet.IP4Header{Src: src4, Dst: dst},
+					SrcPort:   1234,
+					DstPort:   port,
+				}, nil))
+				for _, flags := range []packet.TCPFlag{packet.TCPSyn, packet.TCPAck} {
+					add(packet.Generate(packet.IP4Header{IPProto: ipproto.TCP, Src: src4, Dst: dst}, tcpSegment(1234, port, flags)))
+				}
+			} else {
+				add(packet.Generate(packet.UDP6Header{
+					IP6Header: packet.IP6Header{Src: src6, Dst: dst},
+					SrcPort:   1234,
+					DstPort:   port,
+				}, nil))
+				for _, flags := range []packet.TCPFlag{packet.TCPSyn, packet.TCPAck} {
+					add(packet.Generate(packet.IP6Header{IPProto: ipproto.TCP, Src: src6, Dst: dst}, tcpSegment(1234, port, flags)))
+				}
+			}
+		}
+	}
+	return pkts
+}
+
+// setTestLocalBackend sets ns.lb to a new LocalBackend, so that the
+// peerapi, SSH and 4via6 checks in shouldProcessInbound are exercised.
+func setTestLocalBackend(t testing.TB, ns *Impl) {
+	lb, err := ipnlocal.NewLocalBackend(t.Logf, "logid", new(mem.Store), nil, ns.e, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lb.Shutdown)
+	ns.lb.Store(lb)
+}
+
+func TestFastRejectInboundConsistent(t *testing.T) {
+	localIPs := map[netip.Addr]bool{
+		netip.MustParseAddr("100.64.0.1"):        true,
+		netip.MustParseAddr("fd7a:115c:a1e0::1"): true,
+	}
+	pkts := inboundTestPackets()
+	for _, localIPs_ := range []bool{false, true} {
+		for _, subnets := range []bool{false, true} {
+			for _, linkLocal := range []bool{false, true} {
+				name := fmt.Sprintf("local=%v/subnets=%v/linklocal=%v", localIPs_, subnets, linkLocal)
+				t.Run(name, func(t *testing.T) {
+					ns := makeNetstack(t, func(impl *Impl) {
+						impl.ProcessLocalIPs = localIPs_
+						impl.ProcessSubnets = subnets
+						impl.HandleLinkLocalIPv6 = linkLocal
+						impl.FastInboundReject = true
+						impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return localIPs[ip] })
+						setTestLocalBackend(t, impl)
+					})
+					for _, p := range pkts {
+						if !ns.fastRejectInbound(p) {
+							continue
+						}
+						ns.FastInboundReject = false
+						slow := ns.shouldProcessInbound(p, nil)
+						ns.FastInboundReject = true
+						if slow {
+							t.Errorf("fast path rejected %v (proto %v), but slow path accepts it", p, p.IPProto)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestFastRejectInboundLatePeerAPI(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.FastInboundReject = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		setTestLocalBackend(t, impl)
+	})
+	const peerAPIPort = 41641 // not known when the port set was built
+	tcp := func(flags packet.TCPFlag) *packet.Parsed {
+		p := new(packet.Parsed)
+		p.Decode(packet.Generate(packet.IP4Header{
+			IPProto: ipproto.TCP,
+			Src:     netip.MustParseAddr("100.64.0.2"),
+			Dst:     localIP,
+		}, tcpSegment(1234, peerAPIPort, flags)))
+		return p
+	}
+
+	// A SYN to a local IP gets the full check, in case the port is a
+	// peerapi listener started since the last netmap.
+	if ns.fastRejectInbound(tcp(packet.TCPSyn)) {
+		t.Error("fast path rejected SYN to a local IP")
+	}
+	if !ns.fastRejectInbound(tcp(packet.TCPAck)) {
+		t.Error("fast path didn't reject ACK to an unknown port")
+	}
+	// Once the full check has seen the peerapi port, the connection's
+	// other packets aren't rejected either.
+	atomic.StoreUint32(&ns.peerapiPort4Atomic, peerAPIPort)
+	if ns.fastRejectInbound(tcp(packet.TCPAck)) {
+		t.Error("fast path rejected ACK to the peerapi port")
+	}
+}
+
+func TestPortSet(t *testing.T) {
+	var s portSet
+	for _, port := range []uint16{0, 22, 63, 64, 65535} {
+		if s.contains(port) {
+			t.Errorf("empty set contains %d", port)
+		}
+		s.add(port)
+		if !s.contains(port) {
+			t.Errorf("set doesn't contain %d after add", port)
+		}
+	}
+	if s.contains(23) || s.contains(65534) {
+		t.Errorf("set contains ports that weren't added")
+	}
+}
+
+func BenchmarkShouldProcessInbound(b *testing.B) {
+	for _, fast := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fast=%v", fast), func(b *testing.B) {
+			ns := makeNetstack(b, func(impl *Impl) {
+				impl.FastInboundReject = fast
+				setTestLocalBackend(b, impl)
+			})
+			pkt := new(packet.Parsed)
+			pkt.Decode(packet.Generate(packet.IP4Header{
+				IPProto: ipproto.TCP,
+				Src:     netip.MustParseAddr("100.64.0.2"),
+				Dst:     netip.MustParseAddr("100.64.0.1"),
+			}, tcpSegment(1234, 443, packet.TCPSyn)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if ns.shouldProcessInbound(pkt, nil) {
+					b.Fatal("unexpectedly processing packet")
+				}
+			}
+		})
+	}
+}
+
+func TestUseDialerForSubnets(t *testing.T) {
+	var dialed []netip.AddrPort
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.UseDialerForSubnets = true
+		impl.dialer.UseNetstackForIP = func(netip.Addr) bool { return true }
+		impl.dialer.NetstackDialTCP = func(_ context.Context, ipp netip.AddrPort) (net.Conn, error) {
+			dialed = append(dialed, ipp)
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		}
+	})
+
+	subnetAddr := netip.MustParseAddrPort("192.0.2.1:80")
+	c, err := ns.dialBackendTCP(context.Background(), subnetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(dialed) != 1 || dialed[0] != subnetAddr {
+		t.Errorf("dialer dialed %v; want [%v]", dialed, subnetAddr)
+	}
+
+	// Loopback backends don't go through the dialer.
+	dialed = nil
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err = ns.dialBackendTCP(context.Background(), ln.Addr().(*net.TCPAddr).AddrPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(dialed) != 0 {
+		t.Errorf("dialer dialed %v for loopback backend; want none", dialed)
+	}
+}
+
+// dnsQuery returns a DNS query message for name with type typ.
+func dnsQuery(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+	b.StartQuestions()
+	if err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  typ,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestMagicDNSUDPTruncation(t *testing.T) {
+	// A response with 50 A records, well over 512 bytes.
+	bigResponse := func(q []byte) []byte {
+		var p dnsmessage.Parser
+		h, err := p.Start(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		question, err := p.Question()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Response = true
+		b := dnsmessage.NewBuilder(nil, h)
+		b.StartQuestions()
+		b.Question(question)
+		b.StartAnswers()
+		for i := 0; i < 50; i++ {
+			b.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60},
+				dnsmessage.AResource{A: [4]byte{100, 64, 0, byte(i)}})
+		}
+		resp, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.DNSTransport = func(_ context.Context, q []byte) ([]byte, error) {
+			return bigResponse(q), nil
+		}
+	})
+	// ednsQuery returns a query advertising a UDP payload size of size.
+	ednsQuery := func(size uint16) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("big.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+		b.StartAdditionals()
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(int(size), 0, false); err != nil {
+			t.Fatal(err)
+		}
+		b.OPTResource(opt, dnsmessage.OPTResource{})
+		q, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+
+	for _, tt := range []struct {
+		name        string
+		query       []byte
+		wantTrunc   bool
+		wantAnswers int
+	}{
+		{"no-edns", dnsQuery(t, "big.example.com.", dnsmessage.TypeA), true, 0},
+		{"edns-512", ednsQuery(512), true, 0},
+		{"edns-4096", ednsQuery(4096), false, 50},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := udpPair(t)
+			if _, err := client.WriteTo(tt.query, server.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			go ns.handleMagicDNSUDP(client.LocalAddr().(*net.UDPAddr).AddrPort(), server)
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 4096)
+			n, _, err := client.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Truncated != tt.wantTrunc || len(msg.Answers) != tt.wantAnswers {
+				t.Errorf("got %d-byte response with TC=%v and %d answers; want TC=%v and %d answers", n, msg.Truncated, len(msg.Answers), tt.wantTrunc, tt.wantAnswers)
+			}
+			if tt.wantTrunc && (len(msg.Questions) != 1 || n > minDNSUDPSize) {
+				t.Errorf("truncated response = %d bytes with questions %v; want the question in at most %d bytes", n, msg.Questions, minDNSUDPSize)
+			}
+		})
+	}
+}
+
+func TestDNSPreHandler(t *testing.T) {
+	const typeHTTPS = dnsmessage.Type(65) // not in our version of dnsmessage
+	handledResp := []byte("handled by pre-handler")
+	client, server := udpPair(t)
+	src := client.LocalAddr().(*net.UDPAddr).AddrPort()
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.DNSPreHandler = func(q []byte, from netip.AddrPort) ([]byte, bool) {
+			if from != src {
+				t.Errorf("pre-handler got src %v; want %v", from, src)
+			}
+			var p dnsmessage.Parser
+			if _, err := p.Start(q); err != nil {
+				return nil, false
+			}
+			if qq, err := p.Question(); err != nil || qq.Type != typeHTTPS {
+				return nil, false
+			}
+			return handledResp, true
+		}
+	})
+
+	queries := [][]byte{
+		dnsQuery(t, "example.com.", typeHTTPS),
+		[]byte("not a DNS query"), // passed through to the DNS manager
+	}
+	for _, q := range queries {
+		if _, err := client.WriteTo(q, server.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go ns.handleMagicDNSUDP(src, server)
+
+	buf := make([]byte, 1500)
+	var resps []string
+	for range queries {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resps = append(resps, string(buf[:n]))
+	}
+	if resps[0] != string(handledResp) {
+		t.Errorf("HTTPS query got response %q; want %q", resps[0], handledResp)
+	}
+	if resps[1] == string(handledResp) {
+		t.Errorf("pass-through query was answered by the pre-handler")
+	}
+}
+
+func TestViaInfo(t *testing.T) {
+	ns := &Impl{}
+	tests := []struct {
+		dst       string
+		wantUnder string // or empty if not 4via6
+	}{
+		// The 4via6 address for 10.1.1.9 in site 7.
+		{"fd7a:115c:a1e0:b1a:0:7:a01:109", "10.1.1.9"},
+		{"fd7a:115c:a1e0::2", ""},
+		{"10.1.1.9", ""},
+	}
+	for _, tt := range tests {
+		under, isVia := ns.ViaInfo(netip.MustParseAddr(tt.dst))
+		if isVia != (tt.wantUnder != "") {
+			t.Errorf("ViaInfo(%s) isVia = %v; want %v", tt.dst, isVia, !isVia)
+			continue
+		}
+		if isVia && under.String() != tt.wantUnder {
+			t.Errorf("ViaInfo(%s) = %v; want %v", tt.dst, under, tt.wantUnder)
+		}
+	}
+}
+
+func TestActiveConnsFamilies4via6(t *testing.T) {
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+	})
+
+	// The 4via6 address for 10.1.1.9 in site 7.
+	dst := netip.MustParseAddrPort("[fd7a:115c:a1e0:b1a:0:7:a01:109]:5303")
+	src := netip.MustParseAddrPort("[fd7a:115c:a1e0::2]:0")
+	ns.addSubnetAddress(dst.Addr())
+	var wq waiter.Queue
+	client, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(dst.Addr().AsSlice()),
+		Port: dst.Port(),
+	}, nil, ipv6.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		ns.forwardUDP(client, &wq, src, dst)
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+		if conns := ns.ActiveConns(); len(conns) != 0 {
+			t.Errorf("ActiveConns after close = %v; want none", conns)
+		}
+	}()
+
+	var conns []ConnInfo
+	for deadline := time.Now().Add(5 * time.Second); len(conns) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		conns = ns.ActiveConns()
+	}
+	if len(conns) != 1 {
+		t.Fatalf("got %d active conns; want 1", len(conns))
+	}
+	c := conns[0]
+	if c.Proto != ipproto.UDP || c.Src != src || c.Dst != dst {
+		t.Errorf("got conn %+v; want UDP from %v to %v", c, src, dst)
+	}
+	if want := netip.MustParseAddrPort("10.1.1.9:5303"); c.Backend != want {
+		t.Errorf("Backend = %v; want %v", c.Backend, want)
+	}
+	if c.ClientFamily() != 6 || c.BackendFamily() != 4 {
+		t.Errorf("families = v%d->v%d; want v6->v4", c.ClientFamily(), c.BackendFamily())
+	}
+}
+
+func TestNewUDPSessionRate(t *testing.T) {
+	const limit = 10
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.NewUDPSessionRate = limit
+	})
+	var allowed int
+	for i := 0; i < 1000; i++ {
+		src := netip.AddrFrom4([4]byte{100, 64, byte(i >> 8), byte(i)})
+		if ns.allowNewUDPSession(src) {
+			allowed++
+		}
+	}
+	if allowed < limit || allowed > limit+1 {
+		t.Errorf("allowed %d new sessions; want about %d", allowed, limit)
+	}
+}
+
+func TestNewUDPSessionRatePerSource(t *testing.T) {
+	const limit = 5
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.NewUDPSessionRatePerSource = limit
+	})
+	scanner := netip.MustParseAddr("100.64.0.1")
+	var allowed int
+	for i := 0; i < 100; i++ {
+		if ns.allowNewUDPSession(scanner) {
+			allowed++
+		}
+	}
+	if allowed < limit || allowed > limit+1 {
+		t.Errorf("allowed %d new sessions from one source; want about %d", allowed, limit)
+	}
+	// Other sources are unaffected.
+	if !ns.allowNewUDPSession(netip.MustParseAddr("100.64.0.2")) {
+		t.Errorf("new session from another source was rate limited")
+	}
+}
+
+func TestDNSTransport(t *testing.T) {
+	query := dnsQuery(t, "example.com.", dnsmessage.TypeA)
+	// A mock DNS-over-HTTPS upstream: it receives the wire-format query
+	// as an HTTP POST body would and returns a wire-format response.
+	gotQueries := make(chan []byte, 10)
+	doh := func(ctx context.Context, q []byte) ([]byte, error) {
+		gotQueries <- append([]byte(nil), q...)
+		var p dnsmessage.Parser
+		h, err := p.Start(q)
+		if err != nil {
+			return nil, err
+		}
+		qq, err := p.Question()
+		if err != nil {
+			return nil, err
+		}
+		h.Response = true
+		b := dnsmessage.NewBuilder(nil, h)
+		b.StartQuestions()
+		b.Question(qq)
+		b.StartAnswers()
+		b.AResource(dnsmessage.ResourceHeader{Name: qq.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+		return b.Finish()
+	}
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.DNSTransport = doh
+	})
+
+	client, server := udpPair(t)
+	if _, err := client.WriteTo(query, server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	go ns.handleMagicDNSUDP(client.LocalAddr().(*net.UDPAddr).AddrPort(), server)
+
+	buf := make([]byte, 1500)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-gotQueries; string(got) != string(query) {
+		t.Errorf("transport got query %q; want %q", got, query)
+	}
+	var p dnsmessage.Parser
+	if _, err := p.Start(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	p.SkipAllQuestions()
+	ans, err := p.AnswerHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := p.AResource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ans.Name.String() != "example.com." || a.A != [4]byte{192, 0, 2, 1} {
+		t.Errorf("got answer %v %v; want example.com. 192.0.2.1", ans.Name, a.A)
+	}
+}
+
+func TestDNSResolverOverride(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	type call struct {
+		query string
+		src   netip.AddrPort
+	}
+	calls := make(chan call, 10)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.DNSResolverOverride = func(_ context.Context, q []byte, src netip.AddrPort) ([]byte, error) {
+			calls <- call{string(q), src}
+			return []byte("answer"), nil
+		}
+	})
+	addLocalIP(t, ns, localIP)
+
+	// MagicDNS queries over UDP and TCP go to the override.
+	client, server := udpPair(t)
+	if _, err := client.WriteTo([]byte("udp-query"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	clientAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+	go ns.handleMagicDNSUDP(clientAddr, server)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "answer" {
+		t.Errorf("UDP response = %q; want %q", buf[:n], "answer")
+	}
+	if got, want := <-calls, (call{"udp-query", clientAddr}); got != want {
+		t.Errorf("UDP query: override called with %+v; want %+v", got, want)
+	}
+	tcpSrc := netip.MustParseAddrPort("100.64.0.2:1234")
+	if resp, err := ns.timedDNSQuery()(context.Background(), []byte("tcp-query"), tcpSrc); err != nil || string(resp) != "answer" {
+		t.Errorf("TCP query = %q, %v; want %q", resp, err, "answer")
+	}
+	if got, want := <-calls, (call{"tcp-query", tcpSrc}); got != want {
+		t.Errorf("TCP query: override called with %+v; want %+v", got, want)
+	}
+
+	// Other UDP traffic is still forwarded to its backend.
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	pkt := &packet.Parsed{}
+	pkt.Decode(packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{Src: tcpSrc.Addr(), Dst: localIP},
+		SrcPort:   tcpSrc.Port(),
+		DstPort:   uint16(backend.LocalAddr().(*net.UDPAddr).Port),
+	}, []byte("hello")))
+	ns.injectInbound(pkt, nil)
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err = backend.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("backend got %q; want %q", buf[:n], "hello")
+	}
+	select {
+	case c := <-calls:
+		t.Errorf("override called for forwarded traffic with %+v", c)
+	default:
+	}
+}
+
+func TestConnTagger(t *testing.T) {
+	dst := netip.MustParseAddrPort("192.0.2.1:5304")
+	src := netip.MustParseAddrPort("100.64.0.2:0")
+	logs := make(chan string, 100)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+		impl.ConnTagger = func(gotSrc, gotDst netip.AddrPort) string {
+			if gotSrc != src || gotDst != dst {
+				t.Errorf("ConnTagger(%v, %v); want (%v, %v)", gotSrc, gotDst, src, dst)
+			}
+			return "trace-1234"
+		}
+		impl.logf = func(format string, args ...any) {
+			select {
+			case logs <- fmt.Sprintf(format, args...):
+			default:
+			}
+		}
+	})
+
+	ns.addSubnetAddress(dst.Addr())
+	var wq waiter.Queue
+	client, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(dst.Addr().AsSlice()),
+		Port: dst.Port(),
+	}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		ns.forwardUDP(client, &wq, src, dst)
+		close(done)
+	}()
+
+	var conns []ConnInfo
+	for deadline := time.Now().Add(5 * time.Second); len(conns) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		conns = ns.ActiveConns()
+	}
+	if len(conns) != 1 || conns[0].Tag != "trace-1234" {
+		t.Fatalf("ActiveConns = %+v; want one conn tagged trace-1234", conns)
+	}
+
+	client.Close()
+	<-done
+	for {
+		select {
+		case l := <-logs:
+			if strings.Contains(l, "closed") {
+				if !strings.Contains(l, `tag="trace-1234"`) {
+					t.Errorf("close summary %q is missing tag", l)
+				}
+				return
+			}
+		default:
+			t.Fatal("no close summary logged")
+		}
+	}
+}
+
+func TestAcquireBackend(t *testing.T) {
+	dst := netip.MustParseAddrPort("192.0.2.1:80")
+	pooled, other := net.Pipe()
+	defer other.Close()
+	var acquired, released int
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.AcquireBackend = func(got netip.AddrPort) (net.Conn, func(), error) {
+			if got != dst {
+				t.Errorf("AcquireBackend(%v); want %v", got, dst)
+			}
+			acquired++
+			return pooled, func() { released++ }, nil
+		}
+		impl.backendDialFunc = func(context.Context, string, string) (net.Conn, error) {
+			t.Error("unexpected backend dial")
+			return nil, errors.New("unexpected dial")
+		}
+	})
+
+	var wq waiter.Queue
+	var gotClient bool
+	getClient := func(...tcpip.SettableSocketOption) *gonet.TCPConn {
+		gotClient = true
+		return nil // as if the client's handshake failed
+	}
+	handled := ns.forwardTCP(getClient, nil, netip.MustParseAddrPort("100.64.0.2:1234"), dst, &wq, dst)
+	if !handled {
+		t.Errorf("forwardTCP didn't handle the connection")
+	}
+	if !gotClient {
+		t.Errorf("forwardTCP didn't proceed to accept the client")
+	}
+	if acquired != 1 || released != 1 {
+		t.Errorf("pool conn acquired %d times and released %d times; want 1 and 1", acquired, released)
+	}
+}
+
+func TestConnectTimeoutFunc(t *testing.T) {
+	const global = 5 * time.Second
+	local := netip.MustParseAddrPort("127.0.0.1:80")
+	subnet := netip.MustParseAddrPort("192.0.2.1:80")
+	timeouts := map[string]time.Duration{}
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.TCPConnectTimeout = global
+		impl.ConnectTimeoutFunc = func(dst netip.AddrPort) time.Duration {
+			if dst.Addr().IsLoopback() {
+				return 100 * time.Millisecond
+			}
+			return 0
+		}
+		impl.backendDialFunc = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				t.Errorf("dial of %s has no deadline", addr)
+			}
+			timeouts[addr] = time.Until(deadline)
+			return nil, errors.New("test dial")
+		}
+	})
+	for _, dst := range []netip.AddrPort{local, subnet} {
+		ns.dialBackendTCP(context.Background(), dst)
+	}
+	if d := timeouts[local.String()]; d <= 0 || d > 100*time.Millisecond {
+		t.Errorf("dial of %v had timeout %v; want ConnectTimeoutFunc's 100ms", local, d)
+	}
+	if d := timeouts[subnet.String()]; d <= time.Second || d > global {
+		t.Errorf("dial of %v had timeout %v; want TCPConnectTimeout's %v", subnet, d, global)
+	}
+}
+
+func TestDefaultConnectTimeout(t *testing.T) {
+	var timeout time.Duration
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.backendDialFunc = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			if deadline, ok := ctx.Deadline(); ok {
+				timeout = time.Until(deadline)
+			}
+			return nil, errors.New("test dial")
+		}
+	})
+	ns.dialBackendTCP(context.Background(), netip.MustParseAddrPort("192.0.2.1:80"))
+	if timeout <= defaultTCPConnectTimeout-5*time.Second || timeout > defaultTCPConnectTimeout {
+		t.Errorf("dial had timeout %v; want %v", timeout, defaultTCPConnectTimeout)
+	}
+}
+
+func TestForwardDialer(t *testing.T) {
+	var dialed []string
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ForwardDialer = func(_ context.Context, network, addr string) (net.Conn, error) {
+			if network != "tcp" {
+				t.Errorf("ForwardDialer network = %q; want tcp", network)
+			}
+			dialed = append(dialed, addr)
+			c, other := net.Pipe()
+			other.Close()
+			return c, nil
+		}
+	})
+	src := netip.MustParseAddrPort("100.64.0.2:1234")
+	for _, tt := range []struct {
+		dst, dialIP netip.AddrPort
+	}{
+		{netip.MustParseAddrPort("100.64.0.1:80"), netip.MustParseAddrPort("127.0.0.1:80")},
+		{netip.MustParseAddrPort("192.0.2.1:80"), netip.MustParseAddrPort("192.0.2.1:80")},
+	} {
+		var wq waiter.Queue
+		getClient := func(...tcpip.SettableSocketOption) *gonet.TCPConn { return nil }
+		if !ns.forwardTCP(getClient, nil, src, tt.dst, &wq, tt.dialIP) {
+			t.Errorf("forwardTCP to %v didn't handle the connection", tt.dst)
+		}
+	}
+	want := []string{"127.0.0.1:80", "192.0.2.1:80"}
+	if !reflect.DeepEqual(dialed, want) {
+		t.Errorf("ForwardDialer dialed %v; want %v", dialed, want)
+	}
+}
+
+func TestBackendPoolForPort(t *testing.T) {
+	backends := []string{"127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003"}
+	var mu sync.Mutex
+	dialed := map[string]int{}
+	failing := map[string]bool{}
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.BackendPoolForPort = map[uint16][]string{80: backends}
+		impl.backendDialFunc = func(_ context.Context, _, addr string) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dialed[addr]++
+			if failing[addr] {
+				return nil, errors.New("test dial failure")
+			}
+			c, other := net.Pipe()
+			other.Close()
+			return c, nil
+		}
+	})
+	forward := func() {
+		t.Helper()
+		var wq waiter.Queue
+		getClient := func(...tcpip.SettableSocketOption) *gonet.TCPConn { return nil }
+		dst := netip.MustParseAddrPort("100.64.0.1:80")
+		if !ns.forwardTCP(getClient, nil, netip.MustParseAddrPort("100.64.0.2:1234"), dst, &wq, netip.MustParseAddrPort("127.0.0.1:80")) {
+			t.Fatal("forwardTCP didn't handle the connection")
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		forward()
+	}
+	want := map[string]int{"127.0.0.1:8001": 2, "127.0.0.1:8002": 2, "127.0.0.1:8003": 2}
+	if !reflect.DeepEqual(dialed, want) {
+		t.Errorf("round-robin dials = %v; want %v", dialed, want)
+	}
+
+	// A failed backend is dialed once, with the connection going to the
+	// next one, and then skipped.
+	dialed = map[string]int{}
+	failing["127.0.0.1:8001"] = true
+	for i := 0; i < 6; i++ {
+		forward()
+	}
+	want = map[string]int{"127.0.0.1:8001": 1, "127.0.0.1:8002": 3, "127.0.0.1:8003": 3}
+	if !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dials with a failed backend = %v; want %v", dialed, want)
+	}
+
+	// If they all fail, the connection isn't handled.
+	failing["127.0.0.1:8002"] = true
+	failing["127.0.0.1:8003"] = true
+	var wq waiter.Queue
+	if ns.forwardTCP(nil, nil, netip.MustParseAddrPort("100.64.0.2:1234"), netip.MustParseAddrPort("100.64.0.1:80"), &wq, netip.MustParseAddrPort("127.0.0.1:80")) {
+		t.Error("forwardTCP handled a connection with no working backends")
+	}
+
+	if err := (&Impl{BackendPoolForPort: map[uint16][]string{80: {"localhost"}}}).Start(); err == nil {
+		t.Error("Start with an invalid backend address succeeded; want error")
+	}
+}
+
+func TestBackendPoolLeastConns(t *testing.T) {
+	p, err := newBackendPool([]string{"127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.backends[0].inFlight.Store(2)
+	p.backends[1].inFlight.Store(1)
+	p.backends[2].inFlight.Store(3)
+	for i := 0; i < 3; i++ {
+		if got := p.order(true)[0].addr.String(); got != "127.0.0.1:8002" {
+			t.Errorf("least-conns pick %d = %v; want 127.0.0.1:8002", i, got)
+		}
+	}
+	p.backends[1].failedAt.Store(time.Now().UnixNano())
+	if got := p.order(true)[0].addr.String(); got != "127.0.0.1:8001" {
+		t.Errorf("least-conns pick with the least loaded failed = %v; want 127.0.0.1:8001", got)
+	}
+}
+
+func TestMaxDNSTCPMessageSize(t *testing.T) {
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.MaxDNSTCPMessageSize = 512
+	})
+	peer, server := tcpPair(t)
+	c := ns.limitDNSTCPConn(server)
+
+	// A request within the limit is read as-is, even if it arrives in
+	// pieces.
+	req := make([]byte, 2+300)
+	binary.BigEndian.PutUint16(req, 300)
+	go func() {
+		peer.Write(req[:1])
+		time.Sleep(10 * time.Millisecond)
+		peer.Write(req[1:])
+	}()
+	if _, err := io.ReadFull(c, make([]byte, len(req))); err != nil {
+		t.Fatalf("reading request within limit: %v", err)
+	}
+
+	// An oversized request is rejected once its length is read, and
+	// the connection is closed.
+	var prefix [2]byte
+	binary.BigEndian.PutUint16(prefix[:], 60000)
+	peer.Write(prefix[:])
+	if _, err := c.Read(make([]byte, 100)); err == nil {
+		t.Fatal("read of oversized request succeeded")
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("peer read after oversized request = %v; want EOF", err)
+	}
+}
+
+func TestPacketRates(t *testing.T) {
+	clock := &tstest.Clock{Start: time.Unix(1000, 0)}
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.timeNow = clock.Now
+	})
+	src := netip.MustParseAddr("100.64.0.2")
+	dst := netip.MustParseAddr("100.64.0.1")
+
+	inject := func(b []byte) {
+		p := new(packet.Parsed)
+		p.Decode(b)
+		if got := ns.injectInbound(p, nil); got != filter.DropSilently {
+			t.Fatalf("injectInbound = %v; want DropSilently", got)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		inject(packet.Generate(packet.IP4Header{IPProto: ipproto.TCP, Src: src, Dst: dst}, tcpSegment(1234, 80, packet.TCPAck)))
+	}
+	for i := 0; i < 2; i++ {
+		inject(packet.Generate(packet.UDP4Header{IP4Header: packet.IP4Header{Src: src, Dst: dst}, SrcPort: 1234, DstPort: 80}, nil))
+	}
+	_, payload := packet.ICMPEchoPayload(nil)
+	inject(packet.Generate(packet.ICMP4Header{
+		IP4Header: packet.IP4Header{IPProto: ipproto.ICMPv4, Src: src, Dst: dst},
+		Type:      packet.ICMP4EchoRequest,
+	}, payload))
+
+	clock.Advance(2 * time.Second)
+	st := ns.PacketRates(PacketStats{})
+	if st.TCP != 3 || st.UDP != 2 || st.ICMP != 1 || st.Other != 0 {
+		t.Errorf("got counts TCP=%d UDP=%d ICMP=%d Other=%d; want 3, 2, 1, 0", st.TCP, st.UDP, st.ICMP, st.Other)
+	}
+	if st.Window != 2*time.Second || st.TCPRate != 1.5 || st.UDPRate != 1 {
+		t.Errorf("got Window=%v TCPRate=%v UDPRate=%v; want 2s, 1.5, 1", st.Window, st.TCPRate, st.UDPRate)
+	}
+
+	// Rates are relative to the PacketStats passed in, so pollers
+	// don't reset each other's baselines.
+	inject(packet.Generate(packet.IP4Header{IPProto: ipproto.TCP, Src: src, Dst: dst}, tcpSegment(1234, 80, packet.TCPAck)))
+	clock.Advance(time.Second)
+	for _, poller := range []string{"first", "second"} {
+		got := ns.PacketRates(st)
+		if got.TCP != 4 || got.Window != time.Second || got.TCPRate != 1 || got.UDPRate != 0 {
+			t.Errorf("%s poller: TCP=%d Window=%v TCPRate=%v UDPRate=%v; want 4, 1s, 1, 0", poller, got.TCP, got.Window, got.TCPRate, got.UDPRate)
+		}
+	}
+}
+
+func TestRefusedPortTTL(t *testing.T) {
+	// Find a local port with nothing listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := ln.Addr().(*net.TCPAddr).AddrPort()
+	ln.Close()
+
+	var dials int
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.RefusedPortTTL = 50 * time.Millisecond
+		impl.backendDialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials++
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+	})
+	forward := func() (handled bool) {
+		var wq waiter.Queue
+		getClient := func(...tcpip.SettableSocketOption) *gonet.TCPConn {
+			t.Fatal("unexpected getClient call for dead port")
+			return nil
+		}
+		return ns.forwardTCP(getClient, nil, netip.MustParseAddrPort("100.64.0.2:1234"), netip.MustParseAddrPort("100.64.0.1:80"), &wq, deadAddr)
+	}
+
+	if forward() {
+		t.Fatal("forward to dead port was handled")
+	}
+	if dials != 1 {
+		t.Fatalf("got %d dials; want 1", dials)
+	}
+	if forward() {
+		t.Fatal("second forward to dead port was handled")
+	}
+	if dials != 1 {
+		t.Errorf("second attempt dialed the dead port; want it reset immediately")
+	}
+
+	// Once the entry expires, the port is probed again.
+	time.Sleep(60 * time.Millisecond)
+	forward()
+	if dials != 2 {
+		t.Errorf("got %d dials after TTL expired; want 2", dials)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	tests := []struct {
+		name      string
+		idle      time.Duration
+		peerClose bool
+		want      CloseReason
+	}{
+		{"idle-timeout", 50 * time.Millisecond, false, CloseIdleTimeout},
+		{"peer-closed", time.Minute, true, ClosePeer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			closed := make(chan ConnInfo, 1)
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+				impl.udpIdleTimeout = tt.idle
+				impl.OnConnClose = func(ci ConnInfo) { closed <- ci }
+			})
+
+			dst := netip.MustParseAddrPort("192.0.2.1:5305")
+			ns.addSubnetAddress(dst.Addr())
+			var wq waiter.Queue
+			client, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+				NIC:  nicID,
+				Addr: tcpip.Address(dst.Addr().AsSlice()),
+				Port: dst.Port(),
+			}, nil, ipv4.ProtocolNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			go ns.forwardUDP(client, &wq, netip.MustParseAddrPort("100.64.0.2:0"), dst)
+
+			if tt.peerClose {
+				for deadline := time.Now().Add(5 * time.Second); len(ns.ActiveConns()) == 0 && time.Now().Before(deadline); {
+					time.Sleep(time.Millisecond)
+				}
+				client.Close()
+			}
+			select {
+			case ci := <-closed:
+				if ci.CloseReason != tt.want {
+					t.Errorf("CloseReason = %v; want %v", ci.CloseReason, tt.want)
+				}
+				if ci.Dst != dst {
+					t.Errorf("Dst = %v; want %v", ci.Dst, dst)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnConnClose not called")
+			}
+		})
+	}
+}
+
+func TestUDPIdleTimeout(t *testing.T) {
+	closed := make(chan ConnInfo, 2)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+		impl.OnConnClose = func(ci ConnInfo) { closed <- ci }
+		impl.UDPIdleTimeout = func(port uint16) time.Duration {
+			if port == 5305 {
+				return 50 * time.Millisecond
+			}
+			return 0
+		}
+	})
+	if got := ns.udpIdleTimeoutFor(53); got != 0 {
+		t.Errorf("idle timeout for port 53 = %v; want 0 for the default", got)
+	}
+
+	dst := netip.MustParseAddrPort("192.0.2.1:5305")
+	ns.addSubnetAddress(dst.Addr())
+	var wq waiter.Queue
+	client, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(dst.Addr().AsSlice()),
+		Port: dst.Port(),
+	}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go ns.forwardUDP(client, &wq, netip.MustParseAddrPort("100.64.0.2:0"), dst)
+
+	select {
+	case ci := <-closed:
+		if ci.CloseReason != CloseIdleTimeout {
+			t.Errorf("CloseReason = %v; want %v", ci.CloseReason, CloseIdleTimeout)
+		}
+	case <-time.After(10 * time.Second): // well under the 2 minute default
+		t.Fatal("UDP session didn't time out")
+	}
+}
+
+func TestEnsureBackendPort(t *testing.T) {
+	ensured := make(chan uint16, 1)
+	released := make(chan uint16, 1)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+		impl.udpIdleTimeout = 50 * time.Millisecond
+		impl.EnsureBackendPort = func(proto string, port uint16) error {
+			if proto != "udp" {
+				t.Errorf("EnsureBackendPort proto = %q; want udp", proto)
+			}
+			ensured <- port
+			return nil
+		}
+		impl.ReleaseBackendPort = func(proto string, port uint16) {
+			released <- port
+		}
+	})
+
+	// Pick a free port for the client, which forwardUDP binds its
+	// backend socket to.
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcPort := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+	pc.Close()
+
+	dst := netip.MustParseAddrPort("192.0.2.1:5305")
+	ns.addSubnetAddress(dst.Addr())
+	var wq waiter.Queue
+	client, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(dst.Addr().AsSlice()),
+		Port: dst.Port(),
+	}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go ns.forwardUDP(client, &wq, netip.AddrPortFrom(netip.MustParseAddr("100.64.0.2"), srcPort), dst)
+
+	for _, c := range []struct {
+		name string
+		ch   chan uint16
+	}{{"EnsureBackendPort", ensured}, {"ReleaseBackendPort", released}} {
+		select {
+		case port := <-c.ch:
+			if port != srcPort {
+				t.Errorf("%s port = %d; want %d", c.name, port, srcPort)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not called", c.name)
+		}
+	}
+}
+
+func TestAnswerLocalPings(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	peerIP := netip.MustParseAddr("100.64.0.2")
+	for _, answer := range []bool{false, true} {
+		t.Run(fmt.Sprint(answer), func(t *testing.T) {
+			var pongs [][]byte
+			var relayed atomic.Int32
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.ProcessLocalIPs = true
+				impl.AnswerLocalPings = answer
+				impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+				impl.localPongFunc = func(pong []byte) { pongs = append(pongs, pong) }
+				impl.userPingFunc = func(netip.Addr, []byte) { relayed.Add(1) }
+			})
+
+			icmph := packet.ICMP4Header{
+				IP4Header: packet.IP4Header{
+					IPProto: ipproto.ICMPv4,
+					Src:     peerIP,
+					Dst:     localIP,
+				},
+				Type: packet.ICMP4EchoRequest,
+				Code: packet.ICMP4NoCode,
+			}
+			_, payload := packet.ICMPEchoPayload(nil)
+			pkt := &packet.Parsed{}
+			pkt.Decode(packet.Generate(icmph, payload))
+			if _, ok := ns.shouldHandlePing(pkt); ok != answer {
+				t.Errorf("shouldHandlePing = %v; want %v", ok, answer)
+			}
+			ns.injectInbound(pkt, nil)
+
+			if !answer {
+				if len(pongs) != 0 {
+					t.Errorf("got %d replies; want none", len(pongs))
+				}
+				return
+			}
+			if len(pongs) != 1 {
+				t.Fatalf("got %d replies; want 1", len(pongs))
+			}
+			var reply packet.Parsed
+			reply.Decode(pongs[0])
+			if !reply.IsEchoResponse() || reply.Src.Addr() != localIP || reply.Dst.Addr() != peerIP {
+				t.Errorf("reply = %v; want echo response from %v to %v", &reply, localIP, peerIP)
+			}
+			if n := relayed.Load(); n != 0 {
+				t.Errorf("relayed %d pings of a local IP; want 0", n)
+			}
+		})
+	}
+}
+
+func TestDisableICMP(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	subnetIP := netip.MustParseAddr("192.0.2.1")
+	peerIP := netip.MustParseAddr("100.64.0.2")
+	var relayed, injected atomic.Int32
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.ProcessSubnets = true
+		impl.DisableICMP = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.userPingFunc = func(netip.Addr, []byte) { relayed.Add(1) }
+		impl.injectPacketFunc = func(pkt *stack.PacketBuffer, _ bool) {
+			injected.Add(1)
+			pkt.DecRef()
+		}
+	})
+	addLocalIP(t, ns, localIP)
+
+	for _, dst := range []netip.Addr{localIP, subnetIP} {
+		icmph := packet.ICMP4Header{
+			IP4Header: packet.IP4Header{IPProto: ipproto.ICMPv4, Src: peerIP, Dst: dst},
+			Type:      packet.ICMP4EchoRequest,
+			Code:      packet.ICMP4NoCode,
+		}
+		_, payload := packet.ICMPEchoPayload(nil)
+		pkt := &packet.Parsed{}
+		pkt.Decode(packet.Generate(icmph, payload))
+		if _, ok := ns.shouldHandlePing(pkt); ok {
+			t.Errorf("shouldHandlePing(ping of %v) = true; want false", dst)
+		}
+		if got := ns.injectInbound(pkt, nil); got != filter.DropSilently {
+			t.Errorf("injectInbound(ping of %v) = %v; want DropSilently", dst, got)
+		}
+	}
+	ns.injectPortUnreachable(netip.AddrPortFrom(peerIP, 1234), netip.AddrPortFrom(subnetIP, 53))
+
+	// Give netstack a moment to (wrongly) reply.
+	time.Sleep(50 * time.Millisecond)
+	if n := relayed.Load(); n != 0 {
+		t.Errorf("relayed %d pings; want 0", n)
+	}
+	if n := injected.Load(); n != 0 {
+		t.Errorf("sent %d packets; want 0", n)
+	}
+}
+
+func TestMaxEchoReplyPayload(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	peerIP := netip.MustParseAddr("100.64.0.2")
+	for _, max := range []int{0, 64} {
+		t.Run(fmt.Sprint(max), func(t *testing.T) {
+			var pongs [][]byte
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.ProcessLocalIPs = true
+				impl.AnswerLocalPings = true
+				impl.MaxEchoReplyPayload = max
+				impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+				impl.localPongFunc = func(pong []byte) { pongs = append(pongs, pong) }
+			})
+
+			icmph := packet.ICMP4Header{
+				IP4Header: packet.IP4Header{
+					IPProto: ipproto.ICMPv4,
+					Src:     peerIP,
+					Dst:     localIP,
+				},
+				Type: packet.ICMP4EchoRequest,
+				Code: packet.ICMP4NoCode,
+			}
+			data := bytes.Repeat([]byte("x"), 1000)
+			_, payload := packet.ICMPEchoPayload(data)
+			pkt := &packet.Parsed{}
+			pkt.Decode(packet.Generate(icmph, payload))
+			ns.injectInbound(pkt, nil)
+
+			if len(pongs) != 1 {
+				t.Fatalf("got %d replies; want 1", len(pongs))
+			}
+			var reply packet.Parsed
+			reply.Decode(pongs[0])
+			want := payload
+			if max != 0 {
+				want = payload[:4+max]
+			}
+			if got := reply.Payload(); !bytes.Equal(got, want) {
+				t.Errorf("reply payload is %d bytes; want %d", len(got), len(want))
+			}
+		})
+	}
+
+	ns := &Impl{MaxEchoReplyPayload: -1}
+	if err := ns.Start(); err == nil {
+		t.Errorf("Start with negative MaxEchoReplyPayload succeeded; want error")
+	}
+}
+
+func TestTCPCongestionControl(t *testing.T) {
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.TCPCongestionControl = "cubic"
+	})
+	var got tcpip.CongestionControlOption
+	if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != "cubic" {
+		t.Errorf("congestion control = %q; want cubic", got)
+	}
+
+	ns.TCPCongestionControl = "bbr"
+	const want = `netstack: TCPCongestionControl "bbr" is not one of ["reno" "cubic"]`
+	if err := ns.Validate(); err == nil || err.Error() != want {
+		t.Errorf("Validate = %v; want %q", err, want)
+	}
+}
+
+func TestTCPBufferSizes(t *testing.T) {
+	recv := BufferSizeRange{Min: 4 << 10, Default: 2 << 20, Max: 16 << 20}
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.TCPBufferSizes = &TCPBufferSizes{Receive: recv}
+	})
+	var gotRecv tcpip.TCPReceiveBufferSizeRangeOption
+	if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &gotRecv); err != nil {
+		t.Fatal(err)
+	}
+	if want := (tcpip.TCPReceiveBufferSizeRangeOption{Min: recv.Min, Default: recv.Default, Max: recv.Max}); gotRecv != want {
+		t.Errorf("receive buffer sizes = %+v; want %+v", gotRecv, want)
+	}
+	var gotSend tcpip.TCPSendBufferSizeRangeOption
+	if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &gotSend); err != nil {
+		t.Fatal(err)
+	}
+	if gotSend.Default != tcp.DefaultSendBufferSize {
+		t.Errorf("send buffer sizes = %+v; want gVisor's default", gotSend)
+	}
+
+	bad := &Impl{TCPBufferSizes: &TCPBufferSizes{Send: BufferSizeRange{Min: 8 << 10, Default: 4 << 10, Max: 1 << 20}}}
+	if err := bad.Validate(); err == nil {
+		t.Error("Validate with Default < Min succeeded; want error")
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	peerIP := netip.MustParseAddr("100.64.0.2")
+	var pongs [][]byte
+	sent := make(chan []byte, 1)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.DefaultTTL = 7
+		impl.DefaultHopLimit = 9
+		impl.ProcessLocalIPs = true
+		impl.AnswerLocalPings = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.localPongFunc = func(pong []byte) { pongs = append(pongs, pong) }
+		impl.injectPacketFunc = func(pkt *stack.PacketBuffer, _ bool) {
+			sent <- pkt.ToView().AsSlice()
+			pkt.DecRef()
+		}
+	})
+
+	// A reply to a ping, made by netstack.
+	icmph := packet.ICMP4Header{
+		IP4Header: packet.IP4Header{
+			IPProto: ipproto.ICMPv4,
+			Src:     peerIP,
+			Dst:     localIP,
+		},
+		Type: packet.ICMP4EchoRequest,
+		Code: packet.ICMP4NoCode,
+	}
+	_, payload := packet.ICMPEchoPayload(nil)
+	pkt := &packet.Parsed{}
+	pkt.Decode(packet.Generate(icmph, payload))
+	ns.injectInbound(pkt, nil)
+	if len(pongs) != 1 {
+		t.Fatalf("got %d replies; want 1", len(pongs))
+	}
+	if h := header.IPv4(pongs[0]); h.TTL() != 7 || !h.IsChecksumValid() {
+		t.Errorf("reply TTL = %d, checksum valid = %v; want 7, true", h.TTL(), h.IsChecksumValid())
+	}
+
+	// A packet sent by gVisor.
+	addLocalIP(t, ns, localIP)
+	c, err := gonet.DialUDP(ns.ipstack,
+		&tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(localIP.AsSlice())},
+		&tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(peerIP.AsSlice()), Port: 1234},
+		ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-sent:
+		if ttl := header.IPv4(b).TTL(); ttl != 7 {
+			t.Errorf("UDP packet TTL = %d; want 7", ttl)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for UDP packet")
+	}
+
+	var ttl tcpip.DefaultTTLOption
+	if err := ns.ipstack.NetworkProtocolOption(ipv6.ProtocolNumber, &ttl); err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 9 {
+		t.Errorf("IPv6 default hop limit = %d; want 9", ttl)
+	}
+}
+
+// udpFragments returns a UDP packet from src to dst carrying payload,
+// split into IPv4 fragments of at most fragSize payload bytes each.
+func udpFragments(src, dst netip.AddrPort, payload []byte, fragSize int) [][]byte {
+	udp := make([]byte, header.UDPMinimumSize+len(payload))
+	header.UDP(udp).Encode(&header.UDPFields{
+		SrcPort: src.Port(),
+		DstPort: dst.Port(),
+		Length:  uint16(len(udp)),
+	})
+	copy(udp[header.UDPMinimumSize:], payload)
+
+	var frags [][]byte
+	for off := 0; off < len(udp); off += fragSize {
+		end := off + fragSize
+		if end > len(udp) {
+			end = len(udp)
+		}
+		var flags uint8
+		if end < len(udp) {
+			flags = header.IPv4FlagMoreFragments
+		}
+		b := make([]byte, header.IPv4MinimumSize+end-off)
+		ip := header.IPv4(b)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength:    uint16(len(b)),
+			ID:             1234,
+			Flags:          flags,
+			FragmentOffset: uint16(off),
+			TTL:            64,
+			Protocol:       uint8(header.UDPProtocolNumber),
+			SrcAddr:        tcpip.Address(src.Addr().AsSlice()),
+			DstAddr:        tcpip.Address(dst.Addr().AsSlice()),
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		copy(b[header.IPv4MinimumSize:], udp[off:end])
+		frags = append(frags, b)
+	}
+	return frags
+}
+
+func TestReassemblyLimits(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	src := netip.MustParseAddrPort("100.64.0.2:1234")
+	dst := netip.AddrPortFrom(localIP, 5306)
+	payload := make([]byte, 2000)
+	frags := udpFragments(src, dst, payload, 800) // 3 fragments
+
+	tests := []struct {
+		name   string
+		config func(*Impl)
+		want   bool // whether the packet is reassembled
+	}{
+		{"default", func(*Impl) {}, true},
+		{"within-limits", func(impl *Impl) {
+			impl.MaxReassemblyFragments = 3
+			impl.MaxReassemblyMemory = 4096
+		}, true},
+		{"disabled", func(impl *Impl) { impl.DisableReassembly = true }, false},
+		{"too-many-fragments", func(impl *Impl) { impl.MaxReassemblyFragments = 2 }, false},
+		{"too-much-memory", func(impl *Impl) { impl.MaxReassemblyMemory = 1500 }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.ProcessLocalIPs = true
+				impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+				tt.config(impl)
+			})
+			addLocalIP(t, ns, localIP)
+			c, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+				NIC:  nicID,
+				Addr: tcpip.Address(localIP.AsSlice()),
+				Port: dst.Port(),
+			}, nil, ipv4.ProtocolNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			for _, f := range frags {
+				p := &packet.Parsed{}
+				p.Decode(f)
+				ns.injectInbound(p, nil)
+			}
+
+			c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			buf := make([]byte, 4096)
+			n, _, err := c.ReadFrom(buf)
+			if got := err == nil; got != tt.want {
+				t.Fatalf("reassembled = %v (err=%v); want %v", got, err, tt.want)
+			}
+			if tt.want && n != len(payload) {
+				t.Errorf("read %d bytes; want %d", n, len(payload))
+			}
+		})
+	}
+}
+
+func TestReassemblyMemoryReleased(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	dst := netip.AddrPortFrom(localIP, 5306)
+	payload := make([]byte, 1000)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.MaxReassemblyMemory = 1500 // room for one packet's fragments
+	})
+	addLocalIP(t, ns, localIP)
+	c, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(localIP.AsSlice()),
+		Port: dst.Port(),
+	}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Reassembled packets don't count against MaxReassemblyMemory, so
+	// packets sent back to back all get through.
+	const packets = 3
+	for i := 0; i < packets; i++ {
+		src := netip.AddrPortFrom(netip.AddrFrom4([4]byte{100, 64, 0, byte(2 + i)}), 1234)
+		for _, f := range udpFragments(src, dst, payload, 800) { // 2 fragments
+			p := &packet.Parsed{}
+			p.Decode(f)
+			ns.injectInbound(p, nil)
+		}
+	}
+	buf := make([]byte, 4096)
+	for i := 0; i < packets; i++ {
+		c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, _, err := c.ReadFrom(buf); err != nil {
+			t.Fatalf("packet %d not reassembled: %v", i, err)
+		}
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.fragmentBytes != 0 || len(ns.fragments) != 0 {
+		t.Errorf("fragmentBytes = %d with %d packets tracked; want 0, 0", ns.fragmentBytes, len(ns.fragments))
+	}
+}
+
+func TestReassemblyLimitsValidation(t *testing.T) {
+	for i, config := range []func(*Impl){
+		func(impl *Impl) { impl.MaxReassemblyFragments = -1 },
+		func(impl *Impl) { impl.MaxReassemblyMemory = maxReassemblyMemory + 1 },
+		func(impl *Impl) { impl.ReassemblyTimeout = time.Hour },
+	} {
+		ns := &Impl{}
+		config(ns)
+		if err := ns.validateReassemblyLimits(); err == nil {
+			t.Errorf("config %d: validateReassemblyLimits = nil; want error", i)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []struct {
+		name    string
+		config  func(*Impl)
+		wantErr string
+	}{
+		{"negative-retries", func(impl *Impl) { impl.BackendDialRetries = -1 }, "negative BackendDialRetries -1"},
+		{"negative-heartbeat", func(impl *Impl) { impl.HeartbeatInterval = -time.Second }, "negative HeartbeatInterval -1s"},
+		{"dns-tcp-size", func(impl *Impl) { impl.MaxDNSTCPMessageSize = 1 << 16 }, "MaxDNSTCPMessageSize 65536 not in range [0, 65535]"},
+		{"clamp-mss-small", func(impl *Impl) { impl.ClampMSS = 50 }, "ClampMSS 50 is less than 88"},
+		{"reassembly-disabled", func(impl *Impl) {
+			impl.DisableReassembly = true
+			impl.MaxReassemblyFragments = 10
+		}, "reassembly limits set with DisableReassembly"},
+		{"least-conns-no-pool", func(impl *Impl) { impl.BackendPoolLeastConns = true }, "BackendPoolLeastConns set without BackendPoolForPort"},
+		{"pool-port-blocked", func(impl *Impl) {
+			impl.BackendPoolForPort = map[uint16][]string{25: {"127.0.0.1:2525"}}
+			impl.BlockedForwardPorts = []uint16{25}
+		}, "BackendPoolForPort[25] is for a port in BlockedForwardPorts"},
+		{"pings-no-local", func(impl *Impl) { impl.AnswerLocalPings = true }, "AnswerLocalPings set without ProcessLocalIPs"},
+		{"pings-no-icmp", func(impl *Impl) {
+			impl.ProcessLocalIPs = true
+			impl.AnswerLocalPings = true
+			impl.DisableICMP = true
+		}, "AnswerLocalPings or AnswerViaNeighborSolicits set with DisableICMP"},
+		{"static-no-subnets", func(impl *Impl) { impl.StaticSubnetAddrsOnly = true }, "StaticSubnetAddrsOnly set without ProcessSubnets"},
+		{"release-no-ensure", func(impl *Impl) {
+			impl.ReleaseBackendPort = func(string, uint16) {}
+		}, "ReleaseBackendPort set without EnsureBackendPort"},
+		{"websocket-and-acquire", func(impl *Impl) {
+			impl.ForwardViaWebSocket = &url.URL{Scheme: "ws", Host: "example.com"}
+			impl.AcquireBackend = func(netip.AddrPort) (net.Conn, func(), error) { return nil, nil, errors.New("unused") }
+		}, "ForwardViaWebSocket and AcquireBackend are both set"},
+		{"forward-dialer-and-websocket", func(impl *Impl) {
+			impl.ForwardDialer = func(context.Context, string, string) (net.Conn, error) { return nil, errors.New("unused") }
+			impl.ForwardViaWebSocket = &url.URL{Scheme: "ws", Host: "example.com"}
+		}, "ForwardDialer set with ForwardViaWebSocket or AcquireBackend"},
+		{"dns-transport-and-override", func(impl *Impl) {
+			impl.DNSTransport = func(context.Context, []byte) ([]byte, error) { return nil, errors.New("unused") }
+			impl.DNSResolverOverride = func(context.Context, []byte, netip.AddrPort) ([]byte, error) { return nil, errors.New("unused") }
+		}, "DNSTransport and DNSResolverOverride are both set"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := &Impl{}
+			tt.config(ns)
+			err := ns.Validate()
+			if err == nil || err.Error() != "netstack: "+tt.wantErr {
+				t.Errorf("Validate = %v; want %q", err, "netstack: "+tt.wantErr)
+			}
+			if err := ns.Start(); err == nil {
+				t.Errorf("Start succeeded; want error")
+			}
+		})
+	}
+
+	valid := []func(*Impl){
+		func(*Impl) {},
+		func(impl *Impl) {
+			impl.ProcessLocalIPs = true
+			impl.AnswerLocalPings = true
+			impl.ProcessSubnets = true
+			impl.StaticSubnetAddrsOnly = true
+			impl.BackendPoolForPort = map[uint16][]string{80: {"127.0.0.1:8080"}}
+			impl.BackendPoolLeastConns = true
+			impl.BlockedForwardPorts = []uint16{25}
+			impl.EnsureBackendPort = func(string, uint16) error { return nil }
+			impl.ReleaseBackendPort = func(string, uint16) {}
+			impl.MaxDNSTCPMessageSize = 512
+		},
+	}
+	for i, config := range valid {
+		ns := &Impl{}
+		config(ns)
+		if err := ns.Validate(); err != nil {
+			t.Errorf("valid config %d: Validate = %v", i, err)
+		}
+	}
+}
+
+func TestForwardViaWebSocket(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Errorf("websocket.Accept: %v", err)
+			return
+		}
+		conn := wsconn.NetConn(r.Context(), c, websocket.MessageBinary)
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(strings.Replace(srv.URL, "http", "ws", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ForwardViaWebSocket = u
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, err := ns.dialBackendTCP(ctx, netip.MustParseAddrPort("127.0.0.1:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	peer, client := tcpPair(t)
+	proxyDone := make(chan error, 1)
+	go func() {
+		_, err := ns.proxyTCP(client, server, nil)
+		client.Close()
+		proxyDone <- err
+	}()
+
+	const msg = "hello over websocket"
+	if _, err := io.WriteString(peer, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("got %q; want %q", buf, msg)
+	}
+	peer.CloseWrite()
+	select {
+	case <-proxyDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxyTCP didn't return after the peer closed")
+	}
+}
+
+func TestHandlerStats(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.ProcessSubnets = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+	})
+	addLocalIP(t, ns, localIP)
+	udp := func(dst netip.AddrPort) *packet.Parsed {
+		h := packet.UDP4Header{
+			IP4Header: packet.IP4Header{
+				Src: netip.MustParseAddr("100.64.0.2"),
+				Dst: dst.Addr(),
+			},
+			SrcPort: 1234,
+			DstPort: dst.Port(),
+		}
+		p := &packet.Parsed{}
+		p.Decode(packet.Generate(h, dnsQuery(t, "example.com.", dnsmessage.TypeA)))
+		return p
+	}
+	ns.handleLocalPackets(udp(netip.AddrPortFrom(magicDNSIP, 53)), nil)
+	ns.injectInbound(udp(netip.MustParseAddrPort("192.0.2.1:5307")), nil)
+	ns.injectInbound(udp(netip.AddrPortFrom(localIP, 5308)), nil)
+	ns.injectInbound(udp(netip.AddrPortFrom(magicDNSIP, 54)), nil)
+
+	want := map[string]int64{
+		"dns":      1,
+		"ssh":      0,
+		"peerapi":  0,
+		"quad100":  0,
+		"handler":  0,
+		"loopback": 1,
+		"subnet":   1,
+		"rejected": 1,
+	}
+	var got map[string]int64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if got = ns.HandlerStats(); reflect.DeepEqual(got, want) {
+			return
+		}
+	}
+	t.Errorf("HandlerStats = %v; want %v", got, want)
+}
+
+func TestForwardTCPInFunc(t *testing.T) {
+	var mu sync.Mutex
+	var ports []uint16
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.ForwardTCPIn = func(c net.Conn, port uint16) {
+			t.Errorf("ForwardTCPIn called for port %d; want ForwardTCPInFunc used instead", port)
+			c.Close()
+		}
+		impl.ForwardTCPInFunc = func(port uint16) (func(net.Conn), bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			ports = append(ports, port)
+			return func(c net.Conn) { c.Close() }, port == 80
+		}
+	})
+	localIP := netip.MustParseAddr("100.64.0.1")
+	addLocalIP(t, ns, localIP)
+	for _, port := range []uint16{80, 81} {
+		p := &packet.Parsed{}
+		p.Decode(tcpSYN4(netip.MustParseAddrPort("100.64.0.2:1234"), netip.AddrPortFrom(localIP, port)))
+		ns.injectInbound(p, nil)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		hs := ns.HandlerStats()
+		if hs["handler"] == 1 && hs["rejected"] == 1 && ns.Stats().Stack.TCP.ResetsSent == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("HandlerStats = %v, %d resets sent; want port 80 accepted and 81 reset", hs, ns.Stats().Stack.TCP.ResetsSent)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ports) != 2 {
+		t.Errorf("ForwardTCPInFunc called for ports %v; want 80 and 81", ports)
+	}
+}
+
+func TestHandlerChain(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	custom := func(claimed chan<- string) HandlerMatcher {
+		return HandlerMatcher{
+			Name: "custom",
+			Match: func(id stack.TransportEndpointID) (func(net.Conn), bool) {
+				if id.LocalPort != 80 {
+					return nil, false
+				}
+				claimed <- "custom"
+				return func(c net.Conn) { c.Close() }, true
+			},
+		}
+	}
+	tests := []struct {
+		name  string
+		chain func(custom HandlerMatcher) []HandlerMatcher
+		want  string
+	}{
+		{
+			name: "custom_first",
+			chain: func(custom HandlerMatcher) []HandlerMatcher {
+				return append([]HandlerMatcher{custom}, DefaultHandlerChain()...)
+			},
+			want: "custom",
+		},
+		{
+			name: "custom_last",
+			chain: func(custom HandlerMatcher) []HandlerMatcher {
+				return append(DefaultHandlerChain(), custom)
+			},
+			want: "handler",
+		},
+		{
+			name: "handler_disabled",
+			chain: func(custom HandlerMatcher) []HandlerMatcher {
+				var chain []HandlerMatcher
+				for _, m := range DefaultHandlerChain() {
+					if m.Name != "handler" {
+						chain = append(chain, m)
+					}
+				}
+				return append(chain, custom)
+			},
+			want: "custom",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claimed := make(chan string, 2)
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.ProcessLocalIPs = true
+				impl.ForwardTCPInFunc = func(port uint16) (func(net.Conn), bool) {
+					claimed <- "handler"
+					return func(c net.Conn) { c.Close() }, true
+				}
+				impl.HandlerChain = tt.chain(custom(claimed))
+			})
+			addLocalIP(t, ns, localIP)
+			p := &packet.Parsed{}
+			p.Decode(tcpSYN4(netip.MustParseAddrPort("100.64.0.2:1234"), netip.AddrPortFrom(localIP, 80)))
+			ns.injectInbound(p, nil)
+
+			select {
+			case got := <-claimed:
+				if got != tt.want {
+					t.Errorf("claimed by %q; want %q", got, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection wasn't claimed")
+			}
+			select {
+			case got := <-claimed:
+				t.Errorf("also claimed by %q", got)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestHandlerChainValidation(t *testing.T) {
+	ns := &Impl{HandlerChain: []HandlerMatcher{{Name: "nomatch"}}}
+	if err := ns.Start(); err == nil {
+		t.Error("Start succeeded with a HandlerChain entry without Match; want error")
+	}
+}
+
+func TestForwardUDPIn(t *testing.T) {
+	type datagram struct {
+		port uint16
+		from net.Addr
+		data string
+	}
+	got := make(chan datagram, 2)
+	localIP := netip.MustParseAddr("100.64.0.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.ProcessSubnets = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.ForwardUDPIn = func(c net.PacketConn, port uint16) {
+			defer c.Close()
+			buf := make([]byte, 100)
+			n, from, err := c.ReadFrom(buf)
+			if err != nil {
+				t.Errorf("ReadFrom: %v", err)
+				return
+			}
+			got <- datagram{port, from, string(buf[:n])}
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	for _, dst := range []netip.AddrPort{
+		netip.AddrPortFrom(localIP, 5308),
+		netip.MustParseAddrPort("192.0.2.1:5309"), // a subnet, so not handled
+	} {
+		p := &packet.Parsed{}
+		p.Decode(packet.Generate(packet.UDP4Header{
+			IP4Header: packet.IP4Header{Src: netip.MustParseAddr("100.64.0.2"), Dst: dst.Addr()},
+			SrcPort:   1234,
+			DstPort:   dst.Port(),
+		}, []byte("hello")))
+		ns.injectInbound(p, nil)
+	}
+
+	select {
+	case d := <-got:
+		if d.port != 5308 || d.from.String() != "100.64.0.2:1234" || d.data != "hello" {
+			t.Errorf("ForwardUDPIn got %q from %v on port %d; want \"hello\" from 100.64.0.2:1234 on 5308", d.data, d.from, d.port)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ForwardUDPIn wasn't called")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		hs := ns.HandlerStats()
+		if hs["handler"] == 1 && hs["subnet"] == 1 && hs["loopback"] == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("HandlerStats = %v; want 1 handler and 1 subnet", hs)
+		}
+	}
+	select {
+	case d := <-got:
+		t.Errorf("ForwardUDPIn unexpectedly called for port %d", d.port)
+	default:
+	}
+}
+
+func TestPeerAPIPortTTL(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.PeerAPIPortTTL = time.Hour
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		setTestLocalBackend(t, impl)
+	})
+	syn := func(port uint16) *packet.Parsed {
+		p := new(packet.Parsed)
+		p.Decode(packet.Generate(packet.IP4Header{
+			IPProto: ipproto.TCP,
+			Src:     netip.MustParseAddr("100.64.0.2"),
+			Dst:     localIP,
+		}, tcpSegment(1234, port, packet.TCPSyn)))
+		return p
+	}
+
+	ns.shouldProcessInbound(syn(443), nil)
+	ns.shouldProcessInbound(syn(443), nil)
+	if n := ns.peerAPIPortLookups.Load(); n != 1 {
+		t.Fatalf("got %d peerapi port lookups; want 1", n)
+	}
+
+	// Pretend the LocalBackend had reported a peerapi port.
+	ns.mu.Lock()
+	ns.peerAPIPorts[localIP] = peerAPIPortEntry{port: 12345, ok: true, expires: time.Now().Add(time.Hour)}
+	ns.mu.Unlock()
+	if !ns.shouldProcessInbound(syn(12345), nil) {
+		t.Errorf("SYN to cached peerapi port not processed")
+	}
+	if n := ns.peerAPIPortLookups.Load(); n != 1 {
+		t.Errorf("got %d peerapi port lookups; want 1", n)
+	}
+
+	ns.updateIPs(&netmap.NetworkMap{Addresses: []netip.Prefix{netip.PrefixFrom(localIP, 32)}})
+	if ns.shouldProcessInbound(syn(12345), nil) {
+		t.Errorf("SYN to stale peerapi port processed after netmap update")
+	}
+	if n := ns.peerAPIPortLookups.Load(); n != 2 {
+		t.Errorf("got %d peerapi port lookups after netmap update; want 2", n)
+	}
+}
+
+func BenchmarkPeerAPIPortTTL(b *testing.B) {
+	for _, ttl := range []time.Duration{0, time.Second} {
+		b.Run(fmt.Sprintf("ttl=%v", ttl), func(b *testing.B) {
+			ns := makeNetstack(b, func(impl *Impl) {
+				impl.PeerAPIPortTTL = ttl
+				setTestLocalBackend(b, impl)
+			})
+			pkt := new(packet.Parsed)
+			pkt.Decode(packet.Generate(packet.IP4Header{
+				IPProto: ipproto.TCP,
+				Src:     netip.MustParseAddr("100.64.0.2"),
+				Dst:     netip.MustParseAddr("100.64.0.1"),
+			}, tcpSegment(1234, 443, packet.TCPSyn)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ns.shouldProcessInbound(pkt, nil)
+			}
+			b.ReportMetric(float64(ns.peerAPIPortLookups.Load())/float64(b.N), "lookups/op")
+		})
+	}
+}
+
+func TestDiffIPs(t *testing.T) {
+	ap := func(s string) tcpip.AddressWithPrefix {
+		return ipPrefixToAddressWithPrefix(netip.MustParsePrefix(s))
+	}
+	have := func(ss ...string) (ret []tcpip.ProtocolAddress) {
+		for _, s := range ss {
+			ret = append(ret, tcpip.ProtocolAddress{Protocol: ipv4.ProtocolNumber, AddressWithPrefix: ap(s)})
+		}
+		return ret
+	}
+	set := func(ss ...string) map[tcpip.AddressWithPrefix]bool {
+		m := make(map[tcpip.AddressWithPrefix]bool)
+		for _, s := range ss {
+			m[ap(s)] = true
+		}
+		return m
+	}
+	tests := []struct {
+		name       string
+		have       []tcpip.ProtocolAddress
+		want       map[tcpip.AddressWithPrefix]bool
+		wantAdd    map[tcpip.AddressWithPrefix]bool
+		wantRemove map[tcpip.AddressWithPrefix]bool
+	}{
+		{
+			name:       "replace",
+			have:       have("255.255.255.255/32", "100.64.0.1/32", "10.0.0.0/24"),
+			want:       set("100.64.0.2/32", "10.0.0.0/24"),
+			wantAdd:    set("100.64.0.2/32"),
+			wantRemove: set("100.64.0.1/32"),
+		},
+		{
+			name:       "broadcast_never_removed",
+			have:       have("255.255.255.255/32", "100.64.0.1/32"),
+			want:       set(),
+			wantAdd:    set(),
+			wantRemove: set("100.64.0.1/32"),
+		},
+		{
+			name:       "broadcast_in_netmap",
+			have:       have("255.255.255.255/32"),
+			want:       set("255.255.255.255/32", "100.64.0.1/32"),
+			wantAdd:    set("100.64.0.1/32"),
+			wantRemove: set(),
+		},
+		{
+			name:       "broadcast_other_prefix_len",
+			have:       have("255.255.255.255/32", "255.255.255.255/31"),
+			want:       set(),
+			wantAdd:    set(),
+			wantRemove: set("255.255.255.255/31"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			add, remove := diffIPs(tt.have, tt.want)
+			if !reflect.DeepEqual(add, tt.wantAdd) || !reflect.DeepEqual(remove, tt.wantRemove) {
+				t.Errorf("diffIPs = add %v, remove %v; want add %v, remove %v", add, remove, tt.wantAdd, tt.wantRemove)
+			}
+		})
+	}
+}
+
+func TestUpdateIPsBroadcast(t *testing.T) {
+	ns := makeNetstack(t, func(*Impl) {})
+	broadcast := netip.MustParsePrefix("255.255.255.255/32")
+	hasBroadcast := func() bool {
+		for _, pa := range ns.ipstack.AllAddresses()[nicID] {
+			if addressWithPrefixToIPPrefix(pa.AddressWithPrefix) == broadcast {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasBroadcast() {
+		t.Fatalf("no %v before updateIPs", broadcast)
+	}
+	nm := func(ipps ...netip.Prefix) *netmap.NetworkMap {
+		return &netmap.NetworkMap{Addresses: ipps, SelfNode: &tailcfg.Node{Addresses: ipps}}
+	}
+	ip := netip.MustParsePrefix("100.64.0.1/32")
+	for _, step := range []*netmap.NetworkMap{
+		nm(ip),
+		nm(ip, broadcast), // listed, though gVisor already added it
+		nm(),
+	} {
+		ns.updateIPs(step)
+		if !hasBroadcast() {
+			t.Fatalf("after updateIPs(%v), %v was removed", step.Addresses, broadcast)
+		}
+	}
+}
+
+func TestOnAddrsChanged(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		changes []AddrsChange
+		logs    []string
+	)
+	ns := makeNetstack(t, func(impl *Impl) {
+		logf := impl.logf
+		impl.logf = func(format string, args ...any) {
+			mu.Lock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+			mu.Unlock()
+			logf(format, args...)
+		}
+		impl.OnAddrsChanged = func(c AddrsChange) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, c)
+		}
+	})
+	ip1 := netip.MustParsePrefix("100.64.0.1/32")
+	ip2 := netip.MustParsePrefix("100.64.0.2/32")
+	nm := func(ipp netip.Prefix) *netmap.NetworkMap {
+		return &netmap.NetworkMap{
+			Addresses: []netip.Prefix{ipp},
+			SelfNode:  &tailcfg.Node{Addresses: []netip.Prefix{ipp}},
+		}
+	}
+	ns.updateIPs(nm(ip1))
+	ns.updateIPs(nm(ip2))
+	ns.updateIPs(nm(ip2)) // no change, so no callback
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes; want 2: %+v", len(changes), changes)
+	}
+	c1, c2 := changes[0], changes[1]
+	if c1.NetmapHash == "" || c1.NetmapHash == c2.NetmapHash {
+		t.Errorf("netmap hashes %q, %q; want distinct and non-empty", c1.NetmapHash, c2.NetmapHash)
+	}
+	if !reflect.DeepEqual(c1.Added, []netip.Prefix{ip1}) || len(c1.Removed) != 0 {
+		t.Errorf("first change = %+v; want %v added", c1, ip1)
+	}
+	if !reflect.DeepEqual(c2.Added, []netip.Prefix{ip2}) || !reflect.DeepEqual(c2.Removed, []netip.Prefix{ip1}) {
+		t.Errorf("second change = %+v; want %v added, %v removed", c2, ip2, ip1)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("registered IP %s (netmap %s)", ip1, c1.NetmapHash),
+		fmt.Sprintf("deregistered IP %s (netmap %s)", ip1, c2.NetmapHash),
+		fmt.Sprintf("registered IP %s (netmap %s)", ip2, c2.NetmapHash),
+	} {
+		found := false
+		for _, l := range logs {
+			found = found || strings.HasSuffix(l, want)
+		}
+		if !found {
+			t.Errorf("no log line ending in %q", want)
+		}
+	}
+}
+
+func TestStaticSubnetAddrsOnly(t *testing.T) {
+	selfIP := netip.MustParsePrefix("100.64.0.1/32")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessSubnets = true
+		impl.StaticSubnetAddrsOnly = true
+	})
+	ns.updateIPs(&netmap.NetworkMap{
+		Addresses: []netip.Prefix{selfIP},
+		SelfNode: &tailcfg.Node{
+			Addresses:  []netip.Prefix{selfIP},
+			AllowedIPs: []netip.Prefix{selfIP, netip.MustParsePrefix("192.0.2.0/24")},
+		},
+	})
+	udp := func(dst netip.AddrPort) *packet.Parsed {
+		p := &packet.Parsed{}
+		p.Decode(packet.Generate(packet.UDP4Header{
+			IP4Header: packet.IP4Header{
+				Src: netip.MustParseAddr("100.64.0.2"),
+				Dst: dst.Addr(),
+			},
+			SrcPort: 1234,
+			DstPort: dst.Port(),
+		}, []byte("hello")))
+		return p
+	}
+	ns.injectInbound(udp(netip.MustParseAddrPort("198.51.100.1:5309")), nil)
+	ns.injectInbound(udp(netip.MustParseAddrPort("192.0.2.5:5310")), nil)
+
+	var conns []ConnInfo
+	for deadline := time.Now().Add(5 * time.Second); len(conns) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		conns = ns.ActiveConns()
+	}
+	if len(conns) != 1 || conns[0].Dst != netip.MustParseAddrPort("192.0.2.5:5310") {
+		t.Errorf("ActiveConns = %+v; want one session to 192.0.2.5:5310", conns)
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if len(ns.connsOpenBySubnetIP) != 0 {
+		t.Errorf("dynamically registered subnet IPs %v; want none", ns.connsOpenBySubnetIP)
+	}
+}
+
+func TestForwardedDests(t *testing.T) {
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+	})
+	dst1 := netip.MustParseAddrPort("192.0.2.1:5311")
+	dst2 := netip.MustParseAddrPort("192.0.2.2:5312")
+	openFlow := func(dst netip.AddrPort) (closeFlow func()) {
+		ns.addSubnetAddress(dst.Addr())
+		var wq waiter.Queue
+		client, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+			NIC:  nicID,
+			Addr: tcpip.Address(dst.Addr().AsSlice()),
+			Port: dst.Port(),
+		}, nil, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan bool)
+		go func() {
+			ns.forwardUDP(client, &wq, netip.MustParseAddrPort("100.64.0.2:0"), dst)
+			close(done)
+		}()
+		return func() {
+			client.Close()
+			<-done
+		}
+	}
+	waitDests := func(want ...netip.AddrPort) {
+		t.Helper()
+		var got []netip.AddrPort
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if got = ns.ForwardedDests(); reflect.DeepEqual(got, want) {
+				return
+			}
+		}
+		t.Fatalf("ForwardedDests = %v; want %v", got, want)
+	}
+
+	close1 := openFlow(dst1)
+	close2 := openFlow(dst2)
+	defer close2()
+	waitDests(dst1, dst2)
+	close1()
+	waitDests(dst2)
+}
+
+func TestCloseIdleUDPSessions(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Unix(1e9, 0)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+		impl.timeNow = func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}
+	})
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	openFlow := func(dst netip.AddrPort) {
+		ns.addSubnetAddress(dst.Addr())
+		var wq waiter.Queue
+		client, err := gonet.DialUDP(ns.ipstack, &tcpip.FullAddress{
+			NIC:  nicID,
+			Addr: tcpip.Address(dst.Addr().AsSlice()),
+			Port: dst.Port(),
+		}, nil, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		go ns.forwardUDP(client, &wq, netip.MustParseAddrPort("100.64.0.2:0"), dst)
+	}
+	waitDests := func(want ...netip.AddrPort) {
+		t.Helper()
+		var got []netip.AddrPort
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if got = ns.ForwardedDests(); reflect.DeepEqual(got, want) {
+				return
+			}
+		}
+		t.Fatalf("ForwardedDests = %v; want %v", got, want)
+	}
+
+	old := netip.MustParseAddrPort("192.0.2.1:5311")
+	recent := netip.MustParseAddrPort("192.0.2.2:5312")
+	openFlow(old)
+	waitDests(old)
+	advance(90 * time.Second)
+	openFlow(recent)
+	waitDests(old, recent)
+	advance(30 * time.Second)
+
+	if n := ns.CloseIdleUDPSessions(time.Hour); n != 0 {
+		t.Errorf("CloseIdleUDPSessions(1h) = %d; want 0", n)
+	}
+	if n := ns.CloseIdleUDPSessions(time.Minute); n != 1 {
+		t.Errorf("CloseIdleUDPSessions(1m) = %d; want 1", n)
+	}
+	waitDests(recent)
+}
+
+func TestOnSubnetAddrRegistered(t *testing.T) {
+	type registration struct{ peer, addr netip.Addr }
+	var got []registration
+	var logs []string
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessSubnets = true
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+		impl.OnSubnetAddrRegistered = func(peer, addr netip.Addr) {
+			got = append(got, registration{peer, addr})
+		}
+		impl.logf = func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		}
+		impl.limitedLogf = logger.RateLimitedFn(impl.logf, time.Minute, 2, 10)
+	})
+	handler := ns.wrapProtoHandler(func(stack.TransportEndpointID, *stack.PacketBuffer) bool { return true })
+	peer := netip.MustParseAddr("100.64.0.2")
+	subnetIP := netip.MustParseAddr("192.0.2.1")
+	tei := stack.TransportEndpointID{
+		LocalAddress:  tcpip.Address(subnetIP.AsSlice()),
+		LocalPort:     80,
+		RemoteAddress: tcpip.Address(peer.AsSlice()),
+		RemotePort:    1234,
+	}
+	handler(tei, nil)
+	handler(tei, nil) // already registered
+
+	if want := []registration{{peer, subnetIP}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("registrations = %v; want %v", got, want)
+	}
+	wantLog := "netstack: registered subnet IP 192.0.2.1 for traffic from 100.64.0.2"
+	n := 0
+	for _, l := range logs {
+		if l == wantLog {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d %q logs; want 1 in %q", n, wantLog, logs)
+	}
+
+	// A peer scanning a subnet registers every address, but doesn't
+	// flood the log.
+	for i := 2; i < 102; i++ {
+		tei.LocalAddress = tcpip.Address(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}).AsSlice())
+		handler(tei, nil)
+	}
+	if len(got) != 101 {
+		t.Errorf("got %d registrations; want 101", len(got))
+	}
+	if len(logs) > 20 {
+		t.Errorf("got %d logs for 101 registrations; want them rate limited", len(logs))
+	}
+}
+
+func TestUptime(t *testing.T) {
+	clock := &tstest.Clock{Start: time.Unix(1e9, 0)}
+	var ns *Impl
+	makeNetstack(t, func(impl *Impl) {
+		ns = impl
+		impl.timeNow = clock.Now
+		if got := impl.StartedAt(); !got.IsZero() {
+			t.Errorf("before Start, StartedAt = %v; want zero", got)
+		}
+		if got := impl.Uptime(); got != 0 {
+			t.Errorf("before Start, Uptime = %v; want 0", got)
+		}
+	})
+	if got, want := ns.StartedAt(), clock.Now(); !got.Equal(want) {
+		t.Errorf("StartedAt = %v; want %v", got, want)
+	}
+	clock.Advance(90 * time.Second)
+	if got := ns.Uptime(); got != 90*time.Second {
+		t.Errorf("Uptime = %v; want 1m30s", got)
+	}
+}
+
+func TestRegisteredIPs(t *testing.T) {
+	ns := makeNetstack(t, func(*Impl) {})
+	base := ns.RegisteredIPs()
+	ip := netip.MustParseAddr("192.0.2.1")
+	for _, p := range base {
+		if p.Addr() == ip {
+			t.Fatalf("RegisteredIPs = %v before adding %v", base, ip)
+		}
+	}
+
+	ns.addSubnetAddress(ip)
+	got := ns.RegisteredIPs()
+	want := append(append([]netip.Prefix(nil), base...), netip.PrefixFrom(ip, 32))
+	sortPrefixes(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after add: RegisteredIPs = %v; want %v", got, want)
+	}
+
+	ns.removeSubnetAddress(ip)
+	if got := ns.RegisteredIPs(); !reflect.DeepEqual(got, base) {
+		t.Errorf("after remove: RegisteredIPs = %v; want %v", got, base)
+	}
+}
+
+func TestUDPParseError(t *testing.T) {
+	var flows []string
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.OnUDPParseError = func(flow string) { flows = append(flows, flow) }
+	})
+	good := stack.TransportEndpointID{
+		LocalAddress:  tcpip.Address(netip.MustParseAddr("100.64.0.1").AsSlice()),
+		LocalPort:     53,
+		RemoteAddress: tcpip.Address(netip.MustParseAddr("100.64.0.2").AsSlice()),
+		RemotePort:    1234,
+	}
+	if _, _, ok := ns.udpFlowAddrs(good); !ok {
+		t.Fatal("udpFlowAddrs failed for a valid flow")
+	}
+	bad := good
+	bad.RemoteAddress = "\x01\x02\x03" // neither IPv4 nor IPv6
+	if _, _, ok := ns.udpFlowAddrs(bad); ok {
+		t.Fatal("udpFlowAddrs succeeded for an unparseable address")
+	}
+	if n := ns.udpParseErrors.Load(); n != 1 {
+		t.Errorf("udpParseErrors = %d; want 1", n)
+	}
+	if len(flows) != 1 || !strings.HasSuffix(flows[0], "-> 100.64.0.1:53") {
+		t.Errorf("OnUDPParseError calls = %q; want one for the flow to 100.64.0.1:53", flows)
+	}
+}
+
+func TestBlockedForwardPorts(t *testing.T) {
+	closed := make(chan ConnInfo, 10)
+	dialed := make(chan string, 10)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessSubnets = true
+		impl.BlockedForwardPorts = []uint16{25, 445}
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+		impl.OnConnClose = func(ci ConnInfo) {
+			if ci.CloseReason == CloseBlocked {
+				closed <- ci
+			}
+		}
+		impl.backendDialFunc = func(_ context.Context, _, addr string) (net.Conn, error) {
+			dialed <- addr
+			return nil, errors.New("test dial")
+		}
+	})
+	src := netip.MustParseAddr("100.64.0.2")
+	dst := netip.MustParseAddr("192.0.2.1")
+	inject := func(proto ipproto.Proto, port uint16) {
+		var b []byte
+		if proto == ipproto.TCP {
+			b = tcpSYN4(netip.AddrPortFrom(src, 1234), netip.AddrPortFrom(dst, port))
+		} else {
+			b = packet.Generate(packet.UDP4Header{
+				IP4Header: packet.IP4Header{Src: src, Dst: dst},
+				SrcPort:   1234,
+				DstPort:   port,
+			}, []byte("hello"))
+		}
+		p := &packet.Parsed{}
+		p.Decode(b)
+		ns.injectInbound(p, nil)
+	}
+	wantBlocked := func(proto ipproto.Proto, port uint16) {
+		t.Helper()
+		select {
+		case ci := <-closed:
+			if ci.Proto != proto || ci.Dst != netip.AddrPortFrom(dst, port) {
+				t.Errorf("blocked %v %v; want %v %v", ci.Proto, ci.Dst, proto, netip.AddrPortFrom(dst, port))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v to port %d wasn't blocked", proto, port)
+		}
+	}
+
+	inject(ipproto.TCP, 25)
+	wantBlocked(ipproto.TCP, 25)
+	inject(ipproto.UDP, 445)
+	wantBlocked(ipproto.UDP, 445)
+
+	inject(ipproto.TCP, 80)
+	select {
+	case addr := <-dialed:
+		if addr != "192.0.2.1:80" {
+			t.Errorf("dialed %s; want 192.0.2.1:80", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TCP to an unblocked port wasn't forwarded")
+	}
+	inject(ipproto.UDP, 53)
+	for deadline := time.Now().Add(5 * time.Second); len(ns.ActiveConns()) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("UDP to an unblocked port wasn't forwarded")
+		}
+	}
+	select {
+	case ci := <-closed:
+		t.Errorf("unexpectedly blocked %v %v", ci.Proto, ci.Dst)
+	default:
+	}
+}
+
+func TestRewriteUDP(t *testing.T) {
+	ns := makeNetstack(t, func(*Impl) {})
+	listen := func() net.PacketConn {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	sender, src, dst, receiver := listen(), listen(), listen(), listen()
+
+	rewrite := func(payload []byte) []byte {
+		if string(payload) == "drop" {
+			return nil
+		}
+		return bytes.ToUpper(payload)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ns.startPacketCopy(ctx, cancel, DirToServer, dst, receiver.LocalAddr(), src, netip.AddrPort{}, rewrite, func(int) {}, func(error, bool) {})
+
+	for _, msg := range []string{"drop", "hello"} {
+		if _, err := sender.WriteTo([]byte(msg), src.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The dropped packet was sent first, so if it had been forwarded
+	// it would have been read first.
+	if got := string(buf[:n]); got != "HELLO" {
+		t.Errorf("received %q; want %q", got, "HELLO")
+	}
+}
+
+func TestUDPReplySource(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.StrictUDPReplySource = strict
+			})
+			listen := func() net.PacketConn {
+				c, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { c.Close() })
+				return c
+			}
+			backend, other, backendConn, client := listen(), listen(), listen(), listen()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			wantSrc := backend.LocalAddr().(*net.UDPAddr).AddrPort()
+			ns.startPacketCopy(ctx, cancel, DirToClient, client, client.LocalAddr(), backendConn, wantSrc, nil, func(int) {}, func(error, bool) {})
+
+			if _, err := other.WriteTo([]byte("other"), backendConn.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := backend.WriteTo([]byte("backend"), backendConn.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 100)
+			n, _, err := client.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "other"
+			if strict {
+				want = "backend"
+			}
+			if got := string(buf[:n]); got != want {
+				t.Errorf("client received %q first; want %q", got, want)
+			}
+			if got := ns.Stats().UDPRepliesFromOthers; got != 1 {
+				t.Errorf("UDPRepliesFromOthers = %d; want 1", got)
+			}
+		})
+	}
+}
+
+func TestUDPSharedBackendSocket(t *testing.T) {
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.UDPSharedBackendSocket = true
+	})
+	// Backends that echo packets back, prefixed with their name.
+	backend := func(name string) netip.AddrPort {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		go func() {
+			buf := make([]byte, 100)
+			for {
+				n, from, err := c.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				c.WriteTo(append([]byte(name+":"), buf[:n]...), from)
+			}
+		}()
+		return c.LocalAddr().(*net.UDPAddr).AddrPort()
+	}
+	b1, b2 := backend("b1"), backend("b2")
+	clientA := netip.MustParseAddrPort("100.64.0.2:0")
+	clientB := netip.MustParseAddrPort("100.64.0.3:0")
+	flow := func(client, backend netip.AddrPort) *sharedUDPFlow {
+		f, err := ns.sharedUDPFlow(client, backend, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	a1, a2, b := flow(clientA, b1), flow(clientA, b2), flow(clientB, b1)
+	if _, err := ns.sharedUDPFlow(clientA, b1, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err == nil {
+		t.Error("second session from client A to b1 shared its socket")
+	}
+	if a1.LocalAddr().String() != a2.LocalAddr().String() {
+		t.Errorf("client A's sessions use sockets %v and %v; want one", a1.LocalAddr(), a2.LocalAddr())
+	}
+	if a1.LocalAddr().String() == b.LocalAddr().String() {
+		t.Errorf("clients A and B share socket %v", a1.LocalAddr())
+	}
+
+	for _, tt := range []struct {
+		f    *sharedUDPFlow
+		msg  string
+		want string
+	}{
+		{a1, "A", "b1:A"},
+		{a2, "A", "b2:A"},
+		{b, "B", "b1:B"},
+	} {
+		if _, err := tt.f.WriteTo([]byte(tt.msg), net.UDPAddrFromAddrPort(tt.f.backend)); err != nil {
+			t.Fatal(err)
+		}
+		got := make(chan string, 1)
+		go func() {
+			buf := make([]byte, 100)
+			n, _, _ := tt.f.ReadFrom(buf)
+			got <- string(buf[:n])
+		}()
+		select {
+		case g := <-got:
+			if g != tt.want {
+				t.Errorf("session to %v got %q; want %q", tt.f.backend, g, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("session to %v got no reply", tt.f.backend)
+		}
+	}
+
+	for _, f := range []*sharedUDPFlow{a1, a2, b} {
+		f.Close()
+	}
+	ns.udpSharedMu.Lock()
+	defer ns.udpSharedMu.Unlock()
+	if n := len(ns.udpSharedSockets); n != 0 {
+		t.Errorf("%d shared sockets left open after closing all sessions", n)
+	}
+}
+
+func TestUDPBackendBindAddr(t *testing.T) {
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.UDPBackendBindAddr = func(dst netip.AddrPort) netip.Addr {
+			switch dst.Port() {
+			case 1:
+				return netip.MustParseAddr("192.168.1.2")
+			case 2:
+				return netip.MustParseAddr("2001:db8::2") // wrong family for IPv4
+			}
+			return netip.Addr{}
+		}
+	})
+	tests := []struct {
+		dst  string
+		want string
+	}{
+		{"192.0.2.1:1", "192.168.1.2"},
+		{"192.0.2.1:2", "0.0.0.0"},
+		{"192.0.2.1:3", "0.0.0.0"},
+		{"[2001:db8::1]:2", "2001:db8::2"},
+		{"[2001:db8::1]:3", "::"},
+	}
+	for _, tt := range tests {
+		dst := netip.MustParseAddrPort(tt.dst)
+		if got := ns.udpBackendBindIP(dst, dst.Addr().Is4()); got.String() != tt.want {
+			t.Errorf("udpBackendBindIP(%v) = %v; want %v", tt.dst, got, tt.want)
+		}
+	}
+
+	ns.UDPBackendBindAddr = nil
+	if got := ns.udpBackendBindIP(netip.MustParseAddrPort("192.0.2.1:1"), true); got != netip.IPv4Unspecified() {
+		t.Errorf("without UDPBackendBindAddr, bound to %v; want 0.0.0.0", got)
+	}
+}
+
+func TestUDPBackendFamily(t *testing.T) {
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.UDPBackendFamily = func(dst netip.AddrPort) bool { return dst.Port() == 4 }
+	})
+	tests := []struct {
+		dst        string
+		wantListen string
+		wantRemote string
+	}{
+		{"192.0.2.1:6", "[::]:1234", "[::ffff:192.0.2.1]:6"},
+		{"[::ffff:192.0.2.1]:4", "0.0.0.0:1234", "192.0.2.1:4"},
+		{"[2001:db8::1]:4", "[::]:1234", "[2001:db8::1]:4"}, // can't be IPv4
+		{"[2001:db8::1]:6", "[::]:1234", "[2001:db8::1]:6"},
+	}
+	for _, tt := range tests {
+		listen, remote := ns.udpBackendAddrs(netip.MustParseAddrPort(tt.dst), 1234)
+		if listen.String() != tt.wantListen || remote.AddrPort().String() != tt.wantRemote {
+			t.Errorf("udpBackendAddrs(%v) = %v, %v; want %v, %v", tt.dst, listen, remote.AddrPort(), tt.wantListen, tt.wantRemote)
+		}
+	}
+
+	// Forced to IPv6, a socket still reaches an IPv4 backend.
+	backend, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	listen, remote := ns.udpBackendAddrs(backend.LocalAddr().(*net.UDPAddr).AddrPort(), 0)
+	c, err := ns.listenUDPBackend(listen)
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	defer c.Close()
+	if ip := c.LocalAddr().(*net.UDPAddr).IP; ip.To4() != nil {
+		t.Errorf("backend socket bound to %v; want IPv6", ip)
+	}
+	if _, err := c.WriteTo([]byte("hello"), remote); err != nil {
+		t.Skipf("not dual-stack: %v", err)
+	}
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, _, err := backend.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("backend got %q, %v; want \"hello\"", buf[:n], err)
+	}
+}
+
+func TestUDPPortUnreachable(t *testing.T) {
+	var errs [][]byte
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+		// Not an address of this host, so the backend socket can't be
+		// bound.
+		impl.UDPBackendBindAddr = func(netip.AddrPort) netip.Addr { return netip.MustParseAddr("192.0.2.200") }
+		impl.portUnreachableFunc = func(pkt []byte) { errs = append(errs, pkt) }
+	})
+	client := netip.MustParseAddrPort("100.64.0.2:1234")
+	dst := netip.MustParseAddrPort("192.0.2.1:5353")
+	ns.forwardUDP(nil, nil, client, dst)
+
+	if len(errs) != 1 {
+		t.Fatalf("got %d ICMP errors; want 1", len(errs))
+	}
+	var p packet.Parsed
+	p.Decode(errs[0])
+	if !p.IsError() || p.Src.Addr() != dst.Addr() || p.Dst.Addr() != client.Addr() {
+		t.Fatalf("got %v; want ICMP error from %v to %v", &p, dst.Addr(), client.Addr())
+	}
+	if h := p.ICMP4Header(); h.Type != packet.ICMP4Unreachable || h.Code != icmp4PortUnreachable {
+		t.Errorf("got ICMP type %v code %v; want port unreachable", h.Type, h.Code)
+	}
+	// The error quotes the client's packet.
+	var quoted packet.Parsed
+	quoted.Decode(p.Payload()[4:])
+	if quoted.IPProto != ipproto.UDP || quoted.Src != client || quoted.Dst != dst {
+		t.Errorf("quoted packet = %v; want UDP from %v to %v", &quoted, client, dst)
+	}
+}
+
+func TestPacketRatesToHostAndPeers(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+	})
+	addLocalIP(t, ns, localIP)
+
+	// A MagicDNS reply goes back to the host.
+	query := &packet.Parsed{}
+	query.Decode(packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{Src: netip.MustParseAddr("100.64.0.2"), Dst: magicDNSIP},
+		SrcPort:   1234,
+		DstPort:   53,
+	}, dnsQuery(t, "example.com.", dnsmessage.TypeA)))
+	ns.handleLocalPackets(query, nil)
+
+	// Traffic from a local IP goes out to peers.
+	c, err := gonet.DialUDP(ns.ipstack,
+		&tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(localIP.AsSlice())},
+		&tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(netip.MustParseAddr("100.64.0.2").AsSlice()), Port: 1234},
+		ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	var st PacketStats
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if st = ns.PacketRates(PacketStats{}); st.ToHost == 1 && st.ToPeers == 1 {
+			return
+		}
+	}
+	t.Errorf("got ToHost=%d ToPeers=%d; want 1, 1", st.ToHost, st.ToPeers)
+}
+
+// writeSizeConn is a net.Conn that records the size of the largest
+// Write to it.
+type writeSizeConn struct {
+	net.Conn
+	max atomic.Int64
+}
+
+func (c *writeSizeConn) Write(b []byte) (int, error) {
+	if n := int64(len(b)); n > c.max.Load() {
+		c.max.Store(n)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestTCPCopyBufferSize(t *testing.T) {
+	const size = 10000
+	for _, bufSize := range []int{0, 1024} {
+		t.Run(fmt.Sprint(bufSize), func(t *testing.T) {
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.TCPCopyBufferSize = bufSize
+			})
+			server, backend := net.Pipe()
+			clientConn, peer := net.Pipe()
+			client := &writeSizeConn{Conn: clientConn}
+			defer server.Close()
+			defer client.Close()
+			go func() {
+				backend.Write(make([]byte, size))
+				backend.Close()
+			}()
+			go io.Copy(io.Discard, peer)
+
+			if _, err := ns.proxyTCP(client, server, nil); err != nil {
+				t.Fatalf("proxyTCP: %v", err)
+			}
+			got := client.max.Load()
+			if bufSize != 0 && got > int64(bufSize) {
+				t.Errorf("largest write was %d bytes; want at most %d", got, bufSize)
+			}
+			if bufSize == 0 && got <= 1024 {
+				t.Errorf("largest write was %d bytes; want io.Copy's larger default", got)
+			}
+		})
+	}
+
+	ns := &Impl{TCPCopyBufferSize: 1}
+	if err := ns.Start(); err == nil {
+		t.Errorf("Start with TCPCopyBufferSize 1 succeeded; want error")
+	}
+}
+
+func TestReplaceLocalBackend(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		setTestLocalBackend(t, impl)
+	})
+	ack := func(port uint16) *packet.Parsed {
+		p := new(packet.Parsed)
+		p.Decode(packet.Generate(packet.IP4Header{
+			IPProto: ipproto.TCP,
+			Src:     netip.MustParseAddr("100.64.0.2"),
+			Dst:     localIP,
+		}, tcpSegment(1234, port, packet.TCPAck)))
+		return p
+	}
+
+	// Pretend the first LocalBackend reported a peerapi port.
+	atomic.StoreUint32(&ns.peerapiPort4Atomic, 12345)
+	if !ns.shouldProcessInbound(ack(12345), nil) {
+		t.Fatal("peerapi packet not processed")
+	}
+
+	ns.ReplaceLocalBackend(nil)
+	for _, port := range []uint16{22, 12345} {
+		if ns.shouldProcessInbound(ack(port), nil) {
+			t.Errorf("packet to port %d processed without a LocalBackend", port)
+		}
+	}
+
+	setTestLocalBackend(t, ns)
+	ns.ReplaceLocalBackend(ns.lb.Load())
+	if ns.shouldProcessInbound(ack(12345), nil) {
+		t.Errorf("packet to the old LocalBackend's peerapi port processed")
+	}
+	lookups := ns.peerAPIPortLookups.Load()
+	syn := ack(443)
+	syn.TCPFlags = packet.TCPSyn
+	ns.shouldProcessInbound(syn, nil)
+	if ns.peerAPIPortLookups.Load() != lookups+1 {
+		t.Errorf("new LocalBackend wasn't asked for the peerapi port")
+	}
+}
+
+// newTestStack returns a gVisor stack with a single NIC at ip, whose link
+// is the returned channel endpoint.
+func newTestStack(t *testing.T, ip netip.Addr) (*stack.Stack, *channel.Endpoint) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	t.Cleanup(s.Close)
+	ep := channel.New(512, 1280, "")
+	if err := s.CreateNIC(1, ep); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.Address(ip.AsSlice()).WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+	return s, ep
+}
+
+// relayPackets copies packets from one test link to another until ctx is
+// done, dropping those for which drop returns true.
+func relayPackets(ctx context.Context, from, to *channel.Endpoint, drop func(*packet.Parsed) bool) {
+	var p packet.Parsed
+	for {
+		pkt := from.ReadContext(ctx)
+		if pkt == nil {
+			return
+		}
+		b := stack.PayloadSince(pkt.NetworkHeader()).AsSlice()
+		pkt.DecRef()
+		if p.Decode(b); drop(&p) {
+			continue
+		}
+		pb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: bufferv2.MakeWithData(b)})
+		to.InjectInbound(ipv4.ProtocolNumber, pb)
+		pb.DecRef()
+	}
+}
+
+// acceptTestTCPConn joins a "server" stack, standing in for the peer
+// side of netstack, and a peer stack (10.0.0.1 and 10.0.0.2), with a
+// link from the server that drops packets for which drop returns true.
+// It returns the peer's end of a connection to 10.0.0.1:80 and the
+// server's accepted endpoint and its wait queue.
+func acceptTestTCPConn(t *testing.T, drop func(*packet.Parsed) bool) (peerConn *gonet.TCPConn, clientEP tcpip.Endpoint, wq *waiter.Queue) {
+	t.Helper()
+	serverIP := netip.MustParseAddr("10.0.0.1")
+	peerIP := netip.MustParseAddr("10.0.0.2")
+	serverStack, serverLink := newTestStack(t, serverIP)
+	peerStack, peerLink := newTestStack(t, peerIP)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go relayPackets(ctx, serverLink, peerLink, drop)
+	go relayPackets(ctx, peerLink, serverLink, func(*packet.Parsed) bool { return false })
+
+	var lwq waiter.Queue
+	lep, terr := serverStack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &lwq)
+	if terr != nil {
+		t.Fatal(terr)
+	}
+	t.Cleanup(lep.Close)
+	if err := lep.Bind(tcpip.FullAddress{NIC: 1, Addr: tcpip.Address(serverIP.AsSlice()), Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lep.Listen(1); err != nil {
+		t.Fatal(err)
+	}
+	we, acceptCh := waiter.NewChannelEntry(waiter.EventIn)
+	lwq.EventRegister(&we)
+	defer lwq.EventUnregister(&we)
+
+	peerConn, err := gonet.DialTCP(peerStack, tcpip.FullAddress{NIC: 1, Addr: tcpip.Address(serverIP.AsSlice()), Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peerConn.Close() })
+	for clientEP == nil {
+		var terr tcpip.Error
+		clientEP, wq, terr = lep.Accept(nil)
+		if _, ok := terr.(*tcpip.ErrWouldBlock); ok {
+			<-acceptCh
+		} else if terr != nil {
+			t.Fatal(terr)
+		}
+	}
+	return peerConn, clientEP, wq
+}
+
+func TestActiveConnsTCPStats(t *testing.T) {
+	closed := make(chan ConnInfo, 1)
+	backend, backendPeer := net.Pipe()
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.OnConnClose = func(ci ConnInfo) { closed <- ci }
+		impl.backendDialFunc = func(context.Context, string, string) (net.Conn, error) {
+			return backend, nil
+		}
+	})
+
+	// Drop one data segment from the server.
+	var dataSegs int
+	peerConn, clientEP, wq := acceptTestTCPConn(t, func(p *packet.Parsed) bool {
+		if p.IPProto != ipproto.TCP || len(p.Payload()) == 0 {
+			return false
+		}
+		dataSegs++
+		return dataSegs == 5
+	})
+	getClient := func(...tcpip.SettableSocketOption) *gonet.TCPConn {
+		return gonet.NewTCPConn(wq, clientEP)
+	}
+
+	src := netip.MustParseAddrPort("10.0.0.2:1234")
+	dst := netip.MustParseAddrPort("10.0.0.1:80")
+	go ns.forwardTCP(getClient, &clientEP, src, dst, wq, netip.MustParseAddrPort("127.0.0.1:80"))
+
+	const size = 64 << 10
+	go backendPeer.Write(make([]byte, size))
+	if _, err := io.ReadFull(peerConn, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := ns.ActiveConns()
+	if len(conns) != 1 || conns[0].TCP == nil {
+		t.Fatalf("ActiveConns = %+v; want one TCP conn with stats", conns)
+	}
+	if st := conns[0].TCP; st.Retransmits == 0 || st.Cwnd == 0 {
+		t.Errorf("TCP stats = %+v; want non-zero Retransmits and Cwnd", *st)
+	}
+
+	backendPeer.Close()
+	select {
+	case ci := <-closed:
+		if ci.TCP == nil || ci.TCP.Retransmits == 0 {
+			t.Errorf("OnConnClose TCP stats = %+v; want non-zero Retransmits", ci.TCP)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnConnClose not called")
+	}
+}
+
+func TestActiveConnsSendBuffer(t *testing.T) {
+	backend, backendPeer := net.Pipe()
+	defer backendPeer.Close()
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.backendDialFunc = func(context.Context, string, string) (net.Conn, error) {
+			return backend, nil
+		}
+	})
+	// Once stalled, the link from the server drops everything.
+	var stalled atomic.Bool
+	peerConn, clientEP, wq := acceptTestTCPConn(t, func(*packet.Parsed) bool { return stalled.Load() })
+	getClient := func(...tcpip.SettableSocketOption) *gonet.TCPConn {
+		return gonet.NewTCPConn(wq, clientEP)
+	}
+	go ns.forwardTCP(getClient, &clientEP, netip.MustParseAddrPort("10.0.0.2:1234"), netip.MustParseAddrPort("10.0.0.1:80"), wq, netip.MustParseAddrPort("127.0.0.1:80"))
+
+	// waitStats waits for the conn's TCPStats to satisfy ok.
+	waitStats := func(what string, ok func(*TCPStats) bool) *TCPStats {
+		t.Helper()
+		var st *TCPStats
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+			if conns := ns.ActiveConns(); len(conns) == 1 && conns[0].TCP != nil {
+				if st = conns[0].TCP; ok(st) {
+					return st
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("TCP stats = %+v; want %s", st, what)
+			}
+		}
+	}
+	initial := waitStats("a connection", func(st *TCPStats) bool { return true })
+	if initial.SendBufSize <= 0 || initial.SendBufFull {
+		t.Errorf("initial stats = %+v; want an empty send buffer", *initial)
+	}
+
+	// Over a clean link, slow start grows the window.
+	const size = 256 << 10
+	go backendPeer.Write(make([]byte, size))
+	if _, err := io.ReadFull(peerConn, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	grown := waitStats("a grown cwnd", func(st *TCPStats) bool { return st.Cwnd > initial.Cwnd })
+
+	// When the link stalls, the send buffer fills, and the
+	// retransmission timeout shrinks the window.
+	stalled.Store(true)
+	go backendPeer.Write(make([]byte, 4*initial.SendBufSize))
+	waitStats("a full send buffer and shrunk cwnd", func(st *TCPStats) bool {
+		return st.SendBufFull && st.Cwnd < grown.Cwnd
+	})
+}
+
+// errReadConn is a net.Conn whose reads fail with err.
+type errReadConn struct {
+	net.Conn
+	err error
+}
+
+func (c errReadConn) Read([]byte) (int, error) { return 0, c.err }
+
+func TestOnForwardError(t *testing.T) {
+	type forwardError struct {
+		dst netip.AddrPort
+		err error
+	}
+	errs := make(chan forwardError, 10)
+	errReset := errors.New("test backend reset")
+	backend, backendPeer := net.Pipe()
+	defer backendPeer.Close()
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.OnForwardError = func(dst netip.AddrPort, err error) { errs <- forwardError{dst, err} }
+		impl.backendDialFunc = func(context.Context, string, string) (net.Conn, error) {
+			return errReadConn{backend, errReset}, nil
+		}
+	})
+
+	// TCP: the backend fails.
+	_, clientEP, wq := acceptTestTCPConn(t, func(*packet.Parsed) bool { return false })
+	getClient := func(...tcpip.SettableSocketOption) *gonet.TCPConn {
+		return gonet.NewTCPConn(wq, clientEP)
+	}
+	dst := netip.MustParseAddrPort("10.0.0.1:80")
+	go ns.forwardTCP(getClient, &clientEP, netip.MustParseAddrPort("10.0.0.2:1234"), dst, wq, netip.MustParseAddrPort("127.0.0.1:80"))
+	select {
+	case got := <-errs:
+		if got.dst != dst || !errors.Is(got.err, errReset) {
+			t.Errorf("OnForwardError(%v, %v); want (%v, %v)", got.dst, got.err, dst, errReset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnForwardError not called for TCP")
+	}
+
+	// EOF isn't an error.
+	ns.forwardError(dst, io.EOF)
+	select {
+	case got := <-errs:
+		t.Errorf("OnForwardError(%v, %v) for EOF", got.dst, got.err)
+	default:
+	}
+
+	// UDP: startPacketCopy reports failing to write to the backend,
+	// which forwardUDP passes to OnForwardError.
+	src, sender := udpPair(t)
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	type copyFailure struct {
+		err       error
+		srcClosed bool
+	}
+	failed := make(chan copyFailure, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ns.startPacketCopy(ctx, cancel, DirToServer, closed, sender.LocalAddr(), src, netip.AddrPort{}, nil, func(int) {}, func(err error, srcClosed bool) {
+		failed <- copyFailure{err, srcClosed}
+	})
+	if _, err := sender.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case f := <-failed:
+		if f.srcClosed || !errors.Is(f.err, net.ErrClosed) {
+			t.Errorf("startPacketCopy failed with %v, srcClosed=%v; want write error", f.err, f.srcClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("startPacketCopy didn't report the write error")
+	}
+}
+
+func TestClientTCPNoDelay(t *testing.T) {
+	delay := func(ns *Impl) bool {
+		var wq waiter.Queue
+		ep, err := ns.ipstack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ep.Close()
+		ns.applyClientNoDelay(ep)
+		return ep.SocketOptions().GetDelayOption()
+	}
+	tests := []struct {
+		noDelay   string
+		wantDelay bool
+	}{
+		{"", false}, // gVisor's default
+		{"true", false},
+		{"false", true},
+	}
+	for _, tt := range tests {
+		ns := makeNetstack(t, func(impl *Impl) { impl.ClientTCPNoDelay = opt.Bool(tt.noDelay) })
+		if got := delay(ns); got != tt.wantDelay {
+			t.Errorf("ClientTCPNoDelay %q: delay = %v; want %v", tt.noDelay, got, tt.wantDelay)
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	keepalive := func(ns *Impl) KeepaliveConfig {
+		var wq waiter.Queue
+		ep, err := ns.ipstack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ep.Close()
+		ns.applyKeepaliveConfig(ep)
+		var idle tcpip.KeepaliveIdleOption
+		var interval tcpip.KeepaliveIntervalOption
+		ep.GetSockOpt(&idle)
+		ep.GetSockOpt(&interval)
+		count, _ := ep.GetSockOptInt(tcpip.KeepaliveCountOption)
+		return KeepaliveConfig{time.Duration(idle), time.Duration(interval), count}
+	}
+
+	def := KeepaliveConfig{tcp.DefaultKeepaliveIdle, tcp.DefaultKeepaliveInterval, tcp.DefaultKeepaliveCount}
+	if got := keepalive(makeNetstack(t, func(*Impl) {})); got != def {
+		t.Errorf("default keepalive = %+v; want %+v", got, def)
+	}
+	ka := &KeepaliveConfig{Idle: time.Minute, Interval: 5 * time.Second, Count: 3}
+	if got := keepalive(makeNetstack(t, func(impl *Impl) { impl.Keepalive = ka })); got != *ka {
+		t.Errorf("keepalive = %+v; want %+v", got, *ka)
+	}
+
+	for _, bad := range []KeepaliveConfig{
+		{Idle: 0, Interval: time.Second, Count: 1},
+		{Idle: time.Second, Interval: -time.Second, Count: 1},
+		{Idle: time.Second, Interval: time.Second, Count: 0},
+	} {
+		bad := bad
+		ns := &Impl{Keepalive: &bad}
+		if err := ns.Start(); err == nil {
+			t.Errorf("Start with Keepalive %+v succeeded; want error", bad)
+		}
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	release := make(chan struct{})
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.MaxConns = 2
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.backendDialFunc = func(context.Context, string, string) (net.Conn, error) {
+			<-release // hold the connection until the test is done with it
+			return nil, errors.New("test dial")
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	peer := netip.MustParseAddr("100.64.0.2")
+	for i := 0; i < 3; i++ {
+		p := &packet.Parsed{}
+		p.Decode(tcpSYN4(netip.AddrPortFrom(peer, uint16(1000+i)), netip.AddrPortFrom(localIP, 80)))
+		ns.injectInbound(p, nil)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ns.Stats().ConnsOverLimit < 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v; want 1 ConnsOverLimit", ns.Stats())
+		}
+	}
+
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	sendUDP := func(srcPort uint16) {
+		p := &packet.Parsed{}
+		p.Decode(packet.Generate(packet.UDP4Header{
+			IP4Header: packet.IP4Header{Src: peer, Dst: localIP},
+			SrcPort:   srcPort,
+			DstPort:   uint16(backend.LocalAddr().(*net.UDPAddr).Port),
+		}, []byte(fmt.Sprint(srcPort))))
+		ns.injectInbound(p, nil)
+	}
+	// Over the limit, a new UDP session is dropped.
+	sendUDP(2000)
+	if n := ns.Stats().ConnsOverLimit; n != 2 {
+		t.Errorf("ConnsOverLimit = %d after UDP session; want 2", n)
+	}
+
+	// Once the TCP connections end, there's room again.
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); ns.forwardingConns.Load() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d flows still forwarded; want 0", ns.forwardingConns.Load())
+		}
+	}
+	sendUDP(2001)
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, _, err := backend.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "2001" {
+		t.Errorf("backend got %q; want the second UDP session's %q", got, "2001")
+	}
+}
+
+func TestResolveBackend(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	var (
+		mu       sync.Mutex
+		resolves int
+	)
+	dialed := make(chan string, 10)
+	clock := &tstest.Clock{Start: time.Unix(1000, 0)}
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.timeNow = clock.Now
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.ResolveBackend = func(_ context.Context, port uint16, src netip.Addr) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			resolves++
+			if port == 81 {
+				return "", errors.New("no such service")
+			}
+			return fmt.Sprintf("127.0.0.%d:8080", resolves+1), nil
+		}
+		impl.backendDialFunc = func(_ context.Context, _, addr string) (net.Conn, error) {
+			dialed <- addr
+			return nil, errors.New("test dial")
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	peer := netip.MustParseAddr("100.64.0.2")
+	srcPort := uint16(1000)
+	connect := func(port uint16) {
+		srcPort++
+		p := &packet.Parsed{}
+		p.Decode(tcpSYN4(netip.AddrPortFrom(peer, srcPort), netip.AddrPortFrom(localIP, port)))
+		ns.injectInbound(p, nil)
+	}
+	wantDial := func(want string) {
+		t.Helper()
+		select {
+		case got := <-dialed:
+			if got != want {
+				t.Errorf("dialed %v; want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no dial; want one to %v", want)
+		}
+	}
+
+	connect(80)
+	wantDial("127.0.0.2:8080")
+	connect(80) // cached
+	wantDial("127.0.0.2:8080")
+	clock.Advance(resolveBackendTTL)
+	connect(80) // expired, so looked up again
+	wantDial("127.0.0.3:8080")
+
+	// A failed resolution rejects the connection without dialing.
+	// The three failed dials were rejected too. The lookup also
+	// sweeps the now expired entry for port 80.
+	clock.Advance(resolveBackendTTL)
+	connect(81)
+	for deadline := time.Now().Add(5 * time.Second); ns.HandlerStats()["rejected"] != 4; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("HandlerStats = %v; want 4 rejected", ns.HandlerStats())
+		}
+	}
+	select {
+	case addr := <-dialed:
+		t.Errorf("dialed %v after failed resolution", addr)
+	default:
+	}
+	ns.mu.Lock()
+	if n := len(ns.resolvedBackends); n != 0 {
+		t.Errorf("%d cached backends after expiry; want 0", n)
+	}
+	ns.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	if resolves != 3 {
+		t.Errorf("ResolveBackend called %d times; want 3", resolves)
+	}
+}
+
+func TestResolveBackendCanceledByRST(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	started := make(chan bool, 1)
+	canceled := make(chan bool, 1)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.ResolveBackend = func(ctx context.Context, port uint16, src netip.Addr) (string, error) {
+			started <- true
+			<-ctx.Done()
+			canceled <- true
+			return "", ctx.Err()
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	src := netip.MustParseAddrPort("100.64.0.2:1000")
+	dst := netip.AddrPortFrom(localIP, 80)
+
+	p := &packet.Parsed{}
+	p.Decode(tcpSYN4(src, dst))
+	ns.injectInbound(p, nil)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ResolveBackend not called")
+	}
+
+	// The client giving up on the connection cancels the lookup.
+	p = &packet.Parsed{}
+	p.Decode(packet.Generate(packet.IP4Header{
+		IPProto: ipproto.TCP,
+		Src:     src.Addr(),
+		Dst:     dst.Addr(),
+	}, tcpSegment(src.Port(), dst.Port(), packet.TCPRst)))
+	ns.injectInbound(p, nil)
+	select {
+	case <-canceled:
+	case <-time.After(resolveBackendTimeout / 2):
+		t.Fatal("lookup not canceled by RST")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ns.HandlerStats()["rejected"] != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("HandlerStats = %v; want 1 rejected", ns.HandlerStats())
+		}
+	}
+}
+
+func TestLogRejectedPeers(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	known := netip.MustParseAddr("100.64.0.2")
+	unknown := netip.MustParseAddr("100.64.0.3")
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	rejects := make(chan RejectInfo, 10)
+	ns := makeNetstack(t, func(impl *Impl) {
+		logf := impl.logf
+		impl.logf = func(format string, args ...any) {
+			mu.Lock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+			mu.Unlock()
+			logf(format, args...)
+		}
+		impl.ProcessLocalIPs = true
+		impl.BlockedForwardPorts = []uint16{25}
+		impl.LogRejectedPeers = true
+		impl.OnReject = func(ri RejectInfo) { rejects <- ri }
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.whoIsFunc = func(src netip.AddrPort) (node, user string) {
+			if src.Addr() == known {
+				return "laptop.example.ts.net.", "alice@example.com"
+			}
+			return "", ""
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	for _, src := range []netip.Addr{known, unknown} {
+		p := &packet.Parsed{}
+		p.Decode(tcpSYN4(netip.AddrPortFrom(src, 1234), netip.AddrPortFrom(localIP, 25)))
+		ns.injectInbound(p, nil)
+	}
+
+	got := map[netip.Addr]RejectInfo{}
+	for len(got) < 2 {
+		select {
+		case ri := <-rejects:
+			got[ri.Src.Addr()] = ri
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d rejections; want 2", len(got))
+		}
+	}
+	if ri := got[known]; ri.PeerName != "laptop.example.ts.net." || ri.PeerUser != "alice@example.com" || ri.Reason != "blocked port" || ri.Proto != ipproto.TCP {
+		t.Errorf("known peer's rejection = %+v", ri)
+	}
+	if ri := got[unknown]; ri.PeerName != "" || ri.PeerUser != "" {
+		t.Errorf("unknown peer's rejection = %+v; want no identity", ri)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"netstack: rejected TCP from 100.64.0.2:1234 (laptop.example.ts.net., alice@example.com) to 100.64.0.1:25: blocked port",
+		"netstack: rejected TCP from 100.64.0.3:1234 (unknown peer) to 100.64.0.1:25: blocked port",
+	}
+	for _, w := range want {
+		found := false
+		for _, l := range logs {
+			found = found || l == w
+		}
+		if !found {
+			t.Errorf("no log %q in %q", w, logs)
+		}
+	}
+}
+
+func TestLogRejectedUnhandledPort(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	rejects := make(chan RejectInfo, 10)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.ForwardTCPInFunc = func(port uint16) (func(net.Conn), bool) { return nil, false }
+		impl.OnReject = func(ri RejectInfo) { rejects <- ri }
+		impl.whoIsFunc = func(netip.AddrPort) (node, user string) {
+			return "laptop.example.ts.net.", "alice@example.com"
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	p := &packet.Parsed{}
+	p.Decode(tcpSYN4(netip.MustParseAddrPort("100.64.0.2:1234"), netip.AddrPortFrom(localIP, 81)))
+	ns.injectInbound(p, nil)
+
+	select {
+	case ri := <-rejects:
+		if ri.PeerName != "laptop.example.ts.net." || ri.Reason != "unhandled port" || ri.Proto != ipproto.TCP || ri.Dst.Port() != 81 {
+			t.Errorf("rejection = %+v", ri)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no rejection for unhandled port")
+	}
+	if got := ns.HandlerStats()["rejected"]; got != 1 {
+		t.Errorf("rejected = %d; want 1", got)
+	}
+}
+
+func TestLogRejectedUDP(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	peer := netip.MustParseAddr("100.64.0.2")
+	tests := []struct {
+		name   string
+		setup  func(*Impl)
+		flows  int
+		reason string
+		why    CloseReason
+	}{
+		{"shutting_down", func(impl *Impl) { impl.shuttingDown.Store(true) }, 1, "shutting down", CloseShutdown},
+		{"rate_limited", func(impl *Impl) { impl.NewUDPSessionRatePerSource = 1 }, 2, "rate limited", CloseQuotaExceeded},
+		{"max_conns", func(impl *Impl) { impl.MaxConns = 1 }, 2, "over MaxConns", CloseQuotaExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejects := make(chan RejectInfo, 10)
+			closed := make(chan ConnInfo, 10)
+			ns := makeNetstack(t, func(impl *Impl) {
+				impl.ProcessLocalIPs = true
+				impl.OnReject = func(ri RejectInfo) { rejects <- ri }
+				impl.OnConnClose = func(ci ConnInfo) { closed <- ci }
+				impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+				tt.setup(impl)
+			})
+			addLocalIP(t, ns, localIP)
+			for i := 0; i < tt.flows; i++ {
+				p := &packet.Parsed{}
+				p.Decode(packet.Generate(packet.UDP4Header{
+					IP4Header: packet.IP4Header{Src: peer, Dst: localIP},
+					SrcPort:   uint16(1000 + i),
+					DstPort:   53,
+				}, []byte("hello")))
+				ns.injectInbound(p, nil)
+			}
+			select {
+			case ri := <-rejects:
+				if ri.Proto != ipproto.UDP || ri.Reason != tt.reason || ri.Src.Addr() != peer || ri.Dst != netip.AddrPortFrom(localIP, 53) {
+					t.Errorf("rejection = %+v; want UDP %s", ri, tt.reason)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no rejection; want %s", tt.reason)
+			}
+			select {
+			case ci := <-closed:
+				if ci.Proto != ipproto.UDP || ci.CloseReason != tt.why {
+					t.Errorf("OnConnClose got %v %v; want UDP %v", ci.Proto, ci.CloseReason, tt.why)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("OnConnClose not called; want %v", tt.why)
+			}
+		})
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	var dials atomic.Int32
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.backendDialFunc = func(context.Context, string, string) (net.Conn, error) {
+			dials.Add(1)
+			return nil, errors.New("test dial")
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	admin := netip.MustParseAddr("100.64.0.2")
+	other := netip.MustParseAddr("100.64.0.3")
+	port := uint16(1000)
+	connect := func(src netip.Addr) {
+		port++
+		p := &packet.Parsed{}
+		p.Decode(tcpSYN4(netip.AddrPortFrom(src, port), netip.AddrPortFrom(localIP, 80)))
+		ns.injectInbound(p, nil)
+	}
+	// Failed dials are counted as rejected too.
+	waitFor := func(wantDials, wantRejected int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			d, r := int(dials.Load()), int(ns.HandlerStats()["rejected"])
+			if d == wantDials && r == wantRejected {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d dials, %d rejected; want %d, %d", d, r, wantDials, wantRejected)
+			}
+		}
+	}
+
+	ns.EnterMaintenance([]netip.Prefix{netip.PrefixFrom(admin, 32)})
+	connect(admin)
+	connect(other)
+	waitFor(1, 2)
+
+	ns.ExitMaintenance()
+	connect(other)
+	waitFor(2, 3)
+}
+
+func TestPerClientConnRate(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.PerClientConnRate = &ConnRateLimit{Rate: 0.001, Burst: 2}
+		impl.backendDialFunc = func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New("test dial")
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	peerA := netip.MustParseAddr("100.64.0.2")
+	peerB := netip.MustParseAddr("100.64.0.3")
+	for i, src := range []netip.Addr{peerA, peerA, peerA, peerB} {
+		p := &packet.Parsed{}
+		p.Decode(tcpSYN4(netip.AddrPortFrom(src, uint16(1000+i)), netip.AddrPortFrom(localIP, 80)))
+		ns.injectInbound(p, nil)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ns.Stats().TCPConnsAccepted < 4; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v; want 4 TCPConnsAccepted", ns.Stats())
+		}
+	}
+	if n := ns.tcpRateLimited.Load(); n != 1 {
+		t.Errorf("rate limited %d connections; want 1 (peer A's third)", n)
+	}
+
+	// Idle limiters are removed.
+	ns.mu.Lock()
+	for _, cl := range ns.tcpClientLimiters {
+		cl.lastUsed = time.Now().Add(-time.Hour)
+	}
+	ns.tcpClientLimiters[peerB].lastUsed = time.Now()
+	ns.lastClientLimiterSweep = time.Time{}
+	ns.PerClientConnRate = &ConnRateLimit{Rate: 1, Burst: 2} // refills in 2s
+	ns.mu.Unlock()
+	if !ns.allowClientConn(peerB) {
+		t.Errorf("peer B's second connection not allowed")
+	}
+	ns.mu.Lock()
+	_, okA := ns.tcpClientLimiters[peerA]
+	_, okB := ns.tcpClientLimiters[peerB]
+	ns.mu.Unlock()
+	if okA || !okB {
+		t.Errorf("after sweep, have limiters for peer A = %v, peer B = %v; want false, true", okA, okB)
+	}
+
+	bad := &Impl{PerClientConnRate: &ConnRateLimit{Rate: 1}}
+	if err := bad.Validate(); err == nil {
+		t.Errorf("Validate with zero Burst succeeded; want error")
+	}
+}
+
+func TestAcceptSchedule(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	clock := &tstest.Clock{Start: time.Date(2022, 10, 3, 20, 0, 0, 0, time.UTC)}
+	dials := make(chan string, 2)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.AcceptSchedule = func(now time.Time) bool {
+			return now.Hour() >= 9 && now.Hour() < 17
+		}
+		impl.timeNow = clock.Now
+		impl.backendDialFunc = func(_ context.Context, _, addr string) (net.Conn, error) {
+			dials <- addr
+			return nil, errors.New("test dial")
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	syn := func(srcPort uint16) {
+		p := &packet.Parsed{}
+		p.Decode(tcpSYN4(netip.AddrPortFrom(netip.MustParseAddr("100.64.0.2"), srcPort), netip.AddrPortFrom(localIP, 80)))
+		ns.injectInbound(p, nil)
+	}
+
+	// At 20:00, outside the schedule.
+	syn(1000)
+	for deadline := time.Now().Add(5 * time.Second); ns.Stats().TCPConnsAccepted < 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v; want 1 TCPConnsAccepted", ns.Stats())
+		}
+	}
+	select {
+	case addr := <-dials:
+		t.Fatalf("dialed %s outside the schedule", addr)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// At 10:00 the next day, within it.
+	clock.Advance(14 * time.Hour)
+	syn(1001)
+	select {
+	case <-dials:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection within the schedule wasn't forwarded")
+	}
+}
+
+func TestStateJSON(t *testing.T) {
+	clock := &tstest.Clock{Start: time.Unix(1000, 0)}
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.timeNow = clock.Now
+		impl.ProcessSubnets = true
+		impl.ForwardViaWebSocket = &url.URL{Scheme: "wss", User: url.UserPassword("user", "secret"), Host: "example.com"}
+		impl.DialAllowed = func(string, netip.AddrPort) bool { return true }
+	})
+	addLocalIP(t, ns, netip.MustParseAddr("100.64.0.1"))
+	ac := ns.registerConn(ConnInfo{
+		Proto:   ipproto.TCP,
+		Src:     netip.MustParseAddrPort("100.64.0.2:1234"),
+		Dst:     netip.MustParseAddrPort("100.64.0.1:80"),
+		Backend: netip.MustParseAddrPort("127.0.0.1:80"),
+		Start:   time.Now(),
+	}, nil)
+	defer ns.unregisterConn(ac)
+
+	b, err := ns.StateJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("secret")) {
+		t.Errorf("StateJSON exposes ForwardViaWebSocket's password: %s", b)
+	}
+	var st map[string]json.RawMessage
+	if err := json.Unmarshal(b, &st); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"Version", "Time", "Conns", "Addresses", "Routes", "Protocols", "Stats", "Handlers", "Goroutines", "Mem", "Options"} {
+		if _, ok := st[k]; !ok {
+			t.Errorf("StateJSON has no %q key", k)
+		}
+	}
+	var got struct {
+		Time  time.Time
+		Conns []struct {
+			Proto string
+			Dst   netip.AddrPort
+		}
+		Addresses []string
+		Options   map[string]any
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Time.Equal(clock.Now()) {
+		t.Errorf("Time = %v; want %v from ns.now", got.Time, clock.Now())
+	}
+	if len(got.Conns) != 1 || got.Conns[0].Proto != "TCP" || got.Conns[0].Dst != netip.MustParseAddrPort("100.64.0.1:80") {
+		t.Errorf("Conns = %+v; want the TCP conn to 100.64.0.1:80", got.Conns)
+	}
+	if want := []string{"100.64.0.1/32", "255.255.255.255/32"}; !reflect.DeepEqual(got.Addresses, want) {
+		t.Errorf("Addresses = %q; want %q", got.Addresses, want)
+	}
+	for k, want := range map[string]any{
+		"ProcessSubnets":       true,
+		"ForwardViaWebSocket":  true,
+		"DialAllowed":          true,
+		"OnConnClose":          false,
+		"BackendTeardownGrace": "0s",
+	} {
+		if got.Options[k] != want {
+			t.Errorf("Options[%q] = %v; want %v", k, got.Options[k], want)
+		}
+	}
+}
+
+func TestRewriteSubnetDial(t *testing.T) {
+	dials := make(chan string, 2)
+	peer := netip.MustParseAddrPort("100.64.0.2:1234")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessSubnets = true
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+		impl.RewriteSubnetDial = func(src, dst netip.AddrPort) (netip.AddrPort, bool) {
+			if src.Addr() != peer.Addr() {
+				t.Errorf("RewriteSubnetDial src = %v; want %v", src, peer.Addr())
+			}
+			if dst == netip.MustParseAddrPort("192.0.2.1:80") {
+				return netip.MustParseAddrPort("198.51.100.7:8080"), true
+			}
+			return netip.AddrPort{}, false
+		}
+		impl.backendDialFunc = func(_ context.Context, _, addr string) (net.Conn, error) {
+			dials <- addr
+			return nil, errors.New("test dial")
+		}
+	})
+	for _, tt := range []struct {
+		dst, wantDial string
+	}{
+		{"192.0.2.1:80", "198.51.100.7:8080"},
+		{"192.0.2.1:81", "192.0.2.1:81"},
+	} {
+		p := &packet.Parsed{}
+		p.Decode(tcpSYN4(peer, netip.MustParseAddrPort(tt.dst)))
+		ns.injectInbound(p, nil)
+		select {
+		case got := <-dials:
+			if got != tt.wantDial {
+				t.Errorf("connection to %v dialed %v; want %v", tt.dst, got, tt.wantDial)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection to %v not dialed", tt.dst)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	var unhealthy atomic.Bool
+	unhealthy.Store(true)
+	dials := make(chan string, 1)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.HealthCheck = func() error {
+			if unhealthy.Load() {
+				return errors.New("dns manager degraded")
+			}
+			return nil
+		}
+		impl.backendDialFunc = func(_ context.Context, _, addr string) (net.Conn, error) {
+			dials <- addr
+			return nil, errors.New("test dial")
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	syn := func(srcPort uint16) filter.Response {
+		p := &packet.Parsed{}
+		p.Decode(tcpSYN4(netip.AddrPortFrom(netip.MustParseAddr("100.64.0.2"), srcPort), netip.AddrPortFrom(localIP, 80)))
+		return ns.injectInbound(p, nil)
+	}
+
+	if resp := syn(1000); resp != filter.Accept {
+		t.Errorf("while unhealthy, injectInbound = %v; want Accept (not processed)", resp)
+	}
+	select {
+	case addr := <-dials:
+		t.Fatalf("dialed %s while unhealthy", addr)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := ns.Stats().TCPConnsAccepted; n != 0 {
+		t.Errorf("TCPConnsAccepted = %d while unhealthy; want 0", n)
+	}
+
+	unhealthy.Store(false)
+	if resp := syn(1001); resp != filter.DropSilently {
+		t.Errorf("while healthy, injectInbound = %v; want DropSilently (processed)", resp)
+	}
+	select {
+	case <-dials:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not forwarded once healthy")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	peerIP := netip.MustParseAddr("100.64.0.2")
+	subnetIP := netip.MustParseAddr("192.0.2.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessSubnets = true
+		impl.atomicIsLocalIPFunc.Store(func(netip.Addr) bool { return false })
+	})
+	ac := ns.registerConn(ConnInfo{
+		Proto: ipproto.TCP,
+		Src:   netip.AddrPortFrom(peerIP, 1234),
+		Dst:   netip.AddrPortFrom(subnetIP, 80),
+		Start: time.Now(),
+	}, nil)
+
+	done := make(chan error, 1)
+	go func() { done <- ns.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a connection open", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// New connections are reset, and don't leave their subnet IP
+	// registered.
+	p := &packet.Parsed{}
+	p.Decode(tcpSYN4(netip.AddrPortFrom(peerIP, 1235), netip.AddrPortFrom(subnetIP, 80)))
+	ns.injectInbound(p, nil)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if ns.HandlerStats()["rejected"] == 1 && ns.Stats().Stack.TCP.ResetsSent == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("HandlerStats = %v; want new connection rejected", ns.HandlerStats())
+		}
+	}
+
+	ns.unregisterConn(ac)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown = %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't return after the connection ended")
+	}
+	if ns.ctx.Err() == nil {
+		t.Error("ns not closed after Shutdown")
+	}
+}
+
+func TestShutdownAfterUDP(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+	})
+	addLocalIP(t, ns, localIP)
+	backend, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	port := uint16(backend.LocalAddr().(*net.UDPAddr).Port)
+
+	p := &packet.Parsed{}
+	p.Decode(packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{Src: netip.MustParseAddr("100.64.0.2"), Dst: localIP},
+		SrcPort:   1234,
+		DstPort:   port,
+	}, []byte("hello")))
+	ns.injectInbound(p, nil)
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := backend.ReadFrom(make([]byte, 100)); err != nil {
+		t.Fatalf("UDP not forwarded: %v", err)
+	}
+	if n := ns.CloseIdleUDPSessions(0); n != 1 {
+		t.Fatalf("CloseIdleUDPSessions = %d; want 1", n)
+	}
+
+	// With the session over, Shutdown doesn't wait for anything else.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ns.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown = %v; want nil", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	ns := makeNetstack(t, func(*Impl) {})
+	ns.registerConn(ConnInfo{Proto: ipproto.UDP, Start: time.Now()}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ns.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if ns.ctx.Err() == nil {
+		t.Error("ns not closed after Shutdown timed out")
+	}
+}
+
+func TestStats(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	peerIP := netip.MustParseAddr("100.64.0.2")
+	subnetIP := netip.MustParseAddr("192.0.2.1")
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessLocalIPs = true
+		impl.ProcessSubnets = true
+		impl.AnswerLocalPings = true
+		impl.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == localIP })
+		impl.localPongFunc = func([]byte) {}
+		impl.backendDialFunc = func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New("test dial")
+		}
+	})
+	inject := func(b []byte) {
+		p := &packet.Parsed{}
+		p.Decode(b)
+		ns.injectInbound(p, nil)
+	}
+	waitFor := func(what string, cond func(Stats) bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			st := ns.Stats()
+			if cond(st) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s; stats = %+v", what, st)
+			}
+		}
+	}
+
+	// A TCP connection to a subnet IP is accepted, but its backend
+	// dial fails.
+	inject(tcpSYN4(netip.AddrPortFrom(peerIP, 1234), netip.AddrPortFrom(subnetIP, 80)))
+	waitFor("TCP connection not reset", func(st Stats) bool {
+		return st.TCPConnsAccepted == 1 && st.Stack.TCP.ResetsSent == 1
+	})
+	if st := ns.Stats(); st.TCPConnsForwarded != 0 || st.SubnetAddrsRegistered != 1 || st.Stack.IP.PacketsReceived != 1 {
+		t.Errorf("after failed dial, stats = %+v; want 0 TCPConnsForwarded, 1 SubnetAddrsRegistered, 1 IP packet received", st)
+	}
+
+	// forwardTCP counts a connection whose backend it reaches.
+	backend, backendPeer := net.Pipe()
+	defer backendPeer.Close()
+	ns.backendDialFunc = func(context.Context, string, string) (net.Conn, error) {
+		return backend, nil
+	}
+	var wq waiter.Queue
+	getClient := func(...tcpip.SettableSocketOption) *gonet.TCPConn { return nil }
+	dst := netip.AddrPortFrom(subnetIP, 80)
+	ns.forwardTCP(getClient, nil, netip.AddrPortFrom(peerIP, 1234), dst, &wq, dst)
+	if got := ns.Stats().TCPConnsForwarded; got != 1 {
+		t.Errorf("TCPConnsForwarded = %d; want 1", got)
+	}
+
+	// A UDP session stays open until it's idle.
+	inject(packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{Src: peerIP, Dst: subnetIP},
+		SrcPort:   1234,
+		DstPort:   5305,
+	}, []byte("hello")))
+	waitFor("UDP session not open", func(st Stats) bool { return st.UDPSessionsOpen == 1 })
+
+	_, payload := packet.ICMPEchoPayload(nil)
+	inject(packet.Generate(packet.ICMP4Header{
+		IP4Header: packet.IP4Header{IPProto: ipproto.ICMPv4, Src: peerIP, Dst: localIP},
+		Type:      packet.ICMP4EchoRequest,
+		Code:      packet.ICMP4NoCode,
+	}, payload))
+	if got := ns.Stats().PingsHandled; got != 1 {
+		t.Errorf("PingsHandled = %d; want 1", got)
+	}
+}
+
+// writeOutbound writes b, an IPv4 UDP packet, to ns's link endpoint, as
+// if netstack had sent it.
+func TestLogRate(t *testing.T) {
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	waitLogs := func(want ...string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			mu.Lock()
+			got := append([]string(nil), logs...)
+			mu.Unlock()
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("logs = %q; want %q", got, want)
+			}
+		}
+	}
+
+	c := newLogCoalescer(logf, 10*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		c.logf("netstack: could not bind local port %v", i)
+	}
+	c.logf("netstack: heartbeat: %d", 1)
+	c.logf("netstack: heartbeat: %d", 2)
+	waitLogs(
+		"netstack: could not bind local port 0",
+		"netstack: heartbeat: 1",
+		"netstack: heartbeat: 2",
+		`[RATELIMIT] format("netstack: could not bind local port %v") repeated 99 times in the last 10ms`,
+	)
+
+	// After the summary, the next occurrence is logged again, and
+	// flushing summarizes any repeats of it.
+	c.logf("netstack: could not bind local port %v", 100)
+	c.logf("netstack: could not bind local port %v", 101)
+	c.flush()
+	c.logf("netstack: could not bind local port %v", 102)
+	waitLogs(
+		"netstack: could not bind local port 0",
+		"netstack: heartbeat: 1",
+		"netstack: heartbeat: 2",
+		`[RATELIMIT] format("netstack: could not bind local port %v") repeated 99 times in the last 10ms`,
+		"netstack: could not bind local port 100",
+		`[RATELIMIT] format("netstack: could not bind local port %v") repeated 1 times`,
+		"netstack: could not bind local port 102",
+	)
+
+	if err := (&Impl{LogRate: -time.Second}).Start(); err == nil {
+		t.Error("Start succeeded with negative LogRate; want error")
+	}
+}
+
+func TestLinkEndpointQueueSize(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	injecting := make(chan bool, 1)
+	release := make(chan struct{})
+	ns := makeNetstackWithOptions(t, CreateOptions{LinkEndpointQueueSize: 100}, func(impl *Impl) {
+		impl.injectPacketFunc = func(pkt *stack.PacketBuffer, _ bool) {
+			select {
+			case injecting <- true:
+			default:
+			}
+			<-release // block the inject goroutine, so packets queue up
+			pkt.DecRef()
+		}
+	})
+	t.Cleanup(func() { close(release) })
+	addLocalIP(t, ns, localIP)
+
+	c, err := gonet.DialUDP(ns.ipstack,
+		&tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(localIP.AsSlice())},
+		&tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(netip.MustParseAddr("100.64.0.2").AsSlice()), Port: 1234},
+		ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Once the inject goroutine is stuck on the first packet, the queue
+	// holds the next 100.
+	c.Write([]byte("hello"))
+	<-injecting
+	const sent = 150
+	for i := 1; i < sent; i++ {
+		c.Write([]byte("hello"))
+	}
+	const wantQueued = 100
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		queued, drops := ns.MemStats().QueuedPackets, ns.Stats().LinkQueueDrops
+		if queued == wantQueued && drops == sent-wantQueued-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d packets queued, %d dropped; want %d, %d", queued, drops, wantQueued, sent-wantQueued-1)
+		}
+	}
+}
+
+func TestInjectBlocking(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	injecting := make(chan bool, 1)
+	release := make(chan struct{})
+	var injected atomic.Int32
+	ns := makeNetstackWithOptions(t, CreateOptions{LinkEndpointQueueSize: minLinkEndpointQueueSize}, func(impl *Impl) {
+		impl.InjectBlocking = true
+		impl.injectPacketFunc = func(pkt *stack.PacketBuffer, _ bool) {
+			select {
+			case injecting <- true:
+			default:
+			}
+			<-release // block the inject goroutine, so packets queue up
+			injected.Add(1)
+			pkt.DecRef()
+		}
+	})
+	addLocalIP(t, ns, localIP)
+
+	c, err := gonet.DialUDP(ns.ipstack,
+		&tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(localIP.AsSlice())},
+		&tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(netip.MustParseAddr("100.64.0.2").AsSlice()), Port: 1234},
+		ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	<-injecting
+
+	// With the inject goroutine stuck on the first packet, writes block
+	// once the queue is full instead of dropping packets.
+	const sent = 100
+	wrote := make(chan bool)
+	go func() {
+		for i := 1; i < sent; i++ {
+			c.Write([]byte("hello"))
+		}
+		close(wrote)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ns.MemStats().QueuedPackets != minLinkEndpointQueueSize; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d packets queued; want %d", ns.MemStats().QueuedPackets, minLinkEndpointQueueSize)
+		}
+	}
+	select {
+	case <-wrote:
+		t.Fatal("all writes finished with a full queue; want them to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-wrote:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes still blocked after the queue drained")
+	}
+	for deadline := time.Now().Add(5 * time.Second); injected.Load() != sent; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("injected %d packets; want %d", injected.Load(), sent)
+		}
+	}
+	if drops := ns.Stats().LinkQueueDrops; drops != 0 {
+		t.Errorf("%d packets dropped; want 0", drops)
+	}
+}
+
+func TestTCPIPStack(t *testing.T) {
+	ns := makeNetstack(t, func(*Impl) {})
+	s := ns.TCPIPStack()
+	if s == nil || !s.CheckNIC(nicID) {
+		t.Fatalf("TCPIPStack() = %p without netstack's NIC", s)
+	}
+	opt := tcpip.TCPSACKEnabled(false)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+		t.Fatal(err)
+	}
+	var got tcpip.TCPSACKEnabled
+	if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got {
+		t.Errorf("SACK still enabled after disabling it through TCPIPStack")
+	}
+}
+
+func TestSetMTU(t *testing.T) {
+	localIP := netip.MustParseAddr("100.64.0.1")
+	sizes := make(chan int, 10)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.injectPacketFunc = func(pkt *stack.PacketBuffer, _ bool) {
+			sizes <- pkt.Size()
+			pkt.DecRef()
+		}
+	})
+	addLocalIP(t, ns, localIP)
+	c, err := gonet.DialUDP(ns.ipstack,
+		&tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(localIP.AsSlice())},
+		&tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(netip.MustParseAddr("100.64.0.2").AsSlice()), Port: 1234},
+		ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// sendBig sends a datagram bigger than the default MTU and returns
+	// the sizes of the IP packets it was sent in.
+	sendBig := func() (got []int) {
+		t.Helper()
+		if _, err := c.Write(make([]byte, 4000)); err != nil {
+			t.Fatal(err)
+		}
+		for total := 0; total < 4000; {
+			select {
+			case n := <-sizes:
+				got = append(got, n)
+				total += n - header.IPv4MinimumSize
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got packets of sizes %v; want 4000 bytes of payload", got)
+			}
+		}
+		return got
+	}
+
+	if got := sendBig(); len(got) < 2 {
+		t.Errorf("with MTU %d, datagram sent in packets of sizes %v; want fragments", tstun.DefaultMTU, got)
+	}
+	if err := ns.SetMTU(9000); err != nil {
+		t.Fatal(err)
+	}
+	if got := ns.MTU(); got != 9000 {
+		t.Errorf("MTU = %d; want 9000", got)
+	}
+	if got := sendBig(); len(got) != 1 {
+		t.Errorf("with MTU 9000, datagram sent in packets of sizes %v; want 1", got)
+	}
+
+	for _, bad := range []uint32{576, tstun.MaxPacketSize + 1} {
+		if err := ns.SetMTU(bad); err == nil {
+			t.Errorf("SetMTU(%d) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestLinkEndpointQueueSizeValidation(t *testing.T) {
+	for _, n := range []int{-1, 10} {
+		if err := (CreateOptions{LinkEndpointQueueSize: n}).validate(); err == nil {
+			t.Errorf("LinkEndpointQueueSize %d is valid; want error", n)
+		}
+	}
+	for _, n := range []int{0, minLinkEndpointQueueSize, 2048} {
+		if err := (CreateOptions{LinkEndpointQueueSize: n}).validate(); err != nil {
+			t.Errorf("LinkEndpointQueueSize %d: %v", n, err)
+		}
+	}
+}
+
+func writeOutbound(t testing.TB, ns *Impl, b []byte) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: bufferv2.MakeWithData(b)})
+	defer pkt.DecRef()
+	pkt.NetworkProtocolNumber = ipv4.ProtocolNumber
+	pkt.TransportProtocolNumber = udp.ProtocolNumber
+	pkt.NetworkHeader().Consume(header.IPv4MinimumSize)
+	pkt.TransportHeader().Consume(header.UDPMinimumSize)
+	var pkts stack.PacketBufferList
+	pkts.PushBack(pkt)
+	for {
+		n, err := ns.linkEP.WritePackets(pkts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 1 {
+			return
+		}
+		time.Sleep(time.Microsecond) // queue full
+	}
+}
+
+func TestInjectWorkers(t *testing.T) {
+	const flows, perFlow = 8, 200
+	var mu sync.Mutex
+	got := map[uint16][]string{} // by source port
+	toHost := map[uint16]bool{}
+	n := 0
+	done := make(chan bool)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.InjectWorkers = 4
+		impl.injectPacketFunc = func(pkt *stack.PacketBuffer, host bool) {
+			var p packet.Parsed
+			p.Decode(stack.PayloadSince(pkt.NetworkHeader()).AsSlice())
+			pkt.DecRef()
+			mu.Lock()
+			defer mu.Unlock()
+			port := p.Src.Port()
+			got[port] = append(got[port], string(p.Payload()))
+			toHost[port] = host
+			if n++; n == flows*perFlow {
+				close(done)
+			}
+		}
+	})
+	for i := 0; i < perFlow; i++ {
+		for f := 0; f < flows; f++ {
+			src := netip.MustParseAddr("100.64.0.1")
+			if f == 0 {
+				src = magicDNSIP
+			}
+			writeOutbound(t, ns, packet.Generate(packet.UDP4Header{
+				IP4Header: packet.IP4Header{Src: src, Dst: netip.MustParseAddr("100.64.0.2")},
+				SrcPort:   uint16(1000 + f),
+				DstPort:   53,
+			}, []byte(fmt.Sprintf("flow %d packet %d", f, i))))
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("got %d packets; want %d", n, flows*perFlow)
+	}
+	if g := ns.GoroutineStats().Inject; g != 5 {
+		t.Errorf("inject goroutines = %d; want 5", g)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for f := 0; f < flows; f++ {
+		port := uint16(1000 + f)
+		if len(got[port]) != perFlow {
+			t.Fatalf("flow %d: got %d packets; want %d", f, len(got[port]), perFlow)
+		}
+		for i, payload := range got[port] {
+			if want := fmt.Sprintf("flow %d packet %d", f, i); payload != want {
+				t.Fatalf("flow %d packet %d = %q; want %q", f, i, payload, want)
+			}
+		}
+		if toHost[port] != (f == 0) {
+			t.Errorf("flow %d sent to host = %v; want %v", f, toHost[port], f == 0)
+		}
+	}
+
+	if err := (&Impl{InjectWorkers: -1}).Start(); err == nil {
+		t.Errorf("Start with negative InjectWorkers succeeded; want error")
+	}
+}
+
+func TestInjectReaders(t *testing.T) {
+	const want = 1000
+	var n atomic.Int64
+	done := make(chan bool)
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.InjectReaders = 4
+		impl.injectPacketFunc = func(pkt *stack.PacketBuffer, _ bool) {
+			pkt.DecRef()
+			if n.Add(1) == want {
+				close(done)
+			}
+		}
+	})
+	for i := 0; i < want; i++ {
+		writeOutbound(t, ns, packet.Generate(packet.UDP4Header{
+			IP4Header: packet.IP4Header{Src: netip.MustParseAddr("100.64.0.1"), Dst: netip.MustParseAddr("100.64.0.2")},
+			SrcPort:   uint16(1000 + i%16),
+			DstPort:   53,
+		}, []byte("hello")))
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("got %d packets; want %d", n.Load(), want)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		g := ns.GoroutineStats().Inject
+		if g == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("inject goroutines = %d; want 4", g)
+		}
+	}
+
+	for _, bad := range []int{-1, maxInjectReaders + 1} {
+		if err := (&Impl{InjectReaders: bad}).Start(); err == nil {
+			t.Errorf("Start with InjectReaders %d succeeded; want error", bad)
+		}
+	}
+}
+
+func BenchmarkInjectWorkers(b *testing.B) {
+	for _, workers := range []int{0, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkInject(b, func(impl *Impl) { impl.InjectWorkers = workers })
+		})
+	}
+}
+
+func BenchmarkInjectReaders(b *testing.B) {
+	for _, readers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			benchmarkInject(b, func(impl *Impl) { impl.InjectReaders = readers })
+		})
+	}
+}
+
+// benchmarkInject measures how fast packets netstack sends are injected
+// with the options set by config.
+func benchmarkInject(b *testing.B, config func(*Impl)) {
+	const flows = 16
+	pkts := make([][]byte, flows)
+	for f := range pkts {
+		pkts[f] = packet.Generate(packet.UDP4Header{
+			IP4Header: packet.IP4Header{Src: netip.MustParseAddr("100.64.0.1"), Dst: netip.MustParseAddr("100.64.0.2")},
+			SrcPort:   uint16(1000 + f),
+			DstPort:   53,
+		}, make([]byte, 1200))
+	}
+	var n atomic.Int64
+	done := make(chan bool)
+	ns := makeNetstack(b, func(impl *Impl) {
+		config(impl)
+		// Stand in for the tun device, which copies out and parses
+		// each packet.
+		impl.injectPacketFunc = func(pkt *stack.PacketBuffer, _ bool) {
+			var p packet.Parsed
+			p.Decode(stack.PayloadSince(pkt.NetworkHeader()).AsSlice())
+			pkt.DecRef()
+			if n.Add(1) == int64(b.N) {
+				close(done)
+			}
+		}
+	})
+	b.SetBytes(int64(len(pkts[0])))
+	b.ResetTimer()
+	var next atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			writeOutbound(b, ns, pkts[next.Add(1)%flows])
+		}
+	})
+	<-done
+}
+
+func TestSaveRestoreConns(t *testing.T) {
+	want := []SavedConn{
+		{
+			Proto:   ipproto.TCP,
+			Src:     netip.MustParseAddrPort("100.64.0.2:1234"),
+			Dst:     netip.MustParseAddrPort("192.0.2.1:22"),
+			Backend: netip.MustParseAddrPort("192.0.2.1:22"),
+		},
+		{
+			Proto:   ipproto.UDP,
+			Src:     netip.MustParseAddrPort("[fd7a:115c:a1e0::2]:5000"),
+			Dst:     netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:5001"),
+			Backend: netip.MustParseAddrPort("127.0.0.1:5001"),
+		},
+	}
+	ns := makeNetstack(t, func(*Impl) {})
+	for i, c := range want {
+		ns.registerConn(ConnInfo{
+			Proto:   c.Proto,
+			Src:     c.Src,
+			Dst:     c.Dst,
+			Backend: c.Backend,
+			Start:   time.Unix(int64(i), 0),
+		}, nil)
+	}
+	saved, err := ns.SaveConns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Close()
+
+	// Restart.
+	var got []SavedConn
+	ns = makeNetstack(t, func(impl *Impl) {
+		impl.Reconnect = func(c SavedConn) error {
+			got = append(got, c)
+			if c.Proto == ipproto.UDP {
+				return errors.New("test failure")
+			}
+			return nil
+		}
+	})
+	n, err := ns.RestoreConns(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("RestoreConns = %d; want 1", n)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Reconnect called with %+v; want %+v", got, want)
+	}
+
+	for _, bad := range []string{"", "{", `{"Version":99}`} {
+		if _, err := ns.RestoreConns([]byte(bad)); err == nil {
+			t.Errorf("RestoreConns(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestNativePing(t *testing.T) {
+	if nativePing == nil {
+		t.Skip("no native ping on " + runtime.GOOS)
+	}
+	err := nativePing(netip.MustParseAddr("127.0.0.1"), 3*time.Second)
+	if errors.Is(err, errNoNativePing) {
+		t.Skip("can't create an ICMP socket")
+	}
+	if err != nil {
+		t.Fatalf("nativePing(127.0.0.1) = %v", err)
+	}
+}